@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/wiretrustee/wiretrustee/client/internal"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"time"
+)
+
+var (
+	checkTimeout time.Duration
+
+	checkCmd = &cobra.Command{
+		Use:   "check",
+		Short: "checks whether the STUN and TURN servers are reachable from this network",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			InitLog(logLevel, logFormat, logFile)
+
+			config, err := internal.ReadConfig(managementURL, configPath, profile, interfaceName)
+			if err != nil {
+				log.Errorf("failed reading config %s %v", configPath, err)
+				return err
+			}
+
+			myPrivateKey, err := wgtypes.ParseKey(config.PrivateKey)
+			if err != nil {
+				log.Errorf("failed parsing Wireguard key %s: [%s]", config.PrivateKey, err.Error())
+				return err
+			}
+
+			mgmTlsEnabled := false
+			if config.ManagementURL.Scheme == "https" {
+				mgmTlsEnabled = true
+			}
+
+			// the STUN and TURN servers are part of the global Wiretrustee config received on login
+			mgmClient, loginResp, err := connectToManagement(context.Background(), config.ManagementURL.Host, myPrivateKey, mgmTlsEnabled, config.Region)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+			defer mgmClient.Close() //nolint
+
+			stunTurns, err := internal.ToStunTurnURLs(loginResp.GetWiretrusteeConfig())
+			if err != nil {
+				log.Errorf("failed parsing STUN and TURN URLs received from Management Service: %v", err)
+				return err
+			}
+
+			failed := 0
+			for _, result := range internal.CheckStunTurn(stunTurns, checkTimeout) {
+				if result.Err != nil {
+					failed++
+					cmd.Printf("%s\tunreachable\t%v\n", result.URL.String(), result.Err)
+					continue
+				}
+				cmd.Printf("%s\treachable\t%v\n", result.URL.String(), result.Latency.Round(time.Millisecond))
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%d of %d STUN and TURN servers are unreachable", failed, len(stunTurns))
+			}
+			return nil
+		},
+	}
+)
+
+func init() {
+	checkCmd.PersistentFlags().DurationVar(&checkTimeout, "timeout", 5*time.Second, "how long to wait for each STUN and TURN server to respond")
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/wiretrustee/wiretrustee/client/internal"
+)
+
+var downCmd = &cobra.Command{
+	Use:   "down",
+	Short: "stops the running agent",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := requireControlSocket()
+		if err != nil {
+			return err
+		}
+
+		err = internal.NewControlClient(controlSocketPath()).Shutdown()
+		if err != nil {
+			return err
+		}
+
+		cmd.Println("agent is stopping")
+		return nil
+	},
+}
+
+// requireControlSocket checks that the control socket of the agent the commands talk to hasn't been disabled
+func requireControlSocket() error {
+	if controlSocket == "" {
+		return fmt.Errorf("the running agent is reached through its control socket, set --control-socket to the socket the agent has been started with")
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	logOutputStdout = "stdout"
+	logOutputStderr = "stderr"
+)
+
+// configureLog sets the level, the format (text or json) and the output (stdout, stderr or a file path) of the logger.
+// A log file is created if it doesn't exist and appended to otherwise
+func configureLog(logger *log.Logger, logLevel string, logFormat string, logFile string) error {
+	level, err := log.ParseLevel(logLevel)
+	if err != nil {
+		return fmt.Errorf("failed parsing log-level %s: %v", logLevel, err)
+	}
+
+	var formatter log.Formatter
+	switch logFormat {
+	case logFormatText, "":
+		formatter = &log.TextFormatter{}
+	case logFormatJSON:
+		formatter = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf("invalid log-format %s, supported formats [%s|%s]", logFormat, logFormatText, logFormatJSON)
+	}
+
+	output := os.Stderr
+	switch logFile {
+	case logOutputStderr, "":
+	case logOutputStdout:
+		output = os.Stdout
+	default:
+		output, err = os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return fmt.Errorf("failed opening log-file %s: %v", logFile, err)
+		}
+	}
+
+	logger.SetLevel(level)
+	logger.SetFormatter(formatter)
+	logger.SetOutput(output)
+	return nil
+}
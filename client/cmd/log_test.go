@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigureLog_JSONFile(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "client.log")
+
+	logger := log.New()
+	err := configureLog(logger, "debug", logFormatJSON, logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Debug("hello")
+	err = logger.Out.(*os.File).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := map[string]interface{}{}
+	err = json.Unmarshal(content, &entry)
+	if err != nil {
+		t.Fatalf("expecting a JSON log entry, got %q: %v", content, err)
+	}
+	if entry["msg"] != "hello" || entry["level"] != "debug" {
+		t.Errorf("expecting debug entry with message hello, got %v", entry)
+	}
+}
+
+func TestConfigureLog_Invalid(t *testing.T) {
+	for name, args := range map[string][]string{
+		"invalid level":  {"verbose", logFormatText, logOutputStderr},
+		"invalid format": {"info", "xml", logOutputStderr},
+		"invalid file":   {"info", logFormatText, filepath.Join(t.TempDir(), "missing", "client.log")},
+	} {
+		err := configureLog(log.New(), args[0], args[1], args[2])
+		if err == nil {
+			t.Errorf("%s: expecting log configuration to fail", name)
+		}
+	}
+}
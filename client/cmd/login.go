@@ -18,14 +18,15 @@ import (
 
 var (
 	setupKey string
+	jwtToken string
 
 	loginCmd = &cobra.Command{
 		Use:   "login",
 		Short: "login to the Wiretrustee Management Service (first run)",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			InitLog(logLevel)
+			InitLog(logLevel, logFormat, logFile)
 
-			config, err := internal.GetConfig(managementURL, configPath)
+			config, err := internal.GetConfig(managementURL, configPath, profile, interfaceName)
 			if err != nil {
 				log.Errorf("failed getting config %s %v", configPath, err)
 				//os.Exit(ExitSetupFailed)
@@ -55,6 +56,7 @@ var (
 				return err
 			}
 			log.Debugf("connected to anagement Service %s", config.ManagementURL.String())
+			mgmClient.SetRegion(config.Region)
 
 			serverKey, err := mgmClient.GetServerPublicKey()
 			if err != nil {
@@ -63,7 +65,7 @@ var (
 				return err
 			}
 
-			_, err = loginPeer(*serverKey, mgmClient, setupKey)
+			_, err = loginPeer(*serverKey, mgmClient, setupKey, jwtToken)
 			if err != nil {
 				log.Errorf("failed logging-in peer on Management Service : %v", err)
 				//os.Exit(ExitSetupFailed)
@@ -83,13 +85,13 @@ var (
 )
 
 // loginPeer attempts to login to Management Service. If peer wasn't registered, tries the registration flow.
-func loginPeer(serverPublicKey wgtypes.Key, client *mgm.Client, setupKey string) (*mgmProto.LoginResponse, error) {
+func loginPeer(serverPublicKey wgtypes.Key, client *mgm.Client, setupKey string, jwtToken string) (*mgmProto.LoginResponse, error) {
 
 	loginResp, err := client.Login(serverPublicKey)
 	if err != nil {
 		if s, ok := status.FromError(err); ok && s.Code() == codes.PermissionDenied {
 			log.Debugf("peer registration required")
-			return registerPeer(serverPublicKey, client, setupKey)
+			return registerPeer(serverPublicKey, client, setupKey, jwtToken)
 		} else {
 			return nil, err
 		}
@@ -102,7 +104,21 @@ func loginPeer(serverPublicKey wgtypes.Key, client *mgm.Client, setupKey string)
 
 // registerPeer checks whether setupKey was provided via cmd line and if not then it prompts user to enter a key.
 // Otherwise tries to register with the provided setupKey via command line.
-func registerPeer(serverPublicKey wgtypes.Key, client *mgm.Client, setupKey string) (*mgmProto.LoginResponse, error) {
+// When a JWT is provided (and no setupKey) the peer registers with the JWT instead.
+func registerPeer(serverPublicKey wgtypes.Key, client *mgm.Client, setupKey string, jwtToken string) (*mgmProto.LoginResponse, error) {
+
+	if setupKey == "" && jwtToken != "" {
+		log.Debugf("sending peer registration request with a JWT to Management Service")
+		loginResp, err := client.RegisterWithToken(serverPublicKey, jwtToken)
+		if err != nil {
+			log.Errorf("failed registering peer %v", err)
+			return nil, err
+		}
+
+		log.Infof("peer has been successfully registered on Management Service")
+
+		return loginResp, nil
+	}
 
 	var err error
 	if setupKey == "" {
@@ -149,4 +165,5 @@ func promptPeerSetupKey() (string, error) {
 
 func init() {
 	loginCmd.PersistentFlags().StringVar(&setupKey, "setup-key", "", "Setup key obtained from the Management Service Dashboard (used to register peer)")
+	loginCmd.PersistentFlags().StringVar(&jwtToken, "jwt-token", "", "JWT issued by the identity provider the Management Service trusts (used to register peer instead of a setup key)")
 }
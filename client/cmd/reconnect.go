@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/wiretrustee/wiretrustee/client/internal"
+)
+
+var reconnectCmd = &cobra.Command{
+	Use:   "reconnect [peer-key-or-ip]",
+	Short: "reconnects a remote peer of the running agent, all peers when none is given",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := requireControlSocket()
+		if err != nil {
+			return err
+		}
+
+		peer := ""
+		if len(args) == 1 {
+			peer = args[0]
+		}
+
+		restarted, err := internal.NewControlClient(controlSocketPath()).Reconnect(peer)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range restarted {
+			cmd.Printf("reconnecting peer %s\n", key)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/wiretrustee/wiretrustee/client/internal"
+	mgmProto "github.com/wiretrustee/wiretrustee/management/proto"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "reloads the config of the running agent, the same as sending it SIGHUP",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := requireControlSocket()
+		if err != nil {
+			return err
+		}
+
+		err = internal.NewControlClient(controlSocketPath()).Reload()
+		if err != nil {
+			return err
+		}
+
+		cmd.Println("agent has reloaded its config")
+		return nil
+	},
+}
+
+// configReloader re-reads the config file of the running agent and applies the settings that can be changed live
+// (see internal.Config). A reloaded config that is invalid is rejected as a whole, the running agent is left as it is
+type configReloader struct {
+	// mux serializes the reloads of SIGHUP and of the control socket
+	mux    sync.Mutex
+	engine *internal.Engine
+	// running is the config the agent runs with
+	running *internal.Config
+	// login is the response of the Management Service login the engine config is built from
+	login *mgmProto.LoginResponse
+}
+
+// reload re-reads the config file and applies it, the changes requiring a restart are logged only
+func (r *configReloader) reload() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	reloaded, err := internal.ReadConfig(managementURL, configPath, profile, interfaceName)
+	if err != nil {
+		return fmt.Errorf("failed reading config %s: %v", configPath, err)
+	}
+
+	level, err := log.ParseLevel(effectiveLogLevel(reloaded))
+	if err != nil {
+		return fmt.Errorf("invalid log level of config %s: %v", configPath, err)
+	}
+
+	engineConfig, err := internal.BuildEngineConfig(reloaded, &mgmProto.SyncResponse{
+		WiretrusteeConfig: r.login.GetWiretrusteeConfig(),
+		PeerConfig:        r.login.GetPeerConfig(),
+	})
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %v", configPath, err)
+	}
+
+	changes := internal.DiffConfig(r.running, reloaded)
+	if len(changes.RestartRequired) > 0 {
+		log.Warnf("changes of %s in config %s require a restart, they are ignored until then",
+			strings.Join(changes.RestartRequired, ", "), configPath)
+	}
+	if len(changes.Live) == 0 {
+		log.Infof("reloaded config %s, nothing to apply", configPath)
+		return nil
+	}
+
+	log.SetLevel(level)
+	r.engine.Reload(engineConfig)
+
+	// the fields requiring a restart keep their running values so that they show up as changed on the next reload
+	r.running.LogLevel = reloaded.LogLevel
+	r.running.StunsTurns = reloaded.StunsTurns
+	r.running.IFaceBlackList = reloaded.IFaceBlackList
+	r.running.IFaceAllowList = reloaded.IFaceAllowList
+
+	log.Infof("reloaded config %s, applied changes of %s", configPath, strings.Join(changes.Live, ", "))
+	return nil
+}
+
+// effectiveLogLevel returns the log level of the config falling back to the log-level flag
+func effectiveLogLevel(config *internal.Config) string {
+	if config.LogLevel != "" {
+		return config.LogLevel
+	}
+	return logLevel
+}
+
+// setupReloadHandler reloads the config on SIGHUP
+func setupReloadHandler(reloader *configReloader) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			log.Infof("received SIGHUP, reloading config %s", configPath)
+			err := reloader.reload()
+			if err != nil {
+				log.Errorf("rejected reloaded config, keeping the running one: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"github.com/wiretrustee/wiretrustee/client/internal"
+	mgmProto "github.com/wiretrustee/wiretrustee/management/proto"
+	"github.com/wiretrustee/wiretrustee/util"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigReloader_RejectsInvalidConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	running, err := internal.GetConfig("", path, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousPath := configPath
+	configPath = path
+	defer func() { configPath = previousPath }()
+
+	reloaded := *running
+	reloaded.LogLevel = "chatty"
+	err = util.WriteJson(path, &reloaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the engine isn't touched when the config is rejected
+	reloader := &configReloader{
+		running: running,
+		login: &mgmProto.LoginResponse{
+			WiretrusteeConfig: &mgmProto.WiretrusteeConfig{Signal: &mgmProto.HostConfig{Uri: "signal.wiretrustee.com:10000"}},
+			PeerConfig:        &mgmProto.PeerConfig{Address: "100.64.0.1/24"},
+		},
+	}
+	err = reloader.reload()
+	if err == nil {
+		t.Fatalf("expecting config with an invalid log level to be rejected")
+	}
+	if running.LogLevel != "" {
+		t.Errorf("expecting running config to be kept, got log level %s", running.LogLevel)
+	}
+
+	reloaded.LogLevel = "debug"
+	reloaded.StunsTurns = []internal.StunTurnServer{{URI: "turn.example.com"}}
+	err = util.WriteJson(path, &reloaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reloader.reload()
+	if err == nil {
+		t.Fatalf("expecting config with an invalid TURN URL to be rejected")
+	}
+}
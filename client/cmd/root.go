@@ -3,9 +3,11 @@ package cmd
 import (
 	"fmt"
 	"github.com/wiretrustee/wiretrustee/client/internal"
+	"github.com/wiretrustee/wiretrustee/iface"
 	"os"
 	"os/signal"
 	"runtime"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -19,9 +21,24 @@ const (
 
 var (
 	configPath        string
+	profile           string
 	defaultConfigPath string
 	logLevel          string
+	logFormat         string
+	logFile           string
 	managementURL     string
+	interfaceName     string
+	httpAddress       string
+	connectionMode    string
+	ipFamily          string
+	mtuDiscovery      string
+	lazyConnections   bool
+	maxConnects       int
+	heartbeatInterval time.Duration
+	heartbeatMisses   int
+	logSuppressWindow time.Duration
+	checksTimeout     time.Duration
+	controlSocket     string
 
 	rootCmd = &cobra.Command{
 		Use:   "wiretrustee",
@@ -48,10 +65,31 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVar(&managementURL, "management-url", "", fmt.Sprintf("Management Service URL [http|https]://[host]:[port] (default \"%s\")", internal.ManagementURLDefault().String()))
 	rootCmd.PersistentFlags().StringVar(&configPath, "config", defaultConfigPath, "Wiretrustee config file location")
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", internal.DefaultProfile, "config profile to use, each profile has its own Management Service, key, interface and listen port and profiles can run side by side")
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "sets Wiretrustee log level")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", logFormatText, fmt.Sprintf("sets Wiretrustee log format [%s|%s]", logFormatText, logFormatJSON))
+	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", logOutputStderr, fmt.Sprintf("sets Wiretrustee log destination [%s|%s|<file path>]", logOutputStdout, logOutputStderr))
+	rootCmd.PersistentFlags().StringVar(&interfaceName, "interface", "", fmt.Sprintf("Wireguard interface name overriding the one of the profile, use profiles to run multiple tunnels side by side (default \"%s\")", iface.WgInterfaceDefault))
+	rootCmd.PersistentFlags().StringVar(&httpAddress, "http-address", "", "address of the read-only HTTP server exposing /healthz, /readyz, /metrics and /status endpoints, e.g. 127.0.0.1:9090 (disabled when empty)")
+	rootCmd.PersistentFlags().StringVar(&connectionMode, "connection-mode", string(internal.ConnectionModeAuto), fmt.Sprintf("how remote peers are connected [%s|%s|%s]", internal.ConnectionModeAuto, internal.ConnectionModeDirectOnly, internal.ConnectionModeRelayOnly))
+	rootCmd.PersistentFlags().StringVar(&ipFamily, "ip-family", string(internal.IPFamilyAuto), fmt.Sprintf("IP families remote peers are connected over, ipv6 enables IPv6 in addition to IPv4 [%s|%s|%s]", internal.IPFamilyAuto, internal.IPFamilyIPv4, internal.IPFamilyIPv6))
+	rootCmd.PersistentFlags().StringVar(&mtuDiscovery, "mtu-discovery", string(internal.MTUDiscoveryOff), fmt.Sprintf("probes the path MTU to the peers and either logs a recommendation or lowers the interface MTU when needed [%s|%s|%s]", internal.MTUDiscoveryOff, internal.MTUDiscoveryLog, internal.MTUDiscoveryAdjust))
+	rootCmd.PersistentFlags().BoolVar(&lazyConnections, "lazy-connections", false, "connects remote peers on the first traffic to them instead of right away, idle connections are closed")
+	rootCmd.PersistentFlags().IntVar(&maxConnects, "max-concurrent-connects", 0, "limits the number of connections to remote peers negotiated at the same time, the peers of a higher priority are connected first (0 means no limit)")
+	rootCmd.PersistentFlags().DurationVar(&heartbeatInterval, "heartbeat-interval", internal.DefaultHeartbeatInterval, "how often a heartbeat is sent over the connections to the peers to detect stale ones")
+	rootCmd.PersistentFlags().IntVar(&heartbeatMisses, "heartbeat-misses", internal.DefaultHeartbeatMissThreshold, "number of heartbeats missed in a row after which the connection to a peer is restarted")
+	rootCmd.PersistentFlags().DurationVar(&logSuppressWindow, "log-suppress-window", internal.DefaultLogSuppressWindow, "how long repeated connection failures of a peer are suppressed in the log after the first one, a summary is logged afterwards")
+	rootCmd.PersistentFlags().DurationVar(&checksTimeout, "candidates-checks-timeout", internal.DefaultCandidatesChecksTimeout, "how long the connectivity checks with a peer may run after both peers have gathered all of their candidates before the connection attempt is given up")
+	rootCmd.PersistentFlags().StringVar(&controlSocket, "control-socket", internal.DefaultControlPath, "local socket (named pipe on Windows) the running agent is controlled through by the status, reconnect, reload and down commands, suffixed with the profile name for other profiles than the default one (disabled when empty)")
 	rootCmd.AddCommand(serviceCmd)
 	rootCmd.AddCommand(upCmd)
 	rootCmd.AddCommand(loginCmd)
+	rootCmd.AddCommand(checkCmd)
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(reconnectCmd)
+	rootCmd.AddCommand(reloadCmd)
+	rootCmd.AddCommand(rotateKeyCmd)
+	rootCmd.AddCommand(downCmd)
 	serviceCmd.AddCommand(runCmd, startCmd, stopCmd, restartCmd) // service control commands are subcommands of service
 	serviceCmd.AddCommand(installCmd, uninstallCmd)              // service installer commands are subcommands of service
 }
@@ -68,12 +106,11 @@ func SetupCloseHandler() {
 	}()
 }
 
-// InitLog parses and sets log-level input
-func InitLog(logLevel string) {
-	level, err := log.ParseLevel(logLevel)
+// InitLog parses and sets log-level, log-format and log-file input
+func InitLog(logLevel string, logFormat string, logFile string) {
+	err := configureLog(log.StandardLogger(), logLevel, logFormat, logFile)
 	if err != nil {
-		log.Errorf("Failed parsing log-level %s: %s", logLevel, err)
+		log.Errorf("Failed configuring log: %s", err)
 		os.Exit(ExitSetupFailed)
 	}
-	log.SetLevel(level)
 }
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/wiretrustee/wiretrustee/client/internal"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var rotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key",
+	Short: "replaces the Wireguard key of this peer keeping its IP, name and groups (restart the agent afterwards)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		InitLog(logLevel, logFormat, logFile)
+
+		config, err := internal.ReadConfig(managementURL, configPath, profile, interfaceName)
+		if err != nil {
+			log.Errorf("failed reading config %s %v", configPath, err)
+			return err
+		}
+
+		myPrivateKey, err := wgtypes.ParseKey(config.PrivateKey)
+		if err != nil {
+			log.Errorf("failed parsing Wireguard key %s: [%s]", config.PrivateKey, err.Error())
+			return err
+		}
+
+		mgmTlsEnabled := false
+		if config.ManagementURL.Scheme == "https" {
+			mgmTlsEnabled = true
+		}
+
+		// only a registered peer can rotate its key, the request is sent with the current one
+		mgmClient, _, err := connectToManagement(context.Background(), config.ManagementURL.Host, myPrivateKey, mgmTlsEnabled, config.Region)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		defer mgmClient.Close() //nolint
+
+		serverKey, err := mgmClient.GetServerPublicKey()
+		if err != nil {
+			log.Errorf("failed while getting Management Service public key: %v", err)
+			return err
+		}
+
+		err = internal.RotateConfigKey(configPath, profile, func(newPubKey wgtypes.Key) error {
+			_, err := mgmClient.RotateKey(*serverKey, newPubKey)
+			return err
+		})
+		if err != nil {
+			log.Errorf("failed rotating Wireguard key: %v", err)
+			return err
+		}
+
+		log.Infof("Wireguard key of the peer %s has been rotated, restart the agent to connect with the new key", myPrivateKey.PublicKey().String())
+		return nil
+	},
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/kardianos/service"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/wiretrustee/wiretrustee/client/internal"
 )
 
 type program struct {
@@ -11,12 +12,18 @@ type program struct {
 	args []string
 }
 
+// newSVCConfig creates the service config of the profile, other profiles than the default one get a service of their own
 func newSVCConfig() *service.Config {
-	return &service.Config{
+	config := &service.Config{
 		Name:        "wiretrustee",
 		DisplayName: "Wiretrustee",
 		Description: "A WireGuard-based mesh network that connects your devices into a single private network.",
 	}
+	if profile != internal.DefaultProfile {
+		config.Name += "-" + profile
+		config.DisplayName += " (" + profile + ")"
+	}
+	return config
 }
 
 func newSVC(prg *program, conf *service.Config) (service.Service, error) {
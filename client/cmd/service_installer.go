@@ -2,7 +2,9 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/wiretrustee/wiretrustee/client/internal"
 	"runtime"
+	"strconv"
 )
 
 var (
@@ -11,6 +13,13 @@ var (
 		Short: "installs wiretrustee service",
 		Run: func(cmd *cobra.Command, args []string) {
 
+			// the service name is derived from the profile
+			err := internal.ValidateProfileName(profile)
+			if err != nil {
+				cmd.PrintErrln(err)
+				return
+			}
+
 			svcConfig := newSVCConfig()
 
 			svcConfig.Arguments = []string{
@@ -22,6 +31,66 @@ var (
 				logLevel,
 			}
 
+			if logFormat != logFormatText {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--log-format", logFormat)
+			}
+
+			if logFile != logOutputStderr {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--log-file", logFile)
+			}
+
+			if profile != internal.DefaultProfile {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--profile", profile)
+			}
+
+			if interfaceName != "" {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--interface", interfaceName)
+			}
+
+			if connectionMode != string(internal.ConnectionModeAuto) {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--connection-mode", connectionMode)
+			}
+
+			if ipFamily != string(internal.IPFamilyAuto) {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--ip-family", ipFamily)
+			}
+
+			if mtuDiscovery != string(internal.MTUDiscoveryOff) {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--mtu-discovery", mtuDiscovery)
+			}
+
+			if lazyConnections {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--lazy-connections")
+			}
+
+			if maxConnects != 0 {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--max-concurrent-connects", strconv.Itoa(maxConnects))
+			}
+
+			if heartbeatInterval != internal.DefaultHeartbeatInterval {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--heartbeat-interval", heartbeatInterval.String())
+			}
+
+			if heartbeatMisses != internal.DefaultHeartbeatMissThreshold {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--heartbeat-misses", strconv.Itoa(heartbeatMisses))
+			}
+
+			if logSuppressWindow != internal.DefaultLogSuppressWindow {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--log-suppress-window", logSuppressWindow.String())
+			}
+
+			if checksTimeout != internal.DefaultCandidatesChecksTimeout {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--candidates-checks-timeout", checksTimeout.String())
+			}
+
+			if httpAddress != "" {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--http-address", httpAddress)
+			}
+
+			if controlSocket != internal.DefaultControlPath {
+				svcConfig.Arguments = append(svcConfig.Arguments, "--control-socket", controlSocket)
+			}
+
 			if runtime.GOOS == "linux" {
 				// Respected only by systemd systems
 				svcConfig.Dependencies = []string{"After=network.target syslog.target"}
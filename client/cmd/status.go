@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/wiretrustee/wiretrustee/client/internal"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	statusVerbose bool
+
+	statusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "shows the state of the connections to the remote peers of the running agent",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := requireControlSocket()
+			if err != nil {
+				return err
+			}
+
+			report, err := internal.NewControlClient(controlSocketPath()).Status()
+			if err != nil {
+				return err
+			}
+
+			printStatus(cmd.OutOrStdout(), report, statusVerbose)
+			return nil
+		},
+	}
+)
+
+func init() {
+	statusCmd.PersistentFlags().BoolVar(&statusVerbose, "verbose", false, "shows the latest connection events of every peer")
+}
+
+// printStatus writes one line per peer followed by its connection events when verbose
+func printStatus(w io.Writer, report *internal.StatusReport, verbose bool) {
+	fmt.Fprintf(w, "management connected: %t, peers connected: %d/%d\n",
+		report.Health.ManagementConnected, report.Health.ConnectedPeers, report.Health.Peers)
+
+	for _, peer := range report.Peers {
+		fmt.Fprintf(w, "%s\t%s\t%s", peer.WgPubKey, peer.Status, peer.State)
+		if !peer.Quality.Measured.IsZero() {
+			fmt.Fprintf(w, "\tquality %d/100", peer.Quality.Score)
+		}
+		if peer.Failure != "" {
+			fmt.Fprintf(w, "\t%s", peer.Failure)
+		}
+		fmt.Fprintln(w)
+
+		if !verbose {
+			continue
+		}
+		if !peer.Quality.Measured.IsZero() {
+			fmt.Fprintf(w, "  quality: %s\n", formatQuality(peer.Quality))
+		}
+		for _, event := range peer.History {
+			fmt.Fprintf(w, "  %s\t%s\n", event.Time.Format(time.RFC3339Nano), event.Event)
+		}
+	}
+}
+
+// formatQuality lists the measurements the quality score has been computed from, unknown ones are left out
+func formatQuality(quality internal.QualityScore) string {
+	parts := []string{fmt.Sprintf("relayed %t", quality.Relayed)}
+	if quality.RTT >= 0 {
+		parts = append(parts, fmt.Sprintf("rtt %v", quality.RTT))
+	}
+	if quality.PacketLoss >= 0 {
+		parts = append(parts, fmt.Sprintf("loss %.1f%%", quality.PacketLoss*100))
+	}
+	if quality.HandshakeAge >= 0 {
+		parts = append(parts, fmt.Sprintf("handshake %v ago", quality.HandshakeAge.Round(time.Second)))
+	}
+	return strings.Join(parts, ", ")
+}
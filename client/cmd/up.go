@@ -2,7 +2,6 @@ package cmd
 
 import (
 	"context"
-	"github.com/pion/ice/v2"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/wiretrustee/wiretrustee/client/internal"
@@ -13,6 +12,8 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"path/filepath"
+	"strings"
 )
 
 var (
@@ -20,15 +21,24 @@ var (
 		Use:   "up",
 		Short: "start wiretrustee",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			InitLog(logLevel)
+			InitLog(logLevel, logFormat, logFile)
 
-			config, err := internal.ReadConfig(managementURL, configPath)
+			config, err := internal.ReadConfig(managementURL, configPath, profile, interfaceName)
 			if err != nil {
 				log.Errorf("failed reading config %s %v", configPath, err)
 				//os.Exit(ExitSetupFailed)
 				return err
 			}
 
+			if config.LogLevel != "" {
+				level, err := log.ParseLevel(config.LogLevel)
+				if err != nil {
+					log.Errorf("failed parsing log level of config %s: %v", configPath, err)
+					return err
+				}
+				log.SetLevel(level)
+			}
+
 			//validate our peer's Wireguard PRIVATE key
 			myPrivateKey, err := wgtypes.ParseKey(config.PrivateKey)
 			if err != nil {
@@ -45,7 +55,7 @@ var (
 			}
 
 			// connect (just a connection, no stream yet) and login to Management Service to get an initial global Wiretrustee config
-			mgmClient, loginResp, err := connectToManagement(ctx, config.ManagementURL.Host, myPrivateKey, mgmTlsEnabled)
+			mgmClient, loginResp, err := connectToManagement(ctx, config.ManagementURL.Host, myPrivateKey, mgmTlsEnabled, config.Region)
 			if err != nil {
 				log.Warn(err)
 				//os.Exit(ExitSetupFailed)
@@ -60,12 +70,38 @@ var (
 				return err
 			}
 
-			engineConfig, err := createEngineConfig(myPrivateKey, config, loginResp.GetWiretrusteeConfig(), loginResp.GetPeerConfig())
+			// the login response carries the same global config the first sync does
+			engineConfig, err := internal.BuildEngineConfig(config, &mgmProto.SyncResponse{
+				WiretrusteeConfig: loginResp.GetWiretrusteeConfig(),
+				PeerConfig:        loginResp.GetPeerConfig(),
+			})
 			if err != nil {
 				log.Error(err)
 				//os.Exit(ExitSetupFailed)
 				return err
 			}
+			engineConfig.HTTPAddress = httpAddress
+			engineConfig.ConnectionMode, err = internal.ParseConnectionMode(connectionMode)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+			engineConfig.IPFamilyPreference, err = internal.ParseIPFamilyPreference(ipFamily)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+			engineConfig.MTUDiscovery, err = internal.ParseMTUDiscovery(mtuDiscovery)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+			engineConfig.LazyConnections = lazyConnections
+			engineConfig.MaxConcurrentConnects = maxConnects
+			engineConfig.Heartbeat = internal.HeartbeatConfig{Interval: heartbeatInterval, MissThreshold: heartbeatMisses}
+			engineConfig.LogSuppressWindow = logSuppressWindow
+			engineConfig.CandidatesChecksTimeout = checksTimeout
+			engineConfig.StateFile = stateFilePath(configPath, profile)
 
 			// create start the Wiretrustee Engine that will connect to the Signal and Management streams and manage connections to remote peers.
 			engine := internal.NewEngine(signalClient, mgmClient, engineConfig)
@@ -76,9 +112,36 @@ var (
 				return err
 			}
 
+			reloader := &configReloader{engine: engine, running: config, login: loginResp}
 			SetupCloseHandler()
+			setupReloadHandler(reloader)
+
+			var controlServer *internal.ControlServer
+			if controlSocket != "" {
+				controlServer = internal.NewControlServer(controlSocketPath(), engine, internal.ControlHooks{
+					Shutdown: func() { stopCh <- 0 },
+					Reload:   reloader.reload,
+				})
+				err = controlServer.Start()
+				if err != nil {
+					// the agent works without it, only the local CLI commands can't reach it
+					log.Warnf("control server not started: %v", err)
+					controlServer = nil
+				}
+			}
+
 			<-stopCh
 			log.Infof("receive signal to stop running")
+			if controlServer != nil {
+				err = controlServer.Stop()
+				if err != nil {
+					log.Warnf("failed stopping control server %v", err)
+				}
+			}
+			err = engine.Stop()
+			if err != nil {
+				log.Errorf("failed stopping Wiretrustee Connection Engine %v", err)
+			}
 			err = mgmClient.Close()
 			if err != nil {
 				log.Errorf("failed closing Management Service client %v", err)
@@ -93,7 +156,7 @@ var (
 			}
 
 			log.Debugf("removing Wiretrustee interface %s", config.WgIface)
-			err = iface.Close()
+			err = iface.Close(config.WgIface)
 			if err != nil {
 				log.Errorf("failed closing Wiretrustee interface %s %v", config.WgIface, err)
 				//os.Exit(ExitSetupFailed)
@@ -108,51 +171,6 @@ var (
 func init() {
 }
 
-// createEngineConfig converts configuration received from Management Service to EngineConfig
-func createEngineConfig(key wgtypes.Key, config *internal.Config, wtConfig *mgmProto.WiretrusteeConfig, peerConfig *mgmProto.PeerConfig) (*internal.EngineConfig, error) {
-	iFaceBlackList := make(map[string]struct{})
-	for i := 0; i < len(config.IFaceBlackList); i += 2 {
-		iFaceBlackList[config.IFaceBlackList[i]] = struct{}{}
-	}
-
-	stunTurns, err := toStunTurnURLs(wtConfig)
-	if err != nil {
-		return nil, status.Errorf(codes.FailedPrecondition, "failed parsing STUN and TURN URLs received from Management Service : %s", err)
-	}
-
-	return &internal.EngineConfig{
-		StunsTurns:     stunTurns,
-		WgIface:        config.WgIface,
-		WgAddr:         peerConfig.Address,
-		IFaceBlackList: iFaceBlackList,
-		WgPrivateKey:   key,
-	}, nil
-}
-
-// toStunTurnURLs converts Wiretrustee STUN and TURN configs to ice.URL array
-func toStunTurnURLs(wtConfig *mgmProto.WiretrusteeConfig) ([]*ice.URL, error) {
-
-	var stunsTurns []*ice.URL
-	for _, stun := range wtConfig.Stuns {
-		url, err := ice.ParseURL(stun.Uri)
-		if err != nil {
-			return nil, err
-		}
-		stunsTurns = append(stunsTurns, url)
-	}
-	for _, turn := range wtConfig.Turns {
-		url, err := ice.ParseURL(turn.HostConfig.Uri)
-		if err != nil {
-			return nil, err
-		}
-		url.Username = turn.User
-		url.Password = turn.Password
-		stunsTurns = append(stunsTurns, url)
-	}
-
-	return stunsTurns, nil
-}
-
 // connectToSignal creates Signal Service client and established a connection
 func connectToSignal(ctx context.Context, wtConfig *mgmProto.WiretrusteeConfig, ourPrivateKey wgtypes.Key) (*signal.Client, error) {
 	var sigTLSEnabled bool
@@ -172,12 +190,14 @@ func connectToSignal(ctx context.Context, wtConfig *mgmProto.WiretrusteeConfig,
 }
 
 // connectToManagement creates Management Services client, establishes a connection, logs-in and gets a global Wiretrustee config (signal, turn, stun hosts, etc)
-func connectToManagement(ctx context.Context, managementAddr string, ourPrivateKey wgtypes.Key, tlsEnabled bool) (*mgm.Client, *mgmProto.LoginResponse, error) {
+// The region of the peer (see internal.Config.Region) is sent with the login
+func connectToManagement(ctx context.Context, managementAddr string, ourPrivateKey wgtypes.Key, tlsEnabled bool, region string) (*mgm.Client, *mgmProto.LoginResponse, error) {
 	log.Debugf("connecting to management server %s", managementAddr)
 	client, err := mgm.NewClient(ctx, managementAddr, ourPrivateKey, tlsEnabled)
 	if err != nil {
 		return nil, nil, status.Errorf(codes.FailedPrecondition, "failed connecting to Management Service : %s", err)
 	}
+	client.SetRegion(region)
 	log.Debugf("connected to management server %s", managementAddr)
 
 	serverPublicKey, err := client.GetServerPublicKey()
@@ -199,3 +219,18 @@ func connectToManagement(ctx context.Context, managementAddr string, ourPrivateK
 
 	return client, loginResp, nil
 }
+
+// stateFilePath returns the path of the file the Engine state of the profile is saved to next to the config file,
+// e.g. /etc/wiretrustee/config.json -> /etc/wiretrustee/config-state.json (config-state-work.json for the profile work)
+func stateFilePath(configPath string, profile string) string {
+	return internal.ProfilePath(strings.TrimSuffix(configPath, filepath.Ext(configPath))+"-state.json", profile)
+}
+
+// controlSocketPath returns the control socket of the profile, the default socket is suffixed with the profile name
+// so that the agents of several profiles can run side by side
+func controlSocketPath() string {
+	if controlSocket == internal.DefaultControlPath {
+		return internal.ProfilePath(controlSocket, profile)
+	}
+	return controlSocket
+}
@@ -57,7 +57,7 @@ func TestUp_ShouldFail_On_NoConfig(t *testing.T) {
 
 func TestUp(t *testing.T) {
 
-	defer iface.Close()
+	defer iface.Close(iface.WgInterfaceDefault)
 
 	tempDir := t.TempDir()
 	confPath := tempDir + "/config.json"
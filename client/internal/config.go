@@ -6,8 +6,11 @@ import (
 	"github.com/wiretrustee/wiretrustee/iface"
 	"github.com/wiretrustee/wiretrustee/util"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 )
 
 var managementURLDefault *url.URL
@@ -24,19 +27,68 @@ func init() {
 	managementURLDefault = managementURL
 }
 
-// Config Configuration type
+// Config Configuration type.
+// The running agent reloads the config on SIGHUP: LogLevel, StunsTurns, IFaceBlackList and IFaceAllowList are applied
+// live (the STUN/TURN servers and interface lists to the following connection attempts), changes of the other fields
+// require a restart.
+// The top level settings of the config file are the DefaultProfile, the named profiles are kept in Profiles
 type Config struct {
 	// Wireguard private key of local peer
-	PrivateKey     string
-	ManagementURL  *url.URL
-	WgIface        string
+	PrivateKey    string
+	ManagementURL *url.URL
+	WgIface       string
+	// WgPort is the listen port of the Wireguard interface, 0 means iface.WgPort (e.g. in a config written before
+	// profiles existed)
+	WgPort         int `json:",omitempty"`
 	IFaceBlackList []string
+	// IFaceAllowList when not empty restricts connection candidates to these interfaces, IFaceBlackList is ignored then
+	IFaceAllowList []string `json:",omitempty"`
+	// Region is where the peer is located (e.g. eu-central), TURN servers of the same region are preferred
+	Region string `json:",omitempty"`
+	// LogLevel overrides the log-level flag when set (e.g. debug)
+	LogLevel string `json:",omitempty"`
+	// StunsTurns is a list of STUN and TURN servers preferred over the ones received from the Management Service
+	StunsTurns []StunTurnServer `json:",omitempty"`
+	// Profiles are the named profiles of the config file next to the default one, each with its own Management Service,
+	// key, interface and listen port so that they can run side by side. Only set on the top level settings of the file
+	Profiles map[string]*Config `json:",omitempty"`
 }
 
-//createNewConfig creates a new config generating a new Wireguard key and saving to file
-func createNewConfig(managementURL string, configPath string) (*Config, error) {
+// StunTurnServer is a STUN or TURN server of the local config
+type StunTurnServer struct {
+	// URI of the server, e.g. stun:stun.example.com:3478 or turn:turn.example.com:3478?transport=udp
+	URI string
+	// Username and Password are the TURN credentials
+	Username string `json:",omitempty"`
+	Password string `json:",omitempty"`
+}
+
+//createNewConfig creates a new config of the profile generating a new Wireguard key and saving to file.
+//The other profiles of an existing file are kept, the new profile gets the first interface name and listen port none
+//of them uses
+func createNewConfig(managementURL string, configPath string, profile string, wgIface string) (*Config, error) {
+	file := &Config{}
+	if _, err := os.Stat(configPath); err == nil {
+		_, err = util.ReadJson(configPath, file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	wgKey := generateKey()
-	config := &Config{PrivateKey: wgKey, WgIface: iface.WgInterfaceDefault, IFaceBlackList: []string{}}
+	config := &Config{
+		PrivateKey:     wgKey,
+		WgIface:        nextInterfaceName(file.interfaces()),
+		WgPort:         nextListenPort(file.listenPorts()),
+		IFaceBlackList: []string{},
+	}
+	if wgIface != "" {
+		err := iface.ValidateName(wgIface)
+		if err != nil {
+			return nil, err
+		}
+		config.WgIface = wgIface
+	}
 	if managementURL != "" {
 		URL, err := parseManagementURL(managementURL)
 		if err != nil {
@@ -47,60 +99,183 @@ func createNewConfig(managementURL string, configPath string) (*Config, error) {
 		config.ManagementURL = managementURLDefault
 	}
 
-	config.IFaceBlackList = []string{iface.WgInterfaceDefault, "tun0"}
+	config.IFaceBlackList = []string{config.WgIface, "tun0"}
 
-	err := util.WriteJson(configPath, config)
+	file.setProfile(profile, config)
+	err := util.WriteJson(configPath, file)
 	if err != nil {
 		return nil, err
 	}
 
-	return config, nil
+	return file.isolatedProfile(profile), nil
 }
 
+// parseManagementURL parses a Management Service URL and normalizes it (see normalizeManagementURL)
 func parseManagementURL(managementURL string) (*url.URL, error) {
 
+	if !strings.Contains(managementURL, "://") {
+		return nil, fmt.Errorf("invalid Management Service URL provided %s, the scheme is missing. Supported format [http|https]://[host]:[port]", managementURL)
+	}
+
 	parsedMgmtURL, err := url.ParseRequestURI(managementURL)
 	if err != nil {
 		log.Errorf("failed parsing management URL %s: [%s]", managementURL, err.Error())
 		return nil, err
 	}
 
-	if !(parsedMgmtURL.Scheme == "https" || parsedMgmtURL.Scheme == "http") {
-		return nil, fmt.Errorf("invalid Management Service URL provided %s. Supported format [http|https]://[host]:[port]", managementURL)
+	return normalizeManagementURL(parsedMgmtURL)
+}
+
+// normalizeManagementURL validates a Management Service URL and returns it as [http|https]://[host]:[port].
+// The scheme decides whether TLS is used, so anything but http and https is rejected instead of falling back to plaintext.
+// A missing port defaults to 443 for https and 80 for http
+func normalizeManagementURL(managementURL *url.URL) (*url.URL, error) {
+	var defaultPort string
+	switch managementURL.Scheme {
+	case "https":
+		defaultPort = "443"
+	case "http":
+		defaultPort = "80"
+	default:
+		return nil, fmt.Errorf("invalid Management Service URL provided %s, unsupported scheme %q. Supported format [http|https]://[host]:[port]",
+			managementURL.String(), managementURL.Scheme)
 	}
 
-	return parsedMgmtURL, err
+	host := managementURL.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("invalid Management Service URL provided %s, the host is missing. Supported format [http|https]://[host]:[port]",
+			managementURL.String())
+	}
 
+	port := managementURL.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return nil, fmt.Errorf("invalid Management Service URL provided %s, invalid port %s", managementURL.String(), port)
+	}
+
+	return &url.URL{Scheme: managementURL.Scheme, Host: net.JoinHostPort(host, port)}, nil
 }
 
-// ReadConfig reads existing config. In case provided managementURL is not empty overrides the read property
-func ReadConfig(managementURL string, configPath string) (*Config, error) {
-	config := &Config{}
-	_, err := util.ReadJson(configPath, config)
+// ReadConfig reads existing config of the profile (an empty profile is DefaultProfile).
+// In case provided managementURL or wgIface are not empty overrides the read properties
+func ReadConfig(managementURL string, configPath string, profile string, wgIface string) (*Config, error) {
+	profile, err := profileName(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &Config{}
+	_, err = util.ReadJson(configPath, file)
 	if err != nil {
 		return nil, err
 	}
 
+	config := file.isolatedProfile(profile)
+	if config == nil {
+		return nil, fmt.Errorf("profile %s doesn't exist in config %s, the login command creates it", profile, configPath)
+	}
+
 	if managementURL != "" {
 		URL, err := parseManagementURL(managementURL)
 		if err != nil {
 			return nil, err
 		}
 		config.ManagementURL = URL
+	} else {
+		if config.ManagementURL == nil {
+			return nil, fmt.Errorf("the Management Service URL is missing in config %s", configPath)
+		}
+		URL, err := normalizeManagementURL(config.ManagementURL)
+		if err != nil {
+			return nil, fmt.Errorf("config %s: %v", configPath, err)
+		}
+		config.ManagementURL = URL
+	}
+
+	if wgIface != "" {
+		err = iface.ValidateName(wgIface)
+		if err != nil {
+			return nil, err
+		}
+		config.WgIface = wgIface
 	}
 
 	return config, err
 }
 
-// GetConfig reads existing config or generates a new one
-func GetConfig(managementURL string, configPath string) (*Config, error) {
+// GetConfig reads existing config of the profile (an empty profile is DefaultProfile) or generates a new one.
+// The Management Service URL is validated and normalized, see normalizeManagementURL
+func GetConfig(managementURL string, configPath string, profile string, wgIface string) (*Config, error) {
+	profile, err := profileName(profile)
+	if err != nil {
+		return nil, err
+	}
 
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
 		log.Infof("generating new config %s", configPath)
-		return createNewConfig(managementURL, configPath)
-	} else {
-		return ReadConfig(managementURL, configPath)
+		return createNewConfig(managementURL, configPath, profile, wgIface)
+	}
+
+	file := &Config{}
+	_, err = util.ReadJson(configPath, file)
+	if err != nil {
+		return nil, err
+	}
+	if file.profile(profile) == nil {
+		log.Infof("generating new profile %s in config %s", profile, configPath)
+		return createNewConfig(managementURL, configPath, profile, wgIface)
+	}
+	return ReadConfig(managementURL, configPath, profile, wgIface)
+}
+
+// RotateConfigKey replaces the Wireguard private key of the profile of the config at configPath with a newly generated one.
+// rotate re-keys the peer on the Management Service with the public key of the new private key. The new config is
+// written to a pending file first and moved over the config only when rotate succeeds, so that the key the Management
+// Service knows the peer by is never lost (on a failed move the pending file keeps the new key)
+func RotateConfigKey(configPath string, profile string, rotate func(newPubKey wgtypes.Key) error) error {
+	profile, err := profileName(profile)
+	if err != nil {
+		return err
+	}
+
+	file := &Config{}
+	_, err = util.ReadJson(configPath, file)
+	if err != nil {
+		return err
+	}
+	config := file.profile(profile)
+	if config == nil {
+		return fmt.Errorf("profile %s doesn't exist in config %s", profile, configPath)
+	}
+
+	newKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	config.PrivateKey = newKey.String()
+
+	pendingPath := configPath + ".rotating"
+	err = util.WriteJson(pendingPath, file)
+	if err != nil {
+		return fmt.Errorf("failed writing config with the new key to %s: %v", pendingPath, err)
+	}
+
+	err = rotate(newKey.PublicKey())
+	if err != nil {
+		removeErr := os.Remove(pendingPath)
+		if removeErr != nil {
+			log.Warnf("failed removing pending config %s: %v", pendingPath, removeErr)
+		}
+		return err
+	}
+
+	err = os.Rename(pendingPath, configPath)
+	if err != nil {
+		return fmt.Errorf("the key has been rotated but moving %s to %s failed, move it manually: %v", pendingPath, configPath, err)
 	}
+	return nil
 }
 
 // generateKey generates a new Wireguard private key
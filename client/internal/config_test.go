@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"errors"
+	"github.com/wiretrustee/wiretrustee/util"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateConfigKey(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	config, err := GetConfig("", configPath, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readKey := func() string {
+		stored := &Config{}
+		_, err := util.ReadJson(configPath, stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored.PrivateKey
+	}
+
+	// a failed rotation keeps the key
+	err = RotateConfigKey(configPath, "", func(newPubKey wgtypes.Key) error {
+		return errors.New("management is down")
+	})
+	if err == nil {
+		t.Fatalf("expecting failed rotation to return an error")
+	}
+	if readKey() != config.PrivateKey {
+		t.Errorf("expecting key to be kept when the rotation fails")
+	}
+	if _, err := os.Stat(configPath + ".rotating"); !os.IsNotExist(err) {
+		t.Errorf("expecting pending config to be removed, got %v", err)
+	}
+
+	var rotatedTo wgtypes.Key
+	err = RotateConfigKey(configPath, "", func(newPubKey wgtypes.Key) error {
+		rotatedTo = newPubKey
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, err := wgtypes.ParseKey(readKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKey.String() == config.PrivateKey {
+		t.Fatalf("expecting a new key to be stored")
+	}
+	if newKey.PublicKey() != rotatedTo {
+		t.Errorf("expecting the peer to be re-keyed with the public key of the stored key")
+	}
+}
+
+func TestParseManagementURL(t *testing.T) {
+	type testCase struct {
+		name        string
+		url         string
+		expectedURL string
+		expectErr   bool
+	}
+
+	testCases := []testCase{
+		{
+			name:        "https with port",
+			url:         "https://api.example.com:33073",
+			expectedURL: "https://api.example.com:33073",
+		},
+		{
+			name:        "missing https port defaults to 443",
+			url:         "https://api.example.com",
+			expectedURL: "https://api.example.com:443",
+		},
+		{
+			name:        "missing http port defaults to 80",
+			url:         "http://api.example.com",
+			expectedURL: "http://api.example.com:80",
+		},
+		{
+			name:        "IPv6 host",
+			url:         "http://[fd00::1]",
+			expectedURL: "http://[fd00::1]:80",
+		},
+		{
+			name:        "scheme is case insensitive",
+			url:         "HTTPS://api.example.com:33073/",
+			expectedURL: "https://api.example.com:33073",
+		},
+		{
+			name:      "missing scheme",
+			url:       "api.example.com:33073",
+			expectErr: true,
+		},
+		{
+			name:      "wrong scheme",
+			url:       "htps://api.example.com:33073",
+			expectErr: true,
+		},
+		{
+			name:      "grpc scheme",
+			url:       "grpc://api.example.com:33073",
+			expectErr: true,
+		},
+		{
+			name:      "missing host",
+			url:       "https://:33073",
+			expectErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			parsed, err := parseManagementURL(testCase.url)
+			if testCase.expectErr {
+				if err == nil {
+					t.Errorf("expecting URL %s to be rejected, got %s", testCase.url, parsed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.String() != testCase.expectedURL {
+				t.Errorf("expecting URL %s, got %s", testCase.expectedURL, parsed)
+			}
+		})
+	}
+}
+
+func TestGetConfig_ManagementURL(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	_, err := GetConfig("htps://api.example.com:33073", configPath, "", "")
+	if err == nil {
+		t.Fatalf("expecting a new config with a wrong Management Service URL scheme to be rejected")
+	}
+
+	config, err := GetConfig("https://api.example.com", configPath, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ManagementURL.String() != "https://api.example.com:443" {
+		t.Errorf("expecting Management Service URL to be normalized, got %s", config.ManagementURL)
+	}
+
+	// a URL edited in the config file is validated too
+	config.ManagementURL = &url.URL{Scheme: "htps", Host: "api.example.com:33073"}
+	err = util.WriteJson(configPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetConfig("", configPath, "", "")
+	if err == nil {
+		t.Errorf("expecting a config with a wrong Management Service URL scheme to be rejected")
+	}
+}
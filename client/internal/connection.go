@@ -2,20 +2,40 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	ice "github.com/pion/ice/v2"
 	log "github.com/sirupsen/logrus"
 	"github.com/wiretrustee/wiretrustee/iface"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	// DefaultWgKeepAlive default Wireguard keep alive constant
 	DefaultWgKeepAlive = 20 * time.Second
-	privateIPBlocks    []*net.IPNet
+	// DrainIdleInterval is how long the traffic has to stay idle for a draining connection to be considered drained
+	DrainIdleInterval = time.Second
+	// DefaultCandidatesChecksTimeout is how long connectivity checks may run once both peers have gathered all of their
+	// candidates when EngineConfig.CandidatesChecksTimeout isn't set. Only applies when the remote peer signals the end
+	// of its candidates.
+	DefaultCandidatesChecksTimeout = 10 * time.Second
+	privateIPBlocks                []*net.IPNet
+)
+
+var (
+	// ErrNoAnswer the remote peer didn't answer the offer within the timeout, most likely it is offline
+	ErrNoAnswer = errors.New("remote peer didn't answer")
+	// ErrGatherTimeout the local ICE agent hasn't gathered any candidate within the timeout,
+	// most likely the STUN and TURN servers are unreachable
+	ErrGatherTimeout = errors.New("no local candidates gathered")
+	// ErrConnectivityTimeout the candidates have been exchanged but the connectivity checks didn't succeed within the timeout,
+	// the peers can't reach each other neither directly nor through a TURN relay
+	ErrConnectivityTimeout = errors.New("connectivity checks failed")
 )
 
 type Status string
@@ -24,6 +44,8 @@ const (
 	StatusConnected    Status = "Connected"
 	StatusConnecting   Status = "Connecting"
 	StatusDisconnected Status = "Disconnected"
+	// StatusDegraded the connection is connected but heartbeats of the remote peer are missing (see HeartbeatConfig)
+	StatusDegraded Status = "Degraded"
 )
 
 func init() {
@@ -59,10 +81,31 @@ type ConnConfig struct {
 	WgKey wgtypes.Key
 	// Remote Wireguard public key
 	RemoteWgKey wgtypes.Key
+	// Wireguard preshared key shared with the remote peer, nil when none
+	PreSharedKey *wgtypes.Key
 
+	// StunTurnURLS is a list of STUN and TURN servers ordered by preference (see EngineConfig.StunsTurns)
 	StunTurnURLS []*ice.URL
 
 	iFaceBlackList map[string]struct{}
+	// iFaceAllowList restricts candidate gathering to the listed interfaces (see EngineConfig.IFaceAllowList)
+	iFaceAllowList map[string]struct{}
+	// candidateFilter excludes local candidates it returns false for (see EngineConfig.CandidateFilter)
+	candidateFilter func(candidate ice.Candidate) bool
+	// connectionMode limits the gathered candidates and the STUN and TURN servers used (see EngineConfig.ConnectionMode)
+	connectionMode ConnectionMode
+	// ipFamily defines the IP families candidates are gathered on (see EngineConfig.IPFamilyPreference)
+	ipFamily IPFamilyPreference
+	// proxyBuffers sizes the buffers of the Wireguard proxy (see EngineConfig.ProxyBuffers)
+	proxyBuffers ProxyBufferConfig
+	// heartbeat defines the heartbeat over the ICE connection once connected (see EngineConfig.Heartbeat)
+	heartbeat HeartbeatConfig
+	// candidatesChecksTimeout is how long connectivity checks may run once both peers have gathered all of their
+	// candidates (see EngineConfig.CandidatesChecksTimeout)
+	candidatesChecksTimeout time.Duration
+	// onEndpointChange is called with the Wireguard endpoint of the remote peer and the selected candidate pair
+	// once it has been configured (optional)
+	onEndpointChange func(endpoint string, relayed bool, pair string)
 }
 
 // IceCredentials ICE protocol credentials struct
@@ -73,8 +116,13 @@ type IceCredentials struct {
 
 // Connection Holds information about a connection and handles signal protocol
 type Connection struct {
+	// lastHeartbeat is when the latest heartbeat of the remote peer has been received (unix nanoseconds, 0 when none),
+	// accessed atomically and kept first in the struct to guarantee 64-bit alignment
+	lastHeartbeat int64
+
 	Config ConnConfig
-	// signalCandidate is a handler function to signal remote peer about local connection candidate
+	// signalCandidate is a handler function to signal remote peer about local connection candidate.
+	// A nil candidate signals that all the local candidates have been gathered
 	signalCandidate func(candidate ice.Candidate) error
 
 	// signalOffer is a handler function to signal remote peer our connection offer (credentials)
@@ -91,12 +139,34 @@ type Connection struct {
 
 	wgProxy *WgProxy
 
+	// connected is signaled once the connection has been established
 	connected *Cond
 	closeCond *Cond
 
+	// localCandidatesDone is signaled when the local ICE agent has gathered all of its candidates
+	localCandidatesDone *Cond
+	// remoteCandidatesDone is signaled when the remote peer has sent all of its candidates
+	remoteCandidatesDone *Cond
+	// localCandidates is the number of local candidates signaled to the remote peer, accessed atomically
+	localCandidates int32
+
 	remoteAuthCond sync.Once
 
+	// stateMux guards state, Status, failure and quality
+	stateMux sync.Mutex
+	// state is the current stage of the connection lifecycle, changed only through transition
+	state ConnState
+	// Status is the Status of the current state, StatusDegraded while connected with heartbeats missing
 	Status Status
+	// failure is the error Open has returned
+	failure error
+	// quality is the latest quality score while connected (see monitorQuality)
+	quality QualityScore
+	// pendingOffer is an offer of the remote peer received before Open, see holdOffer
+	pendingOffer *pendingOffer
+
+	// history keeps the latest events of the connection for debugging
+	history *connHistory
 }
 
 // NewConnection Creates a new connection and sets handling functions for signal protocol
@@ -106,37 +176,88 @@ func NewConnection(config ConnConfig,
 	signalAnswer func(uFrag string, pwd string) error,
 ) *Connection {
 
-	return &Connection{
-		Config:            config,
-		signalCandidate:   signalCandidate,
-		signalOffer:       signalOffer,
-		signalAnswer:      signalAnswer,
-		remoteAuthChannel: make(chan IceCredentials, 1),
-		closeCond:         NewCond(),
-		connected:         NewCond(),
-		agent:             nil,
-		wgProxy:           NewWgProxy(config.WgIface, config.RemoteWgKey.String(), config.WgAllowedIPs, config.WgListenAddr),
-		Status:            StatusDisconnected,
+	conn := &Connection{
+		Config:               config,
+		signalCandidate:      signalCandidate,
+		signalOffer:          signalOffer,
+		signalAnswer:         signalAnswer,
+		remoteAuthChannel:    make(chan IceCredentials, 1),
+		closeCond:            NewCond(),
+		connected:            NewCond(),
+		localCandidatesDone:  NewCond(),
+		remoteCandidatesDone: NewCond(),
+		agent:                nil,
+		wgProxy:              NewWgProxy(config.WgIface, config.RemoteWgKey.String(), config.WgAllowedIPs, config.PreSharedKey, config.WgListenAddr, config.proxyBuffers, config.connectionMode.wgKeepAlive()),
+		state:                ConnStateNew,
+		Status:               ConnStateNew.Status(),
+		history:              &connHistory{},
 	}
+	conn.wgProxy.onHeartbeat = conn.onHeartbeat
+	return conn
+}
+
+// History returns the latest events of the connection (at most connHistorySize), the oldest first
+func (conn *Connection) History() []ConnEvent {
+	return conn.history.list()
+}
+
+// State returns the current state of the connection
+func (conn *Connection) State() ConnState {
+	conn.stateMux.Lock()
+	defer conn.stateMux.Unlock()
+	return conn.state
+}
+
+// CurrentStatus returns the Status of the connection, unlike the Status of its State it tells a degraded connection apart
+func (conn *Connection) CurrentStatus() Status {
+	conn.stateMux.Lock()
+	defer conn.stateMux.Unlock()
+	return conn.Status
+}
+
+// Failure returns the error Open has returned (e.g. wrapping ErrNoAnswer), nil while Open is running
+func (conn *Connection) Failure() error {
+	conn.stateMux.Lock()
+	defer conn.stateMux.Unlock()
+	return conn.failure
+}
+
+// transition moves the connection to the next state. Out of order transitions (e.g. to Connected after Close)
+// are rejected with an error and the state stays unchanged
+func (conn *Connection) transition(next ConnState) error {
+	conn.stateMux.Lock()
+	defer conn.stateMux.Unlock()
+
+	if !conn.state.canTransitionTo(next) {
+		return fmt.Errorf("connection to peer %s can't move from state %s to %s", conn.Config.RemoteWgKey.String(), conn.state, next)
+	}
+
+	log.Debugf("connection to peer %s moved from state %s to %s", conn.Config.RemoteWgKey.String(), conn.state, next)
+	conn.history.add("state %s -> %s", conn.state, next)
+	conn.state = next
+	conn.Status = next.Status()
+	return nil
 }
 
 // Open opens connection to a remote peer.
-// Will block until the connection has successfully established
-func (conn *Connection) Open(timeout time.Duration) error {
+// Will block until the connection has been closed, the connected Cond is signaled once it has been established.
+// A connection that hasn't been established within the timeout fails with an error wrapping ErrNoAnswer, ErrGatherTimeout
+// or ErrConnectivityTimeout depending on the stage it was stuck at
+func (conn *Connection) Open(timeout time.Duration) (err error) {
+	deadline := time.Now().Add(timeout)
+	defer func() {
+		if err != nil {
+			conn.stateMux.Lock()
+			conn.failure = err
+			conn.stateMux.Unlock()
+			conn.history.add("failed: %v", err)
+			// rejected when the connection has been closed already, it stays closed
+			_ = conn.transition(ConnStateFailed)
+		}
+	}()
 
 	// create an ice.Agent that will be responsible for negotiating and establishing actual peer-to-peer connection
-	a, err := ice.NewAgent(&ice.AgentConfig{
-		// MulticastDNSMode: ice.MulticastDNSModeQueryAndGather,
-		NetworkTypes: []ice.NetworkType{ice.NetworkTypeUDP4},
-		Urls:         conn.Config.StunTurnURLS,
-		InterfaceFilter: func(s string) bool {
-			if conn.Config.iFaceBlackList == nil {
-				return true
-			}
-			_, ok := conn.Config.iFaceBlackList[s]
-			return !ok
-		},
-	})
+	a, err := ice.NewAgent(conn.newAgentConfig())
 	conn.agent = a
 
 	if err != nil {
@@ -153,12 +274,25 @@ func (conn *Connection) Open(timeout time.Duration) error {
 		return err
 	}
 
+	// remote peer signals are accepted from now on
+	err = conn.transition(ConnStateGathering)
+	if err != nil {
+		return err
+	}
+
 	err = conn.signalCredentials()
 	if err != nil {
 		return err
 	}
 
-	conn.Status = StatusConnecting
+	// the remote peer may have initiated before the connection has been opened, it waits for the answer
+	if offer := conn.takeHeldOffer(); offer != nil {
+		err = conn.OnOffer(offer.credentials)
+		if err != nil {
+			return err
+		}
+	}
+
 	log.Infof("trying to connect to peer %s", conn.Config.RemoteWgKey.String())
 
 	// wait until credentials have been sent from the remote peer (will arrive via a signal server)
@@ -167,15 +301,21 @@ func (conn *Connection) Open(timeout time.Duration) error {
 
 		log.Infof("got a connection confirmation from peer %s", conn.Config.RemoteWgKey.String())
 
+		err = conn.transition(ConnStateConnecting)
+		if err != nil {
+			return err
+		}
+
 		err = conn.agent.GatherCandidates()
 		if err != nil {
 			return err
 		}
 
 		isControlling := conn.Config.WgKey.PublicKey().String() > conn.Config.RemoteWgKey.String()
-		remoteConn, err := conn.openConnectionToRemote(isControlling, remoteAuth)
+		remoteConn, err := conn.openConnectionToRemote(isControlling, remoteAuth, time.Until(deadline))
 		if err != nil {
-			log.Errorf("failed establishing connection with the remote peer %s %s", conn.Config.RemoteWgKey.String(), err)
+			// the Engine logs the failure before retrying, without repeating it for every attempt
+			log.Debugf("failed establishing connection with the remote peer %s %s", conn.Config.RemoteWgKey.String(), err)
 			return err
 		}
 
@@ -185,41 +325,129 @@ func (conn *Connection) Open(timeout time.Duration) error {
 		}
 		remoteIP := net.ParseIP(pair.Remote.Address())
 		myIp := net.ParseIP(pair.Remote.Address())
+		relayed := pair.Local.Type() == ice.CandidateTypeRelay || pair.Remote.Type() == ice.CandidateTypeRelay
+		var endpoint string
 		// in case the remote peer is in the local network or one of the peers has public static IP -> no need for a Wireguard proxy, direct communication is possible.
 		if (pair.Local.Type() == ice.CandidateTypeHost && pair.Remote.Type() == ice.CandidateTypeHost) && (isPublicIP(remoteIP) || isPublicIP(myIp)) {
 			log.Debugf("it is possible to establish a direct connection (without proxy) to peer %s - my addr: %s, remote addr: %s", conn.Config.RemoteWgKey.String(), pair.Local.Address(), pair.Remote.Address())
-			err = conn.wgProxy.StartLocal(fmt.Sprintf("%s:%d", pair.Remote.Address(), iface.WgPort))
+			endpoint = net.JoinHostPort(pair.Remote.Address(), strconv.Itoa(iface.WgPort))
+			err = conn.wgProxy.StartLocal(endpoint)
 			if err != nil {
 				return err
 			}
+			go conn.readHeartbeats(remoteConn)
 		} else {
 			log.Infof("establishing secure tunnel to peer %s via selected candidate pair %s", conn.Config.RemoteWgKey.String(), pair)
 			err = conn.wgProxy.Start(remoteConn)
 			if err != nil {
 				return err
 			}
+			endpoint = conn.wgProxy.wgConn.LocalAddr().String()
 		}
 
-		conn.Status = StatusConnected
+		err = conn.transition(ConnStateConnected)
+		if err != nil {
+			return err
+		}
+		conn.connected.Signal()
+		conn.history.add("connected via %s (relayed: %t, endpoint %s)", pair, relayed, endpoint)
 		log.Infof("opened connection to peer %s", conn.Config.RemoteWgKey.String())
+		go conn.monitorQuality(relayed)
+		go conn.monitorHeartbeat(remoteConn)
+
+		if conn.Config.onEndpointChange != nil {
+			conn.Config.onEndpointChange(endpoint, relayed, pair.String())
+		}
 	case <-conn.closeCond.C:
-		conn.Status = StatusDisconnected
 		return fmt.Errorf("connection to peer %s has been closed", conn.Config.RemoteWgKey.String())
 	case <-time.After(timeout):
+		_ = conn.transition(ConnStateFailed)
 		err := conn.Close()
 		if err != nil {
 			log.Warnf("error while closing connection to peer %s -> %s", conn.Config.RemoteWgKey.String(), err.Error())
 		}
-		conn.Status = StatusDisconnected
-		return fmt.Errorf("timeout of %vs exceeded while waiting for the remote peer %s", timeout.Seconds(), conn.Config.RemoteWgKey.String())
+		return fmt.Errorf("%w: timeout of %vs exceeded while waiting for the remote peer %s", ErrNoAnswer, timeout.Seconds(), conn.Config.RemoteWgKey.String())
 	}
 
 	// wait until connection has been closed
 	<-conn.closeCond.C
-	conn.Status = StatusDisconnected
 	return fmt.Errorf("connection to peer %s has been closed", conn.Config.RemoteWgKey.String())
 }
 
+// newAgentConfig creates a configuration of the ICE agent of the connection.
+// STUN and TURN URLs are passed in the order of ConnConfig.StunTurnURLS (the preference order), the agent gets its own copy
+// of the list so that it can't be reordered afterwards.
+// The connection mode limits the URLs and the gathered candidate types, the IP family preference the network types.
+func (conn *Connection) newAgentConfig() *ice.AgentConfig {
+	urls := conn.Config.connectionMode.filterURLs(conn.Config.StunTurnURLS)
+
+	return &ice.AgentConfig{
+		// MulticastDNSMode: ice.MulticastDNSModeQueryAndGather,
+		NetworkTypes:    conn.Config.ipFamily.networkTypes(),
+		Urls:            urls,
+		CandidateTypes:  conn.Config.connectionMode.candidateTypes(),
+		InterfaceFilter: withCandidateFilter(newInterfaceFilter(conn.Config.iFaceAllowList, conn.Config.iFaceBlackList), conn.Config.candidateFilter),
+	}
+}
+
+// withCandidateFilter extends an ICE interface filter with the candidate filter: candidates are gathered on an interface
+// only when the candidate filter accepts the host candidate of at least one of its addresses, so that the agent never
+// gathers nor checks the candidates of the rejected interfaces. Rejected candidates the agent gathers anyway (other
+// addresses of an accepted interface, server reflexive and relayed candidates) are dropped by listenOnLocalCandidates
+func withCandidateFilter(interfaceFilter func(string) bool, candidateFilter func(ice.Candidate) bool) func(string) bool {
+	if candidateFilter == nil {
+		return interfaceFilter
+	}
+	return func(name string) bool {
+		return interfaceFilter(name) && hasAllowedHostCandidate(name, candidateFilter)
+	}
+}
+
+// hasAllowedHostCandidate checks whether the candidate filter accepts the host candidate of an address of the interface.
+// An interface whose addresses can't be read is left to the agent
+func hasAllowedHostCandidate(name string, candidateFilter func(ice.Candidate) bool) bool {
+	netIface, err := net.InterfaceByName(name)
+	if err != nil {
+		return true
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return true
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		candidate, err := ice.NewCandidateHost(&ice.CandidateHostConfig{
+			Network:   "udp",
+			Address:   ipNet.IP.String(),
+			Component: ice.ComponentRTP,
+		})
+		if err != nil {
+			continue
+		}
+		if candidateFilter(candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// newInterfaceFilter creates an ICE interface filter accepting the interfaces of a non-empty allowList only,
+// otherwise the interfaces not in the blackList. The allowList takes precedence, the blackList is ignored when both are set
+func newInterfaceFilter(allowList map[string]struct{}, blackList map[string]struct{}) func(string) bool {
+	return func(name string) bool {
+		if len(allowList) > 0 {
+			_, ok := allowList[name]
+			return ok
+		}
+		_, ok := blackList[name]
+		return !ok
+	}
+}
+
 func isPublicIP(ip net.IP) bool {
 	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
 		return false
@@ -239,6 +467,8 @@ func (conn *Connection) Close() error {
 	conn.closeCond.Do(func() {
 
 		log.Warnf("closing connection to peer %s", conn.Config.RemoteWgKey.String())
+		// any state but Closed can move to Closed and Do runs once
+		_ = conn.transition(ConnStateClosed)
 
 		if a := conn.agent; a != nil {
 			e := a.Close()
@@ -259,21 +489,84 @@ func (conn *Connection) Close() error {
 	return err
 }
 
+// CloseGracefully drains the connection before closing it: the traffic keeps flowing in both directions until it has
+// been idle for DrainIdleInterval or the grace period is over, so that the flows in progress can complete. New flows
+// aren't opened through it, the connection has been removed from the Engine already (e.g. the peer isn't reconnected).
+// A concurrent Close ends the drain right away. Connections that aren't connected are closed without a drain
+func (conn *Connection) CloseGracefully(grace time.Duration) error {
+	if grace > 0 && conn.State() == ConnStateConnected {
+		log.Debugf("draining connection to peer %s for up to %v", conn.Config.RemoteWgKey.String(), grace)
+		conn.waitDrained(grace)
+	}
+	return conn.Close()
+}
+
+// waitDrained blocks until the traffic in both directions has been idle for DrainIdleInterval, the grace period is
+// over or the connection has been closed
+func (conn *Connection) waitDrained(grace time.Duration) {
+	deadline := time.NewTimer(grace)
+	defer deadline.Stop()
+	ticker := time.NewTicker(DrainIdleInterval)
+	defer ticker.Stop()
+
+	relayed := conn.Stats()
+	for {
+		select {
+		case <-ticker.C:
+			current := conn.Stats()
+			if current == relayed {
+				return
+			}
+			relayed = current
+		case <-deadline.C:
+			log.Debugf("grace period of connection to peer %s is over", conn.Config.RemoteWgKey.String())
+			return
+		case <-conn.closeCond.C:
+			return
+		}
+	}
+}
+
+// Stats returns the number of bytes relayed through the Wireguard proxy of the connection.
+// Stays zero when the peers communicate directly without the proxy
+func (conn *Connection) Stats() ProxyStats {
+	if conn.wgProxy == nil {
+		return ProxyStats{}
+	}
+	return conn.wgProxy.Stats()
+}
+
 // OnAnswer Handles the answer from the other peer
 func (conn *Connection) OnAnswer(remoteAuth IceCredentials) error {
+	if state := conn.State(); !state.acceptsRemoteEvents() {
+		log.Debugf("ignoring answer from peer %s in state %s", conn.Config.RemoteWgKey.String(), state)
+		return nil
+	}
 
 	conn.remoteAuthCond.Do(func() {
 		log.Debugf("OnAnswer from peer %s", conn.Config.RemoteWgKey.String())
+		conn.history.add("answer received")
 		conn.remoteAuthChannel <- remoteAuth
 	})
 	return nil
 }
 
-// OnOffer Handles the offer from the other peer
+// OnOffer Handles the offer from the other peer.
+// An offer received before Open is held and answered by Open
 func (conn *Connection) OnOffer(remoteAuth IceCredentials) error {
+	if conn.holdOffer(pendingOffer{credentials: remoteAuth, received: time.Now()}) {
+		log.Debugf("holding offer from peer %s until the connection is opened", conn.Config.RemoteWgKey.String())
+		return nil
+	}
+
+	if state := conn.State(); !state.acceptsRemoteEvents() {
+		log.Debugf("ignoring offer from peer %s in state %s", conn.Config.RemoteWgKey.String(), state)
+		return nil
+	}
 
 	conn.remoteAuthCond.Do(func() {
 		log.Debugf("OnOffer from peer %s", conn.Config.RemoteWgKey.String())
+		conn.history.add("offer received")
 		conn.remoteAuthChannel <- remoteAuth
 		uFrag, pwd, err := conn.agent.GetLocalUserCredentials()
 		if err != nil { //nolint
@@ -289,6 +582,10 @@ func (conn *Connection) OnOffer(remoteAuth IceCredentials) error {
 
 // OnRemoteCandidate Handles remote candidate provided by the peer.
 func (conn *Connection) OnRemoteCandidate(candidate ice.Candidate) error {
+	if state := conn.State(); !state.acceptsRemoteEvents() {
+		log.Debugf("ignoring candidate from peer %s in state %s", conn.Config.RemoteWgKey.String(), state)
+		return nil
+	}
 
 	log.Debugf("onRemoteCandidate from peer %s -> %s", conn.Config.RemoteWgKey.String(), candidate.String())
 
@@ -300,25 +597,85 @@ func (conn *Connection) OnRemoteCandidate(candidate ice.Candidate) error {
 	return nil
 }
 
+// OnRemoteEndOfCandidates handles the remote peer signaling that it has sent all of its candidates
+func (conn *Connection) OnRemoteEndOfCandidates() {
+	if state := conn.State(); !state.acceptsRemoteEvents() {
+		log.Debugf("ignoring end of candidates from peer %s in state %s", conn.Config.RemoteWgKey.String(), state)
+		return
+	}
+	log.Debugf("onRemoteEndOfCandidates from peer %s", conn.Config.RemoteWgKey.String())
+	conn.history.add("remote peer sent all of its candidates")
+	conn.remoteCandidatesDone.Signal()
+}
+
 // openConnectionToRemote opens an ice.Conn to the remote peer. This is a real peer-to-peer connection
-// blocks until connection has been established
-func (conn *Connection) openConnectionToRemote(isControlling bool, credentials IceCredentials) (*ice.Conn, error) {
+// blocks until connection has been established, until the timeout or until the connectivity checks have run for
+// the candidates checks timeout after both peers have finished gathering candidates
+func (conn *Connection) openConnectionToRemote(isControlling bool, credentials IceCredentials, timeout time.Duration) (*ice.Conn, error) {
 	var realConn *ice.Conn
 	var err error
 
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go conn.cancelOnChecksTimeout(ctx, cancel, conn.Config.checksTimeout())
+
 	if isControlling {
-		realConn, err = conn.agent.Dial(context.TODO(), credentials.uFrag, credentials.pwd)
+		realConn, err = conn.agent.Dial(ctx, credentials.uFrag, credentials.pwd)
 	} else {
-		realConn, err = conn.agent.Accept(context.TODO(), credentials.uFrag, credentials.pwd)
+		realConn, err = conn.agent.Accept(ctx, credentials.uFrag, credentials.pwd)
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, conn.connectivityFailure(err)
 	}
 
 	return realConn, err
 }
 
+// connectivityFailure tells why the ICE agent hasn't connected to the remote peer:
+// no local candidate to offer (ErrGatherTimeout) or no candidate pair that works (ErrConnectivityTimeout)
+func (conn *Connection) connectivityFailure(err error) error {
+	select {
+	case <-conn.closeCond.C:
+		return fmt.Errorf("connection to peer %s has been closed", conn.Config.RemoteWgKey.String())
+	default:
+	}
+
+	if atomic.LoadInt32(&conn.localCandidates) == 0 {
+		return fmt.Errorf("%w for peer %s: %v", ErrGatherTimeout, conn.Config.RemoteWgKey.String(), err)
+	}
+
+	return fmt.Errorf("%w with peer %s: %v", ErrConnectivityTimeout, conn.Config.RemoteWgKey.String(), err)
+}
+
+// checksTimeout returns ConnConfig.candidatesChecksTimeout falling back to DefaultCandidatesChecksTimeout
+func (config ConnConfig) checksTimeout() time.Duration {
+	if config.candidatesChecksTimeout > 0 {
+		return config.candidatesChecksTimeout
+	}
+	return DefaultCandidatesChecksTimeout
+}
+
+// cancelOnChecksTimeout cancels the connection attempt if it hasn't succeeded within the timeout after both peers have
+// gathered all of their candidates: no new candidate pairs will show up, so waiting longer is pointless.
+// Peers that never signal the end of their candidates are waited for as before.
+func (conn *Connection) cancelOnChecksTimeout(ctx context.Context, cancel context.CancelFunc, timeout time.Duration) {
+	for _, done := range []*Cond{conn.localCandidatesDone, conn.remoteCandidatesDone} {
+		select {
+		case <-done.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	select {
+	case <-time.After(timeout):
+		log.Infof("connectivity checks with peer %s didn't succeed within %v after gathering all candidates", conn.Config.RemoteWgKey.String(), timeout)
+		cancel()
+	case <-ctx.Done():
+	}
+}
+
 // signalCredentials prepares local user credentials and signals them to the remote peer
 func (conn *Connection) signalCredentials() error {
 	localUFrag, localPwd, err := conn.agent.GetLocalUserCredentials()
@@ -330,6 +687,7 @@ func (conn *Connection) signalCredentials() error {
 	if err != nil {
 		return err
 	}
+	conn.history.add("offer sent")
 	return nil
 }
 
@@ -337,14 +695,28 @@ func (conn *Connection) signalCredentials() error {
 // signals them to the remote peer
 func (conn *Connection) listenOnLocalCandidates() error {
 	err := conn.agent.OnCandidate(func(candidate ice.Candidate) {
-		if candidate != nil {
-			log.Debugf("discovered local candidate %s", candidate.String())
-			err := conn.signalCandidate(candidate)
+		if candidate == nil {
+			// nil candidate indicates that the gathering has been completed
+			log.Debugf("gathered all local candidates for peer %s", conn.Config.RemoteWgKey.String())
+			conn.history.add("gathered %d local candidates", atomic.LoadInt32(&conn.localCandidates))
+			conn.localCandidatesDone.Signal()
+			err := conn.signalCandidate(nil)
 			if err != nil {
-				log.Errorf("failed signaling candidate to the remote peer %s %s", conn.Config.RemoteWgKey.String(), err)
-				//todo ??
-				return
+				log.Errorf("failed signaling end of candidates to the remote peer %s %s", conn.Config.RemoteWgKey.String(), err)
 			}
+			return
+		}
+		if !conn.isCandidateAllowed(candidate) {
+			log.Debugf("dropping local candidate %s rejected by the candidate filter", candidate.String())
+			return
+		}
+		log.Debugf("discovered local candidate %s", candidate.String())
+		atomic.AddInt32(&conn.localCandidates, 1)
+		err := conn.signalCandidate(candidate)
+		if err != nil {
+			log.Errorf("failed signaling candidate to the remote peer %s %s", conn.Config.RemoteWgKey.String(), err)
+			//todo ??
+			return
 		}
 	})
 
@@ -355,10 +727,19 @@ func (conn *Connection) listenOnLocalCandidates() error {
 	return nil
 }
 
+// isCandidateAllowed checks whether a local candidate passes the configured candidate filter
+func (conn *Connection) isCandidateAllowed(candidate ice.Candidate) bool {
+	if conn.Config.candidateFilter == nil {
+		return true
+	}
+	return conn.Config.candidateFilter(candidate)
+}
+
 // listenOnConnectionStateChanges registers callback of an ICE Agent to track connection state
 func (conn *Connection) listenOnConnectionStateChanges() error {
 	err := conn.agent.OnConnectionStateChange(func(state ice.ConnectionState) {
 		log.Debugf("ICE Connection State has changed for peer %s -> %s", conn.Config.RemoteWgKey.String(), state.String())
+		conn.history.add("ICE connection state %s", state.String())
 		if state == ice.ConnectionStateConnected {
 			// closed the connection has been established we can check the selected candidate pair
 			pair, err := conn.agent.GetSelectedCandidatePair()
@@ -0,0 +1,357 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	ice "github.com/pion/ice/v2"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnection_CandidateFilter(t *testing.T) {
+	_, cgnat, err := net.ParseCIDR("100.64.0.0/10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	candidates := map[string]bool{
+		"192.168.1.10": true,
+		"100.64.0.5":   false,
+		"100.127.1.1":  false,
+		"8.8.8.8":      true,
+	}
+
+	conn := NewConnection(ConnConfig{
+		candidateFilter: func(candidate ice.Candidate) bool {
+			return !cgnat.Contains(net.ParseIP(candidate.Address()))
+		},
+	}, nil, nil, nil)
+
+	for address, expected := range candidates {
+		candidate, err := ice.NewCandidateHost(&ice.CandidateHostConfig{
+			Network:   "udp",
+			Address:   address,
+			Port:      51820,
+			Component: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if allowed := conn.isCandidateAllowed(candidate); allowed != expected {
+			t.Errorf("expected candidate %s to be allowed = %v, got %v", address, expected, allowed)
+		}
+	}
+}
+
+func TestConnection_NoCandidateFilter(t *testing.T) {
+	conn := NewConnection(ConnConfig{}, nil, nil, nil)
+
+	candidate, err := ice.NewCandidateHost(&ice.CandidateHostConfig{
+		Network:   "udp",
+		Address:   "100.64.0.5",
+		Port:      51820,
+		Component: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !conn.isCandidateAllowed(candidate) {
+		t.Errorf("expected all candidates to be allowed when no filter is set")
+	}
+}
+
+func TestConnection_AgentConfigPreservesStunTurnOrder(t *testing.T) {
+	var urls []*ice.URL
+	for _, rawURL := range []string{
+		"turn:turn.local.example.com:3478",
+		"stun:stun.local.example.com:3478",
+		"turn:turn.wiretrustee.com:3478",
+		"stun:stun.wiretrustee.com:3468",
+	} {
+		url, err := ice.ParseURL(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, url)
+	}
+
+	conn := NewConnection(ConnConfig{StunTurnURLS: urls}, nil, nil, nil)
+	agentConfig := conn.newAgentConfig()
+
+	if len(agentConfig.Urls) != len(urls) {
+		t.Fatalf("expecting agent config to have %d URLs, got %d", len(urls), len(agentConfig.Urls))
+	}
+
+	for i, url := range urls {
+		if agentConfig.Urls[i] != url {
+			t.Errorf("expecting URL %s at position %d, got %s", url, i, agentConfig.Urls[i])
+		}
+	}
+
+	// reordering the connection config afterwards must not affect the agent
+	urls[0], urls[1] = urls[1], urls[0]
+	if agentConfig.Urls[0] == urls[0] {
+		t.Errorf("expecting agent config to keep its own copy of the URLs")
+	}
+}
+
+func TestConnection_CancelOnChecksTimeout(t *testing.T) {
+	conn := NewConnection(ConnConfig{}, nil, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go conn.cancelOnChecksTimeout(ctx, cancel, 10*time.Millisecond)
+
+	// remote signals are accepted once the connection has been opened
+	err := conn.transition(ConnStateGathering)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.localCandidatesDone.Signal()
+	conn.OnRemoteEndOfCandidates()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Errorf("expecting connection attempt to be canceled after both peers gathered their candidates")
+	}
+}
+
+func TestConnConfig_ChecksTimeout(t *testing.T) {
+	if timeout := (ConnConfig{}).checksTimeout(); timeout != DefaultCandidatesChecksTimeout {
+		t.Errorf("expecting unset candidates checks timeout to be %v, got %v", DefaultCandidatesChecksTimeout, timeout)
+	}
+	if timeout := (ConnConfig{candidatesChecksTimeout: time.Minute}).checksTimeout(); timeout != time.Minute {
+		t.Errorf("expecting configured candidates checks timeout of %v, got %v", time.Minute, timeout)
+	}
+}
+
+func TestConnection_NoRemoteEndOfCandidates(t *testing.T) {
+	conn := NewConnection(ConnConfig{}, nil, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go conn.cancelOnChecksTimeout(ctx, cancel, 10*time.Millisecond)
+
+	// the remote peer doesn't support end of candidates
+	conn.localCandidatesDone.Signal()
+
+	select {
+	case <-ctx.Done():
+		t.Errorf("expecting connection attempt not to be canceled without remote end of candidates")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConnection_StateTransitions(t *testing.T) {
+	conn := NewConnection(ConnConfig{}, nil, nil, nil)
+
+	if conn.State() != ConnStateNew || conn.Status != StatusDisconnected {
+		t.Fatalf("expecting a new connection to be %s and %s, got %s and %s", ConnStateNew, StatusDisconnected, conn.State(), conn.Status)
+	}
+
+	// can't get connected without negotiating first
+	err := conn.transition(ConnStateConnected)
+	if err == nil {
+		t.Errorf("expecting transition from %s to %s to be rejected", ConnStateNew, ConnStateConnected)
+	}
+
+	for _, state := range []ConnState{ConnStateGathering, ConnStateConnecting, ConnStateConnected} {
+		err = conn.transition(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.Status != state.Status() {
+			t.Errorf("expecting status %s in state %s, got %s", state.Status(), state, conn.Status)
+		}
+	}
+
+	err = conn.transition(ConnStateClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, state := range []ConnState{ConnStateGathering, ConnStateConnecting, ConnStateConnected, ConnStateFailed, ConnStateClosed} {
+		err = conn.transition(state)
+		if err == nil {
+			t.Errorf("expecting transition from %s to %s to be rejected", ConnStateClosed, state)
+		}
+	}
+
+	if conn.State() != ConnStateClosed || conn.Status != StatusDisconnected {
+		t.Errorf("expecting closed connection to stay %s and %s, got %s and %s", ConnStateClosed, StatusDisconnected, conn.State(), conn.Status)
+	}
+}
+
+func TestConnection_IgnoresRemoteEventsWhenNotOpen(t *testing.T) {
+	conn := NewConnection(ConnConfig{}, nil, nil, nil)
+
+	// the ICE agent doesn't exist before Open, handling these must not panic
+	err := conn.OnOffer(IceCredentials{uFrag: "uFrag", pwd: "pwd"})
+	if err != nil {
+		t.Error(err)
+	}
+	conn.OnRemoteEndOfCandidates()
+
+	err = conn.transition(ConnStateClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.OnAnswer(IceCredentials{uFrag: "uFrag", pwd: "pwd"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case <-conn.remoteAuthChannel:
+		t.Errorf("expecting remote credentials to be ignored when the connection is not open")
+	case <-conn.remoteCandidatesDone.C:
+		t.Errorf("expecting remote end of candidates to be ignored when the connection is not open")
+	default:
+	}
+}
+
+func TestConnection_OpenNoAnswer(t *testing.T) {
+	conn := NewConnection(ConnConfig{}, func(candidate ice.Candidate) error {
+		return nil
+	}, func(uFrag string, pwd string) error {
+		return nil
+	}, nil)
+
+	// the remote peer never answers the offer
+	err := conn.Open(100 * time.Millisecond)
+	if !errors.Is(err, ErrNoAnswer) {
+		t.Fatalf("expecting open to fail with %v, got %v", ErrNoAnswer, err)
+	}
+	if !errors.Is(conn.Failure(), ErrNoAnswer) {
+		t.Errorf("expecting connection failure to be %v, got %v", ErrNoAnswer, conn.Failure())
+	}
+}
+
+func TestConnection_ConnectivityFailure(t *testing.T) {
+	conn := NewConnection(ConnConfig{}, nil, nil, nil)
+
+	err := conn.connectivityFailure(context.DeadlineExceeded)
+	if !errors.Is(err, ErrGatherTimeout) {
+		t.Errorf("expecting failure without local candidates to be %v, got %v", ErrGatherTimeout, err)
+	}
+
+	conn.localCandidates = 1
+	err = conn.connectivityFailure(context.DeadlineExceeded)
+	if !errors.Is(err, ErrConnectivityTimeout) {
+		t.Errorf("expecting failure with local candidates to be %v, got %v", ErrConnectivityTimeout, err)
+	}
+
+	err = conn.Close()
+	if err != nil {
+		t.Log(err)
+	}
+	err = conn.connectivityFailure(context.Canceled)
+	if errors.Is(err, ErrGatherTimeout) || errors.Is(err, ErrConnectivityTimeout) {
+		t.Errorf("expecting closed connection not to be reported as a timeout, got %v", err)
+	}
+}
+
+func TestConnection_CloseGracefully(t *testing.T) {
+	newConnected := func() *Connection {
+		conn := NewConnection(ConnConfig{}, nil, nil, nil)
+		for _, state := range []ConnState{ConnStateGathering, ConnStateConnecting, ConnStateConnected} {
+			err := conn.transition(state)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return conn
+	}
+
+	// idle connection is drained after DrainIdleInterval
+	conn := newConnected()
+	start := time.Now()
+	_ = conn.CloseGracefully(time.Minute)
+	if elapsed := time.Since(start); elapsed > DrainIdleInterval+time.Second {
+		t.Errorf("expecting idle connection to be drained within %v, took %v", DrainIdleInterval, elapsed)
+	}
+	if conn.State() != ConnStateClosed {
+		t.Errorf("expecting connection to be closed after the drain, got %s", conn.State())
+	}
+
+	// a concurrent Close ends the drain right away
+	conn = newConnected()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = conn.Close()
+	}()
+	start = time.Now()
+	_ = conn.CloseGracefully(time.Minute)
+	if elapsed := time.Since(start); elapsed > DrainIdleInterval {
+		t.Errorf("expecting Close to end the drain, took %v", elapsed)
+	}
+
+	// a connection that isn't connected isn't drained
+	conn = NewConnection(ConnConfig{}, nil, nil, nil)
+	start = time.Now()
+	_ = conn.CloseGracefully(time.Minute)
+	if elapsed := time.Since(start); elapsed > DrainIdleInterval {
+		t.Errorf("expecting connection without traffic to be closed right away, took %v", elapsed)
+	}
+	if conn.State() != ConnStateClosed {
+		t.Errorf("expecting connection to be closed, got %s", conn.State())
+	}
+}
+
+func TestNewInterfaceFilter(t *testing.T) {
+	type testCase struct {
+		name      string
+		allowList map[string]struct{}
+		blackList map[string]struct{}
+		accepted  []string
+		rejected  []string
+	}
+
+	testCases := []testCase{
+		{
+			name:     "no lists",
+			accepted: []string{"eth0", "wlan0", "wt0"},
+		},
+		{
+			name:      "blacklist only",
+			blackList: map[string]struct{}{"wt0": {}, "docker0": {}},
+			accepted:  []string{"eth0", "wlan0"},
+			rejected:  []string{"wt0", "docker0"},
+		},
+		{
+			name:      "allow list only",
+			allowList: map[string]struct{}{"eth0": {}},
+			accepted:  []string{"eth0"},
+			rejected:  []string{"wlan0", "wt0"},
+		},
+		{
+			name:      "allow list takes precedence over blacklist",
+			allowList: map[string]struct{}{"eth0": {}, "docker0": {}},
+			blackList: map[string]struct{}{"wt0": {}, "docker0": {}},
+			accepted:  []string{"eth0", "docker0"},
+			rejected:  []string{"wlan0", "wt0"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			filter := newInterfaceFilter(testCase.allowList, testCase.blackList)
+			for _, name := range testCase.accepted {
+				if !filter(name) {
+					t.Errorf("expecting interface %s to be accepted", name)
+				}
+			}
+			for _, name := range testCase.rejected {
+				if filter(name) {
+					t.Errorf("expecting interface %s to be rejected", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// connectQueue limits the number of connection attempts negotiated at the same time. Waiting attempts get a free slot
+// in the order of their priority (the highest first), attempts of the same priority in the order they have arrived
+type connectQueue struct {
+	mux sync.Mutex
+	// limit is the number of concurrent attempts, 0 means no limit
+	limit   int
+	active  int
+	waiting connectWaiters
+	// seq orders the waiting attempts of the same priority
+	seq uint64
+}
+
+// connectWaiter is an attempt waiting for a free slot, ready is closed once it gets one
+type connectWaiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+}
+
+// newConnectQueue creates a new connectQueue allowing limit concurrent attempts, 0 means no limit
+func newConnectQueue(limit int) *connectQueue {
+	return &connectQueue{limit: limit}
+}
+
+// acquire blocks until the attempt gets a slot and returns the function releasing it.
+// The release function can be called any number of times, the slot is released once
+func (q *connectQueue) acquire(priority int) func() {
+	q.mux.Lock()
+	if q.limit <= 0 || (q.active < q.limit && len(q.waiting) == 0) {
+		q.active++
+		q.mux.Unlock()
+		return q.releaseFunc()
+	}
+
+	waiter := &connectWaiter{priority: priority, seq: q.seq, ready: make(chan struct{})}
+	q.seq++
+	heap.Push(&q.waiting, waiter)
+	q.mux.Unlock()
+
+	<-waiter.ready
+	return q.releaseFunc()
+}
+
+func (q *connectQueue) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(q.release)
+	}
+}
+
+// release hands the slot over to the waiting attempt of the highest priority
+func (q *connectQueue) release() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if len(q.waiting) > 0 {
+		waiter := heap.Pop(&q.waiting).(*connectWaiter)
+		close(waiter.ready)
+		return
+	}
+	q.active--
+}
+
+// connectWaiters is a heap of the waiting attempts, the highest priority first
+type connectWaiters []*connectWaiter
+
+func (w connectWaiters) Len() int { return len(w) }
+
+func (w connectWaiters) Less(i, j int) bool {
+	if w[i].priority != w[j].priority {
+		return w[i].priority > w[j].priority
+	}
+	return w[i].seq < w[j].seq
+}
+
+func (w connectWaiters) Swap(i, j int) { w[i], w[j] = w[j], w[i] }
+
+func (w *connectWaiters) Push(x interface{}) {
+	*w = append(*w, x.(*connectWaiter))
+}
+
+func (w *connectWaiters) Pop() interface{} {
+	old := *w
+	n := len(old)
+	waiter := old[n-1]
+	old[n-1] = nil
+	*w = old[:n-1]
+	return waiter
+}
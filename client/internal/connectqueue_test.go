@@ -0,0 +1,93 @@
+package internal
+
+import (
+	mgmProto "github.com/wiretrustee/wiretrustee/management/proto"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestByPriority(t *testing.T) {
+	remotePeers := []*mgmProto.RemotePeerConfig{
+		{WgPubKey: "laptop"},
+		{WgPubKey: "dns", Priority: 10},
+		{WgPubKey: "phone"},
+		{WgPubKey: "exit", Priority: 5},
+		{WgPubKey: "printer", Priority: -1},
+		{WgPubKey: "backup-dns", Priority: 10},
+	}
+
+	var keys []string
+	for _, peer := range byPriority(remotePeers) {
+		keys = append(keys, peer.WgPubKey)
+	}
+
+	expected := []string{"dns", "backup-dns", "exit", "laptop", "phone", "printer"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expecting peers to be dispatched in order %v, got %v", expected, keys)
+	}
+}
+
+func TestConnectQueue_HigherPriorityFirst(t *testing.T) {
+	queue := newConnectQueue(1)
+
+	// occupy the only slot so that the following attempts wait
+	release := queue.acquire(0)
+
+	var mux sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i, priority := range []int{0, 5, 1, 5, 10} {
+		wg.Add(1)
+		go func(priority int) {
+			defer wg.Done()
+			release := queue.acquire(priority)
+			mux.Lock()
+			order = append(order, priority)
+			mux.Unlock()
+			release()
+		}(priority)
+		// wait for the attempt to be queued so that the arrival order is known
+		waitQueued(t, queue, i+1)
+	}
+
+	release()
+	wg.Wait()
+
+	expected := []int{10, 5, 5, 1, 0}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expecting attempts to get a slot in order %v, got %v", expected, order)
+	}
+}
+
+func TestConnectQueue_NoLimit(t *testing.T) {
+	queue := newConnectQueue(0)
+
+	// none of the attempts waits for a slot
+	for i := 0; i < 10; i++ {
+		queue.acquire(0)
+	}
+
+	release := queue.acquire(0)
+	release()
+	release()
+	if queue.active != 10 {
+		t.Errorf("expecting a slot to be released once, got %d active attempts", queue.active)
+	}
+}
+
+// waitQueued waits for the queue to have the given number of waiting attempts
+func waitQueued(t *testing.T, queue *connectQueue, waiting int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		queue.mux.Lock()
+		n := len(queue.waiting)
+		queue.mux.Unlock()
+		if n == waiting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d queued attempts", waiting)
+}
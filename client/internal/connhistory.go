@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// connHistorySize is the number of events kept in the history of a connection, older events are dropped
+const connHistorySize = 50
+
+// ConnEvent is a timestamped event of the connection to a remote peer (e.g. offer sent, connected)
+type ConnEvent struct {
+	Time  time.Time
+	Event string
+}
+
+// connHistory is a fixed size ring buffer of the latest connection events.
+// The history of a peer is carried over to the following connection attempts so that flapping shows up in one place
+type connHistory struct {
+	mux    sync.Mutex
+	events [connHistorySize]ConnEvent
+	// next is the position the next event is written to
+	next int
+	// count is the number of events in the buffer
+	count int
+}
+
+// add records a new event overwriting the oldest one when the buffer is full
+func (h *connHistory) add(format string, args ...interface{}) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.events[h.next] = ConnEvent{Time: time.Now(), Event: fmt.Sprintf(format, args...)}
+	h.next = (h.next + 1) % connHistorySize
+	if h.count < connHistorySize {
+		h.count++
+	}
+}
+
+// list returns a copy of the recorded events, the oldest first
+func (h *connHistory) list() []ConnEvent {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	events := make([]ConnEvent, 0, h.count)
+	start := (h.next - h.count + connHistorySize) % connHistorySize
+	for i := 0; i < h.count; i++ {
+		events = append(events, h.events[(start+i)%connHistorySize])
+	}
+	return events
+}
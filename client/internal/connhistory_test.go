@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestConnHistory_Wraparound(t *testing.T) {
+	history := &connHistory{}
+	if len(history.list()) != 0 {
+		t.Fatalf("expecting empty history")
+	}
+
+	total := connHistorySize + 7
+	for i := 0; i < total; i++ {
+		history.add("event %d", i)
+	}
+
+	events := history.list()
+	if len(events) != connHistorySize {
+		t.Fatalf("expecting %d events, got %d", connHistorySize, len(events))
+	}
+	// the oldest events have been dropped and the rest is ordered oldest first
+	for i, event := range events {
+		expected := fmt.Sprintf("event %d", total-connHistorySize+i)
+		if event.Event != expected {
+			t.Errorf("expecting event %d to be %q, got %q", i, expected, event.Event)
+		}
+		if i > 0 && event.Time.Before(events[i-1].Time) {
+			t.Errorf("expecting event %d not to be older than the previous one", i)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"fmt"
+	ice "github.com/pion/ice/v2"
+	"time"
+)
+
+// ConnectionMode defines how the Engine connects to remote peers
+type ConnectionMode string
+
+const (
+	// ConnectionModeAuto gathers all candidate types and lets ICE pick the best working pair (the default)
+	ConnectionModeAuto ConnectionMode = "auto"
+	// ConnectionModeDirectOnly never relays the traffic: only host and server reflexive candidates are gathered
+	// and TURN servers are not contacted
+	ConnectionModeDirectOnly ConnectionMode = "direct-only"
+	// ConnectionModeRelayOnly always relays the traffic through TURN, e.g. behind a symmetric NAT where direct connections never work.
+	// Only relay candidates are gathered, STUN servers are not contacted and the local interfaces are not scanned.
+	// Wireguard keepalive is lowered to RelayWgKeepAlive to keep the TURN allocation and permissions warm
+	ConnectionModeRelayOnly ConnectionMode = "relay-only"
+)
+
+// RelayWgKeepAlive is the Wireguard keep alive used in the ConnectionModeRelayOnly mode.
+// It has to stay below the TURN permission lifetime and the usual NAT UDP mapping timeouts
+const RelayWgKeepAlive = 10 * time.Second
+
+// ParseConnectionMode parses a connection mode name. An empty name is ConnectionModeAuto
+func ParseConnectionMode(mode string) (ConnectionMode, error) {
+	switch ConnectionMode(mode) {
+	case "", ConnectionModeAuto:
+		return ConnectionModeAuto, nil
+	case ConnectionModeDirectOnly, ConnectionModeRelayOnly:
+		return ConnectionMode(mode), nil
+	default:
+		return "", fmt.Errorf("invalid connection mode %s, supported modes [%s|%s|%s]", mode,
+			ConnectionModeAuto, ConnectionModeDirectOnly, ConnectionModeRelayOnly)
+	}
+}
+
+// candidateTypes returns the candidate types the ICE agent gathers in the mode, nil means the pion default (all types)
+func (m ConnectionMode) candidateTypes() []ice.CandidateType {
+	switch m {
+	case ConnectionModeDirectOnly:
+		return []ice.CandidateType{ice.CandidateTypeHost, ice.CandidateTypeServerReflexive}
+	case ConnectionModeRelayOnly:
+		return []ice.CandidateType{ice.CandidateTypeRelay}
+	default:
+		return nil
+	}
+}
+
+// filterURLs returns the STUN and TURN servers used in the mode keeping their order
+func (m ConnectionMode) filterURLs(urls []*ice.URL) []*ice.URL {
+	filtered := make([]*ice.URL, 0, len(urls))
+	for _, url := range urls {
+		isTurn := url.Scheme == ice.SchemeTypeTURN || url.Scheme == ice.SchemeTypeTURNS
+		if (m == ConnectionModeDirectOnly && isTurn) || (m == ConnectionModeRelayOnly && !isTurn) {
+			continue
+		}
+		filtered = append(filtered, url)
+	}
+	return filtered
+}
+
+// wgKeepAlive returns the Wireguard persistent keep alive used in the mode
+func (m ConnectionMode) wgKeepAlive() time.Duration {
+	if m == ConnectionModeRelayOnly {
+		return RelayWgKeepAlive
+	}
+	return DefaultWgKeepAlive
+}
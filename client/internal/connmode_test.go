@@ -0,0 +1,112 @@
+package internal
+
+import (
+	ice "github.com/pion/ice/v2"
+	"testing"
+	"time"
+)
+
+func TestConnectionMode_AgentConfig(t *testing.T) {
+	var urls []*ice.URL
+	for _, rawURL := range []string{
+		"stun:stun.wiretrustee.com:3468",
+		"turn:turn.wiretrustee.com:3478",
+		"turns:turn.wiretrustee.com:5349",
+	} {
+		url, err := ice.ParseURL(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, url)
+	}
+
+	type testCase struct {
+		name                   string
+		mode                   ConnectionMode
+		expectedURLs           []*ice.URL
+		expectedCandidateTypes []ice.CandidateType
+		expectedKeepAlive      time.Duration
+	}
+
+	testCases := []testCase{
+		{
+			name:                   "unset mode is auto",
+			mode:                   "",
+			expectedURLs:           urls,
+			expectedCandidateTypes: nil,
+			expectedKeepAlive:      DefaultWgKeepAlive,
+		},
+		{
+			name:                   "auto",
+			mode:                   ConnectionModeAuto,
+			expectedURLs:           urls,
+			expectedCandidateTypes: nil,
+			expectedKeepAlive:      DefaultWgKeepAlive,
+		},
+		{
+			name:                   "direct only",
+			mode:                   ConnectionModeDirectOnly,
+			expectedURLs:           urls[:1],
+			expectedCandidateTypes: []ice.CandidateType{ice.CandidateTypeHost, ice.CandidateTypeServerReflexive},
+			expectedKeepAlive:      DefaultWgKeepAlive,
+		},
+		{
+			name:                   "relay only",
+			mode:                   ConnectionModeRelayOnly,
+			expectedURLs:           urls[1:],
+			expectedCandidateTypes: []ice.CandidateType{ice.CandidateTypeRelay},
+			expectedKeepAlive:      RelayWgKeepAlive,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			conn := NewConnection(ConnConfig{StunTurnURLS: urls, connectionMode: testCase.mode}, nil, nil, nil)
+			agentConfig := conn.newAgentConfig()
+
+			if len(agentConfig.Urls) != len(testCase.expectedURLs) {
+				t.Fatalf("expecting agent config to have URLs %v, got %v", testCase.expectedURLs, agentConfig.Urls)
+			}
+			for i, url := range testCase.expectedURLs {
+				if agentConfig.Urls[i] != url {
+					t.Errorf("expecting URL %s at position %d, got %s", url, i, agentConfig.Urls[i])
+				}
+			}
+
+			if len(agentConfig.CandidateTypes) != len(testCase.expectedCandidateTypes) {
+				t.Fatalf("expecting agent config to have candidate types %v, got %v", testCase.expectedCandidateTypes, agentConfig.CandidateTypes)
+			}
+			for i, candidateType := range testCase.expectedCandidateTypes {
+				if agentConfig.CandidateTypes[i] != candidateType {
+					t.Errorf("expecting candidate type %s at position %d, got %s", candidateType, i, agentConfig.CandidateTypes[i])
+				}
+			}
+
+			if conn.wgProxy.keepAlive != testCase.expectedKeepAlive {
+				t.Errorf("expecting Wireguard keep alive %s, got %s", testCase.expectedKeepAlive, conn.wgProxy.keepAlive)
+			}
+		})
+	}
+}
+
+func TestParseConnectionMode(t *testing.T) {
+	for input, expected := range map[string]ConnectionMode{
+		"":            ConnectionModeAuto,
+		"auto":        ConnectionModeAuto,
+		"direct-only": ConnectionModeDirectOnly,
+		"relay-only":  ConnectionModeRelayOnly,
+	} {
+		mode, err := ParseConnectionMode(input)
+		if err != nil {
+			t.Errorf("expecting mode %q to be parsed, got error %v", input, err)
+		}
+		if mode != expected {
+			t.Errorf("expecting mode %q to be parsed as %s, got %s", input, expected, mode)
+		}
+	}
+
+	_, err := ParseConnectionMode("turn-only")
+	if err == nil {
+		t.Errorf("expecting invalid connection mode to fail")
+	}
+}
@@ -0,0 +1,79 @@
+package internal
+
+import "fmt"
+
+// ConnState is a stage of the Connection lifecycle:
+// New -> Gathering -> Connecting -> Connected, any stage can end up Failed and eventually Closed
+type ConnState int
+
+const (
+	// ConnStateNew the Connection has been created but not opened yet
+	ConnStateNew ConnState = iota
+	// ConnStateGathering the ICE agent gathers local candidates and the Connection waits for the remote peer credentials
+	ConnStateGathering
+	// ConnStateConnecting the remote peer credentials have arrived and the ICE connectivity checks are running
+	ConnStateConnecting
+	// ConnStateConnected the Wireguard traffic flows to the remote peer
+	ConnStateConnected
+	// ConnStateFailed the connection attempt has failed (e.g. timeout), the Connection can only be closed
+	ConnStateFailed
+	// ConnStateClosed the Connection has been closed, it can't be reused
+	ConnStateClosed
+)
+
+// connStateTransitions lists the states each state is allowed to move to
+var connStateTransitions = map[ConnState][]ConnState{
+	ConnStateNew:        {ConnStateGathering, ConnStateFailed, ConnStateClosed},
+	ConnStateGathering:  {ConnStateConnecting, ConnStateFailed, ConnStateClosed},
+	ConnStateConnecting: {ConnStateConnected, ConnStateFailed, ConnStateClosed},
+	ConnStateConnected:  {ConnStateFailed, ConnStateClosed},
+	ConnStateFailed:     {ConnStateClosed},
+	ConnStateClosed:     {},
+}
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnStateNew:
+		return "New"
+	case ConnStateGathering:
+		return "Gathering"
+	case ConnStateConnecting:
+		return "Connecting"
+	case ConnStateConnected:
+		return "Connected"
+	case ConnStateFailed:
+		return "Failed"
+	case ConnStateClosed:
+		return "Closed"
+	default:
+		return fmt.Sprintf("Unknown(%d)", int(s))
+	}
+}
+
+// Status returns the connection Status reported for the state
+func (s ConnState) Status() Status {
+	switch s {
+	case ConnStateGathering, ConnStateConnecting:
+		return StatusConnecting
+	case ConnStateConnected:
+		return StatusConnected
+	default:
+		return StatusDisconnected
+	}
+}
+
+// canTransitionTo checks whether moving from the state to the next one is allowed
+func (s ConnState) canTransitionTo(next ConnState) bool {
+	for _, allowed := range connStateTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsRemoteEvents checks whether signals of the remote peer (credentials, candidates) can be handled in the state.
+// Before Open the ICE agent doesn't exist yet and after a failure or Close it must not be touched anymore
+func (s ConnState) acceptsRemoteEvents() bool {
+	return s == ConnStateGathering || s == ConnStateConnecting || s == ConnStateConnected
+}
@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// controlRequestTimeout is how long the ControlClient waits for the agent to respond
+const controlRequestTimeout = 5 * time.Second
+
+// The methods of the control protocol
+const (
+	// ControlMethodStatus reports the Engine health and the state of every peer connection (see StatusReport)
+	ControlMethodStatus = "status"
+	// ControlMethodReconnect reconnects the peer given by ControlRequest.Peer (a key or a tunnel IP) or all peers without it
+	ControlMethodReconnect = "reconnect"
+	// ControlMethodReload reloads the config of the agent
+	ControlMethodReload = "reload"
+	// ControlMethodShutdown stops the agent, the response is sent before it stops
+	ControlMethodShutdown = "shutdown"
+)
+
+// ControlRequest is a request of the control protocol. Requests and responses are JSON objects, one per line,
+// a connection can send any number of requests each followed by its response
+type ControlRequest struct {
+	Method string
+	// Peer is the key or the tunnel IP of the peer to reconnect, all peers when empty
+	Peer string `json:",omitempty"`
+}
+
+// ControlResponse is the response to a ControlRequest
+type ControlResponse struct {
+	// Status is the result of ControlMethodStatus
+	Status *StatusReport `json:",omitempty"`
+	// Peers is the keys of the peers reconnected by ControlMethodReconnect
+	Peers []string `json:",omitempty"`
+	// Error is why the request has failed, empty on success
+	Error string `json:",omitempty"`
+}
+
+// ControlHooks are the actions of the control protocol carried out outside of the Engine by the running agent
+type ControlHooks struct {
+	// Shutdown stops the agent, ControlMethodShutdown is rejected when nil
+	Shutdown func()
+	// Reload reloads the config of the agent, ControlMethodReload is rejected when nil
+	Reload func() error
+}
+
+// ControlServer exposes the running agent to the local CLI commands over a Unix domain socket (a named pipe on Windows).
+// Access is restricted by the permissions of the socket: only the owner (root) on Unix, Administrators and SYSTEM on Windows
+type ControlServer struct {
+	path     string
+	engine   *Engine
+	hooks    ControlHooks
+	listener net.Listener
+	// conns are the open client connections closed on Stop
+	conns map[net.Conn]struct{}
+	// stopped rejects the connections accepted while stopping
+	stopped bool
+	mux     sync.Mutex
+	wg      sync.WaitGroup
+}
+
+// NewControlServer creates a new ControlServer listening on path (see DefaultControlPath)
+func NewControlServer(path string, engine *Engine, hooks ControlHooks) *ControlServer {
+	return &ControlServer{
+		path:   path,
+		engine: engine,
+		hooks:  hooks,
+		conns:  map[net.Conn]struct{}{},
+	}
+}
+
+// Start starts listening on the server path and serves requests in a separate goroutine
+func (s *ControlServer) Start() error {
+	listener, err := listenControl(s.path)
+	if err != nil {
+		return fmt.Errorf("failed listening on control socket %s: %v", s.path, err)
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.serve()
+
+	log.Infof("control server listening on %s", s.path)
+	return nil
+}
+
+// Stop stops accepting requests and closes the open connections
+func (s *ControlServer) Stop() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+
+	s.mux.Lock()
+	s.stopped = true
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mux.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *ControlServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Errorf("control server stopped accepting connections on %s: %v", s.path, err)
+			}
+			return
+		}
+
+		s.mux.Lock()
+		if s.stopped {
+			s.mux.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mux.Unlock()
+
+		s.wg.Add(1)
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn answers the requests of a connection until the client closes it
+func (s *ControlServer) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mux.Lock()
+		delete(s.conns, conn)
+		s.mux.Unlock()
+		_ = conn.Close()
+	}()
+
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	encoder := json.NewEncoder(conn)
+	for {
+		request := ControlRequest{}
+		err := decoder.Decode(&request)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Debugf("failed reading control request: %v", err)
+				_ = encoder.Encode(ControlResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+			}
+			return
+		}
+
+		response, after := s.handle(request)
+		err = encoder.Encode(response)
+		if err != nil {
+			log.Debugf("failed writing control response: %v", err)
+			return
+		}
+		if after != nil {
+			go after()
+		}
+	}
+}
+
+// handle carries out the request, the returned function (optional) runs once the response has been sent
+func (s *ControlServer) handle(request ControlRequest) (ControlResponse, func()) {
+	log.Debugf("received control request %s", request.Method)
+
+	switch request.Method {
+	case ControlMethodStatus:
+		report := newStatusReport(s.engine.Health(), s.engine.ListPeers())
+		return ControlResponse{Status: &report}, nil
+	case ControlMethodReconnect:
+		if request.Peer == "" {
+			return ControlResponse{Peers: s.engine.RestartPeers()}, nil
+		}
+		key, err := s.engine.RestartPeer(request.Peer)
+		if err != nil {
+			return ControlResponse{Error: err.Error()}, nil
+		}
+		return ControlResponse{Peers: []string{key}}, nil
+	case ControlMethodReload:
+		if s.hooks.Reload == nil {
+			return ControlResponse{Error: "reload is not supported by the agent"}, nil
+		}
+		err := s.hooks.Reload()
+		if err != nil {
+			return ControlResponse{Error: err.Error()}, nil
+		}
+		return ControlResponse{}, nil
+	case ControlMethodShutdown:
+		if s.hooks.Shutdown == nil {
+			return ControlResponse{Error: "shutdown is not supported by the agent"}, nil
+		}
+		log.Infof("received shutdown request on control socket %s", s.path)
+		return ControlResponse{}, s.hooks.Shutdown
+	default:
+		return ControlResponse{Error: fmt.Sprintf("unknown method %q", request.Method)}, nil
+	}
+}
+
+// ControlClient sends requests to the ControlServer of the running agent
+type ControlClient struct {
+	path string
+}
+
+// NewControlClient creates a new ControlClient of the agent listening on path
+func NewControlClient(path string) *ControlClient {
+	return &ControlClient{path: path}
+}
+
+// Status returns the Engine health and the state of every peer connection of the agent
+func (c *ControlClient) Status() (*StatusReport, error) {
+	response, err := c.call(ControlRequest{Method: ControlMethodStatus})
+	if err != nil {
+		return nil, err
+	}
+	if response.Status == nil {
+		return nil, fmt.Errorf("agent on %s responded without status", c.path)
+	}
+	return response.Status, nil
+}
+
+// Reconnect reconnects the peer (a key or a tunnel IP) or all peers when empty and returns the keys of the reconnected peers
+func (c *ControlClient) Reconnect(peer string) ([]string, error) {
+	response, err := c.call(ControlRequest{Method: ControlMethodReconnect, Peer: peer})
+	if err != nil {
+		return nil, err
+	}
+	return response.Peers, nil
+}
+
+// Reload makes the agent reload its config
+func (c *ControlClient) Reload() error {
+	_, err := c.call(ControlRequest{Method: ControlMethodReload})
+	return err
+}
+
+// Shutdown stops the agent
+func (c *ControlClient) Shutdown() error {
+	_, err := c.call(ControlRequest{Method: ControlMethodShutdown})
+	return err
+}
+
+// call sends the request over a new connection and waits for the response up to controlRequestTimeout
+func (c *ControlClient) call(request ControlRequest) (*ControlResponse, error) {
+	conn, err := dialControl(c.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed connecting to the agent on %s, is it running? %v", c.path, err)
+	}
+	defer conn.Close()
+
+	// named pipes opened as files don't support deadlines, closing the connection unblocks the pending read
+	timer := time.AfterFunc(controlRequestTimeout, func() {
+		_ = conn.Close()
+	})
+	defer timer.Stop()
+
+	err = json.NewEncoder(conn).Encode(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed sending %s request to the agent on %s: %v", request.Method, c.path, err)
+	}
+
+	response := &ControlResponse{}
+	err = json.NewDecoder(conn).Decode(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s response of the agent on %s: %v", request.Method, c.path, err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("%s request failed: %s", request.Method, response.Error)
+	}
+	return response, nil
+}
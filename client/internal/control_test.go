@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testControlPath returns a control socket path (a named pipe on Windows) unique to the test
+func testControlPath(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		return fmt.Sprintf(`\\.\pipe\wiretrustee-test-%d`, time.Now().UnixNano())
+	}
+	return filepath.Join(t.TempDir(), "control.sock")
+}
+
+func TestControlServer(t *testing.T) {
+	engine := newTestEngine()
+	engine.running = true
+	engine.peers["peerA"] = Peer{WgPubKey: "peerA"}
+	engine.conns["peerA"] = NewConnection(ConnConfig{}, nil, nil, nil)
+
+	shutdown := make(chan struct{}, 1)
+	reloads := 0
+	path := testControlPath(t)
+	server := NewControlServer(path, engine, ControlHooks{
+		Shutdown: func() { shutdown <- struct{}{} },
+		Reload: func() error {
+			reloads++
+			if reloads > 1 {
+				return errors.New("invalid config")
+			}
+			return nil
+		},
+	})
+	err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop() //nolint
+
+	client := NewControlClient(path)
+
+	report, err := client.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Health.Running || len(report.Peers) != 1 || report.Peers[0].WgPubKey != "peerA" {
+		t.Errorf("unexpected status %+v", report)
+	}
+
+	_, err = client.Reconnect("unknown")
+	if err == nil || !strings.Contains(err.Error(), ErrPeerNotFound.Error()) {
+		t.Errorf("expecting reconnect of an unknown peer to fail with %v, got %v", ErrPeerNotFound, err)
+	}
+
+	err = client.Reload()
+	if err != nil {
+		t.Errorf("expecting reload to succeed, got %v", err)
+	}
+	err = client.Reload()
+	if err == nil || !strings.Contains(err.Error(), "invalid config") {
+		t.Errorf("expecting failed reload to be reported, got %v", err)
+	}
+
+	err = client.Shutdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-shutdown:
+	case <-time.After(time.Second):
+		t.Errorf("expecting shutdown hook to be called")
+	}
+
+	err = server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Status()
+	if err == nil {
+		t.Errorf("expecting requests to fail once the server has been stopped")
+	}
+}
+
+func TestControlServer_WithoutHooks(t *testing.T) {
+	path := testControlPath(t)
+	server := NewControlServer(path, newTestEngine(), ControlHooks{})
+	err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop() //nolint
+
+	client := NewControlClient(path)
+	if err := client.Shutdown(); err == nil {
+		t.Errorf("expecting shutdown to be rejected without a hook")
+	}
+	if err := client.Reload(); err == nil {
+		t.Errorf("expecting reload to be rejected without a hook")
+	}
+	if _, err := client.call(ControlRequest{Method: "unknown"}); err == nil {
+		t.Errorf("expecting unknown method to be rejected")
+	}
+}
+
+func TestControlServer_SocketInUse(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("named pipes are not files left behind")
+	}
+
+	path := testControlPath(t)
+	server := NewControlServer(path, newTestEngine(), ControlHooks{})
+	err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expecting socket to be accessible by the owner only, got %v", info.Mode().Perm())
+	}
+
+	other := NewControlServer(path, newTestEngine(), ControlHooks{})
+	err = other.Start()
+	if err == nil {
+		_ = other.Stop()
+		t.Fatalf("expecting a socket of a running agent not to be replaced")
+	}
+
+	err = server.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Start()
+	if err != nil {
+		t.Fatalf("expecting the socket to be reusable once the agent has stopped, got %v", err)
+	}
+	_ = other.Stop()
+}
@@ -0,0 +1,51 @@
+// +build !windows
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// DefaultControlPath is the Unix domain socket the ControlServer of the agent listens on by default
+const DefaultControlPath = "/var/run/wiretrustee.sock"
+
+// controlSocketMode allows only the owner of the agent process (usually root) to talk to the agent
+const controlSocketMode = 0600
+
+// listenControl listens on the Unix domain socket at path. A socket left behind by an agent that hasn't stopped cleanly
+// is replaced, a socket of a running agent isn't
+func listenControl(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("another agent is listening on %s", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed removing stale socket %s: %v", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// restricted before the listener is handed over and anything is served on it
+	err = os.Chmod(path, controlSocketMode)
+	if err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed restricting permissions of %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// dialControl connects to the Unix domain socket at path
+func dialControl(path string) (io.ReadWriteCloser, error) {
+	return net.DialTimeout("unix", path, controlRequestTimeout)
+}
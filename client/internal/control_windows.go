@@ -0,0 +1,23 @@
+package internal
+
+import (
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/ipc/winpipe"
+	"io"
+	"net"
+	"os"
+)
+
+// DefaultControlPath is the named pipe the ControlServer of the agent listens on by default
+const DefaultControlPath = `\\.\pipe\wiretrustee`
+
+// listenControl listens on the named pipe at path. The pipe is restricted to Administrators and SYSTEM the same way
+// the Wireguard UAPI pipe is
+func listenControl(path string) (net.Listener, error) {
+	return winpipe.Listen(path, &winpipe.ListenConfig{SecurityDescriptor: ipc.UAPISecurityDescriptor})
+}
+
+// dialControl opens the named pipe at path
+func dialControl(path string) (io.ReadWriteCloser, error) {
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"github.com/cenkalti/backoff/v4"
 	ice "github.com/pion/ice/v2"
@@ -11,6 +12,8 @@ import (
 	signal "github.com/wiretrustee/wiretrustee/signal/client"
 	sProto "github.com/wiretrustee/wiretrustee/signal/proto"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -20,17 +23,92 @@ import (
 // E.g. this peer will wait PeerConnectionTimeout for the remote peer to respond, if not successful then it will retry the connection attempt.
 const PeerConnectionTimeout = 60 * time.Second
 
+// MaxPeerDrainTimeout caps EngineConfig.PeerDrainTimeout
+const MaxPeerDrainTimeout = 30 * time.Second
+
+// ErrPeerNotFound is returned for a remote peer the Engine doesn't manage a connection to
+var ErrPeerNotFound = errors.New("peer not found")
+
+// SignalSendAttempts is the number of times a message is sent through the Signal Exchange until it is acknowledged
+const SignalSendAttempts = 3
+
+// SignalSendRetryInterval is the time to wait before resending a message that hasn't been acknowledged
+const SignalSendRetryInterval = 500 * time.Millisecond
+
 // EngineConfig is a config for the Engine
 type EngineConfig struct {
-	// StunsTurns is a list of STUN and TURN servers used by ICE
+	// StunsTurns is a list of STUN and TURN servers used by ICE ordered by preference, e.g. a local TURN server
+	// before a public fallback. The order is kept as is all the way to the pion ICE agent (ice.AgentConfig.Urls)
 	StunsTurns []*ice.URL
-	WgIface    string
+	// StunTurnRegions tags the StunsTurns with the region of the server (e.g. eu-central), untagged servers aren't regional
+	StunTurnRegions map[*ice.URL]string
+	// Region is where the peer is located. TURN servers of its region (or of the remote peer's region) are preferred
+	Region  string
+	WgIface string
+	// WgPort is the listen port of the Wireguard interface, 0 means iface.WgPort
+	WgPort int
 	// WgAddr is a Wireguard local address (Wiretrustee Network IP)
 	WgAddr string
 	// WgPrivateKey is a Wireguard private key of our peer (it MUST never leave the machine)
 	WgPrivateKey wgtypes.Key
 	// IFaceBlackList is a list of network interfaces to ignore when discovering connection candidates (ICE related)
 	IFaceBlackList map[string]struct{}
+	// IFaceAllowList is a list of the only network interfaces used to discover connection candidates (ICE related).
+	// It takes precedence over IFaceBlackList: when non-empty the blacklist is ignored. Empty means all interfaces not blacklisted
+	IFaceAllowList map[string]struct{}
+	// CandidateFilter is an optional function excluding local connection candidates (ICE related). It is asked about the
+	// host candidate of each address of the network interfaces before gathering, no candidates are gathered on an
+	// interface none of whose addresses it accepts. Every gathered candidate it returns false for is dropped, it won't be
+	// signaled to the remote peer. When nil all candidates are kept.
+	CandidateFilter func(candidate ice.Candidate) bool
+	// OnPeerEndpointChange is an optional function called every time the Engine configures the Wireguard endpoint of a remote peer.
+	// relayed tells whether the traffic goes through a TURN relay, e.g. to confirm that a relayed connection got upgraded to a direct one.
+	// The endpoint is a local proxy address when the traffic is proxied over the ICE connection.
+	// It is called outside of the Engine locks from the connection goroutine, so it should return quickly
+	OnPeerEndpointChange func(peerKey string, endpoint string, relayed bool)
+	// ConnectionMode limits how the remote peers are connected (directly, through a relay or both). Empty means ConnectionModeAuto
+	ConnectionMode ConnectionMode
+	// IPFamilyPreference defines the IP families the remote peers are connected over (IPv4 only or IPv6 enabled too).
+	// Empty means IPFamilyAuto
+	IPFamilyPreference IPFamilyPreference
+	// HTTPAddress is an address of the optional HTTP server exposing health and metrics endpoints, e.g. 127.0.0.1:9090.
+	// The server is not started when empty
+	HTTPAddress string
+	// PeerDrainTimeout is a grace period given to the connection of a peer removed by the Management Service
+	// to drain before it gets closed (see Connection.CloseGracefully), capped by MaxPeerDrainTimeout.
+	// 0 closes the connection right away. Stopping the Engine always closes connections right away
+	PeerDrainTimeout time.Duration
+	// MTUDiscovery defines whether the path MTU to the remote peers is probed once connected and what happens
+	// when it is below the interface MTU. Empty means MTUDiscoveryOff
+	MTUDiscovery MTUDiscovery
+	// LazyConnections opens the connection to a peer only on the first outbound traffic to it (or an offer of the
+	// remote peer) instead of right away. Until then the peer is idle: Wireguard knows its allowed IPs but no ICE
+	// connection is negotiated. Connections without traffic for LazyIdleTimeout are closed and the peer becomes idle again
+	LazyConnections bool
+	// LazyIdleTimeout is how long a connection opened in lazy mode is kept without traffic. 0 means DefaultLazyIdleTimeout
+	LazyIdleTimeout time.Duration
+	// StateFile is a path of the file the direct endpoints of the connected peers are saved to on Stop and loaded from
+	// on Start to reconnect the peers right away while the connections are negotiated. Disabled when empty
+	StateFile string
+	// ProxyBuffers sizes the buffers of the proxies relaying Wireguard traffic over the peer connections.
+	// The defaults suit most links, see ProxyBufferConfig for tuning fast links
+	ProxyBuffers ProxyBufferConfig
+	// Heartbeat defines the heartbeat over the ICE connections detecting stale connections, see HeartbeatConfig.
+	// The zero value uses the defaults
+	Heartbeat HeartbeatConfig
+	// MaxConcurrentConnects limits the number of connections negotiated at the same time, the waiting peers get
+	// connected in the order of their priority (see Peer.Priority). 0 means no limit
+	MaxConcurrentConnects int
+	// CandidatesChecksTimeout is how long the connectivity checks with a peer may run once both peers have gathered all
+	// of their candidates before the connection attempt is given up, within PeerConnectionTimeout.
+	// 0 means DefaultCandidatesChecksTimeout
+	CandidatesChecksTimeout time.Duration
+	// LogSuppressWindow is how long the repeated failures of the connection attempts to a peer are suppressed in the
+	// log after the first one, a summary is logged once it is over. 0 means DefaultLogSuppressWindow
+	LogSuppressWindow time.Duration
+	// Observer runs the Engine read-only, e.g. for monitoring: no Wireguard interface is created and no connections are
+	// opened, the Management syncs only maintain the view of the peers and their config exposed via ListPeers
+	Observer bool
 }
 
 // Engine is a mechanism responsible for reacting on Signal and Management stream events and managing connections to the remote peers.
@@ -41,6 +119,26 @@ type Engine struct {
 	mgmClient *mgm.Client
 	// conns is a collection of remote peer connections indexed by local public key of the remote peers
 	conns map[string]*Connection
+	// draining is a collection of connections of removed peers being drained before closing (guarded by peerMux)
+	draining map[string]*Connection
+	// peerMTUs is the path MTU discovered to the remote peers (guarded by peerMux)
+	peerMTUs map[string]int
+	// peers is the latest config of the remote peers received from the Management Service (guarded by peerMux)
+	peers map[string]Peer
+	// retrying is the set of peers with a running connection retry loop, see initializePeer (guarded by peerMux)
+	retrying map[string]struct{}
+	// endpoints is the direct Wireguard endpoints of the connected peers persisted on Stop (guarded by peerMux)
+	endpoints map[string]savedEndpoint
+	// savedEndpoints is the endpoints persisted by the previous run loaded on Start, used once (guarded by peerMux)
+	savedEndpoints map[string]savedEndpoint
+	// idle is the peers waiting for traffic in lazy mode, see EngineConfig.LazyConnections (guarded by peerMux)
+	idle map[string]*activityListener
+	// connects limits the connection attempts negotiated at the same time, see EngineConfig.MaxConcurrentConnects
+	connects *connectQueue
+	// pendingOffers is the offers of remote peers not known yet, waiting for a sync to authorize the peers (guarded by peerMux)
+	pendingOffers map[string]pendingOffer
+	// retryLog suppresses the repeated failures of the connection attempts to a peer, see EngineConfig.LogSuppressWindow
+	retryLog *logLimiter
 
 	// peerMux is used to sync peer operations (e.g. open connection, peer removal)
 	peerMux *sync.Mutex
@@ -51,42 +149,202 @@ type Engine struct {
 
 	// wgPort is a Wireguard local listen port
 	wgPort int
+
+	// running indicates whether the Engine has been started and not stopped yet (guarded by syncMsgMux)
+	running bool
+	// mgmConnected indicates whether an update has been received from the Management Service since the stream has been
+	// (re)connected (guarded by syncMsgMux)
+	mgmConnected bool
+
+	// httpServer is an optional server exposing health and metrics endpoints
+	httpServer *HTTPServer
 }
 
 // Peer is an instance of the Connection Peer
 type Peer struct {
 	WgPubKey     string
 	WgAllowedIps string
+	// ConnectionTimeout is a timeout of a connection attempt to the peer suggested by the Management Service.
+	// 0 means PeerConnectionTimeout
+	ConnectionTimeout time.Duration
+	// PreSharedKey is the Wireguard preshared key (base64) the Management Service assigned to the pair of peers, empty when none
+	PreSharedKey string
+	// Region is where the remote peer is located (e.g. eu-central), empty when unknown
+	Region string
+	// Priority orders the connection attempts, peers of a higher priority are connected first. 0 is the default
+	Priority int
+}
+
+// connectionTimeout returns the timeout of a connection attempt to the peer falling back to PeerConnectionTimeout
+func (p Peer) connectionTimeout() time.Duration {
+	if p.ConnectionTimeout > 0 {
+		return p.ConnectionTimeout
+	}
+	return PeerConnectionTimeout
+}
+
+// preSharedKey parses the preshared key of the peer, nil when the peer has none
+func (p Peer) preSharedKey() *wgtypes.Key {
+	if p.PreSharedKey == "" {
+		return nil
+	}
+	key, err := wgtypes.ParseKey(p.PreSharedKey)
+	if err != nil {
+		log.Warnf("ignoring invalid preshared key of peer %s: %v", p.WgPubKey, err)
+		return nil
+	}
+	return &key
+}
+
+// toPeer converts a remote peer config received from the Management Service to a Peer
+func toPeer(remotePeer *mgmProto.RemotePeerConfig) Peer {
+	return Peer{
+		WgPubKey:          remotePeer.GetWgPubKey(),
+		WgAllowedIps:      strings.Join(remotePeer.GetAllowedIps(), ","),
+		ConnectionTimeout: time.Duration(remotePeer.GetConnectionTimeout()) * time.Second,
+		PreSharedKey:      remotePeer.GetPresharedKey(),
+		Region:            remotePeer.GetRegion(),
+		Priority:          int(remotePeer.GetPriority()),
+	}
+}
+
+// Health is a snapshot of the Engine state
+type Health struct {
+	// Running indicates whether the Engine has been started and not stopped yet
+	Running bool
+	// ManagementConnected indicates whether the Engine has received an update from the Management Service
+	ManagementConnected bool
+	// Peers is the number of remote peers the Engine manages connections to
+	Peers int
+	// ConnectedPeers is the number of remote peers with an open connection
+	ConnectedPeers int
+}
+
+// PeerState is a snapshot of a remote peer connection
+type PeerState struct {
+	WgPubKey string
+	Status   Status
+	// State is the stage of the connection lifecycle the Status is derived from
+	State ConnState
+	// Stats is the traffic relayed through the connection proxy
+	Stats ProxyStats
+	// Quality is the latest quality score of the connection, a zero Score unless connected
+	Quality QualityScore
+	// Failure is why the connection attempt has failed (e.g. wrapping ErrNoAnswer), nil unless the attempt has ended
+	Failure error
+	// History is the latest events of the connections to the peer, the oldest first
+	History []ConnEvent
+	// Idle is true for a peer waiting for traffic in lazy mode, it has no connection
+	Idle bool
+	// Config is the latest config of the peer received from the Management Service
+	Config Peer
 }
 
 // NewEngine creates a new Connection Engine
 func NewEngine(signalClient *signal.Client, mgmClient *mgm.Client, config *EngineConfig) *Engine {
 	return &Engine{
-		signal:     signalClient,
-		mgmClient:  mgmClient,
-		conns:      map[string]*Connection{},
-		peerMux:    &sync.Mutex{},
-		syncMsgMux: &sync.Mutex{},
-		config:     config,
+		signal:         signalClient,
+		mgmClient:      mgmClient,
+		conns:          map[string]*Connection{},
+		draining:       map[string]*Connection{},
+		peerMTUs:       map[string]int{},
+		peers:          map[string]Peer{},
+		retrying:       map[string]struct{}{},
+		endpoints:      map[string]savedEndpoint{},
+		savedEndpoints: map[string]savedEndpoint{},
+		idle:           map[string]*activityListener{},
+		connects:       newConnectQueue(config.MaxConcurrentConnects),
+		pendingOffers:  map[string]pendingOffer{},
+		retryLog:       newLogLimiter(config.LogSuppressWindow),
+		peerMux:        &sync.Mutex{},
+		syncMsgMux:     &sync.Mutex{},
+		config:         config,
 	}
 }
 
 // Start creates a new Wireguard tunnel interface and listens to events from Signal and Management services
 // Connections to remote peers are not established here.
-// However, they will be established once an event with a list of peers to connect to will be received from Management Service
+// However, they will be established once an event with a list of peers to connect to will be received from Management Service.
+// In the Observer mode no interface is created
 func (e *Engine) Start() error {
 
+	if e.config.Observer {
+		log.Infof("starting in observer mode, no Wireguard interface is created and no connections are opened")
+	} else {
+		err := e.startInterface()
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.config.HTTPAddress != "" {
+		e.httpServer = NewHTTPServer(e.config.HTTPAddress, e)
+		err := e.httpServer.Start()
+		if err != nil {
+			log.Errorf("failed starting HTTP server on %s: [%s]", e.config.HTTPAddress, err.Error())
+			return err
+		}
+	}
+
+	e.syncMsgMux.Lock()
+	e.running = true
+	e.syncMsgMux.Unlock()
+
+	e.receiveSignalEvents()
+	e.receiveManagementEvents()
+
+	return nil
+}
+
+// startInterface creates and configures the Wireguard interface and loads the endpoints saved by the previous run
+func (e *Engine) startInterface() error {
 	wgIface := e.config.WgIface
 	wgAddr := e.config.WgAddr
 	myPrivateKey := e.config.WgPrivateKey
 
-	err := iface.Create(wgIface, wgAddr)
+	err := iface.ValidateName(wgIface)
+	if err != nil {
+		log.Errorf("invalid interface name %s: [%s]", wgIface, err.Error())
+		return err
+	}
+
+	_, err = ParseConnectionMode(string(e.config.ConnectionMode))
+	if err != nil {
+		log.Errorf("invalid connection mode: [%s]", err.Error())
+		return err
+	}
+
+	_, err = ParseIPFamilyPreference(string(e.config.IPFamilyPreference))
+	if err != nil {
+		log.Errorf("invalid IP family preference: [%s]", err.Error())
+		return err
+	}
+
+	err = e.config.Heartbeat.validate()
+	if err != nil {
+		log.Errorf("invalid heartbeat config: [%s]", err.Error())
+		return err
+	}
+
+	if e.config.MaxConcurrentConnects < 0 {
+		err = fmt.Errorf("invalid max concurrent connects %d, must not be negative", e.config.MaxConcurrentConnects)
+		log.Errorf("invalid max concurrent connects: [%s]", err.Error())
+		return err
+	}
+
+	if e.config.LogSuppressWindow < 0 {
+		err = fmt.Errorf("invalid log suppress window %v, must not be negative", e.config.LogSuppressWindow)
+		log.Errorf("invalid log suppress window: [%s]", err.Error())
+		return err
+	}
+
+	err = iface.Create(wgIface, wgAddr)
 	if err != nil {
 		log.Errorf("failed creating interface %s: [%s]", wgIface, err.Error())
 		return err
 	}
 
-	err = iface.Configure(wgIface, myPrivateKey.String())
+	err = iface.Configure(wgIface, myPrivateKey.String(), e.config.WgPort)
 	if err != nil {
 		log.Errorf("failed configuring Wireguard interface [%s]: %s", wgIface, err.Error())
 		return err
@@ -99,14 +357,109 @@ func (e *Engine) Start() error {
 	}
 	e.wgPort = *port
 
-	e.receiveSignalEvents()
-	e.receiveManagementEvents()
+	e.loadSavedEndpoints()
 
 	return nil
 }
 
-// initializePeer peer agent attempt to open connection
+// Stop closes all the remote peer connections and shuts down the HTTP server if it has been started.
+// Signal and Management clients and the Wireguard interface are left to the caller
+func (e *Engine) Stop() error {
+	// the HTTP server is stopped before taking syncMsgMux, its in-flight requests need it to report the Engine Health
+	var httpErr error
+	if e.httpServer != nil {
+		httpErr = e.httpServer.Stop()
+		if httpErr != nil {
+			log.Errorf("failed stopping HTTP server: %v", httpErr)
+		}
+		e.httpServer = nil
+	}
+
+	e.syncMsgMux.Lock()
+	defer e.syncMsgMux.Unlock()
+
+	e.running = false
+
+	if !e.config.Observer {
+		e.saveEndpoints()
+	}
+
+	e.peerMux.Lock()
+	peers := make([]string, 0, len(e.conns)+len(e.idle))
+	for key := range e.conns {
+		peers = append(peers, key)
+	}
+	for key := range e.idle {
+		peers = append(peers, key)
+	}
+	// the drain of removed peers doesn't delay the shutdown
+	for key, conn := range e.draining {
+		delete(e.draining, key)
+		closeErr := conn.Close()
+		if closeErr != nil {
+			log.Warnf("failed closing draining connection to peer %s: %v", key, closeErr)
+		}
+	}
+	e.peerMux.Unlock()
+
+	err := e.removePeerConnections(peers)
+	if err == nil {
+		err = httpErr
+	}
+
+	return err
+}
+
+// Health returns a snapshot of the Engine state
+func (e *Engine) Health() Health {
+	e.syncMsgMux.Lock()
+	health := Health{
+		Running:             e.running,
+		ManagementConnected: e.mgmConnected,
+	}
+	e.syncMsgMux.Unlock()
+
+	for _, peer := range e.ListPeers() {
+		health.Peers++
+		if peer.Status == StatusConnected || peer.Status == StatusDegraded {
+			health.ConnectedPeers++
+		}
+	}
+
+	return health
+}
+
+// initializePeer peer agent attempt to open connection.
+// It retries until the connection is open or the peer has been removed, only one retry loop runs per peer.
+// Only the peers of the current sync (e.peers) are connected, a peer removed before the loop has started is skipped
 func (e *Engine) initializePeer(peer Peer) {
+	e.peerMux.Lock()
+	latest, known := e.peers[peer.WgPubKey]
+	if !known {
+		e.peerMux.Unlock()
+		log.Debugf("peer %s has been removed before connecting, not connecting", peer.WgPubKey)
+		return
+	}
+	peer = latest
+	if _, ok := e.retrying[peer.WgPubKey]; ok {
+		e.peerMux.Unlock()
+		return
+	}
+	e.retrying[peer.WgPubKey] = struct{}{}
+	saved, ok := e.savedEndpoints[peer.WgPubKey]
+	delete(e.savedEndpoints, peer.WgPubKey)
+	if _, exists := e.conns[peer.WgPubKey]; !exists {
+		// the remote peer has sent an offer before the sync authorizing it, its connection holds the offer
+		if _, pending := e.pendingOffers[peer.WgPubKey]; pending {
+			e.newPeerConnection(e.wgPort, e.config.WgPrivateKey, peer)
+		}
+	}
+	e.peerMux.Unlock()
+
+	if ok {
+		go e.seedSavedEndpoint(peer, saved)
+	}
+
 	var backOff = &backoff.ExponentialBackOff{
 		InitialInterval:     backoff.DefaultInitialInterval,
 		RandomizationFactor: backoff.DefaultRandomizationFactor,
@@ -117,19 +470,50 @@ func (e *Engine) initializePeer(peer Peer) {
 		Clock:               backoff.SystemClock,
 	}
 	operation := func() error {
-		_, err := e.openPeerConnection(e.wgPort, e.config.WgPrivateKey, peer)
+		// the config of the peer may have changed since the last attempt (e.g. a rotated preshared key)
+		e.peerMux.Lock()
+		if latest, ok := e.peers[peer.WgPubKey]; ok {
+			peer = latest
+		}
+		e.peerMux.Unlock()
+
+		release := e.connects.acquire(peer.Priority)
+		defer release()
+
+		// the peer may have been removed while waiting for its turn
+		e.peerMux.Lock()
+		_, ok := e.peers[peer.WgPubKey]
+		if !ok {
+			delete(e.retrying, peer.WgPubKey)
+			e.peerMux.Unlock()
+			e.retryLog.forget(peer.WgPubKey)
+			log.Infof("peer %s has been removed while waiting to connect, not retrying", peer.WgPubKey)
+			return nil
+		}
+		e.peerMux.Unlock()
+
+		conn, err := e.openPeerConnection(e.wgPort, e.config.WgPrivateKey, peer, release)
 		e.peerMux.Lock()
 		defer e.peerMux.Unlock()
 		if _, ok := e.conns[peer.WgPubKey]; !ok {
+			e.retryLog.forget(peer.WgPubKey)
 			log.Infof("removing connection attempt with Peer: %v, not retrying", peer.WgPubKey)
+			delete(e.retrying, peer.WgPubKey)
 			return nil
 		}
 
 		if err != nil {
-			log.Warnln(err)
-			log.Warnln("retrying connection because of error: ", err.Error())
+			e.logConnectionFailure(peer.WgPubKey, err)
 			return err
 		}
+		// restarted by RestartPeer after it has been opened
+		if conn.State() != ConnStateConnected {
+			log.Infof("connection to peer %s has been restarted, reconnecting", peer.WgPubKey)
+			return fmt.Errorf("connection to peer %s has been restarted", peer.WgPubKey)
+		}
+		// the failures suppressed before the connection has been opened are summarized
+		e.retryLog.forget(peer.WgPubKey)
+		delete(e.retrying, peer.WgPubKey)
 		return nil
 	}
 
@@ -140,20 +524,104 @@ func (e *Engine) initializePeer(peer Peer) {
 	}
 }
 
+// logConnectionFailure logs the cause of a failed connection attempt to the peer before it is retried.
+// Repeated failures of the same kind of the peer are suppressed for EngineConfig.LogSuppressWindow, e.g. of a peer that
+// stays offline, a failure of another kind (e.g. the peer came online but can't be reached) is logged right away
+func (e *Engine) logConnectionFailure(peerKey string, err error) {
+	switch {
+	case errors.Is(err, signal.ErrPeerOffline):
+		e.retryLog.logf(log.InfoLevel, peerKey, "offline", "peer %s is offline, retrying: %v", peerKey, err)
+	case errors.Is(err, ErrNoAnswer):
+		e.retryLog.logf(log.WarnLevel, peerKey, "no-answer", "peer %s didn't answer, it is probably offline, retrying: %v", peerKey, err)
+	case errors.Is(err, ErrGatherTimeout):
+		e.retryLog.logf(log.WarnLevel, peerKey, "gather-timeout", "no local candidates gathered for peer %s, check the STUN and TURN servers, retrying: %v", peerKey, err)
+	case errors.Is(err, ErrConnectivityTimeout):
+		e.retryLog.logf(log.WarnLevel, peerKey, "connectivity-timeout", "connectivity checks with peer %s failed, the peers can't reach each other directly or via TURN, retrying: %v", peerKey, err)
+	default:
+		e.retryLog.logf(log.WarnLevel, peerKey, "other", "retrying connection to peer %s because of error: %v", peerKey, err)
+	}
+}
+
+// removePeerConnections closes existing connections of the given peers and removes them.
+// A failure to remove one peer doesn't stop the removal of the rest: all peers are attempted and
+// the failures are reported together in a single error.
 func (e *Engine) removePeerConnections(peers []string) error {
 	e.peerMux.Lock()
 	defer e.peerMux.Unlock()
+
+	var failed []string
 	for _, peer := range peers {
 		err := e.removePeerConnection(peer)
 		if err != nil {
-			return err
+			log.Warnf("failed removing connection to peer %s: %v", peer, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", peer, err))
 		}
 	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed removing %d of %d peer connections [%s]", len(failed), len(peers), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// drainPeerConnections removes the connections of the given peers and closes them gracefully in the background
+// giving them EngineConfig.PeerDrainTimeout to drain. Without a drain timeout the connections are closed right away
+// the same way removePeerConnections does
+func (e *Engine) drainPeerConnections(peers []string) error {
+	grace := e.config.PeerDrainTimeout
+	if grace > MaxPeerDrainTimeout {
+		grace = MaxPeerDrainTimeout
+	}
+	if grace <= 0 {
+		return e.removePeerConnections(peers)
+	}
+
+	e.peerMux.Lock()
+	defer e.peerMux.Unlock()
+
+	for _, peer := range peers {
+		conn, exists := e.conns[peer]
+		delete(e.conns, peer)
+		delete(e.peerMTUs, peer)
+		delete(e.peers, peer)
+		delete(e.pendingOffers, peer)
+		delete(e.endpoints, peer)
+		err := e.unwatchPeer(peer)
+		if err != nil {
+			log.Warnf("failed removing idle peer %s: %v", peer, err)
+		}
+		if !exists || conn == nil {
+			continue
+		}
+
+		e.draining[peer] = conn
+		go func(peer string, conn *Connection) {
+			err := conn.CloseGracefully(grace)
+			if err != nil {
+				log.Warnf("failed closing drained connection to peer %s: %v", peer, err)
+			}
+
+			e.peerMux.Lock()
+			defer e.peerMux.Unlock()
+			if e.draining[peer] == conn {
+				delete(e.draining, peer)
+			}
+		}(peer, conn)
+	}
+
 	return nil
 }
 
 // removePeerConnection closes existing peer connection and removes peer
 func (e *Engine) removePeerConnection(peerKey string) error {
+	delete(e.peerMTUs, peerKey)
+	delete(e.peers, peerKey)
+	delete(e.pendingOffers, peerKey)
+	delete(e.endpoints, peerKey)
+	err := e.unwatchPeer(peerKey)
+	if err != nil {
+		return err
+	}
 	conn, exists := e.conns[peerKey]
 	if exists && conn != nil {
 		delete(e.conns, peerKey)
@@ -162,6 +630,170 @@ func (e *Engine) removePeerConnection(peerKey string) error {
 	return nil
 }
 
+// probePeerMTU discovers the path MTU to the peer through the tunnel and compares the interface MTU to the lowest
+// MTU of all the peers: peers on different paths may support different MTUs but they all share the interface.
+// Depending on EngineConfig.MTUDiscovery a lower MTU is either recommended in the log or set on the interface.
+// The interface MTU is never raised back, e.g. when the peer with the lowest MTU goes away
+func (e *Engine) probePeerMTU(peer Peer) {
+	ifaceMTU, err := iface.GetMTU(e.config.WgIface)
+	if err != nil {
+		log.Warnf("failed reading MTU of interface %s: %v", e.config.WgIface, err)
+		return
+	}
+	if ifaceMTU <= iface.MinMTU {
+		log.Debugf("MTU %d of interface %s is the minimum, skipping MTU discovery of peer %s", ifaceMTU, e.config.WgIface, peer.WgPubKey)
+		return
+	}
+
+	remoteIP, err := peerTunnelIP(peer.WgAllowedIps)
+	if err != nil {
+		log.Warnf("failed discovering MTU of peer %s: %v", peer.WgPubKey, err)
+		return
+	}
+
+	probe, err := newPingProbe(remoteIP)
+	if err != nil {
+		log.Warnf("failed discovering MTU of peer %s: %v", peer.WgPubKey, err)
+		return
+	}
+	defer probe.Close() //nolint
+
+	mtu, ok := discoverMTU(ifaceMTU, probe.probe)
+	if !ok {
+		log.Debugf("peer %s doesn't answer MTU probes", peer.WgPubKey)
+		return
+	}
+	log.Debugf("discovered path MTU %d to peer %s", mtu, peer.WgPubKey)
+
+	e.peerMux.Lock()
+	defer e.peerMux.Unlock()
+
+	if _, exists := e.conns[peer.WgPubKey]; !exists {
+		return
+	}
+	e.peerMTUs[peer.WgPubKey] = mtu
+
+	lowest := ifaceMTU
+	for _, peerMTU := range e.peerMTUs {
+		if peerMTU < lowest {
+			lowest = peerMTU
+		}
+	}
+	if lowest >= ifaceMTU {
+		return
+	}
+
+	if e.config.MTUDiscovery != MTUDiscoveryAdjust {
+		log.Warnf("large packets to peer %s may get lost: path MTU %d is below MTU %d of interface %s, consider lowering the interface MTU to %d",
+			peer.WgPubKey, mtu, ifaceMTU, e.config.WgIface, lowest)
+		return
+	}
+
+	err = iface.SetMTU(e.config.WgIface, lowest)
+	if err != nil {
+		log.Errorf("failed lowering MTU of interface %s to %d: %v", e.config.WgIface, lowest, err)
+		return
+	}
+	log.Infof("lowered MTU of interface %s from %d to %d, the lowest path MTU of the peers", e.config.WgIface, ifaceMTU, lowest)
+}
+
+// RestartPeer closes the connection to a remote peer and opens a new one, e.g. when the tunnel to a single peer is stuck.
+// The peer is either its Wireguard public key or its IP in the tunnel. Returns the key of the restarted peer
+// or an error wrapping ErrPeerNotFound
+func (e *Engine) RestartPeer(peer string) (string, error) {
+	e.peerMux.Lock()
+	defer e.peerMux.Unlock()
+
+	key, ok := e.lookupPeerKey(peer)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrPeerNotFound, peer)
+	}
+	e.restartPeer(key)
+	return key, nil
+}
+
+// RestartPeers restarts the connections to all remote peers (see RestartPeer) and returns their keys
+func (e *Engine) RestartPeers() []string {
+	e.peerMux.Lock()
+	defer e.peerMux.Unlock()
+
+	keys := make([]string, 0, len(e.conns))
+	for key := range e.conns {
+		e.restartPeer(key)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// restartPeer closes the current connection of the peer and lets its retry loop open a new one.
+// A loop still running retries on its own once the connection has been closed, otherwise a new loop is started.
+// Must be called with peerMux locked
+func (e *Engine) restartPeer(key string) {
+	log.Infof("restarting connection to peer %s", key)
+	if conn := e.conns[key]; conn != nil {
+		err := conn.Close()
+		if err != nil {
+			log.Warnf("failed closing connection to peer %s: %v", key, err)
+		}
+	}
+	if _, ok := e.retrying[key]; ok {
+		return
+	}
+	peer, ok := e.peers[key]
+	if !ok {
+		log.Warnf("config of peer %s is missing, can't reconnect", key)
+		return
+	}
+	go e.initializePeer(peer)
+}
+
+// updatePreSharedKey applies a changed preshared key of a known peer (e.g. rotated by the Management Service).
+// The connection to the peer is restarted with the new key, an idle peer is reconfigured in place
+func (e *Engine) updatePreSharedKey(peer Peer) {
+	e.peerMux.Lock()
+	defer e.peerMux.Unlock()
+
+	known, ok := e.peers[peer.WgPubKey]
+	if !ok || known.PreSharedKey == peer.PreSharedKey {
+		return
+	}
+	known.PreSharedKey = peer.PreSharedKey
+	e.peers[peer.WgPubKey] = known
+	log.Infof("preshared key of peer %s has changed", peer.WgPubKey)
+
+	if listener, ok := e.idle[peer.WgPubKey]; ok {
+		err := iface.UpdatePeer(e.config.WgIface, known.WgPubKey, known.WgAllowedIps, 0, listener.endpoint(), known.preSharedKey())
+		if err != nil {
+			log.Warnf("failed updating preshared key of idle peer %s: %v", peer.WgPubKey, err)
+		}
+		return
+	}
+	if _, ok := e.conns[peer.WgPubKey]; ok {
+		e.restartPeer(peer.WgPubKey)
+	}
+}
+
+// lookupPeerKey finds the key of a connected peer by its key or its IP in the tunnel. Must be called with peerMux locked
+func (e *Engine) lookupPeerKey(peer string) (string, bool) {
+	if _, ok := e.conns[peer]; ok {
+		return peer, true
+	}
+	ip := net.ParseIP(peer)
+	if ip == nil {
+		return "", false
+	}
+	for key, conn := range e.conns {
+		if conn == nil {
+			continue
+		}
+		peerIP, err := peerTunnelIP(conn.Config.WgAllowedIPs)
+		if err == nil && peerIP.Equal(ip) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
 // GetPeerConnectionStatus returns a connection Status or nil if peer connection wasn't found
 func (e *Engine) GetPeerConnectionStatus(peerKey string) *Status {
 	e.peerMux.Lock()
@@ -169,26 +801,112 @@ func (e *Engine) GetPeerConnectionStatus(peerKey string) *Status {
 
 	conn, exists := e.conns[peerKey]
 	if exists && conn != nil {
-		return &conn.Status
+		status := conn.CurrentStatus()
+		return &status
 	}
 
 	return nil
 }
 
-// openPeerConnection opens a new remote peer connection
-func (e *Engine) openPeerConnection(wgPort int, myKey wgtypes.Key, peer Peer) (*Connection, error) {
+// ListPeers returns a snapshot of the remote peer connections
+func (e *Engine) ListPeers() []PeerState {
+	e.peerMux.Lock()
+	defer e.peerMux.Unlock()
+
+	peers := make([]PeerState, 0, len(e.conns))
+	for key, conn := range e.conns {
+		if conn == nil {
+			continue
+		}
+		state := conn.State()
+		peers = append(peers, PeerState{
+			WgPubKey: key,
+			Status:   conn.CurrentStatus(),
+			State:    state,
+			Stats:    conn.Stats(),
+			Quality:  conn.Quality(),
+			Failure:  conn.Failure(),
+			History:  conn.History(),
+			Config:   e.peers[key],
+		})
+	}
+	for key := range e.idle {
+		peers = append(peers, PeerState{
+			WgPubKey: key,
+			Status:   StatusDisconnected,
+			State:    ConnStateNew,
+			Idle:     true,
+			Config:   e.peers[key],
+		})
+	}
+	if e.config.Observer {
+		peers = append(peers, e.observedPeers()...)
+	}
+
+	return peers
+}
+
+// openPeerConnection opens a new remote peer connection.
+// A connection created on an offer of the remote peer that hasn't been opened yet is opened instead.
+// settled is called once the connection has been established or the attempt has failed, e.g. to release the connect
+// slot of the attempt while the open connection keeps running
+func (e *Engine) openPeerConnection(wgPort int, myKey wgtypes.Key, peer Peer, settled func()) (*Connection, error) {
 	e.peerMux.Lock()
+	conn, ok := e.conns[peer.WgPubKey]
+	if !ok || conn == nil || conn.State() != ConnStateNew {
+		conn = e.newPeerConnection(wgPort, myKey, peer)
+	}
+	e.peerMux.Unlock()
+
+	opened := make(chan struct{})
+	go func() {
+		select {
+		case <-conn.connected.C:
+		case <-opened:
+		}
+		settled()
+	}()
+
+	// blocks until the connection is closed (or the attempt has failed)
+	err := conn.Open(peer.connectionTimeout())
+	close(opened)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
 
+// newPeerConnection creates a connection to the remote peer and replaces the previous one in e.conns, the connection
+// isn't opened. An offer the remote peer has sent before the peer was known is handed over to the connection.
+// Must be called with peerMux locked
+func (e *Engine) newPeerConnection(wgPort int, myKey wgtypes.Key, peer Peer) *Connection {
 	remoteKey, _ := wgtypes.ParseKey(peer.WgPubKey)
 	connConfig := &ConnConfig{
-		WgListenAddr:   fmt.Sprintf("127.0.0.1:%d", wgPort),
-		WgPeerIP:       e.config.WgAddr,
-		WgIface:        e.config.WgIface,
-		WgAllowedIPs:   peer.WgAllowedIps,
-		WgKey:          myKey,
-		RemoteWgKey:    remoteKey,
-		StunTurnURLS:   e.config.StunsTurns,
-		iFaceBlackList: e.config.IFaceBlackList,
+		WgListenAddr:            fmt.Sprintf("127.0.0.1:%d", wgPort),
+		WgPeerIP:                e.config.WgAddr,
+		WgIface:                 e.config.WgIface,
+		WgAllowedIPs:            peer.WgAllowedIps,
+		WgKey:                   myKey,
+		RemoteWgKey:             remoteKey,
+		PreSharedKey:            peer.preSharedKey(),
+		StunTurnURLS:            selectRegionalURLs(e.config.StunsTurns, e.config.StunTurnRegions, e.config.Region, peer.Region),
+		iFaceBlackList:          e.config.IFaceBlackList,
+		iFaceAllowList:          e.config.IFaceAllowList,
+		candidateFilter:         e.config.CandidateFilter,
+		connectionMode:          e.config.ConnectionMode,
+		ipFamily:                e.config.IPFamilyPreference,
+		proxyBuffers:            e.config.ProxyBuffers,
+		heartbeat:               e.config.Heartbeat,
+		candidatesChecksTimeout: e.config.CandidatesChecksTimeout,
+	}
+	connConfig.onEndpointChange = func(endpoint string, relayed bool, pair string) {
+		e.recordEndpoint(remoteKey.String(), endpoint, pair)
+		if onChange := e.config.OnPeerEndpointChange; onChange != nil {
+			onChange(remoteKey.String(), endpoint, relayed)
+		}
+		if e.config.MTUDiscovery.enabled() {
+			go e.probePeerMTU(peer)
+		}
 	}
 
 	signalOffer := func(uFrag string, pwd string) error {
@@ -201,20 +919,53 @@ func (e *Engine) openPeerConnection(wgPort int, myKey wgtypes.Key, peer Peer) (*
 	signalCandidate := func(candidate ice.Candidate) error {
 		return signalCandidate(candidate, myKey, remoteKey, e.signal)
 	}
+	// a peer added back while its previous connection is still draining: the old connection must not remove
+	// the Wireguard peer configured by the new one
+	if draining, ok := e.draining[remoteKey.String()]; ok {
+		delete(e.draining, remoteKey.String())
+		err := draining.Close()
+		if err != nil {
+			log.Warnf("failed closing draining connection to peer %s: %v", remoteKey.String(), err)
+		}
+	}
+
 	conn := NewConnection(*connConfig, signalCandidate, signalOffer, signalAnswer)
+	// keep the history of the previous attempts so that a flapping connection can be followed
+	if previous, ok := e.conns[remoteKey.String()]; ok && previous != nil {
+		conn.history = previous.history
+	}
 	e.conns[remoteKey.String()] = conn
-	e.peerMux.Unlock()
 
-	// blocks until the connection is open (or timeout)
-	err := conn.Open(PeerConnectionTimeout)
-	if err != nil {
-		return nil, err
+	if offer, ok := e.takePendingOffer(remoteKey.String()); ok {
+		conn.holdOffer(offer)
 	}
-	return conn, nil
+
+	return conn
+}
+
+// sendSignal sends a message through the Signal Exchange resending it when it hasn't been acknowledged
+// (up to SignalSendAttempts times). Messages to an offline remote peer aren't resent, signal.ErrPeerOffline is returned
+func sendSignal(s *signal.Client, msg *sProto.Message) error {
+	var err error
+	for attempt := 1; attempt <= SignalSendAttempts; attempt++ {
+		err = s.Send(msg)
+		if err == nil || errors.Is(err, signal.ErrPeerOffline) {
+			return err
+		}
+		if attempt < SignalSendAttempts {
+			log.Debugf("resending %s to peer %s, attempt %d of %d: %v", msg.GetBody().GetType(), msg.GetRemoteKey(), attempt+1, SignalSendAttempts, err)
+			time.Sleep(SignalSendRetryInterval)
+		}
+	}
+	return err
 }
 
 func signalCandidate(candidate ice.Candidate, myKey wgtypes.Key, remoteKey wgtypes.Key, s *signal.Client) error {
-	err := s.Send(&sProto.Message{
+	if candidate == nil {
+		return signalEndOfCandidates(myKey, remoteKey, s)
+	}
+
+	err := sendSignal(s, &sProto.Message{
 		Key:       myKey.PublicKey().String(),
 		RemoteKey: remoteKey.String(),
 		Body: &sProto.Body{
@@ -231,6 +982,24 @@ func signalCandidate(candidate ice.Candidate, myKey wgtypes.Key, remoteKey wgtyp
 	return nil
 }
 
+// signalEndOfCandidates lets the remote peer know that all of our candidates have been sent.
+// Peers not supporting it ignore the message
+func signalEndOfCandidates(myKey wgtypes.Key, remoteKey wgtypes.Key, s *signal.Client) error {
+	err := sendSignal(s, &sProto.Message{
+		Key:       myKey.PublicKey().String(),
+		RemoteKey: remoteKey.String(),
+		Body: &sProto.Body{
+			Type: sProto.Body_END_OF_CANDIDATES,
+		},
+	})
+	if err != nil {
+		log.Errorf("failed signaling end of candidates to the remote peer %s %s", remoteKey.String(), err)
+		return err
+	}
+
+	return nil
+}
+
 func signalAuth(uFrag string, pwd string, myKey wgtypes.Key, remoteKey wgtypes.Key, s *signal.Client, isAnswer bool) error {
 
 	var t sProto.Body_Type
@@ -246,7 +1015,7 @@ func signalAuth(uFrag string, pwd string, myKey wgtypes.Key, remoteKey wgtypes.K
 	if err != nil {
 		return err
 	}
-	err = s.Send(msg)
+	err = sendSignal(s, msg)
 	if err != nil {
 		return err
 	}
@@ -256,121 +1025,229 @@ func signalAuth(uFrag string, pwd string, myKey wgtypes.Key, remoteKey wgtypes.K
 
 // receiveManagementEvents connects to the Management Service event stream to receive updates from the management service
 // E.g. when a new peer has been registered and we are allowed to connect to it.
+// Losing the Management Service (e.g. an outage) doesn't affect the existing peer connections, they are kept as they are.
+// Peers are reconciled (added and removed) only when a fresh update arrives after the stream has been reconnected.
 func (e *Engine) receiveManagementEvents() {
 
 	log.Debugf("connecting to Management Service updates stream")
 
-	e.mgmClient.Sync(func(update *mgmProto.SyncResponse) error {
-		// todo handle changes of global settings (in update.GetWiretrusteeConfig())
-		// todo handle changes of peer settings (in update.GetPeerConfig())
+	e.mgmClient.SetDisconnectHandler(e.onManagementDisconnect)
+	e.mgmClient.Sync(e.handleSync)
 
-		e.syncMsgMux.Lock()
-		defer e.syncMsgMux.Unlock()
+	log.Infof("connected to Management Service updates stream")
+}
 
-		remotePeers := update.GetRemotePeers()
-		if len(remotePeers) != 0 {
+// onManagementDisconnect is called when the Management Service stream breaks, the Engine isn't ready until a fresh
+// update arrives on the reconnected stream
+func (e *Engine) onManagementDisconnect(err error) {
+	e.syncMsgMux.Lock()
+	defer e.syncMsgMux.Unlock()
 
-			remotePeerMap := make(map[string]struct{})
-			for _, peer := range remotePeers {
-				remotePeerMap[peer.GetWgPubKey()] = struct{}{}
-			}
+	if e.mgmConnected {
+		log.Warnf("lost connection to the Management Service, keeping the peer connections until it is back: %v", err)
+	}
+	e.mgmConnected = false
+}
+
+// handleSync applies an update received from the Management Service.
+// The update holds the full list of the remote peers, connections to the peers missing in the list are removed
+func (e *Engine) handleSync(update *mgmProto.SyncResponse) error {
+	// todo handle changes of global settings (in update.GetWiretrusteeConfig())
+
+	e.syncMsgMux.Lock()
+	defer e.syncMsgMux.Unlock()
+
+	if !e.running {
+		return nil
+	}
+	e.mgmConnected = true
+
+	if e.config.Observer {
+		e.observeSync(update)
+		return nil
+	}
+
+	if update.GetPeerConfig() != nil {
+		err := e.updateAddress(update.GetPeerConfig().GetAddress())
+		if err != nil {
+			return err
+		}
+	}
+
+	remotePeers := update.GetRemotePeers()
+	if len(remotePeers) != 0 {
+
+		remotePeerMap := make(map[string]struct{})
+		for _, peer := range remotePeers {
+			remotePeerMap[peer.GetWgPubKey()] = struct{}{}
+		}
 
-			//remove peers that are no longer available for us
-			toRemove := []string{}
-			for p := range e.conns {
-				if _, ok := remotePeerMap[p]; !ok {
-					toRemove = append(toRemove, p)
-				}
+		//remove peers that are no longer available for us
+		// e.conns is also changed by the lazy connections in the background, it is read under peerMux only
+		toRemove := []string{}
+		e.peerMux.Lock()
+		for p := range e.conns {
+			if _, ok := remotePeerMap[p]; !ok {
+				toRemove = append(toRemove, p)
 			}
-			err := e.removePeerConnections(toRemove)
-			if err != nil {
-				return err
+		}
+		for p := range e.idle {
+			if _, ok := remotePeerMap[p]; !ok {
+				toRemove = append(toRemove, p)
 			}
+		}
+		e.peerMux.Unlock()
+		err := e.drainPeerConnections(toRemove)
+		if err != nil {
+			// removed peers are not in e.conns anymore, so we can proceed with the rest of the update
+			log.Warn(err)
+		}
 
-			// add new peers
-			for _, peer := range remotePeers {
-				peerKey := peer.GetWgPubKey()
-				peerIPs := peer.GetAllowedIps()
-				if _, ok := e.conns[peerKey]; !ok {
-					go e.initializePeer(Peer{
-						WgPubKey:     peerKey,
-						WgAllowedIps: strings.Join(peerIPs, ","),
-					})
-				}
-
+		// add new peers, the peers of a higher priority first
+		for _, peer := range byPriority(remotePeers) {
+			e.updatePreSharedKey(peer)
+			if e.config.LazyConnections {
+				e.addLazyPeer(peer)
+				continue
+			}
+			e.peerMux.Lock()
+			_, ok := e.conns[peer.WgPubKey]
+			if !ok {
+				e.peers[peer.WgPubKey] = peer
+			}
+			e.peerMux.Unlock()
+			if !ok {
+				go e.initializePeer(peer)
 			}
 		}
+	}
 
-		return nil
+	return nil
+}
+
+// byPriority converts the remote peer configs to Peers ordered by priority, the highest first.
+// Peers of the same priority keep the order of the Management Service
+func byPriority(remotePeers []*mgmProto.RemotePeerConfig) []Peer {
+	peers := make([]Peer, 0, len(remotePeers))
+	for _, remotePeer := range remotePeers {
+		peers = append(peers, toPeer(remotePeer))
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		return peers[i].Priority > peers[j].Priority
 	})
+	return peers
+}
 
-	log.Infof("connected to Management Service updates stream")
+// updateAddress changes the address of the Wireguard interface in place when it differs from the current one,
+// the existing peer connections are kept
+func (e *Engine) updateAddress(address string) error {
+	e.peerMux.Lock()
+	defer e.peerMux.Unlock()
+
+	if address == "" || address == e.config.WgAddr {
+		return nil
+	}
+
+	log.Infof("peer address changed from %s to %s, updating interface %s", e.config.WgAddr, address, e.config.WgIface)
+	err := iface.UpdateAddress(e.config.WgIface, address)
+	if err != nil {
+		log.Errorf("failed updating address of interface %s: [%s]", e.config.WgIface, err.Error())
+		return err
+	}
+	e.config.WgAddr = address
+
+	return nil
 }
 
 // receiveSignalEvents connects to the Signal Service event stream to negotiate connection with remote peers
 func (e *Engine) receiveSignalEvents() {
 	// connect to a stream of messages coming from the signal server
-	e.signal.Receive(func(msg *sProto.Message) error {
+	e.signal.Receive(e.handleSignalMessage)
 
-		e.syncMsgMux.Lock()
-		defer e.syncMsgMux.Unlock()
+	e.signal.WaitConnected()
+}
 
-		conn := e.conns[msg.Key]
-		if conn == nil {
+// handleSignalMessage negotiates the connection to the remote peer that has sent the message.
+// An offer of a peer without a connection creates the connection, see onOfferWithoutConnection
+func (e *Engine) handleSignalMessage(msg *sProto.Message) error {
+	e.syncMsgMux.Lock()
+	defer e.syncMsgMux.Unlock()
+
+	if e.config.Observer {
+		// observers don't negotiate connections
+		return nil
+	}
+
+	e.peerMux.Lock()
+	conn := e.conns[msg.Key]
+	e.peerMux.Unlock()
+	if conn == nil {
+		if msg.GetBody().Type != sProto.Body_OFFER {
 			return fmt.Errorf("wrongly addressed message %s", msg.Key)
 		}
-
-		if conn.Config.RemoteWgKey.String() != msg.Key {
-			return fmt.Errorf("unknown peer %s", msg.Key)
+		if e.config.LazyConnections {
+			e.activatePeer(msg.Key, "offer of the remote peer")
+		}
+		remoteCred, err := signal.UnMarshalCredential(msg)
+		if err != nil {
+			return err
 		}
+		return e.onOfferWithoutConnection(msg.Key, IceCredentials{
+			uFrag: remoteCred.UFrag,
+			pwd:   remoteCred.Pwd,
+		})
+	}
 
-		switch msg.GetBody().Type {
-		case sProto.Body_OFFER:
-			remoteCred, err := signal.UnMarshalCredential(msg)
-			if err != nil {
-				return err
-			}
-			err = conn.OnOffer(IceCredentials{
-				uFrag: remoteCred.UFrag,
-				pwd:   remoteCred.Pwd,
-			})
+	if conn.Config.RemoteWgKey.String() != msg.Key {
+		return fmt.Errorf("unknown peer %s", msg.Key)
+	}
 
-			if err != nil {
-				return err
-			}
+	switch msg.GetBody().Type {
+	case sProto.Body_OFFER:
+		remoteCred, err := signal.UnMarshalCredential(msg)
+		if err != nil {
+			return err
+		}
+		err = conn.OnOffer(IceCredentials{
+			uFrag: remoteCred.UFrag,
+			pwd:   remoteCred.Pwd,
+		})
 
-			return nil
-		case sProto.Body_ANSWER:
-			remoteCred, err := signal.UnMarshalCredential(msg)
-			if err != nil {
-				return err
-			}
-			err = conn.OnAnswer(IceCredentials{
-				uFrag: remoteCred.UFrag,
-				pwd:   remoteCred.Pwd,
-			})
+		if err != nil {
+			return err
+		}
 
-			if err != nil {
-				return err
-			}
+		return nil
+	case sProto.Body_ANSWER:
+		remoteCred, err := signal.UnMarshalCredential(msg)
+		if err != nil {
+			return err
+		}
+		err = conn.OnAnswer(IceCredentials{
+			uFrag: remoteCred.UFrag,
+			pwd:   remoteCred.Pwd,
+		})
 
-		case sProto.Body_CANDIDATE:
+		if err != nil {
+			return err
+		}
 
-			candidate, err := ice.UnmarshalCandidate(msg.GetBody().Payload)
-			if err != nil {
-				log.Errorf("failed on parsing remote candidate %s -> %s", candidate, err)
-				return err
-			}
+	case sProto.Body_CANDIDATE:
 
-			err = conn.OnRemoteCandidate(candidate)
-			if err != nil {
-				log.Errorf("error handling CANDIATE from %s", msg.Key)
-				return err
-			}
+		candidate, err := ice.UnmarshalCandidate(msg.GetBody().Payload)
+		if err != nil {
+			log.Errorf("failed on parsing remote candidate %s -> %s", candidate, err)
+			return err
 		}
 
-		return nil
-	})
+		err = conn.OnRemoteCandidate(candidate)
+		if err != nil {
+			log.Errorf("error handling CANDIATE from %s", msg.Key)
+			return err
+		}
+	case sProto.Body_END_OF_CANDIDATES:
+		conn.OnRemoteEndOfCandidates()
+	}
 
-	e.signal.WaitConnected()
+	return nil
 }
@@ -0,0 +1,370 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	ice "github.com/pion/ice/v2"
+	"github.com/wiretrustee/wiretrustee/encryption"
+	"github.com/wiretrustee/wiretrustee/iface"
+	mgm "github.com/wiretrustee/wiretrustee/management/client"
+	mgmProto "github.com/wiretrustee/wiretrustee/management/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestToPeer_ConnectionTimeout(t *testing.T) {
+	type testCase struct {
+		name       string
+		remotePeer *mgmProto.RemotePeerConfig
+		expected   time.Duration
+	}
+
+	testCases := []testCase{
+		{
+			name: "timeout suggested by management",
+			remotePeer: &mgmProto.RemotePeerConfig{
+				WgPubKey:          "RRHf3Ma6z6mdLbriAJbqhX7+nM/B71lgw2+91q3LfhU=",
+				AllowedIps:        []string{"100.64.0.2/32"},
+				ConnectionTimeout: 15,
+			},
+			expected: 15 * time.Second,
+		},
+		{
+			name: "no timeout falls back to the default",
+			remotePeer: &mgmProto.RemotePeerConfig{
+				WgPubKey:   "RRHf3Ma6z6mdLbriAJbqhX7+nM/B71lgw2+91q3LfhU=",
+				AllowedIps: []string{"100.64.0.2/32"},
+			},
+			expected: PeerConnectionTimeout,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			peer := toPeer(testCase.remotePeer)
+
+			if peer.WgPubKey != testCase.remotePeer.GetWgPubKey() {
+				t.Errorf("expecting peer key %s, got %s", testCase.remotePeer.GetWgPubKey(), peer.WgPubKey)
+			}
+			if peer.WgAllowedIps != "100.64.0.2/32" {
+				t.Errorf("expecting peer allowed IPs 100.64.0.2/32, got %s", peer.WgAllowedIps)
+			}
+			if timeout := peer.connectionTimeout(); timeout != testCase.expected {
+				t.Errorf("expecting connection timeout %s, got %s", testCase.expected, timeout)
+			}
+		})
+	}
+}
+
+func TestEngine_UpdateAddressUnchanged(t *testing.T) {
+	engine := newTestEngine()
+	engine.config.WgIface = "wt-non-existing"
+	engine.config.WgAddr = "100.64.0.1/24"
+
+	// neither call may touch the (non existing) interface
+	for _, address := range []string{"", "100.64.0.1/24"} {
+		err := engine.updateAddress(address)
+		if err != nil {
+			t.Errorf("expecting address %q not to update the interface, got %v", address, err)
+		}
+	}
+
+	if engine.config.WgAddr != "100.64.0.1/24" {
+		t.Errorf("expecting engine address to stay 100.64.0.1/24, got %s", engine.config.WgAddr)
+	}
+}
+
+func TestEngine_StopEndsPeerDrain(t *testing.T) {
+	engine := newTestEngine()
+	engine.config.PeerDrainTimeout = time.Minute
+
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := NewConnection(ConnConfig{WgKey: key, RemoteWgKey: remoteKey.PublicKey()}, nil, nil, nil)
+	for _, state := range []ConnState{ConnStateGathering, ConnStateConnecting, ConnStateConnected} {
+		err = conn.transition(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	engine.conns[remoteKey.PublicKey().String()] = conn
+
+	err = engine.drainPeerConnections([]string{remoteKey.PublicKey().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine.peerMux.Lock()
+	_, connected := engine.conns[remoteKey.PublicKey().String()]
+	_, draining := engine.draining[remoteKey.PublicKey().String()]
+	engine.peerMux.Unlock()
+	if connected || !draining {
+		t.Fatalf("expecting removed peer connection to be draining")
+	}
+
+	_ = engine.Stop()
+
+	if conn.State() != ConnStateClosed {
+		t.Errorf("expecting Stop to close draining connection, got state %s", conn.State())
+	}
+}
+
+func TestEngine_RestartPeer(t *testing.T) {
+	engine := newTestEngine()
+
+	remoteKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey := remoteKey.PublicKey().String()
+
+	conn := NewConnection(ConnConfig{RemoteWgKey: remoteKey.PublicKey(), WgAllowedIPs: "100.64.0.2/32"}, nil, nil, nil)
+	engine.conns[peerKey] = conn
+	// a running retry loop opens the new connection, no new loop is started
+	engine.retrying[peerKey] = struct{}{}
+
+	_, err = engine.RestartPeer("100.64.0.3")
+	if !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("expecting unknown peer IP to be rejected with ErrPeerNotFound, got %v", err)
+	}
+	_, err = engine.RestartPeer("unknown")
+	if !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("expecting unknown peer key to be rejected with ErrPeerNotFound, got %v", err)
+	}
+	if conn.State() == ConnStateClosed {
+		t.Fatalf("expecting connection to be kept when the peer isn't found")
+	}
+
+	key, err := engine.RestartPeer("100.64.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != peerKey {
+		t.Errorf("expecting peer %s to be found by its IP, got %s", peerKey, key)
+	}
+	if conn.State() != ConnStateClosed {
+		t.Errorf("expecting connection to be closed on restart, got state %s", conn.State())
+	}
+
+	restarted := engine.RestartPeers()
+	if len(restarted) != 1 || restarted[0] != peerKey {
+		t.Errorf("expecting all peers to be restarted, got %v", restarted)
+	}
+}
+
+// mockManagementServer sends a single update on every Sync stream and keeps the stream open until dropStream is closed
+type mockManagementServer struct {
+	mgmProto.UnimplementedManagementServiceServer
+	key        wgtypes.Key
+	update     *mgmProto.SyncResponse
+	synced     chan struct{}
+	dropStream chan struct{}
+}
+
+func (m *mockManagementServer) GetServerKey(ctx context.Context, req *mgmProto.Empty) (*mgmProto.ServerKeyResponse, error) {
+	return &mgmProto.ServerKeyResponse{Key: m.key.PublicKey().String()}, nil
+}
+
+func (m *mockManagementServer) Sync(req *mgmProto.EncryptedMessage, srv mgmProto.ManagementService_SyncServer) error {
+	peerKey, err := wgtypes.ParseKey(req.GetWgPubKey())
+	if err != nil {
+		return err
+	}
+
+	body, err := encryption.EncryptMessage(peerKey, m.key, m.update)
+	if err != nil {
+		return err
+	}
+
+	err = srv.Send(&mgmProto.EncryptedMessage{WgPubKey: m.key.PublicKey().String(), Body: body})
+	if err != nil {
+		return err
+	}
+	m.synced <- struct{}{}
+
+	<-m.dropStream
+	return status.Errorf(codes.Unavailable, "management is down")
+}
+
+func TestEngine_KeepsPeersWhenManagementIsDown(t *testing.T) {
+	serverKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remotePeers := []string{"RRHf3Ma6z6mdLbriAJbqhX7+nM/B71lgw2+91q3LfhU=", "LLHf3Ma6z6mdLbriAJbqhX7+nM/B71lgw2+91q3LfhU="}
+	update := &mgmProto.SyncResponse{}
+	for _, remotePeer := range remotePeers {
+		update.RemotePeers = append(update.RemotePeers, &mgmProto.RemotePeerConfig{WgPubKey: remotePeer, AllowedIps: []string{"100.64.0.2/32"}})
+	}
+
+	mgmServer := &mockManagementServer{
+		key:        serverKey,
+		update:     update,
+		synced:     make(chan struct{}, 1),
+		dropStream: make(chan struct{}),
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	mgmProto.RegisterManagementServiceServer(server, mgmServer)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	mgmClient, err := mgm.NewClient(context.Background(), listener.Addr().String(), peerKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgmClient.Close() //nolint
+
+	engine := newTestEngine()
+	engine.mgmClient = mgmClient
+	engine.running = true
+	// the peers are already connected, the update doesn't change anything
+	for _, remotePeer := range remotePeers {
+		engine.conns[remotePeer] = NewConnection(ConnConfig{}, nil, nil, nil)
+	}
+
+	// the same as receiveManagementEvents, the test gets notified once the Engine has seen the stream break
+	disconnected := make(chan struct{}, 1)
+	mgmClient.SetDisconnectHandler(func(err error) {
+		engine.onManagementDisconnect(err)
+		select {
+		case disconnected <- struct{}{}:
+		default:
+		}
+	})
+	mgmClient.Sync(engine.handleSync)
+
+	select {
+	case <-mgmServer.synced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for the Management Service update")
+	}
+
+	// the Management Service goes down
+	close(mgmServer.dropStream)
+	server.Stop()
+
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for the Management Service stream to break")
+	}
+
+	engine.peerMux.Lock()
+	defer engine.peerMux.Unlock()
+	for _, remotePeer := range remotePeers {
+		if _, ok := engine.conns[remotePeer]; !ok {
+			t.Errorf("expecting connection to peer %s to be kept while the Management Service is down", remotePeer)
+		}
+	}
+}
+
+func TestEngine_CandidateFilter(t *testing.T) {
+	myKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the filter rejects all the candidates, none of them may be gathered nor reach the remote peer
+	var filterMux sync.Mutex
+	var filtered []string
+	engine := newTestEngine()
+	engine.config.CandidateFilter = func(candidate ice.Candidate) bool {
+		filterMux.Lock()
+		defer filterMux.Unlock()
+		filtered = append(filtered, candidate.Address())
+		return false
+	}
+
+	engine.peerMux.Lock()
+	conn := engine.newPeerConnection(iface.WgPort, myKey, Peer{WgPubKey: remoteKey.PublicKey().String(), WgAllowedIps: "100.64.0.2/32"})
+	engine.peerMux.Unlock()
+
+	// the test takes the place of the Signal Exchange
+	offered := make(chan struct{}, 1)
+	signaled := make(chan ice.Candidate, 16)
+	conn.signalOffer = func(uFrag string, pwd string) error {
+		offered <- struct{}{}
+		return nil
+	}
+	conn.signalCandidate = func(candidate ice.Candidate) error {
+		signaled <- candidate
+		return nil
+	}
+
+	opened := make(chan error, 1)
+	go func() {
+		opened <- conn.Open(10 * time.Second)
+	}()
+	defer func() {
+		_ = conn.Close()
+		<-opened
+	}()
+
+	select {
+	case <-offered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for the offer")
+	}
+	// the remote peer answers, the candidates get gathered
+	err = conn.OnAnswer(IceCredentials{uFrag: "uFrag", pwd: "pwd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for gathered := false; !gathered; {
+		select {
+		case candidate := <-signaled:
+			if candidate == nil {
+				// end of candidates
+				gathered = true
+				continue
+			}
+			t.Errorf("expecting candidate %s rejected by the filter not to be signaled", candidate)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout while waiting for the end of candidates")
+		}
+	}
+
+	filterMux.Lock()
+	defer filterMux.Unlock()
+	if len(filtered) == 0 {
+		t.Skip("no local addresses to filter")
+	}
+
+	// the rejected addresses haven't been gathered at all, the agent has no candidates to check
+	gatheredCandidates, err := conn.agent.GetLocalCandidates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, candidate := range gatheredCandidates {
+		t.Errorf("expecting candidate %s rejected by the filter not to be gathered", candidate)
+	}
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"fmt"
+	ice "github.com/pion/ice/v2"
+	mgmProto "github.com/wiretrustee/wiretrustee/management/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+)
+
+// BuildEngineConfig assembles the EngineConfig from the local client Config and the global config received from the
+// Management Service (the first SyncResponse, the LoginResponse carries the same WiretrusteeConfig and PeerConfig).
+// The STUN and TURN servers of the local config come first followed by the ones of the Management Service.
+// Options not covered by either (e.g. EngineConfig.HTTPAddress) are left to the caller
+func BuildEngineConfig(localConfig *Config, sync *mgmProto.SyncResponse) (*EngineConfig, error) {
+	if localConfig == nil {
+		return nil, fmt.Errorf("local config is missing")
+	}
+	if sync == nil {
+		return nil, fmt.Errorf("sync response of the Management Service is missing")
+	}
+
+	privateKey, err := wgtypes.ParseKey(localConfig.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing Wireguard private key of the local config: %v", err)
+	}
+
+	if localConfig.WgIface == "" {
+		return nil, fmt.Errorf("interface name of the local config is empty")
+	}
+
+	peerConfig := sync.GetPeerConfig()
+	if peerConfig.GetAddress() == "" {
+		return nil, fmt.Errorf("peer address wasn't received from the Management Service")
+	}
+	_, _, err = net.ParseCIDR(peerConfig.GetAddress())
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing peer address %s received from the Management Service: %v", peerConfig.GetAddress(), err)
+	}
+
+	wtConfig := sync.GetWiretrusteeConfig()
+	if wtConfig == nil {
+		return nil, fmt.Errorf("global Wiretrustee config wasn't received from the Management Service")
+	}
+	stunTurns, err := ToStunTurnURLs(wtConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing STUN and TURN URLs received from the Management Service: %v", err)
+	}
+	regions := stunTurnRegions(wtConfig, stunTurns)
+
+	// the servers of the local config are preferred
+	var localStunTurns []*ice.URL
+	for _, server := range localConfig.StunsTurns {
+		url, err := ice.ParseURL(server.URI)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing STUN or TURN URL %s of the local config: %v", server.URI, err)
+		}
+		url.Username = server.Username
+		url.Password = server.Password
+		localStunTurns = append(localStunTurns, url)
+	}
+	stunTurns = append(localStunTurns, stunTurns...)
+
+	iFaceBlackList := make(map[string]struct{})
+	for _, name := range localConfig.IFaceBlackList {
+		iFaceBlackList[name] = struct{}{}
+	}
+	// never gather connection candidates on our own tunnel
+	iFaceBlackList[localConfig.WgIface] = struct{}{}
+
+	var iFaceAllowList map[string]struct{}
+	if len(localConfig.IFaceAllowList) > 0 {
+		iFaceAllowList = make(map[string]struct{})
+		for _, name := range localConfig.IFaceAllowList {
+			if name == localConfig.WgIface {
+				return nil, fmt.Errorf("interface allow list of the local config can't contain the Wireguard interface %s", name)
+			}
+			iFaceAllowList[name] = struct{}{}
+		}
+	}
+
+	return &EngineConfig{
+		StunsTurns:      stunTurns,
+		StunTurnRegions: regions,
+		Region:          localConfig.Region,
+		WgIface:         localConfig.WgIface,
+		WgPort:          localConfig.WgPort,
+		WgAddr:          peerConfig.GetAddress(),
+		IFaceBlackList:  iFaceBlackList,
+		IFaceAllowList:  iFaceAllowList,
+		WgPrivateKey:    privateKey,
+	}, nil
+}
+
+// ToStunTurnURLs converts Wiretrustee STUN and TURN configs to ice.URL array.
+// The order received from the Management Service is preserved: STUNs first followed by TURNs
+func ToStunTurnURLs(wtConfig *mgmProto.WiretrusteeConfig) ([]*ice.URL, error) {
+
+	var stunsTurns []*ice.URL
+	for _, stun := range wtConfig.GetStuns() {
+		url, err := ice.ParseURL(stun.GetUri())
+		if err != nil {
+			return nil, fmt.Errorf("STUN %s: %v", stun.GetUri(), err)
+		}
+		stunsTurns = append(stunsTurns, url)
+	}
+	for _, turn := range wtConfig.GetTurns() {
+		url, err := ice.ParseURL(turn.GetHostConfig().GetUri())
+		if err != nil {
+			return nil, fmt.Errorf("TURN %s: %v", turn.GetHostConfig().GetUri(), err)
+		}
+		url.Username = turn.GetUser()
+		url.Password = turn.GetPassword()
+		stunsTurns = append(stunsTurns, url)
+	}
+
+	return stunsTurns, nil
+}
+
+// stunTurnRegions tags the URLs converted by ToStunTurnURLs (same order: STUNs first followed by TURNs) with the region
+// of their servers. Servers without a region are left out
+func stunTurnRegions(wtConfig *mgmProto.WiretrusteeConfig, stunsTurns []*ice.URL) map[*ice.URL]string {
+	var hosts []*mgmProto.HostConfig
+	hosts = append(hosts, wtConfig.GetStuns()...)
+	for _, turn := range wtConfig.GetTurns() {
+		hosts = append(hosts, turn.GetHostConfig())
+	}
+
+	regions := make(map[*ice.URL]string)
+	for i, url := range stunsTurns {
+		if i < len(hosts) && hosts[i].GetRegion() != "" {
+			regions[url] = hosts[i].GetRegion()
+		}
+	}
+	return regions
+}
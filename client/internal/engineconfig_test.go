@@ -0,0 +1,243 @@
+package internal
+
+import (
+	mgmProto "github.com/wiretrustee/wiretrustee/management/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"testing"
+)
+
+func newTestSyncResponse() *mgmProto.SyncResponse {
+	return &mgmProto.SyncResponse{
+		WiretrusteeConfig: &mgmProto.WiretrusteeConfig{
+			Stuns: []*mgmProto.HostConfig{
+				{Uri: "stun:stun.wiretrustee.com:3468", Protocol: mgmProto.HostConfig_UDP},
+			},
+			Turns: []*mgmProto.ProtectedHostConfig{
+				{
+					HostConfig: &mgmProto.HostConfig{Uri: "turn:turn.wiretrustee.com:3478", Protocol: mgmProto.HostConfig_UDP},
+					User:       "user",
+					Password:   "password",
+				},
+			},
+			Signal: &mgmProto.HostConfig{Uri: "signal.wiretrustee.com:10000", Protocol: mgmProto.HostConfig_HTTPS},
+		},
+		PeerConfig: &mgmProto.PeerConfig{Address: "100.64.0.1/24"},
+	}
+}
+
+func TestBuildEngineConfig(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localConfig := &Config{
+		PrivateKey:     key.String(),
+		WgIface:        "wt0",
+		IFaceBlackList: []string{"wt0", "tun0", "docker0"},
+	}
+
+	engineConfig, err := BuildEngineConfig(localConfig, newTestSyncResponse())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if engineConfig.WgPrivateKey != key {
+		t.Errorf("expecting Wireguard private key of the local config")
+	}
+	if engineConfig.WgIface != "wt0" {
+		t.Errorf("expecting interface wt0, got %s", engineConfig.WgIface)
+	}
+	if engineConfig.WgAddr != "100.64.0.1/24" {
+		t.Errorf("expecting address 100.64.0.1/24, got %s", engineConfig.WgAddr)
+	}
+
+	if len(engineConfig.StunsTurns) != 2 {
+		t.Fatalf("expecting 2 STUN and TURN URLs, got %d", len(engineConfig.StunsTurns))
+	}
+	if engineConfig.StunsTurns[0].String() != "stun:stun.wiretrustee.com:3468" {
+		t.Errorf("expecting STUN first, got %s", engineConfig.StunsTurns[0])
+	}
+	turn := engineConfig.StunsTurns[1]
+	if turn.Host != "turn.wiretrustee.com" || turn.Username != "user" || turn.Password != "password" {
+		t.Errorf("expecting TURN with credentials, got %s %s", turn, turn.Username)
+	}
+
+	for _, name := range []string{"wt0", "tun0", "docker0"} {
+		if _, ok := engineConfig.IFaceBlackList[name]; !ok {
+			t.Errorf("expecting interface %s to be blacklisted", name)
+		}
+	}
+}
+
+func TestBuildEngineConfig_IFaceAllowList(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engineConfig, err := BuildEngineConfig(&Config{PrivateKey: key.String(), WgIface: "wt0"}, newTestSyncResponse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if engineConfig.IFaceAllowList != nil {
+		t.Errorf("expecting no interface allow list, got %v", engineConfig.IFaceAllowList)
+	}
+
+	engineConfig, err = BuildEngineConfig(&Config{PrivateKey: key.String(), WgIface: "wt0", IFaceAllowList: []string{"eth0"}}, newTestSyncResponse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := engineConfig.IFaceAllowList["eth0"]; !ok || len(engineConfig.IFaceAllowList) != 1 {
+		t.Errorf("expecting interface allow list [eth0], got %v", engineConfig.IFaceAllowList)
+	}
+}
+
+func TestBuildEngineConfig_LocalStunTurns(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localConfig := &Config{
+		PrivateKey: key.String(),
+		WgIface:    "wt0",
+		StunsTurns: []StunTurnServer{{URI: "turn:turn.example.com:3478", Username: "local", Password: "secret"}},
+	}
+	engineConfig, err := BuildEngineConfig(localConfig, newTestSyncResponse())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(engineConfig.StunsTurns) != 3 {
+		t.Fatalf("expecting 3 STUN and TURN URLs, got %d", len(engineConfig.StunsTurns))
+	}
+	local := engineConfig.StunsTurns[0]
+	if local.Host != "turn.example.com" || local.Username != "local" || local.Password != "secret" {
+		t.Errorf("expecting TURN of the local config first, got %s %s", local, local.Username)
+	}
+
+	localConfig.StunsTurns = []StunTurnServer{{URI: "turn.example.com"}}
+	_, err = BuildEngineConfig(localConfig, newTestSyncResponse())
+	if err == nil {
+		t.Errorf("expecting invalid STUN or TURN URL of the local config to be rejected")
+	}
+}
+
+func TestBuildEngineConfig_Regions(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sync := newTestSyncResponse()
+	sync.WiretrusteeConfig.Turns = append(sync.WiretrusteeConfig.Turns, &mgmProto.ProtectedHostConfig{
+		HostConfig: &mgmProto.HostConfig{Uri: "turn:eu.turn.wiretrustee.com:3478", Protocol: mgmProto.HostConfig_UDP, Region: "eu-central"},
+	})
+
+	engineConfig, err := BuildEngineConfig(&Config{PrivateKey: key.String(), WgIface: "wt0", Region: "eu-central"}, sync)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if engineConfig.Region != "eu-central" {
+		t.Errorf("expecting region eu-central of the local config, got %s", engineConfig.Region)
+	}
+	if len(engineConfig.StunTurnRegions) != 1 {
+		t.Fatalf("expecting 1 regional server, got %d", len(engineConfig.StunTurnRegions))
+	}
+	turn := engineConfig.StunsTurns[2]
+	if engineConfig.StunTurnRegions[turn] != "eu-central" {
+		t.Errorf("expecting TURN %s to be tagged with region eu-central, got %q", turn, engineConfig.StunTurnRegions[turn])
+	}
+}
+
+func TestBuildEngineConfig_Invalid(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		name        string
+		localConfig *Config
+		sync        func() *mgmProto.SyncResponse
+	}
+
+	validConfig := &Config{PrivateKey: key.String(), WgIface: "wt0"}
+
+	testCases := []testCase{
+		{
+			name:        "missing local config",
+			localConfig: nil,
+			sync:        newTestSyncResponse,
+		},
+		{
+			name:        "missing sync response",
+			localConfig: validConfig,
+			sync: func() *mgmProto.SyncResponse {
+				return nil
+			},
+		},
+		{
+			name:        "invalid private key",
+			localConfig: &Config{PrivateKey: "invalid", WgIface: "wt0"},
+			sync:        newTestSyncResponse,
+		},
+		{
+			name:        "missing interface name",
+			localConfig: &Config{PrivateKey: key.String()},
+			sync:        newTestSyncResponse,
+		},
+		{
+			name:        "missing peer address",
+			localConfig: validConfig,
+			sync: func() *mgmProto.SyncResponse {
+				sync := newTestSyncResponse()
+				sync.PeerConfig = nil
+				return sync
+			},
+		},
+		{
+			name:        "invalid peer address",
+			localConfig: validConfig,
+			sync: func() *mgmProto.SyncResponse {
+				sync := newTestSyncResponse()
+				sync.PeerConfig.Address = "100.64.0.1"
+				return sync
+			},
+		},
+		{
+			name:        "missing Wiretrustee config",
+			localConfig: validConfig,
+			sync: func() *mgmProto.SyncResponse {
+				sync := newTestSyncResponse()
+				sync.WiretrusteeConfig = nil
+				return sync
+			},
+		},
+		{
+			name:        "Wireguard interface in allow list",
+			localConfig: &Config{PrivateKey: key.String(), WgIface: "wt0", IFaceAllowList: []string{"eth0", "wt0"}},
+			sync:        newTestSyncResponse,
+		},
+		{
+			name:        "invalid TURN URL",
+			localConfig: validConfig,
+			sync: func() *mgmProto.SyncResponse {
+				sync := newTestSyncResponse()
+				sync.WiretrusteeConfig.Turns[0].HostConfig.Uri = "turn.wiretrustee.com"
+				return sync
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := BuildEngineConfig(testCase.localConfig, testCase.sync())
+			if err == nil {
+				t.Errorf("expecting engine config to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultHeartbeatInterval is how often a heartbeat is sent over the ICE connection of a connected peer
+	DefaultHeartbeatInterval = 5 * time.Second
+	// DefaultHeartbeatMissThreshold is the number of heartbeats missed in a row after which the connection is restarted
+	DefaultHeartbeatMissThreshold = 3
+)
+
+// heartbeatPacket is sent over the ICE connection next to the proxied Wireguard traffic. Wireguard messages start with
+// the message type (1-4) followed by 3 zero bytes, so the packet can't be mistaken for one. Peers without heartbeat
+// support forward it to Wireguard that drops it
+var heartbeatPacket = []byte{0xff, 'w', 't', 'h', 'b'}
+
+// HeartbeatConfig defines the application level heartbeat over the ICE connection of a connected peer.
+// The heartbeat detects a stale ICE connection (e.g. a dead TURN relay or an expired NAT mapping) faster than a failing
+// Wireguard handshake: a connection missing a heartbeat is reported as StatusDegraded and it is restarted after
+// MissThreshold heartbeats missed in a row. Heartbeats are only expected from remote peers that have sent one before,
+// peers without heartbeat support are never restarted
+type HeartbeatConfig struct {
+	// Interval is how often a heartbeat is sent, 0 means DefaultHeartbeatInterval
+	Interval time.Duration
+	// MissThreshold is the number of heartbeats missed in a row after which the connection is restarted,
+	// 0 means DefaultHeartbeatMissThreshold
+	MissThreshold int
+}
+
+// interval returns Interval falling back to DefaultHeartbeatInterval
+func (c HeartbeatConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return DefaultHeartbeatInterval
+}
+
+// missThreshold returns MissThreshold falling back to DefaultHeartbeatMissThreshold
+func (c HeartbeatConfig) missThreshold() int {
+	if c.MissThreshold > 0 {
+		return c.MissThreshold
+	}
+	return DefaultHeartbeatMissThreshold
+}
+
+// validate rejects negative settings
+func (c HeartbeatConfig) validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("invalid heartbeat interval %v, must not be negative", c.Interval)
+	}
+	if c.MissThreshold < 0 {
+		return fmt.Errorf("invalid heartbeat miss threshold %d, must not be negative", c.MissThreshold)
+	}
+	return nil
+}
+
+// isHeartbeat checks whether a packet received over the ICE connection is a heartbeat
+func isHeartbeat(packet []byte) bool {
+	return bytes.Equal(packet, heartbeatPacket)
+}
+
+// missedHeartbeats returns the number of heartbeats missed in a row when the latest one has been received since ago.
+// A heartbeat is missed once it is late by a whole interval, that absorbs the jitter of the remote peer's timer
+func missedHeartbeats(since time.Duration, interval time.Duration) int {
+	missed := int(since/interval) - 1
+	if missed < 0 {
+		return 0
+	}
+	return missed
+}
+
+// onHeartbeat records a heartbeat received from the remote peer
+func (conn *Connection) onHeartbeat() {
+	atomic.StoreInt64(&conn.lastHeartbeat, time.Now().UnixNano())
+}
+
+// readHeartbeats handles the heartbeats received over the ICE connection of a direct connection, the Wireguard traffic
+// doesn't go through it and nothing else reads it. Blocks until the ICE connection has been closed
+func (conn *Connection) readHeartbeats(remoteConn net.Conn) {
+	// a short buffer fails the read of a larger packet
+	buf := make([]byte, conn.Config.proxyBuffers.packetSize())
+	for {
+		n, err := remoteConn.Read(buf)
+		if err != nil {
+			// reads fail only once the ICE agent has been closed
+			log.Debugf("stopped reading heartbeats of peer %s: %v", conn.Config.RemoteWgKey.String(), err)
+			return
+		}
+		if isHeartbeat(buf[:n]) {
+			conn.onHeartbeat()
+		}
+	}
+}
+
+// monitorHeartbeat sends heartbeats to the remote peer every interval and checks the ones received from it.
+// A missed heartbeat marks the connection as degraded, a received one recovers it. Reaching the miss threshold closes
+// the connection so that the retry loop of the Engine negotiates a new ICE connection.
+// Blocks until the connection has been closed
+func (conn *Connection) monitorHeartbeat(remoteConn net.Conn) {
+	interval := conn.Config.heartbeat.interval()
+	threshold := conn.Config.heartbeat.missThreshold()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.closeCond.C:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := remoteConn.Write(heartbeatPacket)
+		if err != nil {
+			log.Debugf("failed sending heartbeat to peer %s: %v", conn.Config.RemoteWgKey.String(), err)
+		}
+
+		last := atomic.LoadInt64(&conn.lastHeartbeat)
+		if last == 0 {
+			// the remote peer hasn't sent any heartbeat, it may not support them
+			continue
+		}
+
+		missed := missedHeartbeats(time.Since(time.Unix(0, last)), interval)
+		if missed >= threshold {
+			log.Warnf("missed %d heartbeats of peer %s, restarting the connection", missed, conn.Config.RemoteWgKey.String())
+			conn.history.add("missed %d heartbeats, restarting", missed)
+			err = conn.Close()
+			if err != nil {
+				log.Warnf("error while closing connection to peer %s -> %s", conn.Config.RemoteWgKey.String(), err.Error())
+			}
+			return
+		}
+		conn.setDegraded(missed > 0)
+	}
+}
+
+// setDegraded switches the Status of a connected connection between StatusConnected and StatusDegraded
+func (conn *Connection) setDegraded(degraded bool) {
+	conn.stateMux.Lock()
+	defer conn.stateMux.Unlock()
+
+	if conn.state != ConnStateConnected || (conn.Status == StatusDegraded) == degraded {
+		return
+	}
+
+	if degraded {
+		log.Infof("connection to peer %s is degraded, heartbeats are missing", conn.Config.RemoteWgKey.String())
+		conn.history.add("degraded, heartbeats are missing")
+		conn.Status = StatusDegraded
+		return
+	}
+	log.Infof("connection to peer %s has recovered, heartbeats are received again", conn.Config.RemoteWgKey.String())
+	conn.history.add("recovered, heartbeats are received again")
+	conn.Status = StatusConnected
+}
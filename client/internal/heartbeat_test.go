@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMissedHeartbeats(t *testing.T) {
+	interval := 5 * time.Second
+
+	type testCase struct {
+		name     string
+		since    time.Duration
+		expected int
+	}
+
+	testCases := []testCase{
+		{name: "just received", since: 0, expected: 0},
+		{name: "next one due", since: interval, expected: 0},
+		{name: "late by less than an interval", since: interval + interval/2, expected: 0},
+		{name: "late by an interval", since: 2 * interval, expected: 1},
+		{name: "late by 3 intervals", since: 4*interval + time.Second, expected: 3},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			missed := missedHeartbeats(testCase.since, interval)
+			if missed != testCase.expected {
+				t.Errorf("expecting %d missed heartbeats, got %d", testCase.expected, missed)
+			}
+		})
+	}
+}
+
+func TestIsHeartbeat(t *testing.T) {
+	if !isHeartbeat(heartbeatPacket) {
+		t.Errorf("expecting heartbeat packet to be recognized")
+	}
+
+	// a Wireguard handshake initiation starts with its message type followed by 3 zero bytes
+	handshake := make([]byte, 148)
+	handshake[0] = 1
+	if isHeartbeat(handshake) || isHeartbeat(handshake[:len(heartbeatPacket)]) {
+		t.Errorf("expecting Wireguard message not to be taken for a heartbeat")
+	}
+}
+
+func TestWgProxy_Heartbeat(t *testing.T) {
+	wgConn, wgPeer := net.Pipe()
+	remoteConn, remotePeer := net.Pipe()
+
+	proxy := NewWgProxy("wt0", "remote", "10.30.30.2/32", nil, "127.0.0.1:51820", ProxyBufferConfig{}, DefaultWgKeepAlive)
+	proxy.wgConn = wgConn
+	var heartbeats int32
+	proxy.onHeartbeat = func() {
+		atomic.AddInt32(&heartbeats, 1)
+	}
+
+	go proxy.proxyToLocalWireguard(remoteConn)
+
+	defer func() {
+		close(proxy.close)
+		wgPeer.Close()
+		remotePeer.Close()
+	}()
+
+	_, err := remotePeer.Write(heartbeatPacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromRemote := []byte("reply")
+	_, err = remotePeer.Write(fromRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the heartbeat isn't forwarded, the first packet local Wireguard receives is the reply
+	buf := make([]byte, 1500)
+	n, err := wgPeer.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != string(fromRemote) {
+		t.Errorf("expecting local Wireguard to receive %s, got %s", fromRemote, buf[:n])
+	}
+	if atomic.LoadInt32(&heartbeats) != 1 {
+		t.Errorf("expecting 1 heartbeat to be handled, got %d", atomic.LoadInt32(&heartbeats))
+	}
+	// the proxy counts the bytes once local Wireguard has read them, the counter may lag behind the read
+	deadline := time.Now().Add(time.Second)
+	for proxy.Stats().BytesFromRemote < uint64(len(fromRemote)) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := proxy.Stats(); stats.BytesFromRemote != uint64(len(fromRemote)) {
+		t.Errorf("expecting heartbeats not to be counted, got %d bytes from remote", stats.BytesFromRemote)
+	}
+}
+
+func TestConnection_Heartbeat(t *testing.T) {
+	interval := 50 * time.Millisecond
+	conn := NewConnection(ConnConfig{heartbeat: HeartbeatConfig{Interval: interval, MissThreshold: 5}}, nil, nil, nil)
+	for _, state := range []ConnState{ConnStateGathering, ConnStateConnecting, ConnStateConnected} {
+		err := conn.transition(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remoteConn, remotePeer := net.Pipe()
+	defer remoteConn.Close()
+	defer remotePeer.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// the remote peer sends heartbeats while alive and drains the ones it receives
+	var alive int32 = 1
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, err := remotePeer.Read(buf)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if atomic.LoadInt32(&alive) == 0 {
+				continue
+			}
+			_, err := remotePeer.Write(heartbeatPacket)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	go conn.readHeartbeats(remoteConn)
+	go conn.monitorHeartbeat(remoteConn)
+
+	waitFor := func(description string, condition func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for connection %s, status %s, state %s", description, conn.CurrentStatus(), conn.State())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	time.Sleep(5 * interval)
+	if status := conn.CurrentStatus(); status != StatusConnected {
+		t.Fatalf("expecting connection receiving heartbeats to be %s, got %s", StatusConnected, status)
+	}
+
+	atomic.StoreInt32(&alive, 0)
+	waitFor("to be degraded", func() bool { return conn.CurrentStatus() == StatusDegraded })
+	if state := conn.State(); state != ConnStateConnected {
+		t.Errorf("expecting degraded connection to stay %s, got %s", ConnStateConnected, state)
+	}
+
+	atomic.StoreInt32(&alive, 1)
+	waitFor("to recover", func() bool { return conn.CurrentStatus() == StatusConnected })
+
+	atomic.StoreInt32(&alive, 0)
+	waitFor("to be restarted", func() bool { return conn.State() == ConnStateClosed })
+	if status := conn.CurrentStatus(); status != StatusDisconnected {
+		t.Errorf("expecting restarted connection to be %s, got %s", StatusDisconnected, status)
+	}
+}
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// httpServerShutdownTimeout is the time given to in-flight requests to complete when the HTTPServer is stopped
+const httpServerShutdownTimeout = 5 * time.Second
+
+// HTTPServer exposes the Engine health and metrics over HTTP:
+// /healthz reports the Engine Health and fails when the Engine is not running,
+// /readyz fails until the Engine is connected to the Management Service,
+// /metrics exposes the peer connection metrics in the Prometheus text format,
+// /status reports the Engine Health and the state of every peer connection including its event history.
+// The server is read-only, it is often reachable from the network for scraping. Actions changing the state of the
+// agent (e.g. reconnecting peers) are served by the local ControlServer only
+type HTTPServer struct {
+	address  string
+	engine   *Engine
+	server   *http.Server
+	listener net.Listener
+}
+
+// NewHTTPServer creates a new HTTPServer reporting the state of the Engine
+func NewHTTPServer(address string, engine *Engine) *HTTPServer {
+	s := &HTTPServer{
+		address: address,
+		engine:  engine,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/status", s.handleStatus)
+	s.server = &http.Server{Handler: mux}
+
+	return s
+}
+
+// Start starts listening on the server address and serves requests in a separate goroutine
+func (s *HTTPServer) Start() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("HTTP server stopped serving on %s: %v", s.address, err)
+		}
+	}()
+
+	log.Infof("HTTP server listening on %s", listener.Addr().String())
+
+	return nil
+}
+
+// Addr returns the address the server listens on or nil if it hasn't been started
+func (s *HTTPServer) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Stop gracefully shuts down the server
+func (s *HTTPServer) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), httpServerShutdownTimeout)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+func (s *HTTPServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	health := s.engine.Health()
+	code := http.StatusOK
+	if !health.Running {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, health)
+}
+
+func (s *HTTPServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	health := s.engine.Health()
+	code := http.StatusOK
+	if !health.Running || !health.ManagementConnected {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, health)
+}
+
+func (s *HTTPServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err := w.Write([]byte(formatMetrics(s.engine.Health(), s.engine.ListPeers())))
+	if err != nil {
+		log.Debugf("failed writing metrics response: %v", err)
+	}
+}
+
+// StatusReport is the response of the /status endpoint
+type StatusReport struct {
+	Health Health
+	Peers  []PeerStatus
+}
+
+// PeerStatus is the state of a peer connection in the StatusReport
+type PeerStatus struct {
+	WgPubKey string
+	Status   Status
+	State    string
+	Stats    ProxyStats
+	Quality  QualityScore
+	// Failure is the message of PeerState.Failure, empty if the connection attempt hasn't failed
+	Failure string `json:",omitempty"`
+	History []ConnEvent
+}
+
+func (s *HTTPServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newStatusReport(s.engine.Health(), s.engine.ListPeers()))
+}
+
+// newStatusReport creates a StatusReport with the peers sorted by key
+func newStatusReport(health Health, peers []PeerState) StatusReport {
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].WgPubKey < peers[j].WgPubKey
+	})
+
+	report := StatusReport{Health: health, Peers: make([]PeerStatus, 0, len(peers))}
+	for _, peer := range peers {
+		status := PeerStatus{
+			WgPubKey: peer.WgPubKey,
+			Status:   peer.Status,
+			State:    peer.State.String(),
+			Stats:    peer.Stats,
+			Quality:  peer.Quality,
+			History:  peer.History,
+		}
+		if peer.Failure != nil {
+			status.Failure = peer.Failure.Error()
+		}
+		report.Peers = append(report.Peers, status)
+	}
+	return report
+}
+
+// formatMetrics renders the Engine metrics in the Prometheus text exposition format
+func formatMetrics(health Health, peers []PeerState) string {
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].WgPubKey < peers[j].WgPubKey
+	})
+
+	var b strings.Builder
+	writeMetric(&b, "wiretrustee_management_connected", "Whether the agent has received an update from the Management Service", "gauge")
+	fmt.Fprintf(&b, "wiretrustee_management_connected %d\n", boolToInt(health.ManagementConnected))
+
+	writeMetric(&b, "wiretrustee_peers", "Number of remote peers", "gauge")
+	fmt.Fprintf(&b, "wiretrustee_peers %d\n", health.Peers)
+
+	writeMetric(&b, "wiretrustee_connected_peers", "Number of remote peers with an open connection", "gauge")
+	fmt.Fprintf(&b, "wiretrustee_connected_peers %d\n", health.ConnectedPeers)
+
+	writeMetric(&b, "wiretrustee_peer_sent_bytes_total", "Bytes sent to a remote peer", "counter")
+	for _, peer := range peers {
+		fmt.Fprintf(&b, "wiretrustee_peer_sent_bytes_total{peer=%q} %d\n", peer.WgPubKey, peer.Stats.BytesToRemote)
+	}
+
+	writeMetric(&b, "wiretrustee_peer_received_bytes_total", "Bytes received from a remote peer", "counter")
+	for _, peer := range peers {
+		fmt.Fprintf(&b, "wiretrustee_peer_received_bytes_total{peer=%q} %d\n", peer.WgPubKey, peer.Stats.BytesFromRemote)
+	}
+
+	return b.String()
+}
+
+func writeMetric(b *strings.Builder, name string, help string, metricType string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Debugf("failed writing HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestEngine() *Engine {
+	return &Engine{
+		conns:          map[string]*Connection{},
+		draining:       map[string]*Connection{},
+		peerMTUs:       map[string]int{},
+		peers:          map[string]Peer{},
+		retrying:       map[string]struct{}{},
+		endpoints:      map[string]savedEndpoint{},
+		savedEndpoints: map[string]savedEndpoint{},
+		idle:           map[string]*activityListener{},
+		connects:       newConnectQueue(0),
+		pendingOffers:  map[string]pendingOffer{},
+		retryLog:       newLogLimiter(0),
+		peerMux:        &sync.Mutex{},
+		syncMsgMux:     &sync.Mutex{},
+		config:         &EngineConfig{},
+	}
+}
+
+func TestHTTPServer_Endpoints(t *testing.T) {
+	engine := newTestEngine()
+	engine.running = true
+
+	server := NewHTTPServer("127.0.0.1:0", engine)
+	err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop() //nolint
+
+	url := fmt.Sprintf("http://%s", server.Addr().String())
+
+	expectStatus := func(path string, expected int) {
+		resp, err := http.Get(url + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("expecting %s to respond with %d, got %d", path, expected, resp.StatusCode)
+		}
+	}
+
+	expectStatus("/healthz", http.StatusOK)
+	// not connected to the Management Service yet
+	expectStatus("/readyz", http.StatusServiceUnavailable)
+	expectStatus("/metrics", http.StatusOK)
+
+	engine.syncMsgMux.Lock()
+	engine.mgmConnected = true
+	engine.syncMsgMux.Unlock()
+	expectStatus("/readyz", http.StatusOK)
+
+	// the Management Service stream has broken
+	engine.onManagementDisconnect(errors.New("stream closed"))
+	expectStatus("/readyz", http.StatusServiceUnavailable)
+
+	engine.syncMsgMux.Lock()
+	engine.running = false
+	engine.syncMsgMux.Unlock()
+	expectStatus("/healthz", http.StatusServiceUnavailable)
+}
+
+func TestEngine_StopShutsDownHTTPServer(t *testing.T) {
+	engine := newTestEngine()
+	engine.running = true
+	engine.httpServer = NewHTTPServer("127.0.0.1:0", engine)
+	err := engine.httpServer.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("http://%s/healthz", engine.httpServer.Addr().String())
+
+	err = engine.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if engine.Health().Running {
+		t.Errorf("expecting engine not to be running after Stop")
+	}
+
+	_, err = http.Get(url)
+	if err == nil {
+		t.Errorf("expecting HTTP server to be shut down after Stop")
+	}
+}
+
+func TestFormatMetrics(t *testing.T) {
+	health := Health{Running: true, ManagementConnected: true, Peers: 2, ConnectedPeers: 1}
+	peers := []PeerState{
+		{WgPubKey: "peerB", Status: StatusConnecting},
+		{WgPubKey: "peerA", Status: StatusConnected, Stats: ProxyStats{BytesToRemote: 10, BytesFromRemote: 20}},
+	}
+
+	metrics := formatMetrics(health, peers)
+
+	expected := []string{
+		"wiretrustee_management_connected 1\n",
+		"wiretrustee_peers 2\n",
+		"wiretrustee_connected_peers 1\n",
+		"wiretrustee_peer_sent_bytes_total{peer=\"peerA\"} 10\n",
+		"wiretrustee_peer_received_bytes_total{peer=\"peerA\"} 20\n",
+		"wiretrustee_peer_received_bytes_total{peer=\"peerB\"} 0\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("expecting metrics to contain %q, got:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestHTTPServer_Status(t *testing.T) {
+	engine := newTestEngine()
+	engine.running = true
+
+	conn := NewConnection(ConnConfig{}, nil, nil, nil)
+	conn.history.add("offer sent")
+	conn.failure = errors.New("no answer")
+	engine.conns["peerA"] = conn
+
+	server := NewHTTPServer("127.0.0.1:0", engine)
+	err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop() //nolint
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/status", server.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	report := StatusReport{}
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.Health.Running || len(report.Peers) != 1 {
+		t.Fatalf("expecting running engine with 1 peer, got %+v", report)
+	}
+	peer := report.Peers[0]
+	if peer.WgPubKey != "peerA" || peer.Failure != "no answer" || peer.State != ConnStateNew.String() {
+		t.Errorf("unexpected peer status %+v", peer)
+	}
+	if len(peer.History) != 1 || peer.History[0].Event != "offer sent" {
+		t.Errorf("expecting the connection history, got %v", peer.History)
+	}
+}
+
+func TestHTTPServer_ReadOnly(t *testing.T) {
+	engine := newTestEngine()
+
+	server := NewHTTPServer("127.0.0.1:0", engine)
+	err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop() //nolint
+
+	// reconnecting peers is served by the control socket only
+	resp, err := http.Post(fmt.Sprintf("http://%s/peers/restart", server.Addr().String()), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expecting restart not to be served over HTTP, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"fmt"
+	ice "github.com/pion/ice/v2"
+)
+
+// IPFamilyPreference defines the IP families the Engine connects remote peers over
+type IPFamilyPreference string
+
+const (
+	// IPFamilyAuto keeps the default behavior: candidates are gathered over IPv4 only
+	IPFamilyAuto IPFamilyPreference = "auto"
+	// IPFamilyIPv4 gathers candidates over IPv4 only
+	IPFamilyIPv4 IPFamilyPreference = "ipv4"
+	// IPFamilyIPv6 enables IPv6: candidates are gathered over IPv6 in addition to IPv4. It doesn't prefer IPv6,
+	// ICE ranks the candidate pairs of both families by their type and selects the best one whichever family it is
+	IPFamilyIPv6 IPFamilyPreference = "ipv6"
+)
+
+// ParseIPFamilyPreference parses an IP family preference name. An empty name is IPFamilyAuto
+func ParseIPFamilyPreference(preference string) (IPFamilyPreference, error) {
+	switch IPFamilyPreference(preference) {
+	case "", IPFamilyAuto:
+		return IPFamilyAuto, nil
+	case IPFamilyIPv4, IPFamilyIPv6:
+		return IPFamilyPreference(preference), nil
+	default:
+		return "", fmt.Errorf("invalid IP family preference %s, supported preferences [%s|%s|%s]", preference,
+			IPFamilyAuto, IPFamilyIPv4, IPFamilyIPv6)
+	}
+}
+
+// networkTypes returns the network types the ICE agent gathers candidates on with the preference
+func (p IPFamilyPreference) networkTypes() []ice.NetworkType {
+	if p == IPFamilyIPv6 {
+		return []ice.NetworkType{ice.NetworkTypeUDP6, ice.NetworkTypeUDP4}
+	}
+	return []ice.NetworkType{ice.NetworkTypeUDP4}
+}
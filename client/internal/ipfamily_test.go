@@ -0,0 +1,62 @@
+package internal
+
+import (
+	ice "github.com/pion/ice/v2"
+	"reflect"
+	"testing"
+)
+
+func TestParseIPFamilyPreference(t *testing.T) {
+	for _, preference := range []string{"", "auto", "ipv4", "ipv6"} {
+		_, err := ParseIPFamilyPreference(preference)
+		if err != nil {
+			t.Errorf("expecting IP family preference %q to be valid, got %v", preference, err)
+		}
+	}
+
+	_, err := ParseIPFamilyPreference("ipv5")
+	if err == nil {
+		t.Errorf("expecting invalid IP family preference to be rejected")
+	}
+}
+
+func TestIPFamilyPreference_AgentConfig(t *testing.T) {
+	type testCase struct {
+		name                 string
+		preference           IPFamilyPreference
+		expectedNetworkTypes []ice.NetworkType
+	}
+
+	testCases := []testCase{
+		{
+			name:                 "unset preference is auto",
+			preference:           "",
+			expectedNetworkTypes: []ice.NetworkType{ice.NetworkTypeUDP4},
+		},
+		{
+			name:                 "auto",
+			preference:           IPFamilyAuto,
+			expectedNetworkTypes: []ice.NetworkType{ice.NetworkTypeUDP4},
+		},
+		{
+			name:                 "ipv4",
+			preference:           IPFamilyIPv4,
+			expectedNetworkTypes: []ice.NetworkType{ice.NetworkTypeUDP4},
+		},
+		{
+			name:                 "ipv6",
+			preference:           IPFamilyIPv6,
+			expectedNetworkTypes: []ice.NetworkType{ice.NetworkTypeUDP6, ice.NetworkTypeUDP4},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			conn := NewConnection(ConnConfig{ipFamily: testCase.preference}, nil, nil, nil)
+			agentConfig := conn.newAgentConfig()
+			if !reflect.DeepEqual(agentConfig.NetworkTypes, testCase.expectedNetworkTypes) {
+				t.Errorf("expecting network types %v, got %v", testCase.expectedNetworkTypes, agentConfig.NetworkTypes)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package internal
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/wiretrustee/wiretrustee/iface"
+	"net"
+	"time"
+)
+
+// DefaultLazyIdleTimeout is how long a connection opened in lazy mode is kept without traffic when
+// EngineConfig.LazyIdleTimeout is not set
+const DefaultLazyIdleTimeout = 15 * time.Minute
+
+var (
+	// lazyIdleCheckInterval is how often the traffic of the connections opened in lazy mode is checked
+	lazyIdleCheckInterval = time.Minute
+	// lazyIdleMaxBytes is the traffic of a connection per lazyIdleCheckInterval still considered idle:
+	// Wireguard keepalives and handshakes keep flowing without any user traffic
+	lazyIdleMaxBytes int64 = 1024
+)
+
+// activityListener detects outbound traffic to an idle peer in lazy mode. The Wireguard peer is configured with the
+// local address of the listener as its endpoint, the first packet Wireguard sends there (a handshake initiation)
+// means that something wants to reach the peer
+type activityListener struct {
+	conn *net.UDPConn
+}
+
+// newActivityListener listens on a random local UDP port
+func newActivityListener() (*activityListener, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	return &activityListener{conn: conn}, nil
+}
+
+// endpoint returns the address the Wireguard peer is configured with
+func (l *activityListener) endpoint() string {
+	return l.conn.LocalAddr().String()
+}
+
+// wait blocks until a packet arrives and returns true or until the listener gets closed and returns false
+func (l *activityListener) wait() bool {
+	buf := make([]byte, 1500)
+	_, _, err := l.conn.ReadFromUDP(buf)
+	return err == nil
+}
+
+func (l *activityListener) close() {
+	err := l.conn.Close()
+	if err != nil {
+		log.Debugf("failed closing activity listener on %s: %v", l.endpoint(), err)
+	}
+}
+
+// lazyIdleTimeout returns EngineConfig.LazyIdleTimeout falling back to DefaultLazyIdleTimeout
+func (e *Engine) lazyIdleTimeout() time.Duration {
+	if e.config.LazyIdleTimeout > 0 {
+		return e.config.LazyIdleTimeout
+	}
+	return DefaultLazyIdleTimeout
+}
+
+// watchPeer keeps a peer idle in lazy mode: Wireguard routes the allowed IPs of the peer to an activityListener
+// and the connection gets opened on the first packet (see activatePeer). Must be called with peerMux locked
+func (e *Engine) watchPeer(peer Peer) error {
+	listener, err := newActivityListener()
+	if err != nil {
+		return err
+	}
+
+	// no keepalive, it would wake the peer up right away
+	err = iface.UpdatePeer(e.config.WgIface, peer.WgPubKey, peer.WgAllowedIps, 0, listener.endpoint(), peer.preSharedKey())
+	if err != nil {
+		listener.close()
+		return err
+	}
+
+	e.idle[peer.WgPubKey] = listener
+	e.peers[peer.WgPubKey] = peer
+
+	log.Debugf("peer %s is idle until there is traffic to it", peer.WgPubKey)
+
+	go func() {
+		if listener.wait() {
+			e.activatePeer(peer.WgPubKey, "outbound traffic")
+		}
+	}()
+
+	return nil
+}
+
+// addLazyPeer makes a new peer idle, known peers are skipped. A peer that can't be made idle is connected right away
+func (e *Engine) addLazyPeer(peer Peer) {
+	e.peerMux.Lock()
+	defer e.peerMux.Unlock()
+
+	if _, ok := e.peers[peer.WgPubKey]; ok {
+		return
+	}
+	if _, ok := e.conns[peer.WgPubKey]; ok {
+		return
+	}
+
+	err := e.watchPeer(peer)
+	if err != nil {
+		log.Warnf("failed making peer %s idle, connecting right away: %v", peer.WgPubKey, err)
+		e.peers[peer.WgPubKey] = peer
+		go e.initializePeer(peer)
+		go e.watchIdleConnection(peer)
+	}
+}
+
+// activatePeer opens the connection to an idle peer, e.g. on outbound traffic or an offer of the remote peer.
+// Peers that aren't idle are skipped
+func (e *Engine) activatePeer(peerKey string, reason string) {
+	e.peerMux.Lock()
+	listener, ok := e.idle[peerKey]
+	if !ok {
+		e.peerMux.Unlock()
+		return
+	}
+	delete(e.idle, peerKey)
+	peer := e.peers[peerKey]
+	e.peerMux.Unlock()
+
+	listener.close()
+	log.Infof("connecting idle peer %s on %s", peerKey, reason)
+
+	go e.initializePeer(peer)
+	go e.watchIdleConnection(peer)
+}
+
+// unwatchPeer stops waiting for traffic to an idle peer and removes it from Wireguard.
+// Must be called with peerMux locked
+func (e *Engine) unwatchPeer(peerKey string) error {
+	listener, ok := e.idle[peerKey]
+	if !ok {
+		return nil
+	}
+	delete(e.idle, peerKey)
+	listener.close()
+	return iface.RemovePeer(e.config.WgIface, peerKey)
+}
+
+// watchIdleConnection closes the connection to a peer opened in lazy mode once its traffic has stayed below
+// lazyIdleMaxBytes per lazyIdleCheckInterval for the lazy idle timeout, and makes the peer idle again.
+// It returns when the peer has been removed
+func (e *Engine) watchIdleConnection(peer Peer) {
+	ticker := time.NewTicker(lazyIdleCheckInterval)
+	defer ticker.Stop()
+
+	var lastBytes int64
+	lastActive := time.Now()
+	for range ticker.C {
+		e.peerMux.Lock()
+		conn, ok := e.conns[peer.WgPubKey]
+		_, known := e.peers[peer.WgPubKey]
+		e.peerMux.Unlock()
+		if !known {
+			return
+		}
+		if !ok || conn == nil || conn.State() != ConnStateConnected {
+			// still connecting
+			lastActive = time.Now()
+			continue
+		}
+
+		wgPeer, err := iface.GetPeer(e.config.WgIface, peer.WgPubKey)
+		if err != nil {
+			continue
+		}
+		bytes := wgPeer.ReceiveBytes + wgPeer.TransmitBytes
+		if bytes-lastBytes > lazyIdleMaxBytes || bytes < lastBytes {
+			lastActive = time.Now()
+		}
+		lastBytes = bytes
+
+		if time.Since(lastActive) < e.lazyIdleTimeout() {
+			continue
+		}
+		if e.deactivatePeer(peer, conn) {
+			return
+		}
+	}
+}
+
+// deactivatePeer closes the idle connection to the peer and waits for traffic to it again.
+// Returns false when the connection has changed in the meantime (e.g. the peer has been removed or restarted)
+func (e *Engine) deactivatePeer(peer Peer, conn *Connection) bool {
+	e.peerMux.Lock()
+	defer e.peerMux.Unlock()
+
+	if e.conns[peer.WgPubKey] != conn {
+		return false
+	}
+	delete(e.conns, peer.WgPubKey)
+
+	log.Infof("closing connection to peer %s idle for %v", peer.WgPubKey, e.lazyIdleTimeout())
+	err := conn.Close()
+	if err != nil {
+		log.Warnf("failed closing idle connection to peer %s: %v", peer.WgPubKey, err)
+	}
+
+	err = e.watchPeer(peer)
+	if err != nil {
+		log.Warnf("failed making peer %s idle, reconnecting: %v", peer.WgPubKey, err)
+		go e.initializePeer(peer)
+		go e.watchIdleConnection(peer)
+	}
+	return true
+}
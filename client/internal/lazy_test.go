@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestActivityListener(t *testing.T) {
+	listener, err := newActivityListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	woken := make(chan bool)
+	go func() {
+		woken <- listener.wait()
+	}()
+
+	// what Wireguard sends to the endpoint of an idle peer
+	conn, err := net.Dial("udp4", listener.endpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("handshake initiation"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ok := <-woken:
+		if !ok {
+			t.Errorf("expecting traffic to wake the listener up")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expecting traffic to wake the listener up")
+	}
+
+	// a closed listener stops waiting without traffic
+	listener.close()
+	if listener.wait() {
+		t.Errorf("expecting closed listener not to report traffic")
+	}
+}
+
+func TestEngine_ListPeersIdle(t *testing.T) {
+	engine := newTestEngine()
+	engine.config.LazyConnections = true
+
+	listener, err := newActivityListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.close()
+	engine.idle["idle"] = listener
+	engine.peers["idle"] = Peer{WgPubKey: "idle"}
+
+	peers := engine.ListPeers()
+	if len(peers) != 1 || !peers[0].Idle || peers[0].Status != StatusDisconnected {
+		t.Fatalf("expecting the idle peer to be listed as idle, got %+v", peers)
+	}
+	if health := engine.Health(); health.Peers != 1 || health.ConnectedPeers != 0 {
+		t.Errorf("expecting the idle peer to count as a disconnected peer, got %+v", health)
+	}
+
+	// known peers aren't made idle again
+	engine.addLazyPeer(Peer{WgPubKey: "idle"})
+	if engine.idle["idle"] != listener {
+		t.Errorf("expecting the idle peer to be kept as is")
+	}
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	log "github.com/sirupsen/logrus"
+	mgmProto "github.com/wiretrustee/wiretrustee/management/proto"
+)
+
+// observeSync replaces the view of the peers with the peers of the Management sync update in the Observer mode.
+// Same as handleSync an update without peers doesn't change the view
+func (e *Engine) observeSync(update *mgmProto.SyncResponse) {
+	remotePeers := update.GetRemotePeers()
+	if len(remotePeers) == 0 {
+		return
+	}
+
+	peers := make(map[string]Peer, len(remotePeers))
+	for _, remotePeer := range remotePeers {
+		peer := toPeer(remotePeer)
+		peers[peer.WgPubKey] = peer
+	}
+
+	e.peerMux.Lock()
+	defer e.peerMux.Unlock()
+
+	e.peers = peers
+	log.Debugf("observing %d peers", len(peers))
+}
+
+// observedPeers returns the state of the peers seen in the Observer mode, none of them has a connection.
+// Must be called with peerMux locked
+func (e *Engine) observedPeers() []PeerState {
+	peers := make([]PeerState, 0, len(e.peers))
+	for key, peer := range e.peers {
+		peers = append(peers, PeerState{
+			WgPubKey: key,
+			Status:   StatusDisconnected,
+			State:    ConnStateNew,
+			Config:   peer,
+		})
+	}
+	return peers
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	mgmProto "github.com/wiretrustee/wiretrustee/management/proto"
+	"testing"
+	"time"
+)
+
+func TestEngine_Observer(t *testing.T) {
+	engine := newTestEngine()
+	engine.config.Observer = true
+	engine.running = true
+
+	sync := &mgmProto.SyncResponse{
+		PeerConfig: &mgmProto.PeerConfig{Address: "100.64.0.1/24"},
+		RemotePeers: []*mgmProto.RemotePeerConfig{
+			{WgPubKey: "peer-a", AllowedIps: []string{"100.64.0.2/32"}, ConnectionTimeout: 30},
+			{WgPubKey: "peer-b", AllowedIps: []string{"100.64.0.3/32"}},
+		},
+	}
+	err := engine.handleSync(sync)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers := engine.ListPeers()
+	if len(peers) != 2 {
+		t.Fatalf("expecting 2 observed peers, got %d", len(peers))
+	}
+	for _, peer := range peers {
+		if peer.Status != StatusDisconnected {
+			t.Errorf("expecting observed peer %s without a connection, got %s", peer.WgPubKey, peer.Status)
+		}
+		if peer.WgPubKey == "peer-a" && (peer.Config.WgAllowedIps != "100.64.0.2/32" || peer.Config.connectionTimeout() != 30*time.Second) {
+			t.Errorf("expecting advertised config of peer-a, got %+v", peer.Config)
+		}
+	}
+	if len(engine.conns) != 0 || len(engine.retrying) != 0 {
+		t.Errorf("expecting no connections to be opened in the observer mode")
+	}
+	if engine.config.WgAddr != "" {
+		t.Errorf("expecting the interface address to be left alone, got %s", engine.config.WgAddr)
+	}
+
+	// a removed peer disappears from the view
+	sync.RemotePeers = sync.RemotePeers[:1]
+	err = engine.handleSync(sync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers = engine.ListPeers()
+	if len(peers) != 1 || peers[0].WgPubKey != "peer-a" {
+		t.Errorf("expecting only peer-a to be observed, got %v", peers)
+	}
+}
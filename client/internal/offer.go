@@ -0,0 +1,110 @@
+package internal
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	// pendingOfferTTL is how long an offer of a remote peer is kept until it is answered. The remote peer waits for an
+	// answer for its connection timeout, an older offer would only fail the connectivity checks
+	pendingOfferTTL = PeerConnectionTimeout
+	// maxPendingOffers caps the offers kept for remote peers that aren't known yet, any peer can send offers via Signal
+	maxPendingOffers = 64
+)
+
+// pendingOffer is an offer of a remote peer received before the connection to the peer has been opened
+type pendingOffer struct {
+	credentials IceCredentials
+	received    time.Time
+}
+
+// expired checks whether the remote peer has probably stopped waiting for the answer to the offer
+func (o pendingOffer) expired(now time.Time) bool {
+	return now.Sub(o.received) >= pendingOfferTTL
+}
+
+// onOfferWithoutConnection handles an offer of a remote peer the Engine has no connection to, e.g. the remote peer
+// initiates while the connection attempt of this peer waits for its turn or before the Management sync authorizing
+// the remote peer has arrived here.
+// A peer authorized by the last sync gets its connection created right away, the connection answers the offer once the
+// retry loop started by the sync opens it. The offer of a peer that isn't known yet is kept for pendingOfferTTL and
+// handed over to the connection created after a sync has authorized the peer
+func (e *Engine) onOfferWithoutConnection(peerKey string, credentials IceCredentials) error {
+	e.peerMux.Lock()
+	peer, ok := e.peers[peerKey]
+	if !ok {
+		e.keepPendingOffer(peerKey, pendingOffer{credentials: credentials, received: time.Now()})
+		e.peerMux.Unlock()
+		return nil
+	}
+
+	conn, ok := e.conns[peerKey]
+	if !ok {
+		log.Debugf("creating connection to peer %s on its offer", peerKey)
+		conn = e.newPeerConnection(e.wgPort, e.config.WgPrivateKey, peer)
+	}
+	e.peerMux.Unlock()
+
+	return conn.OnOffer(credentials)
+}
+
+// keepPendingOffer keeps the offer of a remote peer that isn't known yet, expired offers are dropped.
+// Must be called with peerMux locked
+func (e *Engine) keepPendingOffer(peerKey string, offer pendingOffer) {
+	for key, pending := range e.pendingOffers {
+		if pending.expired(offer.received) {
+			delete(e.pendingOffers, key)
+		}
+	}
+
+	if _, ok := e.pendingOffers[peerKey]; !ok && len(e.pendingOffers) >= maxPendingOffers {
+		log.Debugf("dropping offer of unknown peer %s, %d offers are waiting for a sync already", peerKey, len(e.pendingOffers))
+		return
+	}
+
+	log.Debugf("keeping offer of unknown peer %s until a sync authorizes it", peerKey)
+	e.pendingOffers[peerKey] = offer
+}
+
+// takePendingOffer removes the offer kept for the peer and returns it unless it has expired.
+// Must be called with peerMux locked
+func (e *Engine) takePendingOffer(peerKey string) (pendingOffer, bool) {
+	offer, ok := e.pendingOffers[peerKey]
+	if !ok {
+		return pendingOffer{}, false
+	}
+	delete(e.pendingOffers, peerKey)
+	if offer.expired(time.Now()) {
+		return pendingOffer{}, false
+	}
+	return offer, true
+}
+
+// holdOffer keeps an offer received before the connection has been opened, Open answers it unless it has expired.
+// A later offer replaces an earlier one, the remote peer has restarted its attempt.
+// Returns false when the connection has been opened already
+func (conn *Connection) holdOffer(offer pendingOffer) bool {
+	conn.stateMux.Lock()
+	defer conn.stateMux.Unlock()
+
+	if conn.state != ConnStateNew {
+		return false
+	}
+	conn.pendingOffer = &offer
+	conn.history.add("offer received before opening")
+	return true
+}
+
+// takeHeldOffer returns the offer held by holdOffer, nil when there is none or it has expired
+func (conn *Connection) takeHeldOffer() *pendingOffer {
+	conn.stateMux.Lock()
+	defer conn.stateMux.Unlock()
+
+	offer := conn.pendingOffer
+	conn.pendingOffer = nil
+	if offer == nil || offer.expired(time.Now()) {
+		return nil
+	}
+	return offer
+}
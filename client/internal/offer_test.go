@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"fmt"
+	mgmProto "github.com/wiretrustee/wiretrustee/management/proto"
+	sProto "github.com/wiretrustee/wiretrustee/signal/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"testing"
+	"time"
+)
+
+func TestEngine_OfferBeforeSync(t *testing.T) {
+	engine := newTestEngine()
+	engine.running = true
+	// occupy the only slot so that the connection attempts wait instead of negotiating over Signal
+	engine.connects = newConnectQueue(1)
+	release := engine.connects.acquire(0)
+
+	remoteKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey := remoteKey.PublicKey().String()
+
+	// the remote peer has received its sync first and initiates
+	err = engine.handleSignalMessage(offerMessage(peerKey, "ufrag", "pwd"))
+	if err != nil {
+		t.Fatalf("expecting offer of a peer not known yet to be kept, got %v", err)
+	}
+	engine.peerMux.Lock()
+	_, connected := engine.conns[peerKey]
+	_, pending := engine.pendingOffers[peerKey]
+	engine.peerMux.Unlock()
+	if connected {
+		t.Fatalf("expecting no connection to a peer not authorized by a sync")
+	}
+	if !pending {
+		t.Fatalf("expecting offer of a peer not known yet to be kept")
+	}
+
+	err = engine.handleSync(&mgmProto.SyncResponse{
+		RemotePeers: []*mgmProto.RemotePeerConfig{{WgPubKey: peerKey, AllowedIps: []string{"100.64.0.2/32"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitQueued(t, engine.connects, 1)
+
+	// the connection has been created on the sync and holds the offer until it gets opened
+	engine.peerMux.Lock()
+	conn := engine.conns[peerKey]
+	_, pending = engine.pendingOffers[peerKey]
+	engine.peerMux.Unlock()
+	if conn == nil {
+		t.Fatalf("expecting connection to be created for the offer of the authorized peer")
+	}
+	if pending {
+		t.Errorf("expecting offer to be handed over to the connection")
+	}
+	if state := conn.State(); state != ConnStateNew {
+		t.Errorf("expecting connection waiting for its turn to be %s, got %s", ConnStateNew, state)
+	}
+	offer := conn.takeHeldOffer()
+	if offer == nil || offer.credentials != (IceCredentials{uFrag: "ufrag", pwd: "pwd"}) {
+		t.Errorf("expecting connection to hold the offer of the remote peer, got %v", offer)
+	}
+
+	removeTestPeer(t, engine, peerKey, release)
+}
+
+func TestEngine_OfferOfPeerWithoutConnection(t *testing.T) {
+	engine := newTestEngine()
+	engine.running = true
+	engine.connects = newConnectQueue(1)
+	release := engine.connects.acquire(0)
+
+	remoteKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey := remoteKey.PublicKey().String()
+
+	err = engine.handleSync(&mgmProto.SyncResponse{
+		RemotePeers: []*mgmProto.RemotePeerConfig{{WgPubKey: peerKey, AllowedIps: []string{"100.64.0.2/32"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitQueued(t, engine.connects, 1)
+
+	// the authorized peer waits for its turn, it has no connection yet
+	err = engine.handleSignalMessage(&sProto.Message{Key: peerKey, Body: &sProto.Body{Type: sProto.Body_CANDIDATE}})
+	if err == nil {
+		t.Errorf("expecting a candidate of a peer without connection to be rejected")
+	}
+
+	for _, uFrag := range []string{"first", "second"} {
+		err = engine.handleSignalMessage(offerMessage(peerKey, uFrag, "pwd"))
+		if err != nil {
+			t.Fatalf("expecting offer of an authorized peer to be accepted, got %v", err)
+		}
+	}
+
+	engine.peerMux.Lock()
+	conn := engine.conns[peerKey]
+	engine.peerMux.Unlock()
+	if conn == nil {
+		t.Fatalf("expecting connection to be created on the offer of the authorized peer")
+	}
+	// the latest attempt of the remote peer is answered
+	offer := conn.takeHeldOffer()
+	if offer == nil || offer.credentials.uFrag != "second" {
+		t.Errorf("expecting connection to hold the latest offer, got %v", offer)
+	}
+
+	removeTestPeer(t, engine, peerKey, release)
+
+	// the offers don't bring the removed peer back
+	engine.peerMux.Lock()
+	_, known := engine.peers[peerKey]
+	_, connected := engine.conns[peerKey]
+	engine.peerMux.Unlock()
+	if known || connected {
+		t.Errorf("expecting removed peer %s to stay removed", peerKey)
+	}
+}
+
+func TestEngine_PendingOffers(t *testing.T) {
+	engine := newTestEngine()
+	now := time.Now()
+
+	engine.keepPendingOffer("expired", pendingOffer{received: now.Add(-pendingOfferTTL)})
+	_, ok := engine.takePendingOffer("expired")
+	if ok {
+		t.Errorf("expecting an expired offer not to be handed over")
+	}
+
+	for i := 0; i < maxPendingOffers+10; i++ {
+		engine.keepPendingOffer(fmt.Sprintf("peer%d", i), pendingOffer{received: now})
+	}
+	if len(engine.pendingOffers) != maxPendingOffers {
+		t.Errorf("expecting at most %d offers to be kept, got %d", maxPendingOffers, len(engine.pendingOffers))
+	}
+
+	// expired offers make room for new ones
+	engine.pendingOffers["peer0"] = pendingOffer{received: now.Add(-pendingOfferTTL)}
+	engine.keepPendingOffer("latest", pendingOffer{received: now})
+	if _, ok := engine.takePendingOffer("latest"); !ok {
+		t.Errorf("expecting an offer to replace an expired one")
+	}
+}
+
+// offerMessage builds an offer of the remote peer as received from Signal
+func offerMessage(peerKey string, uFrag string, pwd string) *sProto.Message {
+	return &sProto.Message{
+		Key:  peerKey,
+		Body: &sProto.Body{Type: sProto.Body_OFFER, Payload: fmt.Sprintf("%s:%s", uFrag, pwd)},
+	}
+}
+
+// removeTestPeer removes the peer and waits for its connection retry loop to end once its turn has come
+func removeTestPeer(t *testing.T, engine *Engine, peerKey string, release func()) {
+	// removing the Wireguard peer of the closed connection fails without an interface, the peer is removed anyway
+	_ = engine.removePeerConnections([]string{peerKey})
+	release()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		engine.peerMux.Lock()
+		_, retrying := engine.retrying[peerKey]
+		engine.peerMux.Unlock()
+		if !retrying {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the retry loop of peer %s to end", peerKey)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
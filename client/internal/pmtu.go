@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/wiretrustee/wiretrustee/iface"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MTUDiscovery defines what the Engine does with the path MTU discovered to the remote peers
+type MTUDiscovery string
+
+const (
+	// MTUDiscoveryOff the path MTU isn't probed
+	MTUDiscoveryOff MTUDiscovery = "off"
+	// MTUDiscoveryLog the path MTU is probed and a lower MTU is recommended in the log when needed
+	MTUDiscoveryLog MTUDiscovery = "log"
+	// MTUDiscoveryAdjust the path MTU is probed and the interface MTU is lowered when needed
+	MTUDiscoveryAdjust MTUDiscovery = "adjust"
+)
+
+const (
+	// icmpHeaderLen is the length of the ICMP echo header
+	icmpHeaderLen = 8
+	// icmpProtocol is the IANA protocol number of ICMP for IPv4
+	icmpProtocol = 1
+)
+
+var (
+	// MTUProbeTimeout is how long a MTU probe waits for the remote peer to reply
+	MTUProbeTimeout = time.Second
+	// MTUProbeAttempts is how many times a MTU is probed before it is considered not to get through, single packets may get lost
+	MTUProbeAttempts = 3
+
+	// pingID makes the echo identifiers of concurrent probes (one per peer) unique
+	pingID = uint32(os.Getpid())
+)
+
+// ParseMTUDiscovery converts a MTU discovery mode name (e.g. from a command line flag) to MTUDiscovery.
+// An empty name is MTUDiscoveryOff
+func ParseMTUDiscovery(mode string) (MTUDiscovery, error) {
+	switch MTUDiscovery(strings.ToLower(mode)) {
+	case "", MTUDiscoveryOff:
+		return MTUDiscoveryOff, nil
+	case MTUDiscoveryLog:
+		return MTUDiscoveryLog, nil
+	case MTUDiscoveryAdjust:
+		return MTUDiscoveryAdjust, nil
+	default:
+		return "", fmt.Errorf("invalid MTU discovery mode %s, supported modes [%s|%s|%s]", mode,
+			MTUDiscoveryOff, MTUDiscoveryLog, MTUDiscoveryAdjust)
+	}
+}
+
+// enabled checks whether the path MTU gets probed
+func (m MTUDiscovery) enabled() bool {
+	return m == MTUDiscoveryLog || m == MTUDiscoveryAdjust
+}
+
+// discoverMTU finds the largest MTU between iface.MinMTU and maxMTU the probe gets through with a binary search.
+// Returns false when not even iface.MinMTU gets through (e.g. the remote peer doesn't answer probes)
+func discoverMTU(maxMTU int, probe func(mtu int) bool) (int, bool) {
+	if !probe(iface.MinMTU) {
+		return 0, false
+	}
+	if maxMTU <= iface.MinMTU || probe(maxMTU) {
+		return maxMTU, true
+	}
+
+	// works <= MTU < fails
+	works, fails := iface.MinMTU, maxMTU
+	for fails-works > 1 {
+		mtu := works + (fails-works)/2
+		if probe(mtu) {
+			works = mtu
+		} else {
+			fails = mtu
+		}
+	}
+	return works, true
+}
+
+// pingProbe probes the MTU to a remote peer with ICMP echo requests of the size of the probed MTU sent through the tunnel
+type pingProbe struct {
+	conn     *icmp.PacketConn
+	remoteIP net.IP
+	// privileged is true for raw ICMP sockets, unprivileged sockets get the echo identifier assigned by the kernel
+	privileged bool
+	id         int
+	seq        int
+}
+
+// newPingProbe opens a raw ICMP socket falling back to an unprivileged one (e.g. macOS or Linux with net.ipv4.ping_group_range)
+func newPingProbe(remoteIP net.IP) (*pingProbe, error) {
+	probe := &pingProbe{
+		remoteIP:   remoteIP,
+		privileged: true,
+		id:         int(atomic.AddUint32(&pingID, 1) & 0xffff),
+	}
+
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		conn, err = icmp.ListenPacket("udp4", "0.0.0.0")
+		if err != nil {
+			return nil, err
+		}
+		probe.privileged = false
+	}
+	probe.conn = conn
+
+	return probe, nil
+}
+
+// probe checks whether an IP packet of the size of the MTU reaches the remote peer and gets answered
+func (p *pingProbe) probe(mtu int) bool {
+	payload := make([]byte, mtu-ipv4.HeaderLen-icmpHeaderLen)
+
+	var dst net.Addr = &net.IPAddr{IP: p.remoteIP}
+	if !p.privileged {
+		dst = &net.UDPAddr{IP: p.remoteIP}
+	}
+
+	for attempt := 0; attempt < MTUProbeAttempts; attempt++ {
+		p.seq = (p.seq + 1) & 0xffff
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: p.id, Seq: p.seq, Data: payload},
+		}
+		packet, err := msg.Marshal(nil)
+		if err != nil {
+			return false
+		}
+
+		_, err = p.conn.WriteTo(packet, dst)
+		if err != nil {
+			// e.g. the packet is larger than the MTU of the interface
+			log.Debugf("failed sending MTU probe of %d bytes to %s: %v", mtu, p.remoteIP, err)
+			return false
+		}
+
+		if p.waitReply(p.seq, mtu) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// waitReply waits MTUProbeTimeout for the echo reply of the remote peer to the request with the sequence number
+func (p *pingProbe) waitReply(seq int, mtu int) bool {
+	buf := make([]byte, mtu+ipv4.HeaderLen)
+	err := p.conn.SetReadDeadline(time.Now().Add(MTUProbeTimeout))
+	if err != nil {
+		return false
+	}
+
+	for {
+		n, from, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return false
+		}
+
+		msg, err := icmp.ParseMessage(icmpProtocol, buf[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || (p.privileged && echo.ID != p.id) {
+			continue
+		}
+		if !addrIP(from).Equal(p.remoteIP) {
+			continue
+		}
+		return true
+	}
+}
+
+// Close closes the socket of the probe
+func (p *pingProbe) Close() error {
+	return p.conn.Close()
+}
+
+// addrIP returns the IP of an address ICMP sockets receive from
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
+
+// peerTunnelIP returns the first IP of the allowed IPs of a peer (e.g. 100.64.0.2/32,...) its address in the tunnel
+func peerTunnelIP(allowedIps string) (net.IP, error) {
+	first := strings.TrimSpace(strings.Split(allowedIps, ",")[0])
+	ip, _, err := net.ParseCIDR(first)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing allowed IPs %s: %v", allowedIps, err)
+	}
+	return ip, nil
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"github.com/wiretrustee/wiretrustee/iface"
+	"net"
+	"testing"
+)
+
+func TestDiscoverMTU(t *testing.T) {
+	type testCase struct {
+		name      string
+		maxMTU    int
+		pathMTU   int
+		expected  int
+		reachable bool
+		maxProbes int
+	}
+
+	testCases := []testCase{
+		{
+			name:      "path supports interface MTU",
+			maxMTU:    1420,
+			pathMTU:   1500,
+			expected:  1420,
+			reachable: true,
+			maxProbes: 2,
+		},
+		{
+			name:      "path below interface MTU",
+			maxMTU:    1420,
+			pathMTU:   1350,
+			expected:  1350,
+			reachable: true,
+			maxProbes: 12,
+		},
+		{
+			name:      "path at the floor",
+			maxMTU:    1420,
+			pathMTU:   iface.MinMTU,
+			expected:  iface.MinMTU,
+			reachable: true,
+			maxProbes: 12,
+		},
+		{
+			name:      "peer doesn't answer",
+			maxMTU:    1420,
+			pathMTU:   0,
+			reachable: false,
+			maxProbes: 1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			probes := 0
+			mtu, reachable := discoverMTU(testCase.maxMTU, func(mtu int) bool {
+				probes++
+				if mtu < iface.MinMTU || mtu > testCase.maxMTU {
+					t.Errorf("expecting probed MTU within [%d, %d], got %d", iface.MinMTU, testCase.maxMTU, mtu)
+				}
+				return mtu <= testCase.pathMTU
+			})
+
+			if reachable != testCase.reachable {
+				t.Fatalf("expecting reachable %t, got %t", testCase.reachable, reachable)
+			}
+			if mtu != testCase.expected {
+				t.Errorf("expecting MTU %d, got %d", testCase.expected, mtu)
+			}
+			if probes > testCase.maxProbes {
+				t.Errorf("expecting at most %d probes, got %d", testCase.maxProbes, probes)
+			}
+		})
+	}
+}
+
+func TestParseMTUDiscovery(t *testing.T) {
+	for input, expected := range map[string]MTUDiscovery{
+		"":       MTUDiscoveryOff,
+		"off":    MTUDiscoveryOff,
+		"log":    MTUDiscoveryLog,
+		"adjust": MTUDiscoveryAdjust,
+	} {
+		mode, err := ParseMTUDiscovery(input)
+		if err != nil {
+			t.Errorf("expecting mode %q to be parsed, got error %v", input, err)
+		}
+		if mode != expected {
+			t.Errorf("expecting mode %q to be parsed as %s, got %s", input, expected, mode)
+		}
+	}
+
+	_, err := ParseMTUDiscovery("auto")
+	if err == nil {
+		t.Errorf("expecting invalid MTU discovery mode to fail")
+	}
+}
+
+func TestPeerTunnelIP(t *testing.T) {
+	ip, err := peerTunnelIP("100.64.0.2/32,10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.ParseIP("100.64.0.2")) {
+		t.Errorf("expecting tunnel IP 100.64.0.2, got %s", ip)
+	}
+
+	_, err = peerTunnelIP("")
+	if err == nil {
+		t.Errorf("expecting empty allowed IPs to fail")
+	}
+}
+
+func TestPingProbe_Loopback(t *testing.T) {
+	probe, err := newPingProbe(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Skipf("ICMP sockets are not permitted: %v", err)
+	}
+	defer probe.Close() //nolint
+
+	mtu, reachable := discoverMTU(1500, probe.probe)
+	if !reachable || mtu != 1500 {
+		t.Errorf("expecting loopback to support MTU 1500, got %d (reachable %t)", mtu, reachable)
+	}
+}
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/wiretrustee/wiretrustee/iface"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultProfile is the profile of the top level settings of the config file.
+// A config file without profiles (e.g. written before profiles existed) holds the default profile only
+const DefaultProfile = "default"
+
+// profileNamePattern restricts profile names to the characters safe in the file names derived from them
+var profileNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ValidateProfileName checks that a profile name can be used, an empty name is DefaultProfile
+func ValidateProfileName(profile string) error {
+	_, err := profileName(profile)
+	return err
+}
+
+// profileName validates a profile name and resolves an empty one to DefaultProfile
+func profileName(profile string) (string, error) {
+	if profile == "" {
+		return DefaultProfile, nil
+	}
+	if !profileNamePattern.MatchString(profile) {
+		return "", fmt.Errorf("invalid profile name %s, only letters, digits, - and _ are allowed", profile)
+	}
+	return profile, nil
+}
+
+// ProfilePath derives the path of a file of the profile (e.g. the control socket) from the path of the default
+// profile's one: /var/run/wiretrustee.sock becomes /var/run/wiretrustee-work.sock for the profile work
+func ProfilePath(path string, profile string) string {
+	if profile == "" || profile == DefaultProfile {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + profile + ext
+}
+
+// profile returns the settings of the profile in the config file, nil when the file has no such profile.
+// The default profile exists once it has a key
+func (c *Config) profile(name string) *Config {
+	if name == DefaultProfile {
+		if c.PrivateKey == "" {
+			return nil
+		}
+		return c
+	}
+	return c.Profiles[name]
+}
+
+// setProfile stores the settings of the profile in the config file, the other profiles are kept
+func (c *Config) setProfile(name string, profile *Config) {
+	if name == DefaultProfile {
+		profiles := c.Profiles
+		*c = *profile
+		c.Profiles = profiles
+		return
+	}
+	if c.Profiles == nil {
+		c.Profiles = map[string]*Config{}
+	}
+	c.Profiles[name] = profile
+}
+
+// interfaces returns the Wireguard interfaces of the profiles of the config file by profile name
+func (c *Config) interfaces() map[string]string {
+	interfaces := map[string]string{}
+	if c.PrivateKey != "" {
+		interfaces[DefaultProfile] = c.WgIface
+	}
+	for name, profile := range c.Profiles {
+		if profile != nil && name != DefaultProfile {
+			interfaces[name] = profile.WgIface
+		}
+	}
+	return interfaces
+}
+
+// listenPorts returns the Wireguard listen ports of the profiles of the config file by profile name
+func (c *Config) listenPorts() map[string]int {
+	ports := map[string]int{}
+	if c.PrivateKey != "" {
+		ports[DefaultProfile] = listenPort(c.WgPort)
+	}
+	for name, profile := range c.Profiles {
+		if profile != nil && name != DefaultProfile {
+			ports[name] = listenPort(profile.WgPort)
+		}
+	}
+	return ports
+}
+
+// isolatedProfile returns a copy of the settings of the profile without the other profiles, nil when the file has no
+// such profile. The interfaces of the other profiles are added to the blacklist so that profiles running side by side
+// don't gather connection candidates on each other's tunnels
+func (c *Config) isolatedProfile(name string) *Config {
+	profile := c.profile(name)
+	if profile == nil {
+		return nil
+	}
+
+	isolated := *profile
+	isolated.Profiles = nil
+	isolated.IFaceBlackList = append([]string{}, profile.IFaceBlackList...)
+	for other, wgIface := range c.interfaces() {
+		if other == name || wgIface == "" || wgIface == profile.WgIface || contains(isolated.IFaceBlackList, wgIface) {
+			continue
+		}
+		isolated.IFaceBlackList = append(isolated.IFaceBlackList, wgIface)
+	}
+	return &isolated
+}
+
+// nextInterfaceName returns the first interface name from iface.WgInterfaceDefault on (e.g. wt0, wt1, ...) that isn't
+// used by any of the profiles
+func nextInterfaceName(interfaces map[string]string) string {
+	used := map[string]struct{}{}
+	for _, wgIface := range interfaces {
+		used[wgIface] = struct{}{}
+	}
+
+	prefix := strings.TrimRight(iface.WgInterfaceDefault, "0123456789")
+	index, err := strconv.Atoi(strings.TrimPrefix(iface.WgInterfaceDefault, prefix))
+	if err != nil {
+		index = 0
+	}
+	for {
+		name := prefix + strconv.Itoa(index)
+		if _, ok := used[name]; !ok {
+			return name
+		}
+		index++
+	}
+}
+
+// nextListenPort returns the first port from iface.WgPort on that isn't used by any of the profiles
+func nextListenPort(ports map[string]int) int {
+	used := map[int]struct{}{}
+	for _, port := range ports {
+		used[port] = struct{}{}
+	}
+
+	port := iface.WgPort
+	for {
+		if _, ok := used[port]; !ok {
+			return port
+		}
+		port++
+	}
+}
+
+// listenPort resolves the listen port of a profile, 0 is iface.WgPort
+func listenPort(port int) int {
+	if port == 0 {
+		return iface.WgPort
+	}
+	return port
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"github.com/wiretrustee/wiretrustee/iface"
+	"github.com/wiretrustee/wiretrustee/util"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetConfig_Profiles(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+
+	home, err := GetConfig("https://home.example.com", configPath, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if home.WgIface != iface.WgInterfaceDefault {
+		t.Errorf("expecting default profile to use interface %s, got %s", iface.WgInterfaceDefault, home.WgIface)
+	}
+
+	work, err := GetConfig("https://work.example.com", configPath, "work", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if work.PrivateKey == home.PrivateKey {
+		t.Errorf("expecting profiles to have keys of their own")
+	}
+	if work.WgIface == home.WgIface {
+		t.Errorf("expecting profiles to have interfaces of their own, both use %s", work.WgIface)
+	}
+	if home.WgPort != iface.WgPort || work.WgPort == home.WgPort {
+		t.Errorf("expecting profiles to listen on ports of their own starting from %d, got %d and %d", iface.WgPort, home.WgPort, work.WgPort)
+	}
+	if work.ManagementURL.String() != "https://work.example.com:443" {
+		t.Errorf("expecting work profile to use its own Management Service, got %s", work.ManagementURL)
+	}
+
+	// a new profile keeps the other ones as they are
+	readHome, err := ReadConfig("", configPath, DefaultProfile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readHome.PrivateKey != home.PrivateKey || readHome.ManagementURL.String() != home.ManagementURL.String() {
+		t.Errorf("expecting default profile to be kept when adding a profile")
+	}
+
+	// profiles don't gather candidates on each other's interfaces
+	if !contains(readHome.IFaceBlackList, work.WgIface) {
+		t.Errorf("expecting default profile to blacklist interface %s of the work profile, got %v", work.WgIface, readHome.IFaceBlackList)
+	}
+	readWork, err := ReadConfig("", configPath, "work", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(readWork.IFaceBlackList, home.WgIface) {
+		t.Errorf("expecting work profile to blacklist interface %s of the default profile, got %v", home.WgIface, readWork.IFaceBlackList)
+	}
+	if readWork.Profiles != nil {
+		t.Errorf("expecting the config of a profile not to expose the other profiles")
+	}
+
+	// rotating the key of a profile leaves the other ones alone
+	err = RotateConfigKey(configPath, "work", func(newPubKey wgtypes.Key) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedWork, err := ReadConfig("", configPath, "work", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readHome, err = ReadConfig("", configPath, DefaultProfile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotatedWork.PrivateKey == work.PrivateKey {
+		t.Errorf("expecting the key of the work profile to be rotated")
+	}
+	if readHome.PrivateKey != home.PrivateKey {
+		t.Errorf("expecting the key of the default profile to be kept when rotating the work profile")
+	}
+
+	_, err = ReadConfig("", configPath, "missing", "")
+	if err == nil {
+		t.Errorf("expecting a missing profile to be rejected")
+	}
+	_, err = GetConfig("", configPath, "../etc", "")
+	if err == nil {
+		t.Errorf("expecting an invalid profile name to be rejected")
+	}
+}
+
+func TestReadConfig_WithoutProfiles(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	config := &Config{
+		PrivateKey:     generateKey(),
+		ManagementURL:  ManagementURLDefault(),
+		WgIface:        iface.WgInterfaceDefault,
+		IFaceBlackList: []string{iface.WgInterfaceDefault, "tun0"},
+	}
+	err := util.WriteJson(configPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, profile := range []string{"", DefaultProfile} {
+		read, err := ReadConfig("", configPath, profile, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read.PrivateKey != config.PrivateKey || read.WgIface != config.WgIface {
+			t.Errorf("expecting a config without profiles to be the default profile")
+		}
+	}
+
+	_, err = ReadConfig("", configPath, "work", "")
+	if err == nil {
+		t.Errorf("expecting a config without profiles to have no work profile")
+	}
+}
+
+func TestProfilePath(t *testing.T) {
+	type testCase struct {
+		path     string
+		profile  string
+		expected string
+	}
+
+	testCases := []testCase{
+		{path: "/var/run/wiretrustee.sock", profile: DefaultProfile, expected: "/var/run/wiretrustee.sock"},
+		{path: "/var/run/wiretrustee.sock", profile: "", expected: "/var/run/wiretrustee.sock"},
+		{path: "/var/run/wiretrustee.sock", profile: "work", expected: "/var/run/wiretrustee-work.sock"},
+		{path: "/etc/wiretrustee/config-state.json", profile: "work", expected: "/etc/wiretrustee/config-state-work.json"},
+	}
+
+	for _, testCase := range testCases {
+		path := ProfilePath(testCase.path, testCase.profile)
+		if path != testCase.expected {
+			t.Errorf("expecting path %s of profile %q, got %s", testCase.expected, testCase.profile, path)
+		}
+	}
+}
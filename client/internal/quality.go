@@ -0,0 +1,193 @@
+package internal
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/wiretrustee/wiretrustee/iface"
+	"time"
+)
+
+// QualityCheckInterval is how often the quality of a connected connection is recomputed
+const QualityCheckInterval = 30 * time.Second
+
+// The quality score of a connection starts at 100 and loses points for each of the measurements below, it never goes
+// below 0. A connection that isn't connected (or hasn't been measured yet) scores 0.
+const (
+	// qualityRTTThreshold is the round trip time below which no points are lost
+	qualityRTTThreshold = 20 * time.Millisecond
+	// qualityRTTStep loses one point per step the round trip time is above qualityRTTThreshold
+	qualityRTTStep = 10 * time.Millisecond
+	// qualityMaxRTTPenalty caps the points lost for the round trip time (reached at 420ms)
+	qualityMaxRTTPenalty = 40
+	// qualityUnknownRTTPenalty is lost when the ICE agent hasn't reported a round trip time
+	qualityUnknownRTTPenalty = 20
+	// qualityRelayedPenalty is lost when the traffic is relayed through a TURN server
+	qualityRelayedPenalty = 10
+	// qualityMaxLossPenalty caps the points lost for packet loss, one point per percent lost (reached at 30%)
+	qualityMaxLossPenalty = 30
+	// qualityHandshakeMaxAge is the age of the latest Wireguard handshake above which the tunnel is considered stale.
+	// Wireguard renews the handshake of an active tunnel every 2 minutes
+	qualityHandshakeMaxAge = 3 * time.Minute
+	// qualityStaleHandshakePenalty is lost when the latest Wireguard handshake is older than qualityHandshakeMaxAge
+	qualityStaleHandshakePenalty = 20
+)
+
+// QualityScore is the quality of a connection summed up in Score together with the measurements it has been computed from
+type QualityScore struct {
+	// Score is between 0 (not connected or unusable) and 100 (direct with a low round trip time and no loss)
+	Score int
+	// RTT is the round trip time of the ICE connectivity checks of the selected candidate pair, -1 when unknown
+	RTT time.Duration
+	// Relayed is true when the traffic is relayed through a TURN server
+	Relayed bool
+	// PacketLoss is the fraction (0-1) of the ICE connectivity checks left unanswered since the previous measurement,
+	// -1 when unknown
+	PacketLoss float64
+	// HandshakeAge is the time since the latest Wireguard handshake (or since the connection has been established
+	// when there has been none yet), -1 when unknown
+	HandshakeAge time.Duration
+	// Measured is when the score has been computed, zero when it hasn't been yet
+	Measured time.Time
+}
+
+// newQualityScore computes the Score of the measurements:
+//
+//	100
+//	- min(40, (RTT - 20ms) / 10ms) or 20 when the RTT is unknown
+//	- 10 when relayed
+//	- min(30, PacketLoss in percent) or 0 when the loss is unknown
+//	- 20 when the latest handshake is older than 3 minutes or 0 when its age is unknown
+//
+// and clamps it to 0-100
+func newQualityScore(rtt time.Duration, relayed bool, packetLoss float64, handshakeAge time.Duration, measured time.Time) QualityScore {
+	score := 100
+
+	switch {
+	case rtt < 0:
+		score -= qualityUnknownRTTPenalty
+	case rtt > qualityRTTThreshold:
+		score -= minInt(qualityMaxRTTPenalty, int((rtt-qualityRTTThreshold)/qualityRTTStep))
+	}
+
+	if relayed {
+		score -= qualityRelayedPenalty
+	}
+
+	if packetLoss > 0 {
+		score -= minInt(qualityMaxLossPenalty, int(packetLoss*100))
+	}
+
+	if handshakeAge > qualityHandshakeMaxAge {
+		score -= qualityStaleHandshakePenalty
+	}
+
+	if score < 0 {
+		score = 0
+	}
+
+	return QualityScore{
+		Score:        score,
+		RTT:          rtt,
+		Relayed:      relayed,
+		PacketLoss:   packetLoss,
+		HandshakeAge: handshakeAge,
+		Measured:     measured,
+	}
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// checkStats is the number of ICE connectivity checks of the selected candidate pair sent and answered so far
+type checkStats struct {
+	requests  uint64
+	responses uint64
+}
+
+// packetLoss returns the fraction of the connectivity checks sent since the previous stats left unanswered,
+// -1 when no check has been sent since
+func (s checkStats) packetLoss(previous checkStats) float64 {
+	if s.requests <= previous.requests || s.responses < previous.responses {
+		return -1
+	}
+	requests := s.requests - previous.requests
+	responses := s.responses - previous.responses
+	if responses >= requests {
+		return 0
+	}
+	return 1 - float64(responses)/float64(requests)
+}
+
+// Quality returns the latest quality score of the connection, a zero Score until it has been connected and measured
+func (conn *Connection) Quality() QualityScore {
+	conn.stateMux.Lock()
+	defer conn.stateMux.Unlock()
+	return conn.quality
+}
+
+// monitorQuality recomputes the quality score of the connected connection every QualityCheckInterval until it is closed
+func (conn *Connection) monitorQuality(relayed bool) {
+	connected := time.Now()
+	ticker := time.NewTicker(QualityCheckInterval)
+	defer ticker.Stop()
+
+	var previous checkStats
+	for {
+		rtt, stats := conn.selectedPairStats()
+		quality := newQualityScore(rtt, relayed, stats.packetLoss(previous), conn.handshakeAge(connected), time.Now())
+		previous = stats
+
+		conn.stateMux.Lock()
+		conn.quality = quality
+		conn.stateMux.Unlock()
+		log.Debugf("quality of connection to peer %s is %d (RTT %v, relayed %t, loss %.2f, handshake age %v)",
+			conn.Config.RemoteWgKey.String(), quality.Score, quality.RTT, quality.Relayed, quality.PacketLoss, quality.HandshakeAge)
+
+		select {
+		case <-ticker.C:
+		case <-conn.closeCond.C:
+			conn.stateMux.Lock()
+			conn.quality = QualityScore{}
+			conn.stateMux.Unlock()
+			return
+		}
+	}
+}
+
+// selectedPairStats returns the round trip time (-1 when the agent doesn't report it) and the connectivity check counts
+// of the selected ICE candidate pair
+func (conn *Connection) selectedPairStats() (time.Duration, checkStats) {
+	pair, err := conn.agent.GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return -1, checkStats{}
+	}
+
+	for _, stats := range conn.agent.GetCandidatePairsStats() {
+		if stats.LocalCandidateID != pair.Local.ID() || stats.RemoteCandidateID != pair.Remote.ID() {
+			continue
+		}
+		rtt := time.Duration(-1)
+		if stats.CurrentRoundTripTime > 0 {
+			rtt = time.Duration(stats.CurrentRoundTripTime * float64(time.Second))
+		}
+		return rtt, checkStats{requests: stats.RequestsSent, responses: stats.ResponsesReceived}
+	}
+	return -1, checkStats{}
+}
+
+// handshakeAge returns the time since the latest Wireguard handshake with the remote peer or since connected when
+// there has been none after it, -1 when the Wireguard peer can't be read
+func (conn *Connection) handshakeAge(connected time.Time) time.Duration {
+	wgPeer, err := iface.GetPeer(conn.Config.WgIface, conn.Config.RemoteWgKey.String())
+	if err != nil {
+		return -1
+	}
+	latest := wgPeer.LastHandshakeTime
+	if latest.Before(connected) {
+		latest = connected
+	}
+	return time.Since(latest)
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewQualityScore(t *testing.T) {
+	type testCase struct {
+		name         string
+		rtt          time.Duration
+		relayed      bool
+		packetLoss   float64
+		handshakeAge time.Duration
+		expected     int
+	}
+
+	testCases := []testCase{
+		{
+			name:         "direct with a low RTT",
+			rtt:          15 * time.Millisecond,
+			packetLoss:   0,
+			handshakeAge: time.Minute,
+			expected:     100,
+		},
+		{
+			name:         "RTT above the threshold",
+			rtt:          120 * time.Millisecond,
+			packetLoss:   0,
+			handshakeAge: time.Minute,
+			expected:     90,
+		},
+		{
+			name:         "RTT penalty capped",
+			rtt:          2 * time.Second,
+			packetLoss:   -1,
+			handshakeAge: -1,
+			expected:     60,
+		},
+		{
+			name:         "unknown RTT",
+			rtt:          -1,
+			packetLoss:   -1,
+			handshakeAge: -1,
+			expected:     80,
+		},
+		{
+			name:         "relayed",
+			rtt:          20 * time.Millisecond,
+			relayed:      true,
+			packetLoss:   0,
+			handshakeAge: time.Minute,
+			expected:     90,
+		},
+		{
+			name:         "packet loss",
+			rtt:          10 * time.Millisecond,
+			packetLoss:   0.05,
+			handshakeAge: time.Minute,
+			expected:     95,
+		},
+		{
+			name:         "packet loss penalty capped",
+			rtt:          10 * time.Millisecond,
+			packetLoss:   0.8,
+			handshakeAge: time.Minute,
+			expected:     70,
+		},
+		{
+			name:         "stale handshake",
+			rtt:          10 * time.Millisecond,
+			packetLoss:   0,
+			handshakeAge: 5 * time.Minute,
+			expected:     80,
+		},
+		{
+			name:         "everything bad",
+			rtt:          time.Second,
+			relayed:      true,
+			packetLoss:   1,
+			handshakeAge: time.Hour,
+			expected:     0,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			quality := newQualityScore(testCase.rtt, testCase.relayed, testCase.packetLoss, testCase.handshakeAge, time.Now())
+			if quality.Score != testCase.expected {
+				t.Errorf("expecting score %d, got %d", testCase.expected, quality.Score)
+			}
+		})
+	}
+}
+
+func TestCheckStats_PacketLoss(t *testing.T) {
+	previous := checkStats{requests: 10, responses: 10}
+
+	if loss := (checkStats{requests: 20, responses: 15}).packetLoss(previous); loss != 0.5 {
+		t.Errorf("expecting loss 0.5, got %v", loss)
+	}
+	if loss := (checkStats{requests: 20, responses: 20}).packetLoss(previous); loss != 0 {
+		t.Errorf("expecting no loss, got %v", loss)
+	}
+	if loss := previous.packetLoss(previous); loss != -1 {
+		t.Errorf("expecting unknown loss without new checks, got %v", loss)
+	}
+}
+
+func TestConnection_Quality(t *testing.T) {
+	conn := NewConnection(ConnConfig{}, nil, nil, nil)
+	if quality := conn.Quality(); !quality.Measured.IsZero() || quality.Score != 0 {
+		t.Errorf("expecting no quality score before connected, got %+v", quality)
+	}
+}
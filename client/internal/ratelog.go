@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// DefaultLogSuppressWindow is how long the repeats of a message logged on a retry path are suppressed by default
+const DefaultLogSuppressWindow = time.Minute
+
+// logLimiter keeps the retry paths from flooding the log, e.g. with a permanently offline peer being retried every few
+// seconds. The first message of a key (e.g. a peer) and kind (e.g. the failure) is logged, the following ones of the same
+// key and kind are suppressed for the window. The next message after the window logs a summary of the suppressed ones
+// and starts a new window
+type logLimiter struct {
+	mux    sync.Mutex
+	window time.Duration
+	// entries is the current window of the keys and kinds that have logged a message
+	entries map[logLimiterKey]*logLimiterEntry
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// logLimiterKey identifies the window of the messages of a kind logged for a key
+type logLimiterKey struct {
+	key  string
+	kind string
+}
+
+// logLimiterEntry is the window of a key and kind
+type logLimiterEntry struct {
+	start time.Time
+	// suppressed is the number of messages suppressed in the window
+	suppressed int
+	// level and last are of the latest suppressed message
+	level log.Level
+	last  string
+}
+
+// newLogLimiter creates a logLimiter suppressing repeats for window, 0 means DefaultLogSuppressWindow
+func newLogLimiter(window time.Duration) *logLimiter {
+	if window <= 0 {
+		window = DefaultLogSuppressWindow
+	}
+	return &logLimiter{
+		window:  window,
+		entries: map[logLimiterKey]*logLimiterEntry{},
+		now:     time.Now,
+	}
+}
+
+// logf logs the message of the key and kind unless a message of the same key and kind has been logged within the window
+func (l *logLimiter) logf(level log.Level, key string, kind string, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	entryKey := logLimiterKey{key: key, kind: kind}
+
+	l.mux.Lock()
+	now := l.now()
+	entry, ok := l.entries[entryKey]
+	if ok && now.Sub(entry.start) < l.window {
+		entry.suppressed++
+		entry.level = level
+		entry.last = msg
+		l.mux.Unlock()
+		return
+	}
+	l.entries[entryKey] = &logLimiterEntry{start: now}
+	l.mux.Unlock()
+
+	if ok {
+		entry.logSummary(now)
+	}
+	log.StandardLogger().Log(level, msg)
+}
+
+// forget ends the windows of all the kinds of the key logging a summary of the messages suppressed in them, e.g. once
+// the peer has connected or it has been removed. The next message of the key is logged right away
+func (l *logLimiter) forget(key string) {
+	var forgotten []*logLimiterEntry
+	l.mux.Lock()
+	for entryKey, entry := range l.entries {
+		if entryKey.key == key {
+			forgotten = append(forgotten, entry)
+			delete(l.entries, entryKey)
+		}
+	}
+	now := l.now()
+	l.mux.Unlock()
+
+	for _, entry := range forgotten {
+		entry.logSummary(now)
+	}
+}
+
+// logSummary logs the latest message suppressed in the window with the number of suppressed messages
+func (e *logLimiterEntry) logSummary(now time.Time) {
+	if e.suppressed == 0 {
+		return
+	}
+	log.StandardLogger().Logf(e.level, "%s (repeated %d times in the last %v)", e.last, e.suppressed, now.Sub(e.start).Round(time.Second))
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogLimiter(t *testing.T) {
+	out := log.StandardLogger().Out
+	defer log.SetOutput(out)
+	var output bytes.Buffer
+	log.SetOutput(&output)
+
+	now := time.Now()
+	limiter := newLogLimiter(time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	lines := func() []string {
+		defer output.Reset()
+		trimmed := strings.TrimSpace(output.String())
+		if trimmed == "" {
+			return nil
+		}
+		return strings.Split(trimmed, "\n")
+	}
+
+	// the first failure is logged, the repeats within the window aren't
+	for i := 0; i < 10; i++ {
+		limiter.logf(log.WarnLevel, "offline", "offline", "peer offline is offline, retrying")
+		now = now.Add(5 * time.Second)
+	}
+	logged := lines()
+	if len(logged) != 1 || !strings.Contains(logged[0], "peer offline is offline, retrying") {
+		t.Fatalf("expecting only the first failure to be logged, got %v", logged)
+	}
+
+	// other keys have windows of their own
+	limiter.logf(log.WarnLevel, "other", "offline", "peer other is offline, retrying")
+	if logged := lines(); len(logged) != 1 {
+		t.Fatalf("expecting the first failure of another peer to be logged, got %v", logged)
+	}
+
+	// other kinds of failures of the same key have windows of their own
+	limiter.logf(log.WarnLevel, "offline", "no-answer", "peer offline didn't answer, retrying")
+	if logged := lines(); len(logged) != 1 {
+		t.Fatalf("expecting the first failure of another kind to be logged, got %v", logged)
+	}
+
+	// after the window the suppressed failures are summarized and the new one is logged
+	now = now.Add(10 * time.Second)
+	limiter.logf(log.WarnLevel, "offline", "offline", "peer offline is offline, retrying")
+	logged = lines()
+	if len(logged) != 2 || !strings.Contains(logged[0], "repeated 9 times in the last 1m0s") {
+		t.Fatalf("expecting a summary of 9 suppressed failures and the new failure, got %v", logged)
+	}
+
+	// forgetting a key summarizes its window and the next message is logged right away
+	limiter.logf(log.WarnLevel, "offline", "offline", "peer offline is offline, retrying")
+	limiter.forget("offline")
+	logged = lines()
+	if len(logged) != 1 || !strings.Contains(logged[0], "repeated 1 times") {
+		t.Fatalf("expecting forget to summarize the suppressed failure, got %v", logged)
+	}
+	limiter.logf(log.WarnLevel, "offline", "offline", "peer offline is offline, retrying")
+	if logged := lines(); len(logged) != 1 {
+		t.Fatalf("expecting the failure after forget to be logged, got %v", logged)
+	}
+
+	// a window without suppressed messages has nothing to summarize
+	limiter.forget("other")
+	if logged := lines(); len(logged) != 0 {
+		t.Errorf("expecting no summary without suppressed failures, got %v", logged)
+	}
+}
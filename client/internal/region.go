@@ -0,0 +1,35 @@
+package internal
+
+import (
+	ice "github.com/pion/ice/v2"
+)
+
+// selectRegionalURLs narrows down the TURN servers of a connection to the ones of the region of the local peer,
+// falling back to the region of the remote peer. STUN servers and the preference order are kept as is.
+// All the servers are returned when no TURN server is tagged with either region
+func selectRegionalURLs(urls []*ice.URL, regions map[*ice.URL]string, localRegion string, remoteRegion string) []*ice.URL {
+	for _, region := range []string{localRegion, remoteRegion} {
+		if region == "" {
+			continue
+		}
+
+		selected := make([]*ice.URL, 0, len(urls))
+		matched := false
+		for _, url := range urls {
+			isTurn := url.Scheme == ice.SchemeTypeTURN || url.Scheme == ice.SchemeTypeTURNS
+			if !isTurn {
+				selected = append(selected, url)
+				continue
+			}
+			if regions[url] == region {
+				selected = append(selected, url)
+				matched = true
+			}
+		}
+		if matched {
+			return selected
+		}
+	}
+
+	return urls
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	ice "github.com/pion/ice/v2"
+	"testing"
+)
+
+func TestSelectRegionalURLs(t *testing.T) {
+	parse := func(raw string) *ice.URL {
+		url, err := ice.ParseURL(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return url
+	}
+
+	stun := parse("stun:stun.wiretrustee.com:3468")
+	turnEU := parse("turn:eu.turn.wiretrustee.com:3478")
+	turnUS := parse("turn:us.turn.wiretrustee.com:3478")
+	turnsUS := parse("turns:us.turn.wiretrustee.com:5349")
+	turnGlobal := parse("turn:turn.wiretrustee.com:3478")
+
+	urls := []*ice.URL{stun, turnEU, turnUS, turnsUS, turnGlobal}
+	regions := map[*ice.URL]string{
+		stun:    "eu-central",
+		turnEU:  "eu-central",
+		turnUS:  "us-east",
+		turnsUS: "us-east",
+	}
+
+	type testCase struct {
+		name         string
+		localRegion  string
+		remoteRegion string
+		regions      map[*ice.URL]string
+		expected     []*ice.URL
+	}
+
+	testCases := []testCase{
+		{
+			name:     "no regions",
+			regions:  regions,
+			expected: urls,
+		},
+		{
+			name:        "local region",
+			localRegion: "eu-central",
+			regions:     regions,
+			expected:    []*ice.URL{stun, turnEU},
+		},
+		{
+			name:         "local region preferred over remote region",
+			localRegion:  "us-east",
+			remoteRegion: "eu-central",
+			regions:      regions,
+			expected:     []*ice.URL{stun, turnUS, turnsUS},
+		},
+		{
+			name:         "remote region when local region has no TURN",
+			localRegion:  "ap-south",
+			remoteRegion: "us-east",
+			regions:      regions,
+			expected:     []*ice.URL{stun, turnUS, turnsUS},
+		},
+		{
+			name:         "no match falls back to all servers",
+			localRegion:  "ap-south",
+			remoteRegion: "sa-east",
+			regions:      regions,
+			expected:     urls,
+		},
+		{
+			name:        "untagged servers",
+			localRegion: "eu-central",
+			regions:     nil,
+			expected:    urls,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			selected := selectRegionalURLs(urls, testCase.regions, testCase.localRegion, testCase.remoteRegion)
+			if len(selected) != len(testCase.expected) {
+				t.Fatalf("expecting %v, got %v", testCase.expected, selected)
+			}
+			for i := range selected {
+				if selected[i] != testCase.expected[i] {
+					t.Errorf("expecting %v, got %v", testCase.expected, selected)
+					break
+				}
+			}
+		})
+	}
+}
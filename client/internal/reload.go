@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"net/url"
+	"reflect"
+)
+
+// ConfigChanges is the difference between the running config and a reloaded one (see Config for the live fields)
+type ConfigChanges struct {
+	// Live is the names of the changed fields applied to the running agent
+	Live []string
+	// RestartRequired is the names of the changed fields that take effect only after a restart
+	RestartRequired []string
+}
+
+// DiffConfig compares the running config with the reloaded one
+func DiffConfig(running *Config, reloaded *Config) ConfigChanges {
+	var changes ConfigChanges
+
+	live := func(name string, changed bool) {
+		if changed {
+			changes.Live = append(changes.Live, name)
+		}
+	}
+	restart := func(name string, changed bool) {
+		if changed {
+			changes.RestartRequired = append(changes.RestartRequired, name)
+		}
+	}
+
+	live("LogLevel", running.LogLevel != reloaded.LogLevel)
+	live("StunsTurns", !reflect.DeepEqual(running.StunsTurns, reloaded.StunsTurns))
+	live("IFaceBlackList", !reflect.DeepEqual(running.IFaceBlackList, reloaded.IFaceBlackList))
+	live("IFaceAllowList", !reflect.DeepEqual(running.IFaceAllowList, reloaded.IFaceAllowList))
+
+	restart("PrivateKey", running.PrivateKey != reloaded.PrivateKey)
+	restart("ManagementURL", urlString(running.ManagementURL) != urlString(reloaded.ManagementURL))
+	restart("WgIface", running.WgIface != reloaded.WgIface)
+	restart("WgPort", running.WgPort != reloaded.WgPort)
+	restart("Region", running.Region != reloaded.Region)
+
+	return changes
+}
+
+func urlString(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.String()
+}
+
+// Reload applies the live settings of the config (the STUN and TURN servers and the interface lists) to the running
+// Engine. Established connections are kept, the following connection attempts use the new settings
+func (e *Engine) Reload(config *EngineConfig) {
+	e.peerMux.Lock()
+	defer e.peerMux.Unlock()
+
+	e.config.StunsTurns = config.StunsTurns
+	e.config.StunTurnRegions = config.StunTurnRegions
+	e.config.IFaceBlackList = config.IFaceBlackList
+	e.config.IFaceAllowList = config.IFaceAllowList
+}
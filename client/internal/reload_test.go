@@ -0,0 +1,69 @@
+package internal
+
+import (
+	ice "github.com/pion/ice/v2"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	mgmURL, err := url.Parse("https://api.wiretrustee.com:33073")
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := &Config{
+		PrivateKey:     "key",
+		ManagementURL:  mgmURL,
+		WgIface:        "wt0",
+		IFaceBlackList: []string{"wt0", "tun0"},
+	}
+
+	same := *running
+	changes := DiffConfig(running, &same)
+	if len(changes.Live) != 0 || len(changes.RestartRequired) != 0 {
+		t.Errorf("expecting no changes, got %+v", changes)
+	}
+
+	reloaded := *running
+	reloaded.LogLevel = "debug"
+	reloaded.StunsTurns = []StunTurnServer{{URI: "stun:stun.example.com:3478"}}
+	reloaded.IFaceBlackList = []string{"wt0"}
+	reloaded.WgIface = "wt1"
+	reloaded.ManagementURL = nil
+
+	changes = DiffConfig(running, &reloaded)
+	expectedLive := []string{"LogLevel", "StunsTurns", "IFaceBlackList"}
+	if !reflect.DeepEqual(changes.Live, expectedLive) {
+		t.Errorf("expecting live changes %v, got %v", expectedLive, changes.Live)
+	}
+	expectedRestart := []string{"ManagementURL", "WgIface"}
+	if !reflect.DeepEqual(changes.RestartRequired, expectedRestart) {
+		t.Errorf("expecting changes requiring a restart %v, got %v", expectedRestart, changes.RestartRequired)
+	}
+}
+
+func TestEngine_Reload(t *testing.T) {
+	engine := newTestEngine()
+	engine.config.WgIface = "wt0"
+
+	stun, err := ice.ParseURL("stun:stun.example.com:3478")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Reload(&EngineConfig{
+		StunsTurns:     []*ice.URL{stun},
+		WgIface:        "wt1",
+		IFaceBlackList: map[string]struct{}{"tun0": {}},
+	})
+
+	if len(engine.config.StunsTurns) != 1 || engine.config.StunsTurns[0] != stun {
+		t.Errorf("expecting STUN and TURN servers to be reloaded, got %v", engine.config.StunsTurns)
+	}
+	if _, ok := engine.config.IFaceBlackList["tun0"]; !ok {
+		t.Errorf("expecting interface blacklist to be reloaded, got %v", engine.config.IFaceBlackList)
+	}
+	if engine.config.WgIface != "wt0" {
+		t.Errorf("expecting interface to be kept until restart, got %s", engine.config.WgIface)
+	}
+}
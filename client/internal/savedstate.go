@@ -0,0 +1,196 @@
+package internal
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/wiretrustee/wiretrustee/iface"
+	"github.com/wiretrustee/wiretrustee/util"
+	"net"
+	"os"
+	"time"
+)
+
+// SavedEndpointMaxAge is how long saved endpoints are trusted at all, older ones are ignored on load
+const SavedEndpointMaxAge = 24 * time.Hour
+
+var (
+	// SavedEndpointVerifyTimeout is how long a saved endpoint gets to complete a Wireguard handshake before it is
+	// considered stale
+	SavedEndpointVerifyTimeout = 10 * time.Second
+	// savedEndpointCheckInterval is how often the Wireguard handshake of a saved endpoint is checked
+	savedEndpointCheckInterval = time.Second
+)
+
+// savedEndpoint is the direct Wireguard endpoint of a connected peer persisted across Engine restarts
+type savedEndpoint struct {
+	Endpoint string
+	// CandidatePair is the ICE candidate pair the endpoint has been selected from, kept for debugging
+	CandidatePair string
+	// Time is when the endpoint has been saved
+	Time time.Time
+}
+
+// savedState is the content of EngineConfig.StateFile
+type savedState struct {
+	Endpoints map[string]savedEndpoint
+}
+
+// readSavedEndpoints reads the endpoints saved to the state file skipping the ones older than SavedEndpointMaxAge.
+// A missing file is no saved endpoints
+func readSavedEndpoints(path string) (map[string]savedEndpoint, error) {
+	endpoints := make(map[string]savedEndpoint)
+
+	state := &savedState{}
+	_, err := util.ReadJson(path, state)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return endpoints, nil
+		}
+		return nil, err
+	}
+
+	for key, saved := range state.Endpoints {
+		if time.Since(saved.Time) > SavedEndpointMaxAge {
+			continue
+		}
+		endpoints[key] = saved
+	}
+	return endpoints, nil
+}
+
+// writeSavedEndpoints replaces the state file with the endpoints
+func writeSavedEndpoints(path string, endpoints map[string]savedEndpoint) error {
+	return util.WriteJson(path, &savedState{Endpoints: endpoints})
+}
+
+// isDirectEndpoint checks whether the Wireguard endpoint is the remote peer itself rather than a local proxy
+// (loopback) that doesn't outlive the Engine
+func isDirectEndpoint(endpoint string) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && !ip.IsLoopback()
+}
+
+// recordEndpoint keeps the Wireguard endpoint of a connected peer to be saved on Stop, proxied endpoints are forgotten
+func (e *Engine) recordEndpoint(peerKey string, endpoint string, pair string) {
+	if e.config.StateFile == "" {
+		return
+	}
+
+	e.peerMux.Lock()
+	defer e.peerMux.Unlock()
+
+	if !isDirectEndpoint(endpoint) {
+		delete(e.endpoints, peerKey)
+		return
+	}
+	e.endpoints[peerKey] = savedEndpoint{Endpoint: endpoint, CandidatePair: pair}
+}
+
+// saveEndpoints writes the endpoints of the peers still connected to EngineConfig.StateFile
+func (e *Engine) saveEndpoints() {
+	if e.config.StateFile == "" {
+		return
+	}
+
+	e.peerMux.Lock()
+	endpoints := make(map[string]savedEndpoint)
+	for key, saved := range e.endpoints {
+		if conn := e.conns[key]; conn != nil && conn.State() == ConnStateConnected {
+			saved.Time = time.Now()
+			endpoints[key] = saved
+		}
+	}
+	e.peerMux.Unlock()
+
+	err := writeSavedEndpoints(e.config.StateFile, endpoints)
+	if err != nil {
+		log.Warnf("failed saving endpoints of the connected peers to %s: %v", e.config.StateFile, err)
+		return
+	}
+	log.Debugf("saved endpoints of %d connected peers to %s", len(endpoints), e.config.StateFile)
+}
+
+// loadSavedEndpoints loads the endpoints saved by the previous run from EngineConfig.StateFile, they are used once
+// when the peers are initialized
+func (e *Engine) loadSavedEndpoints() {
+	if e.config.StateFile == "" {
+		return
+	}
+
+	endpoints, err := readSavedEndpoints(e.config.StateFile)
+	if err != nil {
+		log.Warnf("failed loading saved endpoints from %s, peers are connected from scratch: %v", e.config.StateFile, err)
+		return
+	}
+
+	e.peerMux.Lock()
+	e.savedEndpoints = endpoints
+	e.peerMux.Unlock()
+
+	log.Infof("loaded saved endpoints of %d peers from %s", len(endpoints), e.config.StateFile)
+}
+
+// seedSavedEndpoint configures the Wireguard peer with its saved endpoint so that the traffic flows right away while the
+// connection is negotiated. The endpoint may be stale (e.g. the remote peer has moved): unless a Wireguard handshake
+// completes within SavedEndpointVerifyTimeout the Wireguard peer is removed again, provided the connection hasn't
+// configured it in the meantime
+func (e *Engine) seedSavedEndpoint(peer Peer, saved savedEndpoint) {
+	e.peerMux.Lock()
+	if conn, ok := e.conns[peer.WgPubKey]; ok && conn != nil && conn.State() == ConnStateConnected {
+		e.peerMux.Unlock()
+		return
+	}
+	seeded := time.Now()
+	err := iface.UpdatePeer(e.config.WgIface, peer.WgPubKey, peer.WgAllowedIps, e.config.ConnectionMode.wgKeepAlive(), saved.Endpoint, peer.preSharedKey())
+	e.peerMux.Unlock()
+	if err != nil {
+		log.Warnf("failed configuring saved endpoint %s of peer %s: %v", saved.Endpoint, peer.WgPubKey, err)
+		return
+	}
+	log.Infof("reconnecting peer %s via saved endpoint %s while the connection is negotiated", peer.WgPubKey, saved.Endpoint)
+
+	if e.waitHandshake(peer.WgPubKey, seeded) {
+		log.Infof("saved endpoint %s of peer %s has been verified with a handshake", saved.Endpoint, peer.WgPubKey)
+		return
+	}
+
+	e.peerMux.Lock()
+	defer e.peerMux.Unlock()
+
+	conn, ok := e.conns[peer.WgPubKey]
+	if !ok || (conn != nil && conn.State() == ConnStateConnected) {
+		// removed (along with the Wireguard peer) or connected in the meantime
+		return
+	}
+	wgPeer, err := iface.GetPeer(e.config.WgIface, peer.WgPubKey)
+	if err != nil || wgPeer.Endpoint == nil || wgPeer.Endpoint.String() != saved.Endpoint {
+		// the connection has configured its own endpoint
+		return
+	}
+
+	log.Infof("saved endpoint %s of peer %s is stale, no handshake within %v", saved.Endpoint, peer.WgPubKey, SavedEndpointVerifyTimeout)
+	err = iface.RemovePeer(e.config.WgIface, peer.WgPubKey)
+	if err != nil {
+		log.Warnf("failed removing stale endpoint of peer %s: %v", peer.WgPubKey, err)
+	}
+}
+
+// waitHandshake waits SavedEndpointVerifyTimeout for a Wireguard handshake with the peer newer than since
+func (e *Engine) waitHandshake(peerKey string, since time.Time) bool {
+	deadline := time.Now().Add(SavedEndpointVerifyTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(savedEndpointCheckInterval)
+
+		wgPeer, err := iface.GetPeer(e.config.WgIface, peerKey)
+		if err != nil {
+			return false
+		}
+		if wgPeer.LastHandshakeTime.After(since) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSavedEndpoints_ReadWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	endpoints, err := readSavedEndpoints(path)
+	if err != nil {
+		t.Fatalf("expecting a missing state file to be no saved endpoints, got %v", err)
+	}
+	if len(endpoints) != 0 {
+		t.Fatalf("expecting no saved endpoints, got %v", endpoints)
+	}
+
+	err = writeSavedEndpoints(path, map[string]savedEndpoint{
+		"fresh": {Endpoint: "203.0.113.1:51820", CandidatePair: "pair", Time: time.Now()},
+		"stale": {Endpoint: "203.0.113.2:51820", Time: time.Now().Add(-SavedEndpointMaxAge - time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoints, err = readSavedEndpoints(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 {
+		t.Fatalf("expecting endpoints older than SavedEndpointMaxAge to be skipped, got %v", endpoints)
+	}
+	if saved := endpoints["fresh"]; saved.Endpoint != "203.0.113.1:51820" || saved.CandidatePair != "pair" {
+		t.Errorf("unexpected saved endpoint %+v", saved)
+	}
+}
+
+func TestEngine_SaveEndpoints(t *testing.T) {
+	engine := newTestEngine()
+	engine.config.StateFile = filepath.Join(t.TempDir(), "state.json")
+
+	connected := NewConnection(ConnConfig{}, nil, nil, nil)
+	for _, state := range []ConnState{ConnStateGathering, ConnStateConnecting, ConnStateConnected} {
+		err := connected.transition(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	engine.conns["direct"] = connected
+	engine.conns["proxied"] = connected
+	engine.conns["connecting"] = NewConnection(ConnConfig{}, nil, nil, nil)
+
+	engine.recordEndpoint("direct", "203.0.113.1:51820", "pair")
+	// proxied connections are configured with a local proxy endpoint
+	engine.recordEndpoint("proxied", "127.0.0.1:41000", "pair")
+	engine.recordEndpoint("connecting", "203.0.113.3:51820", "pair")
+
+	engine.saveEndpoints()
+
+	endpoints, err := readSavedEndpoints(engine.config.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || endpoints["direct"].Endpoint != "203.0.113.1:51820" {
+		t.Errorf("expecting only the direct endpoint of the connected peer to be saved, got %v", endpoints)
+	}
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"crypto/tls"
+	"fmt"
+	ice "github.com/pion/ice/v2"
+	"github.com/pion/turn/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// StunTurnResult is the outcome of a reachability check of a STUN or TURN server
+type StunTurnResult struct {
+	URL *ice.URL
+	// Latency is how long the STUN binding request or the TURN allocation took
+	Latency time.Duration
+	// Err is nil when the server is reachable
+	Err error
+}
+
+// CheckStunTurn checks every STUN and TURN server in parallel: a binding request is sent to STUN servers and
+// a relay is allocated (and released right away) on TURN servers, over UDP, TCP or TLS depending on the URL.
+// Each check is given the timeout. The results keep the order of the urls
+func CheckStunTurn(urls []*ice.URL, timeout time.Duration) []StunTurnResult {
+	results := make([]StunTurnResult, len(urls))
+
+	var wg sync.WaitGroup
+	wg.Add(len(urls))
+	for i, url := range urls {
+		go func(i int, url *ice.URL) {
+			defer wg.Done()
+			start := time.Now()
+			err := checkStunTurnWithTimeout(url, timeout)
+			results[i] = StunTurnResult{URL: url, Latency: time.Since(start), Err: err}
+		}(i, url)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// checkStunTurnWithTimeout runs the check of a single server and gives up after the timeout
+func checkStunTurnWithTimeout(url *ice.URL, timeout time.Duration) error {
+	conn, err := dialStunTurn(url, timeout)
+	if err != nil {
+		return err
+	}
+	// closing the connection also aborts a pending request when the timeout fires
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- checkStunTurn(url, conn)
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no response from %s within %v", url.String(), timeout)
+	}
+}
+
+// dialStunTurn opens the connection a STUN or TURN client communicates with the server over
+func dialStunTurn(url *ice.URL, timeout time.Duration) (net.PacketConn, error) {
+	addr := net.JoinHostPort(url.Host, fmt.Sprintf("%d", url.Port))
+
+	switch {
+	case url.Proto == ice.ProtoTypeTCP && url.IsSecure():
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, &tls.Config{ServerName: url.Host})
+		if err != nil {
+			return nil, err
+		}
+		return turn.NewSTUNConn(conn), nil
+	case url.Proto == ice.ProtoTypeTCP:
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return turn.NewSTUNConn(conn), nil
+	default:
+		return net.ListenPacket("udp4", "0.0.0.0:0")
+	}
+}
+
+// checkStunTurn sends a binding request to a STUN server or allocates a relay on a TURN server
+func checkStunTurn(url *ice.URL, conn net.PacketConn) error {
+	addr := net.JoinHostPort(url.Host, fmt.Sprintf("%d", url.Port))
+	isTurn := url.Scheme == ice.SchemeTypeTURN || url.Scheme == ice.SchemeTypeTURNS
+
+	config := &turn.ClientConfig{
+		STUNServerAddr: addr,
+		Conn:           conn,
+	}
+	if isTurn {
+		config.TURNServerAddr = addr
+		config.Username = url.Username
+		config.Password = url.Password
+	}
+
+	client, err := turn.NewClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	err = client.Listen()
+	if err != nil {
+		return err
+	}
+
+	if !isTurn {
+		_, err = client.SendBindingRequest()
+		return err
+	}
+
+	relayConn, err := client.Allocate()
+	if err != nil {
+		return err
+	}
+	return relayConn.Close()
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"fmt"
+	ice "github.com/pion/ice/v2"
+	"github.com/pion/turn/v2"
+	"net"
+	"testing"
+	"time"
+)
+
+func startTurnServer(t *testing.T) (*turn.Server, int) {
+	listener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm: "wiretrustee.com",
+		AuthHandler: func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+			if username != "user" {
+				return nil, false
+			}
+			return turn.GenerateAuthKey(username, realm, "password"), true
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: listener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP("127.0.0.1"),
+					Address:      "127.0.0.1",
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, listener.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestCheckStunTurn(t *testing.T) {
+	server, port := startTurnServer(t)
+	defer server.Close()
+
+	// nothing listens on the port of a closed listener
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closedListener.Addr().(*net.TCPAddr).Port
+	closedListener.Close()
+
+	type testCase struct {
+		name      string
+		url       string
+		username  string
+		password  string
+		reachable bool
+	}
+
+	testCases := []testCase{
+		{
+			name:      "STUN binding",
+			url:       fmt.Sprintf("stun:127.0.0.1:%d", port),
+			reachable: true,
+		},
+		{
+			name:      "TURN allocation",
+			url:       fmt.Sprintf("turn:127.0.0.1:%d?transport=udp", port),
+			username:  "user",
+			password:  "password",
+			reachable: true,
+		},
+		{
+			name:      "TURN wrong credentials",
+			url:       fmt.Sprintf("turn:127.0.0.1:%d?transport=udp", port),
+			username:  "user",
+			password:  "wrong",
+			reachable: false,
+		},
+		{
+			name:      "TURN over TCP unreachable",
+			url:       fmt.Sprintf("turn:127.0.0.1:%d?transport=tcp", closedPort),
+			username:  "user",
+			password:  "password",
+			reachable: false,
+		},
+	}
+
+	var urls []*ice.URL
+	for _, testCase := range testCases {
+		url, err := ice.ParseURL(testCase.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		url.Username = testCase.username
+		url.Password = testCase.password
+		urls = append(urls, url)
+	}
+
+	results := CheckStunTurn(urls, 3*time.Second)
+
+	if len(results) != len(testCases) {
+		t.Fatalf("expecting %d results, got %d", len(testCases), len(results))
+	}
+
+	for i, testCase := range testCases {
+		result := results[i]
+		if result.URL != urls[i] {
+			t.Errorf("%s: expecting result of %s, got %s", testCase.name, urls[i], result.URL)
+		}
+		if testCase.reachable && result.Err != nil {
+			t.Errorf("%s: expecting server to be reachable, got %v", testCase.name, result.Err)
+		}
+		if !testCase.reachable && result.Err == nil {
+			t.Errorf("%s: expecting server check to fail", testCase.name)
+		}
+	}
+}
@@ -4,27 +4,75 @@ import (
 	ice "github.com/pion/ice/v2"
 	log "github.com/sirupsen/logrus"
 	"github.com/wiretrustee/wiretrustee/iface"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
+// DefaultProxyPacketBufferSize is the size of the buffers the WgProxy reads packets into, enough for the default
+// interface MTU with the Wireguard overhead
+const DefaultProxyPacketBufferSize = 1500
+
+// ProxyBufferConfig sizes the buffers of the WgProxy of a peer connection.
+// Larger buffers trade memory for throughput: each connection holds 2 packet buffers of PacketSize and the kernel holds
+// up to SocketSize for each direction of the socket to local Wireguard. The OS default socket buffers drop packets
+// of bursts on fast links (1Gbps+), a few MiB (e.g. 4 MiB) keep up with them. The kernel may cap the socket buffers
+// (e.g. net.core.rmem_max and net.core.wmem_max on Linux)
+type ProxyBufferConfig struct {
+	// PacketSize is the size of the buffer a single packet is read into, larger packets get truncated (e.g. with a
+	// jumbo interface MTU). 0 means DefaultProxyPacketBufferSize
+	PacketSize int
+	// SocketSize is the size of the kernel read and write buffers of the socket to local Wireguard (SO_RCVBUF and
+	// SO_SNDBUF). 0 keeps the OS default
+	SocketSize int
+}
+
+// packetSize returns PacketSize falling back to DefaultProxyPacketBufferSize
+func (c ProxyBufferConfig) packetSize() int {
+	if c.PacketSize > 0 {
+		return c.PacketSize
+	}
+	return DefaultProxyPacketBufferSize
+}
+
+// ProxyStats holds the number of bytes relayed by the WgProxy over the ICE connection
+type ProxyStats struct {
+	// BytesToRemote is the number of bytes read from local Wireguard and sent to the remote peer
+	BytesToRemote uint64
+	// BytesFromRemote is the number of bytes received from the remote peer and written to local Wireguard
+	BytesFromRemote uint64
+}
+
 // WgProxy an instance of an instance of the Connection Wireguard Proxy
 type WgProxy struct {
+	// stats is updated atomically and kept first in the struct to guarantee 64-bit alignment
+	stats      ProxyStats
 	iface      string
 	remoteKey  string
 	allowedIps string
-	wgAddr     string
-	close      chan struct{}
-	wgConn     net.Conn
+	// preSharedKey is the Wireguard preshared key shared with the remote peer, nil when none
+	preSharedKey *wgtypes.Key
+	wgAddr       string
+	buffers      ProxyBufferConfig
+	keepAlive    time.Duration
+	close        chan struct{}
+	wgConn       net.Conn
+	// onHeartbeat is called for the heartbeats received from the remote peer, they aren't forwarded to Wireguard (optional)
+	onHeartbeat func()
 }
 
 // NewWgProxy creates a new Connection Wireguard Proxy
-func NewWgProxy(iface string, remoteKey string, allowedIps string, wgAddr string) *WgProxy {
+func NewWgProxy(iface string, remoteKey string, allowedIps string, preSharedKey *wgtypes.Key, wgAddr string, buffers ProxyBufferConfig, keepAlive time.Duration) *WgProxy {
 	return &WgProxy{
-		iface:      iface,
-		remoteKey:  remoteKey,
-		allowedIps: allowedIps,
-		wgAddr:     wgAddr,
-		close:      make(chan struct{}),
+		iface:        iface,
+		remoteKey:    remoteKey,
+		allowedIps:   allowedIps,
+		preSharedKey: preSharedKey,
+		wgAddr:       wgAddr,
+		buffers:      buffers,
+		keepAlive:    keepAlive,
+		close:        make(chan struct{}),
 	}
 }
 
@@ -46,9 +94,17 @@ func (p *WgProxy) Close() error {
 	return nil
 }
 
+// Stats returns the number of bytes relayed by the proxy so far
+func (p *WgProxy) Stats() ProxyStats {
+	return ProxyStats{
+		BytesToRemote:   atomic.LoadUint64(&p.stats.BytesToRemote),
+		BytesFromRemote: atomic.LoadUint64(&p.stats.BytesFromRemote),
+	}
+}
+
 // StartLocal configure the interface with a peer using a direct IP:Port endpoint to the remote host
 func (p *WgProxy) StartLocal(host string) error {
-	err := iface.UpdatePeer(p.iface, p.remoteKey, p.allowedIps, DefaultWgKeepAlive, host)
+	err := iface.UpdatePeer(p.iface, p.remoteKey, p.allowedIps, p.keepAlive, host, p.preSharedKey)
 	if err != nil {
 		log.Errorf("error while configuring Wireguard peer [%s] %s", p.remoteKey, err.Error())
 		return err
@@ -65,9 +121,10 @@ func (p *WgProxy) Start(remoteConn *ice.Conn) error {
 		return err
 	}
 	p.wgConn = wgConn
+	p.configureSocket(wgConn)
 	// add local proxy connection as a Wireguard peer
-	err = iface.UpdatePeer(p.iface, p.remoteKey, p.allowedIps, DefaultWgKeepAlive,
-		wgConn.LocalAddr().String())
+	err = iface.UpdatePeer(p.iface, p.remoteKey, p.allowedIps, p.keepAlive,
+		wgConn.LocalAddr().String(), p.preSharedKey)
 	if err != nil {
 		log.Errorf("error while configuring Wireguard peer [%s] %s", p.remoteKey, err.Error())
 		return err
@@ -79,11 +136,33 @@ func (p *WgProxy) Start(remoteConn *ice.Conn) error {
 	return err
 }
 
+// configureSocket sets the kernel buffer sizes of the socket to local Wireguard, see ProxyBufferConfig.SocketSize.
+// A failure isn't fatal, the proxy works with the OS default buffers
+func (p *WgProxy) configureSocket(conn net.Conn) {
+	size := p.buffers.SocketSize
+	if size <= 0 {
+		return
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return
+	}
+
+	err := udpConn.SetReadBuffer(size)
+	if err != nil {
+		log.Warnf("failed setting read buffer of the proxy of peer %s to %d bytes: %v", p.remoteKey, size, err)
+	}
+	err = udpConn.SetWriteBuffer(size)
+	if err != nil {
+		log.Warnf("failed setting write buffer of the proxy of peer %s to %d bytes: %v", p.remoteKey, size, err)
+	}
+}
+
 // proxyToRemotePeer proxies everything from Wireguard to the remote peer
 // blocks
-func (p *WgProxy) proxyToRemotePeer(remoteConn *ice.Conn) {
+func (p *WgProxy) proxyToRemotePeer(remoteConn net.Conn) {
 
-	buf := make([]byte, 1500)
+	buf := make([]byte, p.buffers.packetSize())
 	for {
 		select {
 		case <-p.close:
@@ -96,20 +175,21 @@ func (p *WgProxy) proxyToRemotePeer(remoteConn *ice.Conn) {
 				continue
 			}
 
-			_, err = remoteConn.Write(buf[:n])
+			n, err = remoteConn.Write(buf[:n])
 			if err != nil {
 				//log.Warnln("failed writing to remote peer: ", err.Error())
 				continue
 			}
+			atomic.AddUint64(&p.stats.BytesToRemote, uint64(n))
 		}
 	}
 }
 
 // proxyToLocalWireguard proxies everything from the remote peer to local Wireguard
 // blocks
-func (p *WgProxy) proxyToLocalWireguard(remoteConn *ice.Conn) {
+func (p *WgProxy) proxyToLocalWireguard(remoteConn net.Conn) {
 
-	buf := make([]byte, 1500)
+	buf := make([]byte, p.buffers.packetSize())
 	for {
 		select {
 		case <-p.close:
@@ -122,11 +202,19 @@ func (p *WgProxy) proxyToLocalWireguard(remoteConn *ice.Conn) {
 				continue
 			}
 
-			_, err = p.wgConn.Write(buf[:n])
+			if isHeartbeat(buf[:n]) {
+				if p.onHeartbeat != nil {
+					p.onHeartbeat()
+				}
+				continue
+			}
+
+			n, err = p.wgConn.Write(buf[:n])
 			if err != nil {
 				//log.Errorf("failed writing to local Wireguard instance %s", err)
 				continue
 			}
+			atomic.AddUint64(&p.stats.BytesFromRemote, uint64(n))
 		}
 	}
 }
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWgProxy_Stats(t *testing.T) {
+	wgConn, wgPeer := net.Pipe()
+	remoteConn, remotePeer := net.Pipe()
+
+	proxy := NewWgProxy("wt0", "remote", "10.30.30.2/32", nil, "127.0.0.1:51820", ProxyBufferConfig{}, DefaultWgKeepAlive)
+	proxy.wgConn = wgConn
+
+	go proxy.proxyToRemotePeer(remoteConn)
+	go proxy.proxyToLocalWireguard(remoteConn)
+
+	defer func() {
+		close(proxy.close)
+		wgPeer.Close()
+		remotePeer.Close()
+	}()
+
+	toRemote := []byte("wireguard handshake")
+	fromRemote := []byte("reply")
+
+	_, err := wgPeer.Write(toRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := remotePeer.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != string(toRemote) {
+		t.Errorf("expecting remote peer to receive %s, got %s", toRemote, buf[:n])
+	}
+
+	_, err = remotePeer.Write(fromRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = wgPeer.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != string(fromRemote) {
+		t.Errorf("expecting local Wireguard to receive %s, got %s", fromRemote, buf[:n])
+	}
+
+	// counters are updated right after the write returns
+	expected := ProxyStats{BytesToRemote: uint64(len(toRemote)), BytesFromRemote: uint64(len(fromRemote))}
+	deadline := time.Now().Add(time.Second)
+	for proxy.Stats() != expected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if stats := proxy.Stats(); stats != expected {
+		t.Errorf("expecting proxy stats %+v, got %+v", expected, stats)
+	}
+}
+
+// benchmarkWgProxy sends bursts of Wireguard sized packets from local Wireguard through the proxy to the remote peer
+// over loopback UDP and reports the share of the packets delivered. Packets dropped by full socket buffers don't count
+// towards the throughput (MB/s is the offered load)
+func benchmarkWgProxy(b *testing.B, buffers ProxyBufferConfig) {
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	proxyConn, err := net.ListenUDP("udp4", loopback)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer proxyConn.Close()
+	wgConn, err := net.DialUDP("udp4", nil, proxyConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer wgConn.Close()
+
+	remotePeer, err := net.ListenUDP("udp4", loopback)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer remotePeer.Close()
+	remoteConn, err := net.DialUDP("udp4", nil, remotePeer.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer remoteConn.Close()
+
+	proxy := NewWgProxy("wt0", "remote", "10.30.30.2/32", nil, "127.0.0.1:51820", buffers, DefaultWgKeepAlive)
+	proxy.wgConn = proxyConn
+	proxy.configureSocket(proxyConn)
+	if buffers.SocketSize > 0 {
+		// the remote side of the benchmark gets the same buffers, the ICE connection isn't the bottleneck measured
+		_ = remotePeer.SetReadBuffer(buffers.SocketSize)
+	}
+	go proxy.proxyToRemotePeer(remoteConn)
+	defer close(proxy.close)
+
+	var received int64
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			_, err := remotePeer.Read(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&received, 1)
+		}
+	}()
+
+	packet := make([]byte, 1280)
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := wgConn.Write(packet)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// wait for the packets in flight
+	last := int64(-1)
+	for current := atomic.LoadInt64(&received); current != last && current < int64(b.N); current = atomic.LoadInt64(&received) {
+		last = current
+		time.Sleep(50 * time.Millisecond)
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(atomic.LoadInt64(&received))/float64(b.N)*100, "%delivered")
+}
+
+func BenchmarkWgProxy(b *testing.B) {
+	for _, socketSize := range []int{0, 256 * 1024, 4 * 1024 * 1024} {
+		b.Run(fmt.Sprintf("socket buffer %d", socketSize), func(b *testing.B) {
+			benchmarkWgProxy(b, ProxyBufferConfig{SocketSize: socketSize})
+		})
+	}
+}
@@ -0,0 +1,28 @@
+// +build darwin windows
+
+package iface
+
+import (
+	"net"
+)
+
+// interfaceIPv4Addrs returns the IPv4 addresses assigned to the interface
+func interfaceIPv4Addrs(iface string) ([]*net.IPNet, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ipv4Addrs []*net.IPNet
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.To4() != nil {
+			ipv4Addrs = append(ipv4Addrs, ipNet)
+		}
+	}
+	return ipv4Addrs, nil
+}
@@ -0,0 +1,86 @@
+package iface
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var (
+	// ErrIfaceExists is returned when an interface can't be created because its name is taken (e.g. by a non Wireguard interface)
+	ErrIfaceExists = errors.New("interface already exists")
+	// ErrNotPrivileged is returned when the process isn't allowed to manage interfaces, it has to run as root
+	// (or with CAP_NET_ADMIN on Linux)
+	ErrNotPrivileged = errors.New("not privileged to manage interfaces, run as root")
+	// ErrKernelModuleMissing is returned when the kernel lacks the module an interface needs (wireguard or tun)
+	ErrKernelModuleMissing = errors.New("kernel module is missing")
+	// ErrIfaceNotFound is returned when an interface doesn't exist (e.g. it hasn't been created before configuring it)
+	ErrIfaceNotFound = errors.New("interface not found")
+)
+
+// Error is an error of an operation on an interface.
+// errors.Is matches it against its Kind and against the underlying error
+type Error struct {
+	// Op is the operation that has failed, e.g. create
+	Op string
+	// Iface is the name of the interface
+	Iface string
+	// Kind is one of the sentinel errors of the package, nil when the condition isn't known
+	Kind error
+	// Err is the underlying error, e.g. of netlink or wgctrl
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Kind == nil {
+		return fmt.Sprintf("%s interface %s: %v", e.Op, e.Iface, e.Err)
+	}
+	return fmt.Sprintf("%s interface %s: %v: %v", e.Op, e.Iface, e.Kind, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error is of the kind of target, e.g. errors.Is(err, ErrNotPrivileged)
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// classifyError returns the sentinel error of a condition the underlying error reports, nil when it isn't a known one
+func classifyError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		// EPERM and EACCES
+		return ErrNotPrivileged
+	case errors.Is(err, os.ErrExist), errors.Is(err, syscall.EBUSY):
+		return ErrIfaceExists
+	case errors.Is(err, syscall.EOPNOTSUPP):
+		// the kernel doesn't know the wireguard link type
+		return ErrKernelModuleMissing
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, syscall.ENODEV):
+		return ErrIfaceNotFound
+	}
+	return nil
+}
+
+// wrapError wraps a failure of the operation op on the interface iface into an Error of the condition it reports.
+// nil stays nil and an Error is returned as is
+func wrapError(op string, iface string, err error) error {
+	return wrapErrorAs(op, iface, err, classifyError(err))
+}
+
+// wrapErrorAs wraps a failure of the operation op on the interface iface into an Error of the given kind.
+// nil stays nil and an Error is returned as is
+func wrapErrorAs(op string, iface string, err error, kind error) error {
+	if err == nil {
+		return nil
+	}
+	var ifaceErr *Error
+	if errors.As(err, &ifaceErr) {
+		return err
+	}
+	return &Error{Op: op, Iface: iface, Kind: kind, Err: err}
+}
@@ -1,6 +1,7 @@
 package iface
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
@@ -8,33 +9,75 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"net"
+	"strings"
 	"time"
 )
 
 const (
 	defaultMTU = 1280
 	WgPort     = 51820
+	// MaxNameLength is the longest interface name accepted by the kernel (IFNAMSIZ minus the trailing NUL on Linux)
+	MaxNameLength = 15
+	// MinMTU is the lowest MTU the Wireguard interface can be set to (the minimum MTU of IPv6 links)
+	MinMTU = 1280
 )
 
 var tunIface tun.Device
 
-// CreateWithUserspace Creates a new Wireguard interface, using wireguard-go userspace implementation
+// ValidateName checks whether a name can be used for a Wireguard interface
+func ValidateName(iface string) error {
+	if iface == "" {
+		return fmt.Errorf("interface name is empty")
+	}
+	if len(iface) > MaxNameLength {
+		return fmt.Errorf("interface name %s is too long, it can have at most %d characters", iface, MaxNameLength)
+	}
+	if strings.ContainsAny(iface, "/: \t\n") {
+		return fmt.Errorf("interface name %s contains invalid characters", iface)
+	}
+	return nil
+}
+
+// GetMTU returns the current MTU of the interface
+func GetMTU(iface string) (int, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return 0, err
+	}
+	return netIface.MTU, nil
+}
+
+// validateMTU checks whether the interface can be set to the MTU
+func validateMTU(mtu int) error {
+	if mtu < MinMTU {
+		return fmt.Errorf("MTU %d is below the minimum of %d", mtu, MinMTU)
+	}
+	return nil
+}
+
+// CreateWithUserspace Creates a new Wireguard interface, using wireguard-go userspace implementation.
+// Errors are of type *Error and match the sentinel error of a known condition, e.g. ErrNotPrivileged
 func CreateWithUserspace(iface string, address string) error {
 	var err error
 	tunIface, err = tun.CreateTUN(iface, defaultMTU)
 	if err != nil {
-		return err
+		kind := classifyError(err)
+		if kind == ErrIfaceNotFound {
+			// the TUN device node (e.g. /dev/net/tun) doesn't exist without the tun module
+			kind = ErrKernelModuleMissing
+		}
+		return wrapErrorAs("create", iface, err, kind)
 	}
 
 	// We need to create a wireguard-go device and listen to configuration requests
 	tunDevice := device.NewDevice(tunIface, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, "[wiretrustee] "))
 	err = tunDevice.Up()
 	if err != nil {
-		return err
+		return wrapError("create", iface, err)
 	}
 	uapi, err := getUAPI(iface)
 	if err != nil {
-		return err
+		return wrapError("create", iface, err)
 	}
 
 	go func() {
@@ -52,7 +95,7 @@ func CreateWithUserspace(iface string, address string) error {
 
 	err = assignAddr(address, iface)
 	if err != nil {
-		return err
+		return wrapError("create", iface, err)
 	}
 	return nil
 }
@@ -98,19 +141,24 @@ func Exists(iface string) (*bool, error) {
 	return &exists, nil
 }
 
-// Configure configures a Wireguard interface
-// The interface must exist before calling this method (e.g. call interface.Create() before)
-func Configure(iface string, privateKey string) error {
+// Configure configures a Wireguard interface to listen on port, 0 means WgPort. Interfaces running side by side need
+// ports of their own.
+// The interface must exist before calling this method (e.g. call interface.Create() before), otherwise the error
+// matches ErrIfaceNotFound
+func Configure(iface string, privateKey string, port int) error {
 
 	log.Debugf("configuring Wireguard interface %s", iface)
 
 	log.Debugf("adding Wireguard private key")
 	key, err := wgtypes.ParseKey(privateKey)
 	if err != nil {
-		return err
+		return wrapError("configure", iface, err)
 	}
 	fwmark := 0
-	p := WgPort
+	p := port
+	if p == 0 {
+		p = WgPort
+	}
 	config := wgtypes.Config{
 		PrivateKey:   &key,
 		ReplacePeers: false,
@@ -118,7 +166,7 @@ func Configure(iface string, privateKey string) error {
 		ListenPort:   &p,
 	}
 
-	return configureDevice(iface, config)
+	return wrapError("configure", iface, configureDevice(iface, config))
 }
 
 // GetListenPort returns the listening port of the Wireguard endpoint
@@ -128,22 +176,32 @@ func GetListenPort(iface string) (*int, error) {
 	//discover Wireguard current configuration
 	wg, err := wgctrl.New()
 	if err != nil {
-		return nil, err
+		return nil, wrapError("get listen port of", iface, err)
 	}
 	defer wg.Close()
 
 	d, err := wg.Device(iface)
 	if err != nil {
-		return nil, err
+		return nil, wrapError("get listen port of", iface, err)
 	}
 	log.Debugf("got Wireguard device listen port %s, %d", iface, d.ListenPort)
 
 	return &d.ListenPort, nil
 }
 
+// parsePeerKey parses the Wireguard public key of a peer. A malformed key is reported instead of configuring a peer
+// that never handshakes
+func parsePeerKey(peerKey string) (wgtypes.Key, error) {
+	key, err := wgtypes.ParseKey(peerKey)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("invalid Wireguard public key %q of peer: %w", peerKey, err)
+	}
+	return key, nil
+}
+
 // UpdatePeer updates existing Wireguard Peer or creates a new one if doesn't exist
-// Endpoint is optional
-func UpdatePeer(iface string, peerKey string, allowedIps string, keepAlive time.Duration, endpoint string) error {
+// Endpoint and preSharedKey are optional
+func UpdatePeer(iface string, peerKey string, allowedIps string, keepAlive time.Duration, endpoint string, preSharedKey *wgtypes.Key) error {
 
 	log.Debugf("updating interface %s peer %s: endpoint %s ", iface, peerKey, endpoint)
 
@@ -153,15 +211,21 @@ func UpdatePeer(iface string, peerKey string, allowedIps string, keepAlive time.
 		return err
 	}
 
-	peerKeyParsed, err := wgtypes.ParseKey(peerKey)
+	peerKeyParsed, err := parsePeerKey(peerKey)
 	if err != nil {
 		return err
 	}
+	// a zero key removes a preshared key the peer might have been configured with before
+	psk := wgtypes.Key{}
+	if preSharedKey != nil {
+		psk = *preSharedKey
+	}
 	peer := wgtypes.PeerConfig{
 		PublicKey:                   peerKeyParsed,
 		ReplaceAllowedIPs:           true,
 		AllowedIPs:                  []net.IPNet{*ipNet},
 		PersistentKeepaliveInterval: &keepAlive,
+		PresharedKey:                &psk,
 	}
 
 	config := wgtypes.Config{
@@ -186,14 +250,15 @@ func UpdatePeerEndpoint(iface string, peerKey string, newEndpoint string) error
 
 	log.Debugf("updating peer %s endpoint %s ", peerKey, newEndpoint)
 
-	peerAddr, err := net.ResolveUDPAddr("udp4", newEndpoint)
+	// IPv4 and IPv6 endpoints, e.g. 1.2.3.4:51820 or [2001:db8::1]:51820
+	peerAddr, err := net.ResolveUDPAddr("udp", newEndpoint)
 	if err != nil {
 		return err
 	}
 
 	log.Debugf("parsed peer endpoint [%s]", peerAddr.String())
 
-	peerKeyParsed, err := wgtypes.ParseKey(peerKey)
+	peerKeyParsed, err := parsePeerKey(peerKey)
 	if err != nil {
 		return err
 	}
@@ -210,11 +275,37 @@ func UpdatePeerEndpoint(iface string, peerKey string, newEndpoint string) error
 	return configureDevice(iface, config)
 }
 
+// GetPeer returns the Wireguard Peer of the interface iface (e.g. its endpoint and last handshake time)
+func GetPeer(iface string, peerKey string) (*wgtypes.Peer, error) {
+	peerKeyParsed, err := parsePeerKey(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wg, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer wg.Close()
+
+	d, err := wg.Device(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, peer := range d.Peers {
+		if peer.PublicKey == peerKeyParsed {
+			return &peer, nil
+		}
+	}
+	return nil, fmt.Errorf("peer %s not found on interface %s", peerKey, iface)
+}
+
 // RemovePeer removes a Wireguard Peer from the interface iface
 func RemovePeer(iface string, peerKey string) error {
 	log.Debugf("Removing peer %s from interface %s ", peerKey, iface)
 
-	peerKeyParsed, err := wgtypes.ParseKey(peerKey)
+	peerKeyParsed, err := parsePeerKey(peerKey)
 	if err != nil {
 		return err
 	}
@@ -4,6 +4,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"net"
 	"os/exec"
+	"strconv"
 	"strings"
 )
 
@@ -38,7 +39,80 @@ func addRoute(iface string, ipNet *net.IPNet) error {
 	return nil
 }
 
+// removeRoute removes the network route of the range provided
+func removeRoute(iface string, ipNet *net.IPNet) error {
+	cmd := exec.Command("route", "delete", "-net", ipNet.String(), "-interface", iface)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Infof("Command: %v failed with output %s and error: ", cmd.String(), out)
+		return err
+	}
+	return nil
+}
+
+// UpdateAddress replaces the IP address of an existing interface without recreating it.
+// Other addresses of the interface and the routes of their ranges are removed after the new one has been set
+func UpdateAddress(iface string, address string) error {
+	ip, ipNet, err := net.ParseCIDR(address)
+	if err != nil {
+		return err
+	}
+
+	previous, err := interfaceIPv4Addrs(iface)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("replacing address of interface %s with %s", iface, address)
+	err = assignAddr(address, iface)
+	if err != nil {
+		return err
+	}
+
+	// ifconfig replaces the first address of the interface, the aliases are left
+	current, err := interfaceIPv4Addrs(iface)
+	if err != nil {
+		return err
+	}
+	for _, addr := range current {
+		if addr.IP.Equal(ip) {
+			continue
+		}
+		cmd := exec.Command("ifconfig", iface, "inet", addr.IP.String(), "-alias")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Infof("Command: %v failed with output %s and error: ", cmd.String(), out)
+			return err
+		}
+	}
+
+	for _, addr := range previous {
+		prevNet := &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+		if prevNet.String() == ipNet.String() {
+			continue
+		}
+		err = removeRoute(iface, prevNet)
+		if err != nil {
+			log.Infoln("Removing route failed with error:", err)
+		}
+	}
+	return nil
+}
+
+// SetMTU changes the MTU of an existing interface, MTUs below MinMTU are rejected
+func SetMTU(iface string, mtu int) error {
+	err := validateMTU(mtu)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("ifconfig", iface, "mtu", strconv.Itoa(mtu))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Infof("Command: %v failed with output %s and error: ", cmd.String(), out)
+		return err
+	}
+	return nil
+}
+
 // Closes the tunnel interface
-func Close() error {
+func Close(iface string) error {
 	return CloseWithUserspace()
 }
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
-	"golang.zx2c4.com/wireguard/wgctrl"
 	"os"
 )
 
@@ -21,7 +20,8 @@ func Create(iface string, address string) error {
 }
 
 // CreateWithKernel Creates a new Wireguard interface using kernel Wireguard module.
-// Works for Linux and offers much better network performance
+// Works for Linux and offers much better network performance.
+// Errors are of type *Error and match the sentinel error of a known condition, e.g. ErrKernelModuleMissing
 func CreateWithKernel(iface string, address string) error {
 	attrs := netlink.NewLinkAttrs()
 	attrs.Name = iface
@@ -35,12 +35,13 @@ func CreateWithKernel(iface string, address string) error {
 	if os.IsExist(err) {
 		log.Infof("interface %s already exists. Will reuse.", iface)
 	} else if err != nil {
-		return err
+		// an unsupported link type means the wireguard module isn't available
+		return wrapError("create", iface, err)
 	}
 
 	err = assignAddr(address, iface)
 	if err != nil {
-		return err
+		return wrapError("create", iface, err)
 	}
 
 	// todo do a discovery
@@ -48,14 +49,14 @@ func CreateWithKernel(iface string, address string) error {
 	err = netlink.LinkSetMTU(&link, defaultMTU)
 	if err != nil {
 		log.Errorf("error setting MTU on interface: %s", iface)
-		return err
+		return wrapError("create", iface, err)
 	}
 
 	log.Debugf("bringing up interface: %s", iface)
 	err = netlink.LinkSetUp(&link)
 	if err != nil {
 		log.Errorf("error bringing up interface: %s", iface)
-		return err
+		return wrapError("create", iface, err)
 	}
 
 	return nil
@@ -98,6 +99,62 @@ func assignAddr(address, name string) error {
 	return err
 }
 
+// UpdateAddress replaces the IP address of an existing interface without recreating it.
+// Other addresses of the interface are removed after the new one has been set
+func UpdateAddress(iface string, address string) error {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = iface
+
+	link := wgLink{
+		attrs: &attrs,
+	}
+
+	addr, err := netlink.ParseAddr(address)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("replacing address of interface %s with %s", iface, address)
+	err = netlink.AddrReplace(&link, addr)
+	if err != nil {
+		return err
+	}
+
+	list, err := netlink.AddrList(&link, 0)
+	if err != nil {
+		return err
+	}
+	for _, a := range list {
+		if a.Equal(*addr) {
+			continue
+		}
+		err = netlink.AddrDel(&link, &a)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetMTU changes the MTU of an existing interface, MTUs below MinMTU are rejected
+func SetMTU(iface string, mtu int) error {
+	err := validateMTU(mtu)
+	if err != nil {
+		return err
+	}
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = iface
+
+	link := wgLink{
+		attrs: &attrs,
+	}
+
+	log.Debugf("setting MTU: %d interface: %s", mtu, iface)
+	return netlink.LinkSetMTU(&link, mtu)
+}
+
 type wgLink struct {
 	attrs *netlink.LinkAttrs
 }
@@ -112,30 +169,18 @@ func (w *wgLink) Type() string {
 	return "wireguard"
 }
 
-// Closes the tunnel interface
-func Close() error {
+// Close closes the tunnel interface, the other Wireguard interfaces (e.g. of other profiles) are left alone
+func Close(iface string) error {
 
 	if tunIface != nil {
 		return CloseWithUserspace()
 	} else {
-		var iface = ""
-		wg, err := wgctrl.New()
-		if err != nil {
-			return err
-		}
-		defer wg.Close()
-		devList, err := wg.Devices()
+		exists, err := Exists(iface)
 		if err != nil {
 			return err
 		}
-		for _, wgDev := range devList {
-			if wgDev.ListenPort == WgPort {
-				iface = wgDev.Name
-				break
-			}
-		}
-		if iface == "" {
-			return fmt.Errorf("Wireguard Interface not found")
+		if !*exists {
+			return wrapErrorAs("close", iface, fmt.Errorf("Wireguard interface not found"), ErrIfaceNotFound)
 		}
 		attrs := netlink.NewLinkAttrs()
 		attrs.Name = iface
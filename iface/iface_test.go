@@ -1,11 +1,15 @@
 package iface
 
 import (
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"net"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -38,7 +42,7 @@ func Test_CreateInterface(t *testing.T) {
 }
 
 func Test_ConfigureInterface(t *testing.T) {
-	err := Configure(ifaceName, key)
+	err := Configure(ifaceName, key, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -62,7 +66,11 @@ func Test_UpdatePeer(t *testing.T) {
 	keepAlive := 15 * time.Second
 	allowedIP := "10.99.99.2/32"
 	endpoint := "127.0.0.1:9900"
-	err := UpdatePeer(ifaceName, peerPubKey, allowedIP, keepAlive, endpoint)
+	preSharedKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = UpdatePeer(ifaceName, peerPubKey, allowedIP, keepAlive, endpoint, &preSharedKey)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -92,6 +100,9 @@ func Test_UpdatePeer(t *testing.T) {
 	if !foundAllowedIP {
 		t.Fatal("configured peer with mismatched Allowed IPs")
 	}
+	if peer.PresharedKey != preSharedKey {
+		t.Fatal("configured peer with mismatched preshared key")
+	}
 }
 
 func Test_UpdatePeerEndpoint(t *testing.T) {
@@ -111,6 +122,54 @@ func Test_UpdatePeerEndpoint(t *testing.T) {
 	}
 }
 
+func Test_UpdatePeerEndpoint_IPv6(t *testing.T) {
+	newEndpoint := "[2001:db8::1]:9999"
+	err := UpdatePeerEndpoint(ifaceName, peerPubKey, newEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := getPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peer.Endpoint.String() != newEndpoint {
+		t.Fatal("configured peer with mismatched endpoint")
+	}
+}
+
+func Test_UpdatePeer_InvalidKey(t *testing.T) {
+	invalidKeys := []string{"", "invalid", "c2hvcnQ=", peerPubKey + "AAAA"}
+	for _, invalidKey := range invalidKeys {
+		err := UpdatePeer(ifaceName, invalidKey, "10.99.99.3/32", 15*time.Second, "127.0.0.1:9901", nil)
+		if err == nil || !strings.Contains(err.Error(), "invalid Wireguard public key") {
+			t.Errorf("expecting UpdatePeer to reject key %q, got %v", invalidKey, err)
+		}
+
+		err = UpdatePeerEndpoint(ifaceName, invalidKey, "127.0.0.1:9901")
+		if err == nil || !strings.Contains(err.Error(), "invalid Wireguard public key") {
+			t.Errorf("expecting UpdatePeerEndpoint to reject key %q, got %v", invalidKey, err)
+		}
+	}
+
+	// no bogus peer (e.g. with an all-zero key) has been configured
+	wg, err := wgctrl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wg.Close()
+	device, err := wg.Device(ifaceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, peer := range device.Peers {
+		if peer.PublicKey.String() != peerPubKey {
+			t.Errorf("expecting only peer %s to be configured, got %s", peerPubKey, peer.PublicKey)
+		}
+	}
+}
+
 func Test_RemovePeer(t *testing.T) {
 	err := RemovePeer(ifaceName, peerPubKey)
 	if err != nil {
@@ -121,8 +180,75 @@ func Test_RemovePeer(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func Test_UpdateAddress(t *testing.T) {
+	newIP := "10.99.98.1"
+	err := UpdateAddress(ifaceName, newIP+"/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	netIface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() == newIP {
+			found = true
+		}
+		if ip.String() == "10.99.99.1" {
+			t.Errorf("expecting the old address to be removed from the interface")
+		}
+	}
+	if !found {
+		t.Errorf("expecting interface to have address %s, got %v", newIP, addrs)
+	}
+}
+
+func Test_SetMTU(t *testing.T) {
+	err := SetMTU(ifaceName, 1400)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtu, err := GetMTU(ifaceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu != 1400 {
+		t.Errorf("expecting interface MTU 1400, got %d", mtu)
+	}
+
+	err = SetMTU(ifaceName, MinMTU-1)
+	if err == nil {
+		t.Errorf("expecting MTU below %d to be rejected", MinMTU)
+	}
+}
+
+func Test_GetListenPort_NotFound(t *testing.T) {
+	_, err := GetListenPort("wt-missing")
+	if !errors.Is(err, ErrIfaceNotFound) {
+		t.Errorf("expecting %v getting the listen port of a missing interface, got %v", ErrIfaceNotFound, err)
+	}
+
+	err = Configure("wt-missing", key, 0)
+	if !errors.Is(err, ErrIfaceNotFound) {
+		t.Errorf("expecting %v configuring a missing interface, got %v", ErrIfaceNotFound, err)
+	}
+}
+
 func Test_Close(t *testing.T) {
-	err := Close()
+	err := Close(ifaceName)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -146,3 +272,71 @@ func getPeer() (wgtypes.Peer, error) {
 	}
 	return emptyPeer, fmt.Errorf("peer not found")
 }
+
+func Test_ValidateName(t *testing.T) {
+	validNames := []string{"wt0", "wt1", ifaceName, "wiretrustee0123"}
+	for _, name := range validNames {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("expecting interface name %s to be valid, got %v", name, err)
+		}
+	}
+
+	invalidNames := []string{"", "wiretrustee01234", "wt/0", "wt 0"}
+	for _, name := range invalidNames {
+		if err := ValidateName(name); err == nil {
+			t.Errorf("expecting interface name %q to be invalid", name)
+		}
+	}
+}
+
+func Test_WrapError(t *testing.T) {
+	type testCase struct {
+		name     string
+		err      error
+		expected error
+	}
+
+	testCases := []testCase{
+		{name: "not root", err: syscall.EPERM, expected: ErrNotPrivileged},
+		{name: "access denied", err: &os.PathError{Op: "open", Path: "/dev/net/tun", Err: syscall.EACCES}, expected: ErrNotPrivileged},
+		{name: "name taken", err: syscall.EEXIST, expected: ErrIfaceExists},
+		{name: "tun busy", err: syscall.EBUSY, expected: ErrIfaceExists},
+		{name: "wireguard link type unknown", err: syscall.EOPNOTSUPP, expected: ErrKernelModuleMissing},
+		{name: "no such device", err: syscall.ENODEV, expected: ErrIfaceNotFound},
+		{name: "wgctrl device missing", err: os.ErrNotExist, expected: ErrIfaceNotFound},
+		{name: "wrapped", err: fmt.Errorf("netlink: %w", syscall.EPERM), expected: ErrNotPrivileged},
+	}
+
+	sentinels := []error{ErrIfaceExists, ErrNotPrivileged, ErrKernelModuleMissing, ErrIfaceNotFound}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := wrapError("create", "wt0", testCase.err)
+			if !errors.Is(err, testCase.expected) {
+				t.Errorf("expecting %v, got %v", testCase.expected, err)
+			}
+			for _, sentinel := range sentinels {
+				if sentinel != testCase.expected && errors.Is(err, sentinel) {
+					t.Errorf("expecting error not to match %v, got %v", sentinel, err)
+				}
+			}
+			if !errors.Is(err, testCase.err) {
+				t.Errorf("expecting the underlying error %v to be kept, got %v", testCase.err, err)
+			}
+			// wrapping again keeps the operation and the kind
+			if rewrapped := wrapError("configure", "wt0", err); rewrapped != err {
+				t.Errorf("expecting an interface error not to be wrapped twice, got %v", rewrapped)
+			}
+		})
+	}
+
+	unknown := wrapError("create", "wt0", fmt.Errorf("unexpected"))
+	for _, sentinel := range sentinels {
+		if errors.Is(unknown, sentinel) {
+			t.Errorf("expecting an unknown error not to match %v", sentinel)
+		}
+	}
+	if wrapError("create", "wt0", nil) != nil {
+		t.Errorf("expecting no error to stay nil")
+	}
+}
@@ -2,6 +2,7 @@ package iface
 
 import (
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wireguard/ipc"
 	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
@@ -40,7 +41,77 @@ func getUAPI(iface string) (net.Listener, error) {
 	return ipc.UAPIListen(iface)
 }
 
+// UpdateAddress replaces the IP address of an existing interface without recreating it.
+// Other addresses of the interface are removed after the new one has been set
+func UpdateAddress(iface string, address string) error {
+	nativeTunDevice := tunIface.(*tun.NativeTun)
+	luid := winipcfg.LUID(nativeTunDevice.LUID())
+
+	ip, ipnet, err := net.ParseCIDR(address)
+	if err != nil {
+		return err
+	}
+
+	previous, err := interfaceIPv4Addrs(iface)
+	if err != nil {
+		return err
+	}
+
+	assigned := false
+	for _, addr := range previous {
+		if addr.IP.Equal(ip) {
+			assigned = true
+		}
+	}
+	if !assigned {
+		log.Debugf("adding address %s to interface: %s", address, iface)
+		err = luid.AddIPAddress(net.IPNet{IP: ip, Mask: ipnet.Mask})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, addr := range previous {
+		if addr.IP.Equal(ip) {
+			continue
+		}
+		log.Debugf("removing address %s from interface: %s", addr, iface)
+		err = luid.DeleteIPAddress(*addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Debugf("replacing Routes of interface: %s", iface)
+	return luid.SetRoutes([]*winipcfg.RouteData{{*ipnet, ipnet.IP, 0}})
+}
+
+// SetMTU changes the MTU of an existing interface, MTUs below MinMTU are rejected
+func SetMTU(iface string, mtu int) error {
+	err := validateMTU(mtu)
+	if err != nil {
+		return err
+	}
+
+	nativeTunDevice := tunIface.(*tun.NativeTun)
+	luid := winipcfg.LUID(nativeTunDevice.LUID())
+
+	log.Debugf("setting MTU: %d interface: %s", mtu, iface)
+	ipInterface, err := luid.IPInterface(windows.AF_INET)
+	if err != nil {
+		return err
+	}
+	ipInterface.NLMTU = uint32(mtu)
+	err = ipInterface.Set()
+	if err != nil {
+		return err
+	}
+
+	nativeTunDevice.ForceMTU(mtu)
+	return nil
+}
+
 // Closes the tunnel interface
-func Close() error {
+func Close(iface string) error {
 	return CloseWithUserspace()
 }
@@ -3,6 +3,7 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"github.com/cenkalti/backoff/v4"
 	"github.com/matishsiao/goInfo"
 	log "github.com/sirupsen/logrus"
@@ -13,6 +14,7 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 	"io"
+	"net"
 	"time"
 )
 
@@ -21,6 +23,10 @@ type Client struct {
 	realClient proto.ManagementServiceClient
 	ctx        context.Context
 	conn       *grpc.ClientConn
+	// region is sent with the system info, see SetRegion
+	region string
+	// onDisconnect is called when the Sync stream breaks, see SetDisconnectHandler
+	onDisconnect func(err error)
 }
 
 // NewClient creates a new client to Management service
@@ -59,6 +65,18 @@ func NewClient(ctx context.Context, addr string, ourPrivateKey wgtypes.Key, tlsE
 	}, nil
 }
 
+// SetRegion sets the region of the peer (e.g. eu-central) sent to the Management Service on registration and login.
+// The Management Service distributes it to the other peers, TURN servers of the same region are preferred
+func (c *Client) SetRegion(region string) {
+	c.region = region
+}
+
+// SetDisconnectHandler sets a function called every time the Sync stream breaks or can't be opened, before it is
+// reconnected. It must be set before calling Sync
+func (c *Client) SetDisconnectHandler(handler func(err error)) {
+	c.onDisconnect = handler
+}
+
 // Close closes connection to the Management Service
 func (c *Client) Close() error {
 	return c.conn.Close()
@@ -80,7 +98,12 @@ func (c *Client) Sync(msgHandler func(msg *proto.SyncResponse) error) {
 			Clock:               backoff.SystemClock,
 		}
 
-		operation := func() error {
+		operation := func() (err error) {
+			defer func() {
+				if err != nil && c.onDisconnect != nil {
+					c.onDisconnect(err)
+				}
+			}()
 
 			// todo we already have it since we did the Login, maybe cache it locally?
 			serverPubKey, err := c.GetServerPublicKey()
@@ -206,6 +229,18 @@ func (c *Client) login(serverKey wgtypes.Key, req *proto.LoginRequest) (*proto.L
 // Takes care of encrypting and decrypting messages.
 // This method will also collect system info and send it with the request (e.g. hostname, os, etc)
 func (c *Client) Register(serverKey wgtypes.Key, setupKey string) (*proto.LoginResponse, error) {
+	return c.login(serverKey, &proto.LoginRequest{SetupKey: setupKey, Meta: systemMeta(c.region)})
+}
+
+// RegisterWithToken registers peer on Management Server with a JWT of the identity provider instead of a setup key.
+// The Management Server maps the token to the account the peer joins.
+// Same as Register this method collects system info and sends it with the request
+func (c *Client) RegisterWithToken(serverKey wgtypes.Key, jwtToken string) (*proto.LoginResponse, error) {
+	return c.login(serverKey, &proto.LoginRequest{JwtToken: jwtToken, Meta: systemMeta(c.region)})
+}
+
+// systemMeta collects the system info sent with the registration request together with the region of the peer
+func systemMeta(region string) *proto.PeerSystemMeta {
 	gi := goInfo.GetInfo()
 	meta := &proto.PeerSystemMeta{
 		Hostname:           gi.Hostname,
@@ -215,12 +250,76 @@ func (c *Client) Register(serverKey wgtypes.Key, setupKey string) (*proto.LoginR
 		Platform:           gi.Platform,
 		Kernel:             gi.Kernel,
 		WiretrusteeVersion: "",
+		Region:             region,
 	}
 	log.Debugf("detected system %v", meta)
-	return c.login(serverKey, &proto.LoginRequest{SetupKey: setupKey, Meta: meta})
+	return meta
+}
+
+// RotateKey replaces the Wireguard public key of the registered peer with newPubKey keeping the peer identity (IP, name and groups).
+// The request is sent with the current key of the client, afterwards the peer has to log in with the new key
+// (e.g. with a new Client)
+func (c *Client) RotateKey(serverKey wgtypes.Key, newPubKey wgtypes.Key) (*proto.LoginResponse, error) {
+	rotateReq, err := encryption.EncryptMessage(serverKey, c.key, &proto.RotateKeyRequest{NewWgPubKey: newPubKey.String()})
+	if err != nil {
+		log.Errorf("failed to encrypt message: %s", err)
+		return nil, err
+	}
+	mgmCtx, cancel := context.WithTimeout(c.ctx, 5*time.Second) //todo make a general setting
+	defer cancel()
+	resp, err := c.realClient.RotateKey(mgmCtx, &proto.EncryptedMessage{
+		WgPubKey: c.key.PublicKey().String(),
+		Body:     rotateReq,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	loginResp := &proto.LoginResponse{}
+	err = encryption.DecryptMessage(serverKey, c.key, resp.Body, loginResp)
+	if err != nil {
+		log.Errorf("failed to decrypt key rotation message: %s", err)
+		return nil, err
+	}
+
+	return loginResp, nil
+}
+
+// GetPeerIP returns the IP the Management Service has assigned to the peer of the client without logging in.
+// An unregistered peer gets codes.NotFound
+func (c *Client) GetPeerIP(serverKey wgtypes.Key) (net.IP, error) {
+	ipReq, err := encryption.EncryptMessage(serverKey, c.key, &proto.GetPeerIPRequest{})
+	if err != nil {
+		log.Errorf("failed to encrypt message: %s", err)
+		return nil, err
+	}
+	mgmCtx, cancel := context.WithTimeout(c.ctx, 5*time.Second) //todo make a general setting
+	defer cancel()
+	resp, err := c.realClient.GetPeerIP(mgmCtx, &proto.EncryptedMessage{
+		WgPubKey: c.key.PublicKey().String(),
+		Body:     ipReq,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ipResp := &proto.PeerIPResponse{}
+	err = encryption.DecryptMessage(serverKey, c.key, resp.Body, ipResp)
+	if err != nil {
+		log.Errorf("failed to decrypt peer IP message: %s", err)
+		return nil, err
+	}
+
+	ip := net.ParseIP(ipResp.GetIp())
+	if ip == nil {
+		return nil, fmt.Errorf("received invalid peer IP %s", ipResp.GetIp())
+	}
+
+	return ip, nil
 }
 
 // Login attempts login to Management Server. Takes care of encrypting and decrypting messages.
+// The system info is sent along so that a changed region of the peer gets applied
 func (c *Client) Login(serverKey wgtypes.Key) (*proto.LoginResponse, error) {
-	return c.login(serverKey, &proto.LoginRequest{})
+	return c.login(serverKey, &proto.LoginRequest{Meta: systemMeta(c.region)})
 }
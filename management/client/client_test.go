@@ -12,6 +12,7 @@ import (
 	"google.golang.org/grpc/status"
 	"net"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -117,6 +118,42 @@ func TestClient_LoginRegistered(t *testing.T) {
 	}
 }
 
+func TestClient_GetPeerIP(t *testing.T) {
+	serverKey, err := tested.GetServerPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(context.TODO(), serverAddr, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.GetPeerIP(*serverKey)
+	if s, ok := status.FromError(err); !ok || s.Code() != codes.NotFound {
+		t.Errorf("expecting err code %d on IP lookup of unregistered peer got %v", codes.NotFound, err)
+	}
+
+	// the tested client is registered already, registering another peer would show up in the Sync of the tested client
+	resp, err := tested.Register(*serverKey, ValidKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := tested.GetPeerIP(*serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.TrimSuffix(resp.GetPeerConfig().GetAddress(), "/24")
+	if ip.String() != expected {
+		t.Errorf("expecting peer IP %s got %s", expected, ip)
+	}
+}
+
 func TestClient_Sync(t *testing.T) {
 	serverKey, err := tested.GetServerPublicKey()
 	if err != nil {
@@ -18,7 +18,7 @@ const _ = grpc.SupportPackageIsVersion7
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type ManagementServiceClient interface {
-	// Login logs in peer. In case server returns codes.PermissionDenied this endpoint can be used to register Peer providing LoginRequest.setupKey
+	// Login logs in peer. In case server returns codes.PermissionDenied this endpoint can be used to register Peer providing LoginRequest.setupKey or LoginRequest.jwtToken
 	Login(ctx context.Context, in *EncryptedMessage, opts ...grpc.CallOption) (*EncryptedMessage, error)
 	// Sync enables peer synchronization. Each peer that is connected to this stream will receive updates from the server.
 	// For example, if a new peer has been added to an account all other connected peers will receive this peer's Wireguard public key as an update
@@ -29,6 +29,17 @@ type ManagementServiceClient interface {
 	GetServerKey(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ServerKeyResponse, error)
 	// health check endpoint
 	IsHealthy(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Empty, error)
+	// RotateKey replaces the Wireguard public key of a registered peer keeping its identity (IP, name and groups).
+	// The EncryptedMessage is sent with the current key of the peer and the body is a RotateKeyRequest.
+	// The response body is a LoginResponse of the peer
+	RotateKey(ctx context.Context, in *EncryptedMessage, opts ...grpc.CallOption) (*EncryptedMessage, error)
+	// GetPeerIP returns the IP assigned to a registered peer, e.g. to set up the interface before the first Sync.
+	// The EncryptedMessage is sent with the key of the peer and the body is a GetPeerIPRequest, a peer can only query its own IP.
+	// The response body is a PeerIPResponse
+	GetPeerIP(ctx context.Context, in *EncryptedMessage, opts ...grpc.CallOption) (*EncryptedMessage, error)
+	// SubscribeEvents streams peer events (e.g. peer connected or removed) of an account to external systems like monitoring.
+	// The caller is authenticated with a JWT sent in the "authorization" metadata as "Bearer <token>"
+	SubscribeEvents(ctx context.Context, in *Empty, opts ...grpc.CallOption) (ManagementService_SubscribeEventsClient, error)
 }
 
 type managementServiceClient struct {
@@ -98,11 +109,61 @@ func (c *managementServiceClient) IsHealthy(ctx context.Context, in *Empty, opts
 	return out, nil
 }
 
+func (c *managementServiceClient) RotateKey(ctx context.Context, in *EncryptedMessage, opts ...grpc.CallOption) (*EncryptedMessage, error) {
+	out := new(EncryptedMessage)
+	err := c.cc.Invoke(ctx, "/management.ManagementService/RotateKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementServiceClient) GetPeerIP(ctx context.Context, in *EncryptedMessage, opts ...grpc.CallOption) (*EncryptedMessage, error) {
+	out := new(EncryptedMessage)
+	err := c.cc.Invoke(ctx, "/management.ManagementService/GetPeerIP", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managementServiceClient) SubscribeEvents(ctx context.Context, in *Empty, opts ...grpc.CallOption) (ManagementService_SubscribeEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ManagementService_ServiceDesc.Streams[1], "/management.ManagementService/SubscribeEvents", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &managementServiceSubscribeEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ManagementService_SubscribeEventsClient interface {
+	Recv() (*PeerEvent, error)
+	grpc.ClientStream
+}
+
+type managementServiceSubscribeEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *managementServiceSubscribeEventsClient) Recv() (*PeerEvent, error) {
+	m := new(PeerEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // ManagementServiceServer is the server API for ManagementService service.
 // All implementations must embed UnimplementedManagementServiceServer
 // for forward compatibility
 type ManagementServiceServer interface {
-	// Login logs in peer. In case server returns codes.PermissionDenied this endpoint can be used to register Peer providing LoginRequest.setupKey
+	// Login logs in peer. In case server returns codes.PermissionDenied this endpoint can be used to register Peer providing LoginRequest.setupKey or LoginRequest.jwtToken
 	Login(context.Context, *EncryptedMessage) (*EncryptedMessage, error)
 	// Sync enables peer synchronization. Each peer that is connected to this stream will receive updates from the server.
 	// For example, if a new peer has been added to an account all other connected peers will receive this peer's Wireguard public key as an update
@@ -113,6 +174,17 @@ type ManagementServiceServer interface {
 	GetServerKey(context.Context, *Empty) (*ServerKeyResponse, error)
 	// health check endpoint
 	IsHealthy(context.Context, *Empty) (*Empty, error)
+	// RotateKey replaces the Wireguard public key of a registered peer keeping its identity (IP, name and groups).
+	// The EncryptedMessage is sent with the current key of the peer and the body is a RotateKeyRequest.
+	// The response body is a LoginResponse of the peer
+	RotateKey(context.Context, *EncryptedMessage) (*EncryptedMessage, error)
+	// GetPeerIP returns the IP assigned to a registered peer, e.g. to set up the interface before the first Sync.
+	// The EncryptedMessage is sent with the key of the peer and the body is a GetPeerIPRequest, a peer can only query its own IP.
+	// The response body is a PeerIPResponse
+	GetPeerIP(context.Context, *EncryptedMessage) (*EncryptedMessage, error)
+	// SubscribeEvents streams peer events (e.g. peer connected or removed) of an account to external systems like monitoring.
+	// The caller is authenticated with a JWT sent in the "authorization" metadata as "Bearer <token>"
+	SubscribeEvents(*Empty, ManagementService_SubscribeEventsServer) error
 	mustEmbedUnimplementedManagementServiceServer()
 }
 
@@ -132,6 +204,15 @@ func (UnimplementedManagementServiceServer) GetServerKey(context.Context, *Empty
 func (UnimplementedManagementServiceServer) IsHealthy(context.Context, *Empty) (*Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method IsHealthy not implemented")
 }
+func (UnimplementedManagementServiceServer) RotateKey(context.Context, *EncryptedMessage) (*EncryptedMessage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RotateKey not implemented")
+}
+func (UnimplementedManagementServiceServer) GetPeerIP(context.Context, *EncryptedMessage) (*EncryptedMessage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPeerIP not implemented")
+}
+func (UnimplementedManagementServiceServer) SubscribeEvents(*Empty, ManagementService_SubscribeEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeEvents not implemented")
+}
 func (UnimplementedManagementServiceServer) mustEmbedUnimplementedManagementServiceServer() {}
 
 // UnsafeManagementServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -220,6 +301,63 @@ func _ManagementService_IsHealthy_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _ManagementService_RotateKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EncryptedMessage)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagementServiceServer).RotateKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/management.ManagementService/RotateKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagementServiceServer).RotateKey(ctx, req.(*EncryptedMessage))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ManagementService_GetPeerIP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EncryptedMessage)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagementServiceServer).GetPeerIP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/management.ManagementService/GetPeerIP",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagementServiceServer).GetPeerIP(ctx, req.(*EncryptedMessage))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ManagementService_SubscribeEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(Empty)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ManagementServiceServer).SubscribeEvents(m, &managementServiceSubscribeEventsServer{stream})
+}
+
+type ManagementService_SubscribeEventsServer interface {
+	Send(*PeerEvent) error
+	grpc.ServerStream
+}
+
+type managementServiceSubscribeEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *managementServiceSubscribeEventsServer) Send(m *PeerEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // ManagementService_ServiceDesc is the grpc.ServiceDesc for ManagementService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -239,6 +377,14 @@ var ManagementService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "isHealthy",
 			Handler:    _ManagementService_IsHealthy_Handler,
 		},
+		{
+			MethodName: "RotateKey",
+			Handler:    _ManagementService_RotateKey_Handler,
+		},
+		{
+			MethodName: "GetPeerIP",
+			Handler:    _ManagementService_GetPeerIP_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -246,6 +392,11 @@ var ManagementService_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _ManagementService_Sync_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "SubscribeEvents",
+			Handler:       _ManagementService_SubscribeEvents_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "management.proto",
 }
@@ -6,6 +6,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,7 +14,9 @@ import (
 type AccountManager struct {
 	Store Store
 	// mutex to synchronise account operations (e.g. generating Peer IP address inside the Network)
-	mux sync.Mutex
+	mux sync.RWMutex
+	// eventBus delivers peer events (e.g. peer connected) to the subscribers
+	eventBus *EventBus
 }
 
 // Account represents a unique account of the system
@@ -22,18 +25,95 @@ type Account struct {
 	SetupKeys map[string]*SetupKey
 	Network   *Network
 	Peers     map[string]*Peer
+	// Rules control which peers of the account can reach each other. All peers can reach each other when empty
+	Rules map[string]*Rule
+	// ReservedIPs are addresses of the account network kept for the infrastructure (e.g. DNS), they are never assigned to peers
+	ReservedIPs []net.IP
+	// PresharedKeySecret is the secret the Wireguard preshared key of each pair of peers is derived from (see presharedKey),
+	// each pair shares its own key
+	PresharedKeySecret string
+	// RequireUniquePeerNames rejects adding or renaming a peer to a name another peer of the account has (case-insensitive,
+	// e.g. when the names are used as DNS records). Peers without a name aren't checked
+	RequireUniquePeerNames bool
+}
+
+//Copy copies Account object, modifying the copy doesn't affect the original
+func (a *Account) Copy() *Account {
+	setupKeys := make(map[string]*SetupKey, len(a.SetupKeys))
+	for id, key := range a.SetupKeys {
+		setupKeys[id] = key.Copy()
+	}
+
+	peers := make(map[string]*Peer, len(a.Peers))
+	for key, peer := range a.Peers {
+		peers[key] = peer.Copy()
+	}
+
+	var rules map[string]*Rule
+	if a.Rules != nil {
+		rules = make(map[string]*Rule, len(a.Rules))
+		for id, rule := range a.Rules {
+			rules[id] = rule.Copy()
+		}
+	}
+
+	var network *Network
+	if a.Network != nil {
+		networkCopy := *a.Network
+		network = &networkCopy
+	}
+
+	var reservedIPs []net.IP
+	if a.ReservedIPs != nil {
+		reservedIPs = make([]net.IP, len(a.ReservedIPs))
+		copy(reservedIPs, a.ReservedIPs)
+	}
+
+	return &Account{
+		Id:                     a.Id,
+		SetupKeys:              setupKeys,
+		Network:                network,
+		Peers:                  peers,
+		Rules:                  rules,
+		ReservedIPs:            reservedIPs,
+		PresharedKeySecret:     a.PresharedKeySecret,
+		RequireUniquePeerNames: a.RequireUniquePeerNames,
+	}
 }
 
 // NewManager creates a new AccountManager with a provided Store
 func NewManager(store Store) *AccountManager {
 	return &AccountManager{
-		Store: store,
-		mux:   sync.Mutex{},
+		Store:    store,
+		mux:      sync.RWMutex{},
+		eventBus: NewEventBus(),
 	}
 }
 
-//AddSetupKey generates a new setup key with a given name and type, and adds it to the specified account
-func (manager *AccountManager) AddSetupKey(accountId string, keyName string, keyType SetupKeyType, expiresIn time.Duration) (*SetupKey, error) {
+// SubscribePeerEvents returns a channel receiving peer events of a given account.
+// The channel has to be released with UnsubscribePeerEvents
+func (manager *AccountManager) SubscribePeerEvents(accountId string) chan *PeerEvent {
+	return manager.eventBus.Subscribe(accountId)
+}
+
+// UnsubscribePeerEvents closes a channel previously obtained with SubscribePeerEvents
+func (manager *AccountManager) UnsubscribePeerEvents(accountId string, channel chan *PeerEvent) {
+	manager.eventBus.Unsubscribe(accountId, channel)
+}
+
+// publishPeerEvent notifies subscribers of the account about a peer event
+func (manager *AccountManager) publishPeerEvent(eventType PeerEventType, accountId string, peer *Peer) {
+	manager.eventBus.Publish(&PeerEvent{
+		Type:      eventType,
+		AccountId: accountId,
+		PeerKey:   peer.Key,
+		PeerIP:    peer.IP,
+		Timestamp: time.Now(),
+	})
+}
+
+//AddSetupKey generates a new setup key with a given name, type and groups peers registered with it join, and adds it to the specified account
+func (manager *AccountManager) AddSetupKey(accountId string, keyName string, keyType SetupKeyType, expiresIn time.Duration, autoGroups []string) (*SetupKey, error) {
 	manager.mux.Lock()
 	defer manager.mux.Unlock()
 
@@ -42,7 +122,7 @@ func (manager *AccountManager) AddSetupKey(accountId string, keyName string, key
 		return nil, status.Errorf(codes.NotFound, "account not found")
 	}
 
-	setupKey := GenerateSetupKey(keyName, keyType, expiresIn)
+	setupKey := GenerateSetupKey(keyName, keyType, expiresIn, autoGroups...)
 	account.SetupKeys[setupKey.Key] = setupKey
 
 	err = manager.Store.SaveAccount(account)
@@ -105,8 +185,8 @@ func (manager *AccountManager) RenameSetupKey(accountId string, keyId string, ne
 	return keyCopy, nil
 }
 
-//GetAccount returns an existing account or error (NotFound) if doesn't exist
-func (manager *AccountManager) GetAccount(accountId string) (*Account, error) {
+//UpdateSetupKeyAutoGroups replaces the groups peers registered with the setup key join. Already registered peers aren't affected.
+func (manager *AccountManager) UpdateSetupKeyAutoGroups(accountId string, keyId string, autoGroups []string) (*SetupKey, error) {
 	manager.mux.Lock()
 	defer manager.mux.Unlock()
 
@@ -115,6 +195,32 @@ func (manager *AccountManager) GetAccount(accountId string) (*Account, error) {
 		return nil, status.Errorf(codes.NotFound, "account not found")
 	}
 
+	setupKey := getAccountSetupKeyById(account, keyId)
+	if setupKey == nil {
+		return nil, status.Errorf(codes.NotFound, "unknown setupKey %s", keyId)
+	}
+
+	keyCopy := setupKey.Copy()
+	keyCopy.AutoGroups = mergeGroups(nil, autoGroups)
+	account.SetupKeys[keyCopy.Key] = keyCopy
+	err = manager.Store.SaveAccount(account)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed updating account key")
+	}
+
+	return keyCopy, nil
+}
+
+//GetAccount returns an existing account or error (NotFound) if doesn't exist
+func (manager *AccountManager) GetAccount(accountId string) (*Account, error) {
+	manager.mux.RLock()
+	defer manager.mux.RUnlock()
+
+	account, err := manager.Store.GetAccount(accountId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "account not found")
+	}
+
 	return account, nil
 }
 
@@ -143,8 +249,8 @@ func (manager *AccountManager) GetOrCreateAccount(accountId string) (*Account, e
 
 //AccountExists checks whether account exists (returns true) or not (returns false)
 func (manager *AccountManager) AccountExists(accountId string) (*bool, error) {
-	manager.mux.Lock()
-	defer manager.mux.Unlock()
+	manager.mux.RLock()
+	defer manager.mux.RUnlock()
 
 	var res bool
 	_, err := manager.Store.GetAccount(accountId)
@@ -172,7 +278,7 @@ func (manager *AccountManager) AddAccount(accountId string) (*Account, error) {
 }
 
 func (manager *AccountManager) createAccount(accountId string) (*Account, error) {
-	account, _ := newAccountWithId(accountId)
+	account, _ := newAccountWithId(accountId, DefaultNetwork())
 
 	err := manager.Store.SaveAccount(account)
 	if err != nil {
@@ -182,8 +288,161 @@ func (manager *AccountManager) createAccount(accountId string) (*Account, error)
 	return account, nil
 }
 
-// newAccountWithId creates a new Account with a default SetupKey (doesn't store in a Store) and provided id
-func newAccountWithId(accountId string) (*Account, *SetupKey) {
+// CreateAccount generates a new Account with a random id and a provided network that peers will get their IPs from
+// and saves it to the Store. If the network is nil, the DefaultNetwork is used.
+func (manager *AccountManager) CreateAccount(network *net.IPNet) (*Account, error) {
+	accountNet := DefaultNetwork()
+	if network != nil {
+		accountNet = net.IPNet{IP: network.IP.Mask(network.Mask), Mask: network.Mask}
+	}
+
+	err := ValidateNetwork(accountNet)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid account network: %v", err)
+	}
+
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+
+	account, _ := newAccountWithId(uuid.New().String(), accountNet)
+
+	err = manager.Store.SaveAccount(account)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed creating account")
+	}
+
+	return account, nil
+}
+
+//SetReservedIPs replaces the addresses of the account network that must never be assigned to peers.
+//Peers already holding one of the addresses keep it
+func (manager *AccountManager) SetReservedIPs(accountId string, reservedIPs []net.IP) (*Account, error) {
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+
+	var updated *Account
+	err := manager.Store.Update(accountId, func(account *Account) error {
+		err := ValidateReservedIPs(account.Network.Net, reservedIPs)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid reserved IPs: %v", err)
+		}
+
+		account.ReservedIPs = make([]net.IP, len(reservedIPs))
+		copy(account.ReservedIPs, reservedIPs)
+		updated = account
+		return nil
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "failed saving reserved IPs")
+	}
+
+	return updated, nil
+}
+
+//SetRequireUniquePeerNames turns the unique peer names setting of the account on or off.
+//It can't be turned on while peers of the account share a name
+func (manager *AccountManager) SetRequireUniquePeerNames(accountId string, require bool) (*Account, error) {
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+
+	var updated *Account
+	err := manager.Store.Update(accountId, func(account *Account) error {
+		if require {
+			for _, peer := range account.Peers {
+				if account.peerNameTaken(peer.Name, peer.Key) {
+					return status.Errorf(codes.FailedPrecondition, "peer name %s is used by more than one peer, rename the peers first", peer.Name)
+				}
+			}
+		}
+
+		account.RequireUniquePeerNames = require
+		updated = account
+		return nil
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "failed saving unique peer names setting")
+	}
+
+	return updated, nil
+}
+
+// peerNameTaken checks whether a peer of the account other than the peer with exceptKey has the name (case-insensitive).
+// Empty names are never taken
+func (a *Account) peerNameTaken(name string, exceptKey string) bool {
+	if name == "" {
+		return false
+	}
+	for key, peer := range a.Peers {
+		if key != exceptKey && strings.EqualFold(peer.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// AccountStats is a summary of an account used by dashboards
+type AccountStats struct {
+	// PeersCount is the number of peers registered under the account
+	PeersCount int
+	// ConnectedPeersCount is the number of peers currently connected to the Management service
+	ConnectedPeersCount int
+	// SetupKeysCount is the number of setup keys of the account
+	SetupKeysCount int
+	// ActiveSetupKeysCount is the number of setup keys that can still be used (not expired, revoked or overused)
+	ActiveSetupKeysCount int
+	// UsedIPs is the number of the account network IPs assigned to peers
+	UsedIPs uint64
+	// UsableIPs is the number of the account network IPs that can be assigned to peers (all but the network address)
+	UsableIPs uint64
+	// NetworkUtilization is UsedIPs / UsableIPs
+	NetworkUtilization float64
+}
+
+// GetAccountStats returns a summary of peers, setup keys and network usage of the account
+func (manager *AccountManager) GetAccountStats(accountId string) (*AccountStats, error) {
+	manager.mux.RLock()
+	defer manager.mux.RUnlock()
+
+	account, err := manager.Store.GetAccount(accountId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "account not found")
+	}
+
+	stats := &AccountStats{
+		PeersCount:     len(account.Peers),
+		SetupKeysCount: len(account.SetupKeys),
+		UsedIPs:        uint64(len(account.Peers)),
+	}
+
+	for _, peer := range account.Peers {
+		if peer.Status != nil && peer.Status.Connected {
+			stats.ConnectedPeersCount++
+		}
+	}
+
+	for _, key := range account.SetupKeys {
+		if key.IsValid() {
+			stats.ActiveSetupKeysCount++
+		}
+	}
+
+	ones, bits := account.Network.Net.Mask.Size()
+	if hostBits := bits - ones; hostBits > 0 && hostBits < 64 {
+		stats.UsableIPs = (uint64(1) << uint(hostBits)) - 1
+		stats.NetworkUtilization = float64(stats.UsedIPs) / float64(stats.UsableIPs)
+	}
+
+	return stats, nil
+}
+
+// newAccountWithId creates a new Account with a default SetupKey (doesn't store in a Store), provided id and network
+func newAccountWithId(accountId string, accountNet net.IPNet) (*Account, *SetupKey) {
 
 	log.Debugf("creating new account")
 
@@ -192,7 +451,7 @@ func newAccountWithId(accountId string) (*Account, *SetupKey) {
 	setupKeys[setupKey.Key] = setupKey
 	network := &Network{
 		Id:  uuid.New().String(),
-		Net: net.IPNet{IP: net.ParseIP("100.64.0.0"), Mask: net.IPMask{255, 192, 0, 0}},
+		Net: accountNet,
 		Dns: ""}
 	peers := make(map[string]*Peer)
 
@@ -204,7 +463,7 @@ func newAccountWithId(accountId string) (*Account, *SetupKey) {
 // newAccount creates a new Account with a default SetupKey (doesn't store in a Store)
 func newAccount() (*Account, *SetupKey) {
 	accountId := uuid.New().String()
-	return newAccountWithId(accountId)
+	return newAccountWithId(accountId, DefaultNetwork())
 }
 
 func getAccountSetupKeyById(acc *Account, keyId string) *SetupKey {
@@ -6,6 +6,7 @@ import (
 	"google.golang.org/grpc/status"
 	"net"
 	"testing"
+	"time"
 )
 
 func TestAccountManager_AddAccount(t *testing.T) {
@@ -196,6 +197,380 @@ func TestAccountManager_AddPeer(t *testing.T) {
 	}
 
 }
+
+func TestAccountManager_CreateAccount(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	_, expectedNetwork, err := net.ParseCIDR("10.10.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := manager.CreateAccount(expectedNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if account.Network.Net.String() != expectedNetwork.String() {
+		t.Errorf("expected account to have Network = %v, got %v", expectedNetwork.String(), account.Network.Net.String())
+	}
+
+	var setupKey *SetupKey
+	for _, key := range account.SetupKeys {
+		setupKey = key
+	}
+
+	expectedPeerIPs := []string{"10.10.0.1", "10.10.0.2"}
+	for _, expectedPeerIP := range expectedPeerIPs {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peer, err := manager.AddPeer(setupKey.Key, Peer{
+			Key:  key.PublicKey().String(),
+			Meta: PeerSystemMeta{},
+			Name: expectedPeerIP,
+		})
+		if err != nil {
+			t.Fatalf("expecting peer to be added, got failure %v", err)
+		}
+
+		if !expectedNetwork.Contains(peer.IP) || peer.IP.String() != expectedPeerIP {
+			t.Errorf("expecting just added peer to have IP = %s, got %s", expectedPeerIP, peer.IP.String())
+		}
+	}
+
+	account, err = manager.CreateAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultNetwork := DefaultNetwork()
+	if account.Network.Net.String() != defaultNetwork.String() {
+		t.Errorf("expected account to have default Network = %v, got %v", defaultNetwork.String(), account.Network.Net.String())
+	}
+}
+
+func TestAccountManager_CreateAccountInvalidNetwork(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	invalidNetworks := []string{
+		// public range
+		"8.8.0.0/16",
+		// too small
+		"10.10.10.0/30",
+		// exceeds the private range
+		"172.0.0.0/8",
+		"fd00::/64",
+	}
+
+	for _, cidr := range invalidNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = manager.CreateAccount(network)
+		if errStatus, ok := status.FromError(err); !ok || errStatus.Code() != codes.InvalidArgument {
+			t.Errorf("expecting account creation with network %s to fail with InvalidArgument, got %v", cidr, err)
+		}
+	}
+}
+
+func TestAccountManager_AddPeerWithAutoGroups(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	account, err := manager.AddAccount("test_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contractorsKey, err := manager.AddSetupKey(account.Id, "contractors", SetupKeyReusable, DefaultSetupKeyDuration,
+		[]string{"contractors", "all", "contractors"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := manager.AddPeer(contractorsKey.Key, Peer{Key: key.PublicKey().String(), Meta: PeerSystemMeta{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertGroups(t, peer.Groups, []string{"contractors", "all"})
+
+	// registering again with a key having other groups keeps the groups the peer already has
+	_, err = manager.UpdateSetupKeyAutoGroups(account.Id, contractorsKey.Id, []string{"all", "support"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err = manager.AddPeer(contractorsKey.Key, Peer{Key: key.PublicKey().String(), Meta: PeerSystemMeta{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertGroups(t, peer.Groups, []string{"contractors", "all", "support"})
+}
+
+func assertGroups(t *testing.T, groups []string, expected []string) {
+	if len(groups) != len(expected) {
+		t.Fatalf("expecting groups %v, got %v", expected, groups)
+	}
+	for i, group := range expected {
+		if groups[i] != group {
+			t.Errorf("expecting groups %v, got %v", expected, groups)
+			return
+		}
+	}
+}
+
+func TestAccountManager_GetAccountStats(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	_, network, err := net.ParseCIDR("10.10.0.0/28")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := manager.CreateAccount(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var setupKey *SetupKey
+	for _, key := range account.SetupKeys {
+		setupKey = key
+	}
+
+	// 3 peers, 2 of them connected
+	for i := 0; i < 3; i++ {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := manager.AddPeer(setupKey.Key, Peer{Key: key.PublicKey().String(), Meta: PeerSystemMeta{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 {
+			err = manager.MarkPeerConnected(peer.Key, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 2 setup keys, 1 of them revoked
+	revokedKey, err := manager.AddSetupKey(account.Id, "revoked", SetupKeyReusable, DefaultSetupKeyDuration, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.RevokeSetupKey(account.Id, revokedKey.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := manager.GetAccountStats(account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := AccountStats{
+		PeersCount:           3,
+		ConnectedPeersCount:  2,
+		SetupKeysCount:       2,
+		ActiveSetupKeysCount: 1,
+		UsedIPs:              3,
+		UsableIPs:            15,
+		NetworkUtilization:   0.2,
+	}
+	if *stats != expected {
+		t.Errorf("expecting account stats %+v, got %+v", expected, *stats)
+	}
+
+	_, err = manager.GetAccountStats("unknown_account")
+	if errStatus, ok := status.FromError(err); !ok || errStatus.Code() != codes.NotFound {
+		t.Errorf("expecting stats of an unknown account to fail with NotFound, got %v", err)
+	}
+}
+
+func TestAccountManager_SetPeerConnectionTimeout(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := manager.AddAccount("test_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var setupKey *SetupKey
+	for _, key := range account.SetupKeys {
+		setupKey = key
+	}
+
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := manager.AddPeer(setupKey.Key, Peer{Key: key.PublicKey().String(), Name: "phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = manager.SetPeerConnectionTimeout(account.Id, peer.Key, 2*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err = manager.GetPeer(peer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peer.ConnectionTimeout != 2*time.Minute {
+		t.Errorf("expecting peer to have connection timeout %s, got %s", 2*time.Minute, peer.ConnectionTimeout)
+	}
+
+	_, err = manager.SetPeerConnectionTimeout(account.Id, peer.Key, -time.Second)
+	if err == nil {
+		t.Errorf("expecting negative connection timeout to be rejected")
+	}
+}
+
+func TestAccountManager_SetPeerPriority(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := manager.AddAccount("test_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var setupKey *SetupKey
+	for _, key := range account.SetupKeys {
+		setupKey = key
+	}
+
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := manager.AddPeer(setupKey.Key, Peer{Key: key.PublicKey().String(), Name: "dns"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peer.Priority != 0 {
+		t.Errorf("expecting new peer to have the default priority 0, got %d", peer.Priority)
+	}
+
+	_, err = manager.SetPeerPriority(account.Id, peer.Key, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err = manager.GetPeer(peer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peer.Priority != 10 {
+		t.Errorf("expecting peer to have priority 10, got %d", peer.Priority)
+	}
+
+	response := toSyncResponse(&Config{Signal: &Host{Proto: HTTP}}, &Peer{Key: "local", IP: net.ParseIP("100.64.0.1")}, []*Peer{peer}, nil)
+	if priority := response.GetRemotePeers()[0].GetPriority(); priority != 10 {
+		t.Errorf("expecting remote peer config to carry priority 10, got %d", priority)
+	}
+}
+
+func TestAccountManager_AddPeerSkipsReservedIPs(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, network, err := net.ParseCIDR("10.10.10.0/28")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := manager.CreateAccount(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reservedIPs := []net.IP{net.ParseIP("10.10.10.1"), net.ParseIP("10.10.10.2")}
+	_, err = manager.SetReservedIPs(account.Id, reservedIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = manager.SetReservedIPs(account.Id, []net.IP{net.ParseIP("10.10.20.1")})
+	if errStatus, ok := status.FromError(err); !ok || errStatus.Code() != codes.InvalidArgument {
+		t.Errorf("expecting reserved IP outside of the network to fail with InvalidArgument, got %v", err)
+	}
+
+	var setupKey *SetupKey
+	for _, key := range account.SetupKeys {
+		setupKey = key
+	}
+
+	// 10.10.10.0 is the network address, the rest of the /28 but the reserved IPs goes to peers
+	expectedPeers := 16 - 1 - len(reservedIPs)
+	for i := 0; ; i++ {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peer, err := manager.AddPeer(setupKey.Key, Peer{Key: key.PublicKey().String(), Name: key.PublicKey().String()})
+		if err != nil {
+			if errStatus, ok := status.FromError(err); !ok || errStatus.Code() != codes.ResourceExhausted {
+				t.Errorf("expecting exhausted network to fail with ResourceExhausted, got %v", err)
+			}
+			if i != expectedPeers {
+				t.Errorf("expecting %d peers to get an IP, got %d", expectedPeers, i)
+			}
+			break
+		}
+
+		for _, reserved := range reservedIPs {
+			if peer.IP.Equal(reserved) {
+				t.Fatalf("expecting reserved IP %s not to be assigned to a peer", reserved)
+			}
+		}
+	}
+}
+
 func createManager(t *testing.T) (*AccountManager, error) {
 	store, err := createStore(t)
 	if err != nil {
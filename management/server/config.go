@@ -31,6 +31,8 @@ type HttpServerConfig struct {
 	AuthIssuer string
 	// AuthKeysLocation is a location of JWT key set containing the public keys used to verify JWT
 	AuthKeysLocation string
+	// AuthGroupsClaim is a JWT claim listing the groups a peer enrolled with the JWT joins (optional)
+	AuthGroupsClaim string
 }
 
 // Host represents a Wiretrustee host (e.g. STUN, TURN, Signal)
@@ -40,4 +42,6 @@ type Host struct {
 	URI      string
 	Username string
 	Password []byte
+	// Region of the host (e.g. eu-central), clients prefer TURN servers of their own region. Empty when not regional
+	Region string
 }
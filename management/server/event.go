@@ -0,0 +1,119 @@
+package server
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+// PeerEventType is a type of the PeerEvent
+type PeerEventType int
+
+const (
+	// PeerConnectedEvent is published when a peer opens a Sync stream to the Management service
+	PeerConnectedEvent PeerEventType = iota
+	// PeerDisconnectedEvent is published when the Sync stream of a peer gets closed
+	PeerDisconnectedEvent
+	// PeerAddedEvent is published when a new peer gets registered under an account
+	PeerAddedEvent
+	// PeerRemovedEvent is published when a peer gets deleted from an account
+	PeerRemovedEvent
+)
+
+// eventChannelBufferSize is a number of events buffered for a subscriber before new events get dropped
+const eventChannelBufferSize = 100
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerConnectedEvent:
+		return "connected"
+	case PeerDisconnectedEvent:
+		return "disconnected"
+	case PeerAddedEvent:
+		return "added"
+	case PeerRemovedEvent:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// PeerEvent represents a change of a peer state within an account
+type PeerEvent struct {
+	Type      PeerEventType
+	AccountId string
+	//PeerKey is a Wireguard public key of the peer
+	PeerKey string
+	//PeerIP is an IP address of the peer within the account network
+	PeerIP    net.IP
+	Timestamp time.Time
+}
+
+// EventBus delivers PeerEvent of an account to its subscribers.
+// Publishing never blocks: events are dropped for subscribers that don't keep up with them.
+type EventBus struct {
+	// accountId -> subscriber channels
+	subscribers map[string]map[chan *PeerEvent]struct{}
+	mux         sync.Mutex
+}
+
+// NewEventBus creates a new EventBus without subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[string]map[chan *PeerEvent]struct{}),
+	}
+}
+
+// Subscribe creates a channel receiving events of a given account.
+// The channel has to be released with Unsubscribe when it is not needed anymore.
+func (bus *EventBus) Subscribe(accountId string) chan *PeerEvent {
+	bus.mux.Lock()
+	defer bus.mux.Unlock()
+
+	channel := make(chan *PeerEvent, eventChannelBufferSize)
+	if _, ok := bus.subscribers[accountId]; !ok {
+		bus.subscribers[accountId] = make(map[chan *PeerEvent]struct{})
+	}
+	bus.subscribers[accountId][channel] = struct{}{}
+
+	log.Debugf("subscribed to events of account %s", accountId)
+	return channel
+}
+
+// Unsubscribe removes the subscription of a given account and closes its channel
+func (bus *EventBus) Unsubscribe(accountId string, channel chan *PeerEvent) {
+	bus.mux.Lock()
+	defer bus.mux.Unlock()
+
+	channels, ok := bus.subscribers[accountId]
+	if !ok {
+		return
+	}
+	if _, ok := channels[channel]; !ok {
+		return
+	}
+
+	delete(channels, channel)
+	close(channel)
+	if len(channels) == 0 {
+		delete(bus.subscribers, accountId)
+	}
+
+	log.Debugf("unsubscribed from events of account %s", accountId)
+}
+
+// Publish sends an event to all subscribers of the event's account.
+// A subscriber with a full channel doesn't receive the event.
+func (bus *EventBus) Publish(event *PeerEvent) {
+	bus.mux.Lock()
+	defer bus.mux.Unlock()
+
+	for channel := range bus.subscribers[event.AccountId] {
+		select {
+		case channel <- event:
+		default:
+			log.Warnf("dropped %s event of peer %s, subscriber of account %s is too slow", event.Type, event.PeerKey, event.AccountId)
+		}
+	}
+}
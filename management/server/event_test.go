@@ -0,0 +1,117 @@
+package server
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"testing"
+)
+
+func TestEventBus_Publish(t *testing.T) {
+	bus := NewEventBus()
+
+	events := bus.Subscribe("account_1")
+	otherEvents := bus.Subscribe("account_2")
+
+	bus.Publish(&PeerEvent{Type: PeerConnectedEvent, AccountId: "account_1", PeerKey: "peer_1"})
+
+	select {
+	case event := <-events:
+		if event.Type != PeerConnectedEvent || event.PeerKey != "peer_1" {
+			t.Errorf("expecting connected event of peer_1, got %s event of %s", event.Type, event.PeerKey)
+		}
+	default:
+		t.Errorf("expecting subscriber of account_1 to receive an event")
+	}
+
+	select {
+	case event := <-otherEvents:
+		t.Errorf("expecting subscriber of account_2 to receive no events, got %s event of %s", event.Type, event.PeerKey)
+	default:
+	}
+}
+
+func TestEventBus_SlowSubscriber(t *testing.T) {
+	bus := NewEventBus()
+
+	events := bus.Subscribe("account_1")
+
+	// must not block even though nobody reads the events
+	for i := 0; i < eventChannelBufferSize*2; i++ {
+		bus.Publish(&PeerEvent{Type: PeerConnectedEvent, AccountId: "account_1", PeerKey: "peer_1"})
+	}
+
+	if len(events) != eventChannelBufferSize {
+		t.Errorf("expecting %d buffered events, got %d", eventChannelBufferSize, len(events))
+	}
+}
+
+func TestEventBus_Unsubscribe(t *testing.T) {
+	bus := NewEventBus()
+
+	events := bus.Subscribe("account_1")
+	bus.Unsubscribe("account_1", events)
+
+	if _, open := <-events; open {
+		t.Errorf("expecting events channel to be closed after unsubscribing")
+	}
+
+	if _, ok := bus.subscribers["account_1"]; ok {
+		t.Errorf("expecting account_1 to have no subscribers")
+	}
+
+	// second unsubscribe must be a no-op
+	bus.Unsubscribe("account_1", events)
+	bus.Publish(&PeerEvent{Type: PeerConnectedEvent, AccountId: "account_1", PeerKey: "peer_1"})
+}
+
+func TestAccountManager_PeerEvents(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := manager.AddAccount("test_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var setupKey *SetupKey
+	for _, key := range account.SetupKeys {
+		setupKey = key
+	}
+
+	events := manager.SubscribePeerEvents(account.Id)
+	defer manager.UnsubscribePeerEvents(account.Id, events)
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey := key.PublicKey().String()
+
+	_, err = manager.AddPeer(setupKey.Key, Peer{Key: peerKey, Name: "test_peer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = manager.MarkPeerConnected(peerKey, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = manager.DeletePeer(account.Id, peerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []PeerEventType{PeerAddedEvent, PeerConnectedEvent, PeerRemovedEvent}
+	for _, expectedType := range expected {
+		select {
+		case event := <-events:
+			if event.Type != expectedType || event.PeerKey != peerKey {
+				t.Errorf("expecting %s event of peer %s, got %s event of %s", expectedType, peerKey, event.Type, event.PeerKey)
+			}
+		default:
+			t.Fatalf("expecting %s event of peer %s, got none", expectedType, peerKey)
+		}
+	}
+}
@@ -17,6 +17,8 @@ const storeFileName = "store.json"
 
 // FileStore represents an account storage backed by a file persisted to disk
 type FileStore struct {
+	// SchemaVersion is the version of the persisted accounts schema, stores written before versioning have 0
+	SchemaVersion        int
 	Accounts             map[string]*Account
 	SetupKeyId2AccountId map[string]string `json:"-"`
 	PeerKeyId2AccountId  map[string]string `json:"-"`
@@ -41,6 +43,7 @@ func restore(file string) (*FileStore, error) {
 	if _, err := os.Stat(file); os.IsNotExist(err) {
 		// create a new FileStore if previously didn't exist (e.g. first run)
 		s := &FileStore{
+			SchemaVersion:        storeSchemaVersion,
 			Accounts:             make(map[string]*Account),
 			mux:                  sync.Mutex{},
 			SetupKeyId2AccountId: make(map[string]string),
@@ -63,6 +66,18 @@ func restore(file string) (*FileStore, error) {
 
 	store := read.(*FileStore)
 	store.storeFile = file
+
+	migrated, err := migrate(store)
+	if err != nil {
+		return nil, err
+	}
+	if migrated {
+		err = store.persist(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	store.SetupKeyId2AccountId = make(map[string]string)
 	store.PeerKeyId2AccountId = make(map[string]string)
 	for accountId, account := range store.Accounts {
@@ -157,25 +172,69 @@ func (s *FileStore) SaveAccount(account *Account) error {
 
 	// todo will override, handle existing keys
 	s.Accounts[account.Id] = account
+	s.index(account)
 
-	// todo check that account.Id and keyId are not exist already
-	// because if keyId exists for other accounts this can be bad
-	for keyId := range account.SetupKeys {
-		s.SetupKeyId2AccountId[strings.ToUpper(keyId)] = account.Id
+	err := s.persist(s.storeFile)
+	if err != nil {
+		return err
 	}
 
-	for _, peer := range account.Peers {
-		s.PeerKeyId2AccountId[peer.Key] = account.Id
+	return nil
+}
+
+// Update applies the update function to a copy of the account and saves the copy if the function succeeds.
+// The read-modify-write happens under the store lock, so concurrent updates of the account can't overwrite each other.
+// The stored account is left unchanged when the update function or persisting the store fails
+func (s *FileStore) Update(accountId string, update func(account *Account) error) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	account, err := s.GetAccount(accountId)
+	if err != nil {
+		return err
 	}
 
-	err := s.persist(s.storeFile)
+	updated := account.Copy()
+	err = update(updated)
+	if err != nil {
+		return err
+	}
+
+	s.Accounts[accountId] = updated
+	s.index(updated)
+
+	err = s.persist(s.storeFile)
 	if err != nil {
+		// roll back to keep the in-memory state consistent with the file
+		s.Accounts[accountId] = account
+		s.index(account)
 		return err
 	}
 
+	// drop the index entries of the peers the update has removed
+	for peerKey := range account.Peers {
+		if _, ok := updated.Peers[peerKey]; !ok {
+			delete(s.PeerKeyId2AccountId, peerKey)
+		}
+	}
+
 	return nil
 }
 
+// index maps setup keys and peer keys of the account to the account Id
+// It is recommended to call it with locking FileStore.mux
+func (s *FileStore) index(account *Account) {
+	// todo check that account.Id and keyId are not exist already
+	// because if keyId exists for other accounts this can be bad
+	for keyId := range account.SetupKeys {
+		s.SetupKeyId2AccountId[strings.ToUpper(keyId)] = account.Id
+	}
+
+	for _, peer := range account.Peers {
+		s.PeerKeyId2AccountId[peer.Key] = account.Id
+	}
+}
+
 func (s *FileStore) GetAccountBySetupKey(setupKey string) (*Account, error) {
 
 	accountId, accountIdFound := s.SetupKeyId2AccountId[strings.ToUpper(setupKey)]
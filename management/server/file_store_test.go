@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestFileStore_UpdateConcurrent(t *testing.T) {
+	store, err := createStore(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, setupKey := newAccount()
+	err = store.SaveAccount(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no AccountManager lock here, the store alone has to keep the increments
+	updates := 50
+	var wg sync.WaitGroup
+	wg.Add(updates)
+	for i := 0; i < updates; i++ {
+		go func() {
+			defer wg.Done()
+			err := store.Update(account.Id, func(account *Account) error {
+				account.SetupKeys[setupKey.Key] = account.SetupKeys[setupKey.Key].IncrementUsage()
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	account, err = store.GetAccount(account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usedTimes := account.SetupKeys[setupKey.Key].UsedTimes; usedTimes != updates {
+		t.Errorf("expecting setup key to be used %d times, got %d", updates, usedTimes)
+	}
+}
+
+func TestFileStore_UpdateFailureKeepsAccount(t *testing.T) {
+	store, err := createStore(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, setupKey := newAccount()
+	err = store.SaveAccount(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Update(account.Id, func(account *Account) error {
+		account.SetupKeys[setupKey.Key] = account.SetupKeys[setupKey.Key].IncrementUsage()
+		return fmt.Errorf("update failed")
+	})
+	if err == nil {
+		t.Errorf("expecting update error to be returned")
+	}
+
+	account, err = store.GetAccount(account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usedTimes := account.SetupKeys[setupKey.Key].UsedTimes; usedTimes != 0 {
+		t.Errorf("expecting failed update not to change the account, setup key used %d times", usedTimes)
+	}
+}
@@ -3,15 +3,19 @@ package server
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/golang/protobuf/ptypes/timestamp"
 	log "github.com/sirupsen/logrus"
 	"github.com/wiretrustee/wiretrustee/encryption"
 	"github.com/wiretrustee/wiretrustee/management/proto"
+	"github.com/wiretrustee/wiretrustee/management/server/http/middleware"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -21,8 +25,13 @@ type Server struct {
 	wgKey          wgtypes.Key
 	proto.UnimplementedManagementServiceServer
 	peerChannels map[string]chan *UpdateChannelMessage
+	// peerStatuses serializes the status writes of each peer, guarded by channelsMux
+	peerStatuses map[string]*peerStatus
 	channelsMux  *sync.Mutex
 	config       *Config
+	// jwtMiddleware validates JWT of the events subscribers. Initialized on the first subscription
+	jwtMiddleware *middleware.JWTMiddleware
+	jwtMux        *sync.Mutex
 }
 
 // AllowedIPsFormat generates Wireguard AllowedIPs format (e.g. 100.30.30.1/32)
@@ -32,6 +41,14 @@ type UpdateChannelMessage struct {
 	Update *proto.SyncResponse
 }
 
+// peerStatus orders the status writes of a single peer made when its updates channel is opened or closed
+type peerStatus struct {
+	// mux is held during a status write of the peer
+	mux sync.Mutex
+	// seq is the sequence number of the latest status change of the peer, guarded by Server.channelsMux
+	seq uint64
+}
+
 // NewServer creates a new Management server
 func NewServer(config *Config, accountManager *AccountManager) (*Server, error) {
 	key, err := wgtypes.GeneratePrivateKey()
@@ -42,9 +59,11 @@ func NewServer(config *Config, accountManager *AccountManager) (*Server, error)
 		wgKey: key,
 		// peerKey -> event channel
 		peerChannels:   make(map[string]chan *UpdateChannelMessage),
+		peerStatuses:   make(map[string]*peerStatus),
 		channelsMux:    &sync.Mutex{},
 		accountManager: accountManager,
 		config:         config,
+		jwtMux:         &sync.Mutex{},
 	}, nil
 }
 
@@ -133,7 +152,7 @@ func (s *Server) registerPeer(peerKey wgtypes.Key, req *proto.LoginRequest) (*Pe
 	if meta == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "peer meta data was not provided")
 	}
-	peer, err := s.accountManager.AddPeer(req.GetSetupKey(), Peer{
+	newPeer := Peer{
 		Key:  peerKey.String(),
 		Name: meta.GetHostname(),
 		Meta: PeerSystemMeta{
@@ -144,33 +163,178 @@ func (s *Server) registerPeer(peerKey wgtypes.Key, req *proto.LoginRequest) (*Pe
 			Platform:  meta.GetPlatform(),
 			OS:        meta.GetOS(),
 			WtVersion: meta.GetWiretrusteeVersion(),
+			Region:    meta.GetRegion(),
 		},
-	})
+	}
+
+	var peer *Peer
+	var err error
+	if req.GetSetupKey() != "" {
+		peer, err = s.accountManager.AddPeer(req.GetSetupKey(), newPeer)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "provided setup key doesn't exists")
+		}
+	} else {
+		accountId, groups, err := s.validateEnrollmentToken(req.GetJwtToken())
+		if err != nil {
+			return nil, err
+		}
+		peer, err = s.accountManager.AddPeerToAccount(accountId, groups, newPeer)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed registering peer")
+		}
+	}
+
+	// notify other peers of our registration
+	err = s.updatePeersOf(peer.Key)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "provided setup key doesn't exists")
+		return nil, err
 	}
 
-	peers, err := s.accountManager.GetPeersForAPeer(peer.Key)
+	return peer, nil
+}
+
+// updatePeersOf sends the current network map to the connected peers that can reach the peer, e.g. when it has been added.
+// It is recommended to call it with locking Server.channelsMux
+func (s *Server) updatePeersOf(peerKey string) error {
+	peers, err := s.accountManager.GetPeersForAPeer(peerKey)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "internal server error")
+		return status.Error(codes.Internal, "internal server error")
 	}
 
-	// notify other peers of our registration
 	for _, remotePeer := range peers {
 		if channel, ok := s.peerChannels[remotePeer.Key]; ok {
-			// exclude notified peer and add ourselves
-			peersToSend := []*Peer{peer}
-			for _, p := range peers {
-				if remotePeer.Key != p.Key {
-					peersToSend = append(peersToSend, p)
-				}
+			// the rules define which peers the notified peer can reach
+			networkMap, err := s.accountManager.GetNetworkMap(remotePeer.Key)
+			if err != nil {
+				log.Warnf("failed getting a list of peers for a peer %s %v", remotePeer.Key, err)
+				continue
 			}
-			update := toSyncResponse(s.config, peer, peersToSend)
+			update := toSyncResponse(s.config, networkMap.Peer, networkMap.Peers, networkMap.PresharedKeys)
 			channel <- &UpdateChannelMessage{Update: update}
 		}
 	}
 
-	return peer, nil
+	return nil
+}
+
+// RotatePresharedKeys replaces the preshared keys of the account (see AccountManager.RotatePresharedKeys) and sends
+// the connected peers of the account their new network map right away so that both peers of a pair switch to the new key
+func (s *Server) RotatePresharedKeys(accountId string) error {
+	err := s.accountManager.RotatePresharedKeys(accountId)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.accountManager.GetAccount(accountId)
+	if err != nil {
+		return err
+	}
+
+	s.channelsMux.Lock()
+	defer s.channelsMux.Unlock()
+
+	for peerKey := range account.Peers {
+		channel, ok := s.peerChannels[peerKey]
+		if !ok {
+			continue
+		}
+		networkMap, err := s.accountManager.GetNetworkMap(peerKey)
+		if err != nil {
+			log.Warnf("failed getting a list of peers for a peer %s %v", peerKey, err)
+			continue
+		}
+		channel <- &UpdateChannelMessage{Update: toSyncResponse(s.config, networkMap.Peer, networkMap.Peers, networkMap.PresharedKeys)}
+	}
+
+	return nil
+}
+
+// RotateKey replaces the Wireguard key of a registered peer keeping its identity.
+// The request is encrypted with the current key which proves the peer owns it. The Sync stream of the current key gets
+// closed and the peers that can reach the peer receive the new key
+func (s *Server) RotateKey(ctx context.Context, req *proto.EncryptedMessage) (*proto.EncryptedMessage, error) {
+	log.Debugf("RotateKey request from peer %s", req.WgPubKey)
+
+	peerKey, err := wgtypes.ParseKey(req.GetWgPubKey())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "provided wgPubKey %s is invalid", req.WgPubKey)
+	}
+
+	account, err := s.accountManager.Store.GetPeerAccount(peerKey.String())
+	if err != nil {
+		return nil, status.Errorf(codes.PermissionDenied, "provided peer with the key wgPubKey %s is not registered", peerKey.String())
+	}
+
+	rotateReq := &proto.RotateKeyRequest{}
+	err = encryption.DecryptMessage(peerKey, s.wgKey, req.Body, rotateReq)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request message")
+	}
+
+	s.channelsMux.Lock()
+	defer s.channelsMux.Unlock()
+
+	peer, err := s.accountManager.RotatePeerKey(account.Id, peerKey.String(), rotateReq.GetNewWgPubKey())
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("rotated key of peer %s to %s", peerKey.String(), peer.Key)
+
+	if channel, ok := s.peerChannels[peerKey.String()]; ok {
+		delete(s.peerChannels, peerKey.String())
+		close(channel)
+	}
+
+	err = s.updatePeersOf(peer.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the peer decrypts the response with the key it has sent the request with
+	encryptedResp, err := encryption.EncryptMessage(peerKey, s.wgKey, &proto.LoginResponse{
+		WiretrusteeConfig: toWiretrusteeConfig(s.config),
+		PeerConfig:        toPeerConfig(peer),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed rotating peer key")
+	}
+
+	return &proto.EncryptedMessage{
+		WgPubKey: s.wgKey.PublicKey().String(),
+		Body:     encryptedResp,
+	}, nil
+}
+
+// GetPeerIP returns the IP of a registered peer.
+// The request is encrypted with the key of the peer which proves the peer owns it, so a peer can only query its own IP
+func (s *Server) GetPeerIP(ctx context.Context, req *proto.EncryptedMessage) (*proto.EncryptedMessage, error) {
+	log.Debugf("GetPeerIP request from peer %s", req.WgPubKey)
+
+	peerKey, err := wgtypes.ParseKey(req.GetWgPubKey())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "provided wgPubKey %s is invalid", req.WgPubKey)
+	}
+
+	err = encryption.DecryptMessage(peerKey, s.wgKey, req.Body, &proto.GetPeerIPRequest{})
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request message")
+	}
+
+	ip, err := s.accountManager.GetPeerIP(peerKey.String())
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "provided peer with the key wgPubKey %s is not registered", peerKey.String())
+	}
+
+	encryptedResp, err := encryption.EncryptMessage(peerKey, s.wgKey, &proto.PeerIPResponse{Ip: ip.String()})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed getting peer IP")
+	}
+
+	return &proto.EncryptedMessage{
+		WgPubKey: s.wgKey.PublicKey().String(),
+		Body:     encryptedResp,
+	}, nil
 }
 
 // Login endpoint first checks whether peer is registered under any account
@@ -187,22 +351,22 @@ func (s *Server) Login(ctx context.Context, req *proto.EncryptedMessage) (*proto
 		return nil, status.Errorf(codes.InvalidArgument, "provided wgPubKey %s is invalid", req.WgPubKey)
 	}
 
+	loginReq := &proto.LoginRequest{}
+	err = encryption.DecryptMessage(peerKey, s.wgKey, req.Body, loginReq)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid request message")
+	}
+
 	peer, err := s.accountManager.GetPeer(peerKey.String())
 	if err != nil {
 		if errStatus, ok := status.FromError(err); ok && errStatus.Code() == codes.NotFound {
 			//peer doesn't exist -> check if setup key was provided
-			loginReq := &proto.LoginRequest{}
-			err = encryption.DecryptMessage(peerKey, s.wgKey, req.Body, loginReq)
-			if err != nil {
-				return nil, status.Errorf(codes.InvalidArgument, "invalid request message")
-			}
-
-			if loginReq.GetSetupKey() == "" {
-				//absent setup key -> permission denied
+			if loginReq.GetSetupKey() == "" && loginReq.GetJwtToken() == "" {
+				//absent setup key and JWT -> permission denied
 				return nil, status.Errorf(codes.PermissionDenied, "provided peer with the key wgPubKey %s is not registered", peerKey.String())
 			}
 
-			//setup key is present -> try normal registration flow
+			//setup key or JWT is present -> try registration flow
 			peer, err = s.registerPeer(peerKey, loginReq)
 			if err != nil {
 				return nil, err
@@ -211,6 +375,14 @@ func (s *Server) Login(ctx context.Context, req *proto.EncryptedMessage) (*proto
 		} else {
 			return nil, status.Error(codes.Internal, "internal server error")
 		}
+	} else if meta := loginReq.GetMeta(); meta != nil && meta.GetRegion() != peer.Meta.Region {
+		// clients older than the regions don't send the meta on login
+		updated, err := s.accountManager.UpdatePeerRegion(peer.Key, meta.GetRegion())
+		if err != nil {
+			log.Warnf("failed updating region of peer %s: %v", peer.Key, err)
+		} else {
+			peer = updated
+		}
 	}
 
 	// if peer has reached this point then it has logged in
@@ -254,6 +426,7 @@ func toWiretrusteeConfig(config *Config) *proto.WiretrusteeConfig {
 		stuns = append(stuns, &proto.HostConfig{
 			Uri:      stun.URI,
 			Protocol: toResponseProto(stun.Proto),
+			Region:   stun.Region,
 		})
 	}
 	var turns []*proto.ProtectedHostConfig
@@ -262,6 +435,7 @@ func toWiretrusteeConfig(config *Config) *proto.WiretrusteeConfig {
 			HostConfig: &proto.HostConfig{
 				Uri:      turn.URI,
 				Protocol: toResponseProto(turn.Proto),
+				Region:   turn.Region,
 			},
 			User:     turn.Username,
 			Password: string(turn.Password),
@@ -284,7 +458,9 @@ func toPeerConfig(peer *Peer) *proto.PeerConfig {
 	}
 }
 
-func toSyncResponse(config *Config, peer *Peer, peers []*Peer) *proto.SyncResponse {
+// toSyncResponse builds the Sync response of the peer, presharedKeys are the preshared keys the peer shares with the peers
+// (by their key)
+func toSyncResponse(config *Config, peer *Peer, peers []*Peer, presharedKeys map[string]string) *proto.SyncResponse {
 
 	wtConfig := toWiretrusteeConfig(config)
 
@@ -293,8 +469,12 @@ func toSyncResponse(config *Config, peer *Peer, peers []*Peer) *proto.SyncRespon
 	remotePeers := make([]*proto.RemotePeerConfig, 0, len(peers))
 	for _, rPeer := range peers {
 		remotePeers = append(remotePeers, &proto.RemotePeerConfig{
-			WgPubKey:   rPeer.Key,
-			AllowedIps: []string{fmt.Sprintf(AllowedIPsFormat, rPeer.IP)}, //todo /32
+			WgPubKey:          rPeer.Key,
+			AllowedIps:        []string{fmt.Sprintf(AllowedIPsFormat, rPeer.IP)}, //todo /32
+			ConnectionTimeout: uint32(rPeer.ConnectionTimeout / time.Second),
+			PresharedKey:      presharedKeys[rPeer.Key],
+			Region:            rPeer.Meta.Region,
+			Priority:          int32(rPeer.Priority),
 		})
 	}
 
@@ -310,10 +490,164 @@ func (s *Server) IsHealthy(ctx context.Context, req *proto.Empty) (*proto.Empty,
 	return &proto.Empty{}, nil
 }
 
+// SubscribeEvents authenticates the caller by the JWT provided in the "authorization" metadata and streams
+// peer events of the caller's account until the caller disconnects.
+// Events are buffered per subscriber and dropped when the subscriber doesn't keep up, so a slow consumer never
+// blocks the rest of the server.
+func (s *Server) SubscribeEvents(req *proto.Empty, srv proto.ManagementService_SubscribeEventsServer) error {
+
+	accountId, err := s.authenticateSubscriber(srv.Context())
+	if err != nil {
+		return err
+	}
+
+	_, err = s.accountManager.GetAccount(accountId)
+	if err != nil {
+		return status.Errorf(codes.PermissionDenied, "account %s is not registered", accountId)
+	}
+
+	events := s.accountManager.SubscribePeerEvents(accountId)
+	defer s.accountManager.UnsubscribePeerEvents(accountId, events)
+
+	for {
+		select {
+		case event, open := <-events:
+			if !open {
+				return nil
+			}
+			err = srv.Send(toPeerEventProto(event))
+			if err != nil {
+				log.Debugf("failed sending event to a subscriber of account %s %v", accountId, err)
+				return status.Errorf(codes.Internal, "failed sending event")
+			}
+		case <-srv.Context().Done():
+			log.Debugf("events stream of account %s has been closed", accountId)
+			return srv.Context().Err()
+		}
+	}
+}
+
+// authenticateSubscriber validates the bearer token of the incoming request and returns the account id it belongs to
+func (s *Server) authenticateSubscriber(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", status.Errorf(codes.Unauthenticated, "missing authorization metadata")
+	}
+
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", status.Errorf(codes.Unauthenticated, "missing authorization token")
+	}
+
+	parts := strings.Fields(values[0])
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		return "", status.Errorf(codes.Unauthenticated, "authorization metadata format must be Bearer {token}")
+	}
+
+	jwtMiddleware, err := s.getJwtMiddleware()
+	if err != nil {
+		log.Errorf("failed initializing JWT validation %v", err)
+		return "", status.Errorf(codes.Unavailable, "authentication is not available")
+	}
+
+	token, err := jwtMiddleware.ValidateToken(parts[1])
+	if err != nil {
+		return "", status.Errorf(codes.Unauthenticated, "invalid authorization token")
+	}
+
+	//actually a user id but for now we have a 1 to 1 mapping.
+	accountId, ok := token.Claims.(jwt.MapClaims)["sub"].(string)
+	if !ok || accountId == "" {
+		return "", status.Errorf(codes.Unauthenticated, "invalid authorization token")
+	}
+
+	return accountId, nil
+}
+
+// validateEnrollmentToken validates the JWT a peer registers with instead of a setup key and returns the account id
+// and the groups (see HttpServerConfig.AuthGroupsClaim) the peer gets
+func (s *Server) validateEnrollmentToken(jwtToken string) (string, []string, error) {
+	jwtMiddleware, err := s.getJwtMiddleware()
+	if err != nil {
+		log.Errorf("failed initializing JWT validation %v", err)
+		return "", nil, status.Errorf(codes.Unavailable, "registration with a JWT is not available")
+	}
+
+	token, err := jwtMiddleware.ValidateToken(jwtToken)
+	if err != nil {
+		log.Debugf("invalid enrollment JWT %v", err)
+		return "", nil, status.Errorf(codes.PermissionDenied, "invalid JWT")
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+
+	//actually a user id but for now we have a 1 to 1 mapping.
+	accountId, ok := claims["sub"].(string)
+	if !ok || accountId == "" {
+		return "", nil, status.Errorf(codes.PermissionDenied, "invalid JWT")
+	}
+
+	var groups []string
+	if s.config.HttpConfig.AuthGroupsClaim != "" {
+		values, _ := claims[s.config.HttpConfig.AuthGroupsClaim].([]interface{})
+		for _, value := range values {
+			if group, ok := value.(string); ok && group != "" {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	return accountId, groups, nil
+}
+
+// getJwtMiddleware returns JWT validation configured by the HttpServerConfig auth properties.
+// The keys are fetched on the first call to avoid depending on the keys location when nobody subscribes to events
+func (s *Server) getJwtMiddleware() (*middleware.JWTMiddleware, error) {
+	s.jwtMux.Lock()
+	defer s.jwtMux.Unlock()
+
+	if s.jwtMiddleware != nil {
+		return s.jwtMiddleware, nil
+	}
+
+	if s.config.HttpConfig == nil || s.config.HttpConfig.AuthKeysLocation == "" {
+		return nil, fmt.Errorf("auth keys location is not configured")
+	}
+
+	jwtMiddleware, err := middleware.NewJwtMiddleware(s.config.HttpConfig.AuthIssuer, s.config.HttpConfig.AuthAudience,
+		s.config.HttpConfig.AuthKeysLocation)
+	if err != nil {
+		return nil, err
+	}
+	s.jwtMiddleware = jwtMiddleware
+
+	return jwtMiddleware, nil
+}
+
+func toPeerEventProto(event *PeerEvent) *proto.PeerEvent {
+	var eventType proto.PeerEvent_Type
+	switch event.Type {
+	case PeerConnectedEvent:
+		eventType = proto.PeerEvent_CONNECTED
+	case PeerDisconnectedEvent:
+		eventType = proto.PeerEvent_DISCONNECTED
+	case PeerAddedEvent:
+		eventType = proto.PeerEvent_ADDED
+	case PeerRemovedEvent:
+		eventType = proto.PeerEvent_REMOVED
+	}
+
+	return &proto.PeerEvent{
+		Type:      eventType,
+		WgPubKey:  event.PeerKey,
+		Address:   event.PeerIP.String(),
+		Timestamp: &timestamp.Timestamp{Seconds: event.Timestamp.Unix(), Nanos: int32(event.Timestamp.Nanosecond())},
+	}
+}
+
 // openUpdatesChannel creates a go channel for a given peer used to deliver updates relevant to the peer.
 func (s *Server) openUpdatesChannel(peerKey string) chan *UpdateChannelMessage {
 	s.channelsMux.Lock()
-	defer s.channelsMux.Unlock()
 	if channel, ok := s.peerChannels[peerKey]; ok {
 		delete(s.peerChannels, peerKey)
 		close(channel)
@@ -321,11 +655,10 @@ func (s *Server) openUpdatesChannel(peerKey string) chan *UpdateChannelMessage {
 	//mbragin: todo shouldn't it be more? or configurable?
 	channel := make(chan *UpdateChannelMessage, 100)
 	s.peerChannels[peerKey] = channel
+	status, seq := s.nextPeerStatus(peerKey)
+	s.channelsMux.Unlock()
 
-	err := s.accountManager.MarkPeerConnected(peerKey, true)
-	if err != nil {
-		log.Warnf("failed marking peer as connected %s %v", peerKey, err)
-	}
+	s.updatePeerStatus(peerKey, status, seq, true)
 
 	log.Debugf("opened updates channel for a peer %s", peerKey)
 	return channel
@@ -334,29 +667,65 @@ func (s *Server) openUpdatesChannel(peerKey string) chan *UpdateChannelMessage {
 // closeUpdatesChannel closes updates channel of a given peer
 func (s *Server) closeUpdatesChannel(peerKey string) {
 	s.channelsMux.Lock()
-	defer s.channelsMux.Unlock()
 	if channel, ok := s.peerChannels[peerKey]; ok {
 		delete(s.peerChannels, peerKey)
 		close(channel)
 	}
+	status, seq := s.nextPeerStatus(peerKey)
+	s.channelsMux.Unlock()
 
-	err := s.accountManager.MarkPeerConnected(peerKey, false)
-	if err != nil {
-		log.Warnf("failed marking peer as disconnected %s %v", peerKey, err)
-	}
+	s.updatePeerStatus(peerKey, status, seq, false)
 
 	log.Debugf("closed updates channel of a peer %s", peerKey)
 }
 
+// nextPeerStatus records a new status change of the peer and returns its sequence number.
+// Must be called with locking Server.channelsMux
+func (s *Server) nextPeerStatus(peerKey string) (*peerStatus, uint64) {
+	status, ok := s.peerStatuses[peerKey]
+	if !ok {
+		status = &peerStatus{}
+		s.peerStatuses[peerKey] = status
+	}
+	status.seq++
+	return status, status.seq
+}
+
+// updatePeerStatus marks the peer as connected or disconnected unless a newer status change of the peer has been
+// recorded in the meantime. Called without holding Server.channelsMux, so that a slow Store write (MarkPeerConnected
+// retries for a while) delays only the status changes of the same peer
+func (s *Server) updatePeerStatus(peerKey string, status *peerStatus, seq uint64, connected bool) {
+	status.mux.Lock()
+	defer status.mux.Unlock()
+
+	s.channelsMux.Lock()
+	stale := status.seq != seq
+	s.channelsMux.Unlock()
+	if stale {
+		log.Debugf("skipped outdated status change of peer %s", peerKey)
+		return
+	}
+
+	err := s.accountManager.MarkPeerConnected(peerKey, connected)
+	if err != nil {
+		if connected {
+			log.Warnf("failed marking peer as connected %s %v", peerKey, err)
+		} else {
+			log.Warnf("failed marking peer as disconnected %s %v", peerKey, err)
+		}
+	}
+}
+
 // sendInitialSync sends initial proto.SyncResponse to the peer requesting synchronization
 func (s *Server) sendInitialSync(peerKey wgtypes.Key, peer *Peer, srv proto.ManagementService_SyncServer) error {
 
-	peers, err := s.accountManager.GetPeersForAPeer(peer.Key)
+	// the peer's own config and its peers come from the same snapshot
+	networkMap, err := s.accountManager.GetNetworkMap(peer.Key)
 	if err != nil {
 		log.Warnf("error getting a list of peers for a peer %s", peer.Key)
 		return err
 	}
-	plainResp := toSyncResponse(s.config, peer, peers)
+	plainResp := toSyncResponse(s.config, networkMap.Peer, networkMap.Peers, networkMap.PresharedKeys)
 
 	encryptedResp, err := encryption.EncryptMessage(peerKey, s.wgKey, plainResp)
 	if err != nil {
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt"
+	"github.com/wiretrustee/wiretrustee/management/proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.wiretrustee.com/"
+	testAudience = "wiretrustee"
+	testKeyId    = "test-key"
+)
+
+// startJwksServer serves a JWKS with a self-signed certificate of the returned signing key
+func startJwksServer(t *testing.T) (*httptest.Server, *rsa.PrivateKey) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "wiretrustee"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := map[string]interface{}{
+		"keys": []map[string]interface{}{
+			{
+				"kty": "RSA",
+				"kid": testKeyId,
+				"use": "sig",
+				"x5c": []string{base64.StdEncoding.EncodeToString(cert)},
+			},
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+
+	return server, privateKey
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = testKeyId
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestServer_RegisterPeerWithToken(t *testing.T) {
+	jwksServer, signingKey := startJwksServer(t)
+	defer jwksServer.Close()
+
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(&Config{
+		HttpConfig: &HttpServerConfig{
+			AuthIssuer:       testIssuer,
+			AuthAudience:     testAudience,
+			AuthKeysLocation: jwksServer.URL,
+			AuthGroupsClaim:  "groups",
+		},
+	}, manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		name         string
+		claims       jwt.MapClaims
+		expectedCode codes.Code
+	}
+
+	testCases := []testCase{
+		{
+			name: "valid token",
+			claims: jwt.MapClaims{
+				"sub":    "test_account",
+				"iss":    testIssuer,
+				"aud":    testAudience,
+				"exp":    time.Now().Add(time.Hour).Unix(),
+				"groups": []string{"devs", "ops"},
+			},
+			expectedCode: codes.OK,
+		},
+		{
+			name: "expired token",
+			claims: jwt.MapClaims{
+				"sub": "test_account",
+				"iss": testIssuer,
+				"aud": testAudience,
+				"exp": time.Now().Add(-time.Hour).Unix(),
+			},
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			name: "wrong issuer",
+			claims: jwt.MapClaims{
+				"sub": "test_account",
+				"iss": "https://other-issuer.com/",
+				"aud": testAudience,
+				"exp": time.Now().Add(time.Hour).Unix(),
+			},
+			expectedCode: codes.PermissionDenied,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			key, err := wgtypes.GenerateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			peer, err := server.registerPeer(key.PublicKey(), &proto.LoginRequest{
+				JwtToken: signToken(t, signingKey, testCase.claims),
+				Meta:     &proto.PeerSystemMeta{Hostname: "peer"},
+			})
+			if testCase.expectedCode != codes.OK {
+				if s, ok := status.FromError(err); !ok || s.Code() != testCase.expectedCode {
+					t.Fatalf("expecting registration to fail with code %s, got %v", testCase.expectedCode, err)
+				}
+				_, err = manager.GetPeer(key.PublicKey().String())
+				if err == nil {
+					t.Errorf("expecting peer not to be registered")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			account, err := manager.GetAccount("test_account")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := account.Peers[peer.Key]; !ok {
+				t.Errorf("expecting peer to be registered in account test_account")
+			}
+			if peer.SetupKey != "" {
+				t.Errorf("expecting peer registered without a setup key, got %s", peer.SetupKey)
+			}
+			if len(peer.Groups) != 2 || peer.Groups[0] != "devs" || peer.Groups[1] != "ops" {
+				t.Errorf("expecting peer to join groups from the token, got %v", peer.Groups)
+			}
+		})
+	}
+}
+
+func TestServer_UpdatePeerStatusSkipsOutdated(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := manager.AddAccount("test_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var setupKey *SetupKey
+	for _, key := range account.SetupKeys {
+		setupKey = key
+	}
+
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := manager.AddPeer(setupKey.Key, Peer{Key: key.PublicKey().String(), Name: "peer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(&Config{}, manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stream of the peer is closed, but the peer reconnects before the disconnect is written
+	server.channelsMux.Lock()
+	closeStatus, closeSeq := server.nextPeerStatus(peer.Key)
+	server.channelsMux.Unlock()
+
+	server.openUpdatesChannel(peer.Key)
+	server.updatePeerStatus(peer.Key, closeStatus, closeSeq, false)
+
+	peer, err = manager.GetPeer(peer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peer.Status.Connected {
+		t.Errorf("expecting outdated disconnect to be skipped, got status %+v", peer.Status)
+	}
+
+	server.closeUpdatesChannel(peer.Key)
+
+	peer, err = manager.GetPeer(peer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Status.Connected {
+		t.Errorf("expecting peer to be marked disconnected")
+	}
+}
+
+// testEventsStream is a server side events stream of a subscriber with the given context
+type testEventsStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testEventsStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testEventsStream) Send(*proto.PeerEvent) error {
+	return nil
+}
+
+func TestServer_SubscribeEventsAuthentication(t *testing.T) {
+	jwksServer, signingKey := startJwksServer(t)
+	defer jwksServer.Close()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = manager.AddAccount("test_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(&Config{
+		HttpConfig: &HttpServerConfig{
+			AuthIssuer:       testIssuer,
+			AuthAudience:     testAudience,
+			AuthKeysLocation: jwksServer.URL,
+		},
+	}, manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimsOf := func(accountId string) jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": accountId,
+			"iss": testIssuer,
+			"aud": testAudience,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	type testCase struct {
+		name         string
+		metadata     metadata.MD
+		expectedCode codes.Code
+	}
+
+	testCases := []testCase{
+		{
+			name:         "missing metadata",
+			expectedCode: codes.Unauthenticated,
+		},
+		{
+			name:         "missing token",
+			metadata:     metadata.Pairs("other", "value"),
+			expectedCode: codes.Unauthenticated,
+		},
+		{
+			name:         "not a bearer token",
+			metadata:     metadata.Pairs("authorization", signToken(t, signingKey, claimsOf("test_account"))),
+			expectedCode: codes.Unauthenticated,
+		},
+		{
+			name:         "malformed JWT",
+			metadata:     metadata.Pairs("authorization", "Bearer not-a-jwt"),
+			expectedCode: codes.Unauthenticated,
+		},
+		{
+			name:         "JWT signed by unknown key",
+			metadata:     metadata.Pairs("authorization", "Bearer "+signToken(t, otherKey, claimsOf("test_account"))),
+			expectedCode: codes.Unauthenticated,
+		},
+		{
+			name: "expired JWT",
+			metadata: metadata.Pairs("authorization", "Bearer "+signToken(t, signingKey, jwt.MapClaims{
+				"sub": "test_account",
+				"iss": testIssuer,
+				"aud": testAudience,
+				"exp": time.Now().Add(-time.Hour).Unix(),
+			})),
+			expectedCode: codes.Unauthenticated,
+		},
+		{
+			name:         "account not owned by caller",
+			metadata:     metadata.Pairs("authorization", "Bearer "+signToken(t, signingKey, claimsOf("other_account"))),
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			name:         "valid token",
+			metadata:     metadata.Pairs("authorization", "Bearer "+signToken(t, signingKey, claimsOf("test_account"))),
+			expectedCode: codes.Canceled,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx := context.Background()
+			if testCase.metadata != nil {
+				ctx = metadata.NewIncomingContext(ctx, testCase.metadata)
+			}
+			// an authenticated subscriber streams until it disconnects, it is disconnected right away
+			ctx, cancel := context.WithCancel(ctx)
+			cancel()
+
+			err := server.SubscribeEvents(&proto.Empty{}, &testEventsStream{ctx: ctx})
+			if testCase.expectedCode == codes.Canceled {
+				if err != context.Canceled {
+					t.Fatalf("expecting subscription to stream until the subscriber disconnects, got %v", err)
+				}
+				return
+			}
+			if s, ok := status.FromError(err); !ok || s.Code() != testCase.expectedCode {
+				t.Fatalf("expecting subscription to fail with code %s, got %v", testCase.expectedCode, err)
+			}
+		})
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/wiretrustee/wiretrustee/management/server"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"net/http"
 	"time"
 )
@@ -17,16 +19,22 @@ type Peers struct {
 
 //PeerResponse is a response sent to the client
 type PeerResponse struct {
-	Name      string
-	IP        string
-	Connected bool
-	LastSeen  time.Time
-	OS        string
+	Name        string
+	IP          string
+	Connected   bool
+	LastSeen    time.Time
+	OS          string
+	Groups      []string
+	Description string
+	Labels      map[string]string
 }
 
-//PeerRequest is a request sent by the client
+//PeerRequest is a request sent by the client.
+//The fields that aren't sent are kept as they are
 type PeerRequest struct {
-	Name string
+	Name        *string
+	Description *string
+	Labels      map[string]string
 }
 
 func NewPeers(accountManager *server.AccountManager) *Peers {
@@ -43,7 +51,19 @@ func (h *Peers) updatePeer(accountId string, peer *server.Peer, w http.ResponseW
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	peer, err = h.accountManager.RenamePeer(accountId, peer.Key, req.Name)
+	peer, err = h.accountManager.UpdatePeer(accountId, peer.Key, server.PeerUpdate{
+		Name:        req.Name,
+		Description: req.Description,
+		Labels:      req.Labels,
+	})
+	if s, ok := status.FromError(err); ok && s.Code() == codes.InvalidArgument {
+		http.Error(w, s.Message(), http.StatusBadRequest)
+		return
+	}
+	if s, ok := status.FromError(err); ok && s.Code() == codes.AlreadyExists {
+		http.Error(w, s.Message(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Errorf("failed updating peer %s under account %s %v", peerIp, accountId, err)
 		http.Redirect(w, r, "/", http.StatusInternalServerError)
@@ -117,11 +137,19 @@ func (h *Peers) GetPeers(w http.ResponseWriter, r *http.Request) {
 }
 
 func toPeerResponse(peer *server.Peer) *PeerResponse {
+	status := peer.Status
+	if status == nil {
+		status = &server.PeerStatus{}
+	}
+
 	return &PeerResponse{
-		Name:      peer.Name,
-		IP:        peer.IP.String(),
-		Connected: peer.Status.Connected,
-		LastSeen:  peer.Status.LastSeen,
-		OS:        fmt.Sprintf("%s %s", peer.Meta.GoOS, peer.Meta.Core),
+		Name:        peer.Name,
+		IP:          peer.IP.String(),
+		Connected:   status.Connected,
+		LastSeen:    status.LastSeen,
+		OS:          fmt.Sprintf("%s %s", peer.Meta.GoOS, peer.Meta.Core),
+		Groups:      peer.Groups,
+		Description: peer.Description,
+		Labels:      peer.Labels,
 	}
 }
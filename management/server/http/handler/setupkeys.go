@@ -18,16 +18,17 @@ type SetupKeys struct {
 
 // SetupKeyResponse is a response sent to the client
 type SetupKeyResponse struct {
-	Id        string
-	Key       string
-	Name      string
-	Expires   time.Time
-	Type      server.SetupKeyType
-	Valid     bool
-	Revoked   bool
-	UsedTimes int
-	LastUsed  time.Time
-	State     string
+	Id         string
+	Key        string
+	Name       string
+	Expires    time.Time
+	Type       server.SetupKeyType
+	Valid      bool
+	Revoked    bool
+	UsedTimes  int
+	LastUsed   time.Time
+	State      string
+	AutoGroups []string
 }
 
 // SetupKeyRequest is a request sent by client. This object contains fields that can be modified
@@ -36,6 +37,8 @@ type SetupKeyRequest struct {
 	Type      server.SetupKeyType
 	ExpiresIn Duration
 	Revoked   bool
+	// AutoGroups replaces the groups peers registered with the key join. Not changed when omitted
+	AutoGroups []string
 }
 
 func NewSetupKeysHandler(accountManager *server.AccountManager) *SetupKeys {
@@ -69,6 +72,14 @@ func (h *SetupKeys) updateKey(accountId string, keyId string, w http.ResponseWri
 		}
 	}
 
+	if req.AutoGroups != nil {
+		key, err = h.accountManager.UpdateSetupKeyAutoGroups(accountId, keyId, req.AutoGroups)
+		if err != nil {
+			http.Error(w, "failed updating key groups", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	if key != nil {
 		writeSuccess(w, key)
 	}
@@ -102,7 +113,7 @@ func (h *SetupKeys) createKey(accountId string, w http.ResponseWriter, r *http.R
 		return
 	}
 
-	setupKey, err := h.accountManager.AddSetupKey(accountId, req.Name, req.Type, req.ExpiresIn.Duration)
+	setupKey, err := h.accountManager.AddSetupKey(accountId, req.Name, req.Type, req.ExpiresIn.Duration, req.AutoGroups)
 	if err != nil {
 		errStatus, ok := status.FromError(err)
 		if ok && errStatus.Code() == codes.NotFound {
@@ -195,15 +206,16 @@ func toResponseBody(key *server.SetupKey) *SetupKeyResponse {
 		state = "valid"
 	}
 	return &SetupKeyResponse{
-		Id:        key.Id,
-		Key:       key.Key,
-		Name:      key.Name,
-		Expires:   key.ExpiresAt,
-		Type:      key.Type,
-		Valid:     key.IsValid(),
-		Revoked:   key.Revoked,
-		UsedTimes: key.UsedTimes,
-		LastUsed:  key.LastUsed,
-		State:     state,
+		Id:         key.Id,
+		Key:        key.Key,
+		Name:       key.Name,
+		Expires:    key.ExpiresAt,
+		Type:       key.Type,
+		Valid:      key.IsValid(),
+		Revoked:    key.Revoked,
+		UsedTimes:  key.UsedTimes,
+		LastUsed:   key.LastUsed,
+		State:      state,
+		AutoGroups: key.AutoGroups,
 	}
 }
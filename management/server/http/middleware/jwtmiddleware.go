@@ -235,3 +235,32 @@ func (m *JWTMiddleware) CheckJWT(w http.ResponseWriter, r *http.Request) error {
 	*r = *newRequest
 	return nil
 }
+
+// ValidateToken parses a raw JWT and validates it the same way CheckJWT does for HTTP requests.
+// Used by callers that receive the token outside an HTTP request (e.g. gRPC metadata)
+func (m *JWTMiddleware) ValidateToken(token string) (*jwt.Token, error) {
+	if token == "" {
+		return nil, errors.New("required authorization token not found")
+	}
+
+	parsedToken, err := jwt.Parse(token, m.Options.ValidationKeyGetter)
+	if err != nil {
+		m.logf("error parsing token: %v", err)
+		return nil, fmt.Errorf("error parsing token: %w", err)
+	}
+
+	if m.Options.SigningMethod != nil && m.Options.SigningMethod.Alg() != parsedToken.Header["alg"] {
+		message := fmt.Sprintf("expected %s signing method but token specified %s",
+			m.Options.SigningMethod.Alg(),
+			parsedToken.Header["alg"])
+		m.logf("Error validating token algorithm: %s", message)
+		return nil, errors.New(message)
+	}
+
+	if !parsedToken.Valid {
+		m.logf("Token is invalid")
+		return nil, errors.New("token is invalid")
+	}
+
+	return parsedToken, nil
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// storeSchemaVersion is the schema version of the accounts persisted by the current FileStore.
+// Bump it together with adding a migration whenever a change of Account, Peer or SetupKey needs existing data to be upgraded
+const storeSchemaVersion = 2
+
+// migration upgrades an account from the previous schema version in place
+type migration func(account *Account)
+
+// migrations[i] upgrades an account from schema version i to i+1
+var migrations = []migration{
+	migrateToV1,
+	migrateToV2,
+}
+
+// migrateToV1 initializes the fields stores persisted before versioning (v0) may miss:
+// nil maps, peers without a status and accounts without a network
+func migrateToV1(account *Account) {
+	if account.SetupKeys == nil {
+		account.SetupKeys = make(map[string]*SetupKey)
+	}
+	if account.Peers == nil {
+		account.Peers = make(map[string]*Peer)
+	}
+	if account.Rules == nil {
+		account.Rules = make(map[string]*Rule)
+	}
+	if account.Network == nil {
+		account.Network = &Network{Net: DefaultNetwork()}
+	}
+
+	for _, peer := range account.Peers {
+		if peer.Status == nil {
+			peer.Status = &PeerStatus{}
+		}
+	}
+}
+
+// migrateToV2 generates the secret the preshared keys of the pairs of peers are derived from for the accounts created
+// before the keys were introduced. An account the secret can't be generated for is left without it, its peers connect
+// without preshared keys until the next peer is added
+func migrateToV2(account *Account) {
+	err := account.updatePresharedKeySecret(false)
+	if err != nil {
+		log.Errorf("failed generating preshared key secret of account %s: %v", account.Id, err)
+	}
+}
+
+// migrate upgrades all the accounts of the store to storeSchemaVersion.
+// Returns true when the store has been upgraded and has to be persisted
+func migrate(store *FileStore) (bool, error) {
+	if store.SchemaVersion > storeSchemaVersion {
+		return false, fmt.Errorf("store schema version %d is newer than the supported version %d", store.SchemaVersion, storeSchemaVersion)
+	}
+	if store.SchemaVersion == storeSchemaVersion {
+		return false, nil
+	}
+
+	for version := store.SchemaVersion; version < storeSchemaVersion; version++ {
+		log.Infof("migrating store from schema version %d to %d", version, version+1)
+		for _, account := range store.Accounts {
+			migrations[version](account)
+		}
+	}
+	store.SchemaVersion = storeSchemaVersion
+
+	return true, nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// storeV0 is a store persisted before versioning: no schema version, no rules and a peer without a status
+const storeV0 = `{
+    "Accounts": {
+        "bf1c8084-ba50-4ce7-9439-34653001fc3b": {
+            "Id": "bf1c8084-ba50-4ce7-9439-34653001fc3b",
+            "SetupKeys": {
+                "A2C8E62B-38F5-4553-B31E-DD66C696CEBB": {
+                    "Key": "A2C8E62B-38F5-4553-B31E-DD66C696CEBB",
+                    "Name": "Default key",
+                    "Type": "reusable",
+                    "CreatedAt": "2021-08-19T20:46:20.005936822+02:00",
+                    "ExpiresAt": "2321-09-18T20:46:20.005936822+02:00",
+                    "Revoked": false,
+                    "UsedTimes": 1
+                }
+            },
+            "Network": {
+                "Id": "af1c8024-ha40-4ce2-9418-34653101fc3c",
+                "Net": {
+                    "IP": "100.64.0.0",
+                    "Mask": "/8AAAA=="
+                },
+                "Dns": null
+            },
+            "Peers": {
+                "RRHf3Ma6z6mdLbriAJbqhX7+nM/B71lgw2+91q3LfhU=": {
+                    "Key": "RRHf3Ma6z6mdLbriAJbqhX7+nM/B71lgw2+91q3LfhU=",
+                    "SetupKey": "A2C8E62B-38F5-4553-B31E-DD66C696CEBB",
+                    "IP": "100.64.0.1",
+                    "Name": "peer",
+                    "Status": null
+                }
+            }
+        }
+    }
+}`
+
+func TestFileStore_MigrateV0(t *testing.T) {
+	dataDir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dataDir, storeFileName), []byte(storeV0), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewStore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.SchemaVersion != storeSchemaVersion {
+		t.Errorf("expecting store to be upgraded to schema version %d, got %d", storeSchemaVersion, store.SchemaVersion)
+	}
+
+	account, err := store.GetAccount("bf1c8084-ba50-4ce7-9439-34653001fc3b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if account.Rules == nil {
+		t.Errorf("expecting account rules to be initialized")
+	}
+
+	peer, err := store.GetPeer("RRHf3Ma6z6mdLbriAJbqhX7+nM/B71lgw2+91q3LfhU=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Status == nil {
+		t.Errorf("expecting peer status to be initialized")
+	}
+
+	// the upgraded store has been persisted
+	store, err = NewStore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.SchemaVersion != storeSchemaVersion {
+		t.Errorf("expecting persisted store to have schema version %d, got %d", storeSchemaVersion, store.SchemaVersion)
+	}
+}
+
+func TestFileStore_NewerSchemaVersion(t *testing.T) {
+	dataDir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dataDir, storeFileName), []byte(`{"SchemaVersion": 1000, "Accounts": {}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewStore(dataDir)
+	if err == nil {
+		t.Errorf("expecting a store with a newer schema version to be rejected")
+	}
+}
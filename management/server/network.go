@@ -11,12 +11,66 @@ var (
 	upperIPv6 = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 )
 
+const (
+	// MaxNetworkPrefixLength is the longest prefix of an account network leaving enough room for peers (14 peers for /28)
+	MaxNetworkPrefixLength = 28
+)
+
+// usableNetworks are ranges an account network has to belong to so peer addresses don't clash with public addresses
+var usableNetworks = []net.IPNet{
+	{IP: net.IP{10, 0, 0, 0}, Mask: net.IPMask{255, 0, 0, 0}},
+	{IP: net.IP{172, 16, 0, 0}, Mask: net.IPMask{255, 240, 0, 0}},
+	{IP: net.IP{192, 168, 0, 0}, Mask: net.IPMask{255, 255, 0, 0}},
+	{IP: net.IP{100, 64, 0, 0}, Mask: net.IPMask{255, 192, 0, 0}},
+}
+
 type Network struct {
 	Id  string
 	Net net.IPNet
 	Dns string
 }
 
+// DefaultNetwork returns the network used for accounts created without a specific network (100.64.0.0/10)
+func DefaultNetwork() net.IPNet {
+	return net.IPNet{IP: net.ParseIP("100.64.0.0"), Mask: net.IPMask{255, 192, 0, 0}}
+}
+
+// ValidateNetwork checks that the network is an IPv4 private (RFC 1918) or shared (RFC 6598) range
+// with a prefix not longer than MaxNetworkPrefixLength
+func ValidateNetwork(network net.IPNet) error {
+	ip := network.IP.To4()
+	ones, bits := network.Mask.Size()
+	if ip == nil || bits != 8*net.IPv4len {
+		return fmt.Errorf("network %s is not an IPv4 network", network.String())
+	}
+
+	if ones > MaxNetworkPrefixLength {
+		return fmt.Errorf("network %s is too small, the prefix length has to be at most %d", network.String(), MaxNetworkPrefixLength)
+	}
+
+	for _, usable := range usableNetworks {
+		usableOnes, _ := usable.Mask.Size()
+		if usable.Contains(ip) && ones >= usableOnes {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("network %s is not within a private range", network.String())
+}
+
+// ValidateReservedIPs checks that the reserved IPs belong to the network and are not the network address itself
+func ValidateReservedIPs(network net.IPNet, reservedIPs []net.IP) error {
+	for _, ip := range reservedIPs {
+		if !network.Contains(ip) {
+			return fmt.Errorf("reserved IP %s is not within the network %s", ip, network.String())
+		}
+		if ip.Equal(network.IP.Mask(network.Mask)) {
+			return fmt.Errorf("reserved IP %s is the network address of %s", ip, network.String())
+		}
+	}
+	return nil
+}
+
 // AllocatePeerIP pics an available IP from an net.IPNet.
 // This method considers already taken IPs and reuses IPs if there are gaps in takenIps
 // E.g. if ipNet=100.30.0.0/16 and takenIps=[100.30.0.1, 100.30.0.5] then the result would be 100.30.0.2
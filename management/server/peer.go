@@ -1,6 +1,9 @@
 package server
 
 import (
+	"github.com/cenkalti/backoff/v4"
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"net"
@@ -8,6 +11,24 @@ import (
 	"time"
 )
 
+const (
+	// peerLastSeenResolution is how stale the stored LastSeen of a peer can get before a status update with an unchanged
+	// connected state is written to the Store
+	peerLastSeenResolution = 30 * time.Second
+
+	// maxPeerDescriptionLength, maxPeerLabels, maxPeerLabelKeyLength and maxPeerLabelValueLength limit the informational
+	// metadata of a peer that is stored with the account
+	maxPeerDescriptionLength = 1024
+	maxPeerLabels            = 64
+	maxPeerLabelKeyLength    = 63
+	maxPeerLabelValueLength  = 256
+
+	peerStatusRetryInitialInterval = 50 * time.Millisecond
+	peerStatusRetryMaxInterval     = 500 * time.Millisecond
+	// peerStatusRetryMaxElapsedTime caps the time spent retrying to save a peer status
+	peerStatusRetryMaxElapsedTime = 2 * time.Second
+)
+
 // PeerSystemMeta is a metadata of a Peer machine system
 type PeerSystemMeta struct {
 	Hostname  string
@@ -17,6 +38,8 @@ type PeerSystemMeta struct {
 	Platform  string
 	OS        string
 	WtVersion string
+	// Region is where the peer is located (e.g. eu-central) set by the client, empty when unknown
+	Region string
 }
 
 type PeerStatus struct {
@@ -40,70 +63,365 @@ type Peer struct {
 	//Name is peer's name (machine name)
 	Name   string
 	Status *PeerStatus
+	//Groups is a list of groups the peer belongs to
+	Groups []string
+	//ConnectionTimeout is a suggested timeout of a connection attempt other peers make to this peer. 0 means the client's default
+	ConnectionTimeout time.Duration
+	//Priority orders the connection attempts other peers make, peers with a higher priority (e.g. a DNS or exit node)
+	//are connected first. 0 is the default priority of all peers
+	Priority int
+	//Description is a free text description of the peer (e.g. its location or owner)
+	Description string
+	//Labels are key/value metadata of the peer for inventory integrations (e.g. a CMDB asset id).
+	//Unlike Groups they don't affect the network map
+	Labels map[string]string
 }
 
-//Copy copies Peer object
+//Copy copies Peer object. A nil Status (e.g. a peer from an older store) is initialized in the copy
 func (p *Peer) Copy() *Peer {
+	status := &PeerStatus{}
+	if p.Status != nil {
+		statusCopy := *p.Status
+		status = &statusCopy
+	}
+
 	return &Peer{
-		Key:      p.Key,
-		SetupKey: p.SetupKey,
-		IP:       p.IP,
-		Meta:     p.Meta,
-		Name:     p.Name,
-		Status:   p.Status,
+		Key:               p.Key,
+		SetupKey:          p.SetupKey,
+		IP:                p.IP,
+		Meta:              p.Meta,
+		Name:              p.Name,
+		Status:            status,
+		Groups:            copyGroups(p.Groups),
+		ConnectionTimeout: p.ConnectionTimeout,
+		Priority:          p.Priority,
+		Description:       p.Description,
+		Labels:            copyLabels(p.Labels),
+	}
+}
+
+// mergeGroups appends groups that aren't in the existing list yet to a copy of it, keeping the order and skipping empty names
+func mergeGroups(existing []string, groups []string) []string {
+	merged := copyGroups(existing)
+	seen := make(map[string]struct{}, len(merged))
+	for _, group := range merged {
+		seen[group] = struct{}{}
+	}
+
+	for _, group := range groups {
+		if _, ok := seen[group]; ok || group == "" {
+			continue
+		}
+		seen[group] = struct{}{}
+		merged = append(merged, group)
+	}
+
+	return merged
+}
+
+// copyGroups copies a list of groups, nil stays nil
+func copyGroups(groups []string) []string {
+	if groups == nil {
+		return nil
+	}
+	c := make([]string, len(groups))
+	copy(c, groups)
+	return c
+}
+
+// copyLabels copies the labels of a peer, nil stays nil
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
+
+// validatePeerLabels checks the description and the labels of a peer against the size limits
+func validatePeerLabels(description string, labels map[string]string) error {
+	if len(description) > maxPeerDescriptionLength {
+		return status.Errorf(codes.InvalidArgument, "peer description is longer than %d characters", maxPeerDescriptionLength)
+	}
+	if len(labels) > maxPeerLabels {
+		return status.Errorf(codes.InvalidArgument, "peer has %d labels, at most %d are allowed", len(labels), maxPeerLabels)
+	}
+	for k, v := range labels {
+		if k == "" {
+			return status.Errorf(codes.InvalidArgument, "peer label key can't be empty")
+		}
+		if len(k) > maxPeerLabelKeyLength {
+			return status.Errorf(codes.InvalidArgument, "peer label key is longer than %d characters", maxPeerLabelKeyLength)
+		}
+		if len(v) > maxPeerLabelValueLength {
+			return status.Errorf(codes.InvalidArgument, "value of peer label %s is longer than %d characters", k, maxPeerLabelValueLength)
+		}
 	}
+	return nil
 }
 
 //GetPeer returns a peer from a Store
 func (manager *AccountManager) GetPeer(peerKey string) (*Peer, error) {
-	manager.mux.Lock()
-	defer manager.mux.Unlock()
+	manager.mux.RLock()
+	defer manager.mux.RUnlock()
 
 	peer, err := manager.Store.GetPeer(peerKey)
 	if err != nil {
 		return nil, err
 	}
 
+	if peer.Status == nil {
+		// peers of older stores may miss the status, the copy gets a default one
+		return peer.Copy(), nil
+	}
+
 	return peer, nil
 }
 
-//MarkPeerConnected marks peer as connected (true) or disconnected (false)
+//GetPeerIP returns the IP assigned to a peer, codes.NotFound when no peer is registered with the key
+func (manager *AccountManager) GetPeerIP(peerKey string) (net.IP, error) {
+	manager.mux.RLock()
+	defer manager.mux.RUnlock()
+
+	peer, err := manager.Store.GetPeer(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := make(net.IP, len(peer.IP))
+	copy(ip, peer.IP)
+	return ip, nil
+}
+
+//MarkPeerConnected marks peer as connected (true) or disconnected (false).
+//A failed Store write is retried with backoff. The manager lock is held for a single attempt only, so that a slow Store
+//doesn't stall the other operations while waiting for the next attempt, the peer is read again on every attempt
 func (manager *AccountManager) MarkPeerConnected(peerKey string, connected bool) error {
+	backOff := &backoff.ExponentialBackOff{
+		InitialInterval:     peerStatusRetryInitialInterval,
+		RandomizationFactor: backoff.DefaultRandomizationFactor,
+		Multiplier:          backoff.DefaultMultiplier,
+		MaxInterval:         peerStatusRetryMaxInterval,
+		MaxElapsedTime:      peerStatusRetryMaxElapsedTime,
+		Stop:                backoff.Stop,
+		Clock:               backoff.SystemClock,
+	}
+	return backoff.Retry(func() error {
+		return manager.savePeerStatus(peerKey, connected)
+	}, backOff)
+}
+
+//savePeerStatus is an attempt of MarkPeerConnected to save the status of the peer. A failed peer lookup isn't retried
+func (manager *AccountManager) savePeerStatus(peerKey string, connected bool) error {
 	manager.mux.Lock()
 	defer manager.mux.Unlock()
 
 	peer, err := manager.Store.GetPeer(peerKey)
 	if err != nil {
-		return err
+		return backoff.Permanent(err)
+	}
+
+	now := time.Now()
+	if !shouldPersistPeerStatus(peer.Status, connected, now) {
+		return nil
 	}
 
 	account, err := manager.Store.GetPeerAccount(peerKey)
 	if err != nil {
-		return err
+		return backoff.Permanent(err)
 	}
 
 	peerCopy := peer.Copy()
-	peerCopy.Status.LastSeen = time.Now()
-	peerCopy.Status.Connected = connected
+	peerCopy.Status = &PeerStatus{LastSeen: now, Connected: connected}
+
 	err = manager.Store.SavePeer(account.Id, peerCopy)
 	if err != nil {
+		log.Warnf("failed saving status of peer %s: %v", peerKey, err)
 		return err
 	}
+
+	eventType := PeerDisconnectedEvent
+	if connected {
+		eventType = PeerConnectedEvent
+	}
+	manager.publishPeerEvent(eventType, account.Id, peerCopy)
+
 	return nil
 }
 
-//RenamePeer changes peer's name
+// shouldPersistPeerStatus checks whether a status update is worth a Store write:
+// the connected state has changed or the stored LastSeen is older than peerLastSeenResolution
+func shouldPersistPeerStatus(status *PeerStatus, connected bool, now time.Time) bool {
+	if status == nil || status.Connected != connected {
+		return true
+	}
+	return now.Sub(status.LastSeen) >= peerLastSeenResolution
+}
+
+//RenamePeer changes peer's name.
+//With Account.RequireUniquePeerNames a name of another peer of the account is rejected with codes.AlreadyExists
 func (manager *AccountManager) RenamePeer(accountId string, peerKey string, newName string) (*Peer, error) {
 	manager.mux.Lock()
 	defer manager.mux.Unlock()
 
+	var renamed *Peer
+	err := manager.Store.Update(accountId, func(account *Account) error {
+		peer, ok := account.Peers[peerKey]
+		if !ok {
+			return status.Errorf(codes.NotFound, "peer %s not found in account %s", peerKey, accountId)
+		}
+		if account.RequireUniquePeerNames && account.peerNameTaken(newName, peerKey) {
+			return status.Errorf(codes.AlreadyExists, "peer name %s is already used in account %s", newName, accountId)
+		}
+
+		peer.Name = newName
+		renamed = peer.Copy()
+		return nil
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "failed renaming peer")
+	}
+
+	return renamed, nil
+}
+
+//PeerUpdate is a change of the settings of a peer, the fields that are nil are kept as they are
+type PeerUpdate struct {
+	Name        *string
+	Description *string
+	// Labels replace all the labels of the peer, an empty map removes them
+	Labels map[string]string
+}
+
+//UpdatePeer applies the update to the peer in a single account update: either all of its fields are applied or none.
+//Descriptions and labels exceeding the size limits are rejected with codes.InvalidArgument, a name already used in an
+//account requiring unique peer names with codes.AlreadyExists
+func (manager *AccountManager) UpdatePeer(accountId string, peerKey string, update PeerUpdate) (*Peer, error) {
+	description := ""
+	if update.Description != nil {
+		description = *update.Description
+	}
+	// the stored description and labels are valid already
+	err := validatePeerLabels(description, update.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+
+	var updated *Peer
+	err = manager.Store.Update(accountId, func(account *Account) error {
+		peer, ok := account.Peers[peerKey]
+		if !ok {
+			return status.Errorf(codes.NotFound, "peer %s not found in account %s", peerKey, accountId)
+		}
+		if update.Name != nil && account.RequireUniquePeerNames && account.peerNameTaken(*update.Name, peerKey) {
+			return status.Errorf(codes.AlreadyExists, "peer name %s is already used in account %s", *update.Name, accountId)
+		}
+
+		if update.Name != nil {
+			peer.Name = *update.Name
+		}
+		if update.Description != nil {
+			peer.Description = *update.Description
+		}
+		if update.Labels != nil {
+			peer.Labels = nil
+			if len(update.Labels) > 0 {
+				// the caller keeps its map
+				peer.Labels = copyLabels(update.Labels)
+			}
+		}
+		updated = peer.Copy()
+		return nil
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "failed updating peer")
+	}
+
+	return updated, nil
+}
+
+//UpdatePeerLabels replaces the description and the labels of a peer. A nil or empty labels map removes all the labels.
+//Descriptions and labels exceeding the size limits are rejected with codes.InvalidArgument
+func (manager *AccountManager) UpdatePeerLabels(accountId string, peerKey string, description string, labels map[string]string) (*Peer, error) {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return manager.UpdatePeer(accountId, peerKey, PeerUpdate{Description: &description, Labels: labels})
+}
+
+//UpdatePeerRegion changes the region of a peer reported by the client (e.g. its config has changed since the registration)
+func (manager *AccountManager) UpdatePeerRegion(peerKey string, region string) (*Peer, error) {
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+
+	account, err := manager.Store.GetPeerAccount(peerKey)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "peer %s not found", peerKey)
+	}
+
+	peer, ok := account.Peers[peerKey]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "peer %s not found", peerKey)
+	}
+
+	peerCopy := peer.Copy()
+	peerCopy.Meta.Region = region
+	err = manager.Store.SavePeer(account.Id, peerCopy)
+	if err != nil {
+		return nil, err
+	}
+
+	return peerCopy, nil
+}
+
+//SetPeerConnectionTimeout changes the connection timeout suggested to the peers connecting to the peer. 0 resets it to the client's default
+func (manager *AccountManager) SetPeerConnectionTimeout(accountId string, peerKey string, timeout time.Duration) (*Peer, error) {
+	if timeout < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "connection timeout can't be negative")
+	}
+
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+
+	peer, err := manager.Store.GetPeer(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	peerCopy := peer.Copy()
+	peerCopy.ConnectionTimeout = timeout
+	err = manager.Store.SavePeer(accountId, peerCopy)
+	if err != nil {
+		return nil, err
+	}
+
+	return peerCopy, nil
+}
+
+//SetPeerPriority changes the priority of the connection attempts other peers make to the peer. 0 resets it to the default
+func (manager *AccountManager) SetPeerPriority(accountId string, peerKey string, priority int) (*Peer, error) {
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+
 	peer, err := manager.Store.GetPeer(peerKey)
 	if err != nil {
 		return nil, err
 	}
 
 	peerCopy := peer.Copy()
-	peerCopy.Name = newName
+	peerCopy.Priority = priority
 	err = manager.Store.SavePeer(accountId, peerCopy)
 	if err != nil {
 		return nil, err
@@ -112,18 +430,126 @@ func (manager *AccountManager) RenamePeer(accountId string, peerKey string, newN
 	return peerCopy, nil
 }
 
+//RotatePeerKey replaces the Wireguard public key of a peer keeping its identity: IP, name, groups and the rest of its settings
+//stay the same. The peer is re-indexed under the new key, the old key can't be used anymore
+func (manager *AccountManager) RotatePeerKey(accountId string, oldKey string, newKey string) (*Peer, error) {
+	_, err := wgtypes.ParseKey(newKey)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid Wireguard public key %s", newKey)
+	}
+	if oldKey == newKey {
+		return nil, status.Errorf(codes.InvalidArgument, "new key of peer %s is the same as the old one", oldKey)
+	}
+
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+
+	// keys are unique across accounts
+	_, err = manager.Store.GetPeer(newKey)
+	if err == nil {
+		return nil, status.Errorf(codes.AlreadyExists, "peer with key %s already exists", newKey)
+	}
+
+	var rotated *Peer
+	err = manager.Store.Update(accountId, func(account *Account) error {
+		peer, ok := account.Peers[oldKey]
+		if !ok {
+			return status.Errorf(codes.NotFound, "peer %s not found", oldKey)
+		}
+
+		peer.Key = newKey
+		delete(account.Peers, oldKey)
+		account.Peers[newKey] = peer
+		// the pairs of the new key derive new preshared keys
+		rotated = peer.Copy()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the peers connected to the old key see it go away and the new one come up
+	manager.publishPeerEvent(PeerRemovedEvent, accountId, &Peer{Key: oldKey, IP: rotated.IP})
+	manager.publishPeerEvent(PeerAddedEvent, accountId, rotated)
+
+	return rotated, nil
+}
+
 //DeletePeer removes peer from the account by it's IP
 func (manager *AccountManager) DeletePeer(accountId string, peerKey string) (*Peer, error) {
 	manager.mux.Lock()
 	defer manager.mux.Unlock()
-	return manager.Store.DeletePeer(accountId, peerKey)
+
+	peer, err := manager.Store.DeletePeer(accountId, peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	manager.publishPeerEvent(PeerRemovedEvent, accountId, peer)
+
+	return peer, nil
 }
 
-//GetPeerByIP returns peer by it's IP
-func (manager *AccountManager) GetPeerByIP(accountId string, peerIP string) (*Peer, error) {
+//DeletePeers removes the peers from the account with a single update of the account. A peer that can't be deleted
+//(e.g. it doesn't exist) doesn't stop the rest, its error is reported in errs by its key. errs is nil when all the peers
+//have been deleted. The IPs of the deleted peers can be assigned to new peers again
+func (manager *AccountManager) DeletePeers(accountId string, peerKeys []string) (deleted []*Peer, errs map[string]error) {
 	manager.mux.Lock()
 	defer manager.mux.Unlock()
 
+	err := manager.Store.Update(accountId, func(account *Account) error {
+		deleted = nil
+		errs = make(map[string]error)
+		for _, peerKey := range peerKeys {
+			peer, ok := account.Peers[peerKey]
+			if !ok {
+				if !containsDeletedPeer(deleted, peerKey) {
+					errs[peerKey] = status.Errorf(codes.NotFound, "peer %s not found", peerKey)
+				}
+				continue
+			}
+			delete(account.Peers, peerKey)
+			deleted = append(deleted, peer.Copy())
+		}
+		return nil
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); !ok {
+			err = status.Errorf(codes.Internal, "failed deleting peers")
+		}
+		// the account hasn't been changed, none of the peers has been deleted
+		errs = make(map[string]error, len(peerKeys))
+		for _, peerKey := range peerKeys {
+			errs[peerKey] = err
+		}
+		return nil, errs
+	}
+
+	for _, peer := range deleted {
+		manager.publishPeerEvent(PeerRemovedEvent, accountId, peer)
+	}
+
+	if len(errs) == 0 {
+		return deleted, nil
+	}
+	return deleted, errs
+}
+
+// containsDeletedPeer checks whether the peer is among the deleted ones, e.g. listed twice for deletion
+func containsDeletedPeer(deleted []*Peer, peerKey string) bool {
+	for _, peer := range deleted {
+		if peer.Key == peerKey {
+			return true
+		}
+	}
+	return false
+}
+
+//GetPeerByIP returns peer by it's IP
+func (manager *AccountManager) GetPeerByIP(accountId string, peerIP string) (*Peer, error) {
+	manager.mux.RLock()
+	defer manager.mux.RUnlock()
+
 	account, err := manager.Store.GetAccount(accountId)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "account not found")
@@ -138,25 +564,92 @@ func (manager *AccountManager) GetPeerByIP(accountId string, peerIP string) (*Pe
 	return nil, status.Errorf(codes.NotFound, "peer with IP %s not found", peerIP)
 }
 
+// ListConnectedPeers returns copies of the peers of the account that are currently connected to the Management Service
+func (manager *AccountManager) ListConnectedPeers(accountId string) ([]*Peer, error) {
+	return manager.listPeers(accountId, func(peer *Peer) bool {
+		return peer.Status != nil && peer.Status.Connected
+	})
+}
+
+// ListPeersSeenSince returns copies of the peers of the account that are connected or have been seen after since.
+// The last seen time is only persisted every peerLastSeenResolution, so since should be older than that
+func (manager *AccountManager) ListPeersSeenSince(accountId string, since time.Time) ([]*Peer, error) {
+	return manager.listPeers(accountId, func(peer *Peer) bool {
+		return peer.Status != nil && (peer.Status.Connected || peer.Status.LastSeen.After(since))
+	})
+}
+
+// listPeers returns copies of the peers of the account matching the filter
+func (manager *AccountManager) listPeers(accountId string, filter func(peer *Peer) bool) ([]*Peer, error) {
+	manager.mux.RLock()
+	defer manager.mux.RUnlock()
+
+	account, err := manager.Store.GetAccount(accountId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "account not found")
+	}
+
+	peers := make([]*Peer, 0)
+	for _, peer := range account.Peers {
+		if filter(peer) {
+			peers = append(peers, peer.Copy())
+		}
+	}
+
+	return peers, nil
+}
+
+// NetworkMap is a consistent snapshot of a peer and the peers it can reach read from the same Account state
+type NetworkMap struct {
+	// Peer is the requesting peer's own config (e.g. IP, groups)
+	Peer *Peer
+	// Peers are the peers of the account the Rules allow the requesting peer to reach
+	Peers []*Peer
+	// PresharedKeys are the preshared keys the requesting peer shares with each of the Peers (by their key)
+	PresharedKeys map[string]string
+}
+
 // GetPeersForAPeer returns a list of peers available for a given peer (key)
-// Effectively all the peers of the original peer's account except for the peer itself
+// Effectively all the peers of the original peer's account except for the peer itself that the account Rules allow
+// the peer to reach
 func (manager *AccountManager) GetPeersForAPeer(peerKey string) ([]*Peer, error) {
-	manager.mux.Lock()
-	defer manager.mux.Unlock()
+	networkMap, err := manager.GetNetworkMap(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return networkMap.Peers, nil
+}
+
+// GetNetworkMap returns the peer (key) together with the peers available for it (see GetPeersForAPeer).
+// Both are read in a single lookup and copied so that a Sync response built from the map doesn't mix up states
+// of the account, e.g. a stale IP of the peer with a newer list of peers
+func (manager *AccountManager) GetNetworkMap(peerKey string) (*NetworkMap, error) {
+	manager.mux.RLock()
+	defer manager.mux.RUnlock()
 
 	account, err := manager.Store.GetPeerAccount(peerKey)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Invalid peer key %s", peerKey)
 	}
 
+	requestingPeer, ok := account.Peers[peerKey]
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "Invalid peer key %s", peerKey)
+	}
+
 	var res []*Peer
+	presharedKeys := make(map[string]string)
 	for _, peer := range account.Peers {
-		if peer.Key != peerKey {
-			res = append(res, peer)
+		if peer.Key != peerKey && account.isConnectionAllowed(requestingPeer, peer) {
+			res = append(res, peer.Copy())
+			if key := account.presharedKey(peerKey, peer.Key); key != "" {
+				presharedKeys[peer.Key] = key
+			}
 		}
 	}
 
-	return res, nil
+	return &NetworkMap{Peer: requestingPeer.Copy(), Peers: res, PresharedKeys: presharedKeys}, nil
 }
 
 // AddPeer adds a new peer to the Store.
@@ -171,53 +664,143 @@ func (manager *AccountManager) AddPeer(setupKey string, peer Peer) (*Peer, error
 
 	upperKey := strings.ToUpper(setupKey)
 
+	var newPeer *Peer
+	// addPeer registers the peer in the account and increments the usage of the setup key.
+	// Both changes are saved together so concurrent registrations can't lose the setup key usage
+	addPeer := func(account *Account) error {
+		sk := getAccountSetupKeyByKey(account, upperKey)
+		if sk == nil {
+			return status.Errorf(codes.NotFound, "unknown setupKey %s", upperKey)
+		}
+
+		if !sk.IsValid() {
+			return status.Errorf(codes.FailedPrecondition, "setup key was expired or overused %s", upperKey)
+		}
+
+		var err error
+		newPeer, err = addAccountPeer(account, peer, sk.Key, sk.AutoGroups)
+		if err != nil {
+			return err
+		}
+
+		account.SetupKeys[sk.Key] = sk.IncrementUsage()
+		return nil
+	}
+
 	var account *Account
 	var err error
-	var sk *SetupKey
 	if len(upperKey) == 0 {
 		// Empty setup key, create a new account for it.
+		var sk *SetupKey
 		account, sk = newAccount()
+		upperKey = sk.Key
+		err = addPeer(account)
+		if err != nil {
+			return nil, err
+		}
+
+		err = manager.Store.SaveAccount(account)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed adding peer")
+		}
 	} else {
 		account, err = manager.Store.GetAccountBySetupKey(upperKey)
 		if err != nil {
 			return nil, status.Errorf(codes.NotFound, "unknown setupKey %s", upperKey)
 		}
 
-		sk = getAccountSetupKeyByKey(account, upperKey)
-		if sk == nil {
-			// shouldn't happen actually
-			return nil, status.Errorf(codes.NotFound, "unknown setupKey %s", upperKey)
+		err = manager.Store.Update(account.Id, addPeer)
+		if err != nil {
+			if _, ok := status.FromError(err); ok {
+				return nil, err
+			}
+			return nil, status.Errorf(codes.Internal, "failed adding peer")
 		}
 	}
 
-	if !sk.IsValid() {
-		return nil, status.Errorf(codes.FailedPrecondition, "setup key was expired or overused %s", upperKey)
+	manager.publishPeerEvent(PeerAddedEvent, account.Id, newPeer)
+
+	return newPeer, nil
+
+}
+
+// AddPeerToAccount registers a new peer in the account without a setup key.
+// Used when the peer has already proven the account it belongs to, e.g. with a JWT of the identity provider.
+// The account is created if it doesn't exist yet. The peer joins the given groups on top of the groups it already has.
+func (manager *AccountManager) AddPeerToAccount(accountId string, groups []string, peer Peer) (*Peer, error) {
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+
+	_, err := manager.Store.GetAccount(accountId)
+	if err != nil {
+		if s, ok := status.FromError(err); !ok || s.Code() != codes.NotFound {
+			return nil, status.Errorf(codes.Internal, "failed retrieving account")
+		}
+		_, err = manager.createAccount(accountId)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	var takenIps []net.IP
+	var newPeer *Peer
+	err = manager.Store.Update(accountId, func(account *Account) error {
+		var err error
+		newPeer, err = addAccountPeer(account, peer, "", groups)
+		return err
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "failed adding peer")
+	}
+
+	manager.publishPeerEvent(PeerAddedEvent, accountId, newPeer)
+
+	return newPeer, nil
+}
+
+// addAccountPeer allocates the next free IP of the account network to the peer and adds the peer to the account.
+// The peer is registered with the setup key (empty if enrolled otherwise) and joins the autoGroups on top of the groups
+// it already has when registering again
+func addAccountPeer(account *Account, peer Peer, setupKey string, autoGroups []string) (*Peer, error) {
+	takenIps := append([]net.IP{}, account.ReservedIPs...)
 	for _, peer := range account.Peers {
 		takenIps = append(takenIps, peer.IP)
 	}
 
 	network := account.Network
-	nextIp, _ := AllocatePeerIP(network.Net, takenIps)
+	nextIp, err := AllocatePeerIP(network.Net, takenIps)
+	if err != nil {
+		return nil, status.Errorf(codes.ResourceExhausted, "no free IP left in the account network %s", network.Net.String())
+	}
+
+	if account.RequireUniquePeerNames && account.peerNameTaken(peer.Name, peer.Key) {
+		return nil, status.Errorf(codes.AlreadyExists, "peer name %s is already used in account %s", peer.Name, account.Id)
+	}
+
+	var groups []string
+	if existing, ok := account.Peers[peer.Key]; ok {
+		groups = existing.Groups
+	}
+	groups = mergeGroups(groups, autoGroups)
 
 	newPeer := &Peer{
 		Key:      peer.Key,
-		SetupKey: sk.Key,
+		SetupKey: setupKey,
 		IP:       nextIp,
 		Meta:     peer.Meta,
 		Name:     peer.Name,
 		Status:   &PeerStatus{Connected: false, LastSeen: time.Now()},
+		Groups:   groups,
 	}
 
 	account.Peers[newPeer.Key] = newPeer
-	account.SetupKeys[sk.Key] = sk.IncrementUsage()
-	err = manager.Store.SaveAccount(account)
+
+	err = account.updatePresharedKeySecret(false)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed adding peer")
+		return nil, status.Errorf(codes.Internal, "failed generating preshared key secret")
 	}
 
 	return newPeer, nil
-
 }
@@ -0,0 +1,786 @@
+package server
+
+import (
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShouldPersistPeerStatus(t *testing.T) {
+	now := time.Now()
+
+	type testCase struct {
+		name      string
+		status    *PeerStatus
+		connected bool
+		expected  bool
+	}
+
+	testCases := []testCase{
+		{
+			name:      "no status yet",
+			status:    nil,
+			connected: true,
+			expected:  true,
+		},
+		{
+			name:      "connected state changed",
+			status:    &PeerStatus{Connected: false, LastSeen: now},
+			connected: true,
+			expected:  true,
+		},
+		{
+			name:      "same state seen recently",
+			status:    &PeerStatus{Connected: true, LastSeen: now.Add(-time.Second)},
+			connected: true,
+			expected:  false,
+		},
+		{
+			name:      "same state with stale last seen",
+			status:    &PeerStatus{Connected: true, LastSeen: now.Add(-peerLastSeenResolution)},
+			connected: true,
+			expected:  true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			persist := shouldPersistPeerStatus(testCase.status, testCase.connected, now)
+			if persist != testCase.expected {
+				t.Errorf("expecting status persistence to be %t, got %t", testCase.expected, persist)
+			}
+		})
+	}
+}
+
+func TestAccountManager_MarkPeerConnectedDebounce(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := manager.AddAccount("test_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var setupKey *SetupKey
+	for _, key := range account.SetupKeys {
+		setupKey = key
+	}
+
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := manager.AddPeer(setupKey.Key, Peer{Key: key.PublicKey().String(), Name: "peer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = manager.MarkPeerConnected(peer.Key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err = manager.GetPeer(peer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastSeen := peer.Status.LastSeen
+
+	// a repeated heartbeat doesn't change anything worth a write
+	err = manager.MarkPeerConnected(peer.Key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err = manager.GetPeer(peer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peer.Status.Connected || !peer.Status.LastSeen.Equal(lastSeen) {
+		t.Errorf("expecting redundant status update to be skipped, got status %+v", peer.Status)
+	}
+
+	err = manager.MarkPeerConnected(peer.Key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err = manager.GetPeer(peer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Status.Connected {
+		t.Errorf("expecting peer to be marked disconnected")
+	}
+}
+
+func TestAccountManager_MarkPeerConnectedNilStatus(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := manager.AddAccount("test_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a peer persisted without a status, e.g. by an older version
+	err = manager.Store.SavePeer(account.Id, &Peer{Key: key.PublicKey().String(), Name: "peer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SavePeer doesn't index new peers, saving the account does
+	account, err = manager.Store.GetAccount(account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Store.SaveAccount(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := manager.GetPeer(key.PublicKey().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Status == nil {
+		t.Fatalf("expecting peer to get a default status")
+	}
+
+	err = manager.MarkPeerConnected(peer.Key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err = manager.GetPeer(peer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peer.Status.Connected {
+		t.Errorf("expecting peer to be marked connected")
+	}
+}
+
+func TestAccountManager_GetNetworkMap(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := manager.AddAccount("test_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var setupKey *SetupKey
+	for _, key := range account.SetupKeys {
+		setupKey = key
+	}
+
+	addPeer := func(name string) *Peer {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := manager.AddPeer(setupKey.Key, Peer{Key: key.PublicKey().String(), Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return peer
+	}
+
+	peer := addPeer("peer-0")
+	for i := 1; i < 3; i++ {
+		addPeer(fmt.Sprintf("peer-%d", i))
+	}
+
+	networkMap, err := manager.GetNetworkMap(peer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if networkMap.Peer.Key != peer.Key || !networkMap.Peer.IP.Equal(peer.IP) {
+		t.Errorf("expecting network map of peer %s with IP %s, got %s with IP %s", peer.Key, peer.IP, networkMap.Peer.Key, networkMap.Peer.IP)
+	}
+	if len(networkMap.Peers) != 2 {
+		t.Errorf("expecting 2 reachable peers, got %d", len(networkMap.Peers))
+	}
+
+	// the snapshot doesn't change with the account
+	_, err = manager.RenamePeer(account.Id, peer.Key, "renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if networkMap.Peer.Name != "peer-0" {
+		t.Errorf("expecting network map to keep the peer name it was read with, got %s", networkMap.Peer.Name)
+	}
+
+	// peers added concurrently show up in full or not at all, never next to a different state of the requesting peer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 3; i < 13; i++ {
+			key, err := wgtypes.GenerateKey()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, err = manager.AddPeer(setupKey.Key, Peer{Key: key.PublicKey().String(), Name: fmt.Sprintf("peer-%d", i)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		networkMap, err = manager.GetNetworkMap(peer.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if networkMap.Peer.Key != peer.Key || !networkMap.Peer.IP.Equal(peer.IP) {
+			t.Fatalf("expecting network map of peer %s with IP %s, got %s with IP %s", peer.Key, peer.IP, networkMap.Peer.Key, networkMap.Peer.IP)
+		}
+		seen := map[string]struct{}{}
+		for _, remotePeer := range networkMap.Peers {
+			if remotePeer.Key == peer.Key {
+				t.Fatalf("expecting network map not to list the requesting peer")
+			}
+			if _, ok := seen[remotePeer.IP.String()]; ok {
+				t.Fatalf("expecting unique peer IPs in the network map, got %s twice", remotePeer.IP)
+			}
+			seen[remotePeer.IP.String()] = struct{}{}
+		}
+	}
+	wg.Wait()
+
+	networkMap, err = manager.GetNetworkMap(peer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networkMap.Peers) != 12 {
+		t.Errorf("expecting 12 reachable peers, got %d", len(networkMap.Peers))
+	}
+}
+
+func TestAccountManager_ListConnectedPeers(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := manager.AddAccount("test_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var setupKey *SetupKey
+	for _, key := range account.SetupKeys {
+		setupKey = key
+	}
+
+	now := time.Now()
+	statuses := map[string]*PeerStatus{
+		"connected":            {Connected: true, LastSeen: now.Add(-time.Hour)},
+		"recently-seen":        {Connected: false, LastSeen: now.Add(-10 * time.Minute)},
+		"disconnected-a-while": {Connected: false, LastSeen: now.Add(-2 * time.Hour)},
+	}
+
+	for name, peerStatus := range statuses {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := manager.AddPeer(setupKey.Key, Peer{Key: key.PublicKey().String(), Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer = peer.Copy()
+		peer.Status = peerStatus
+		err = manager.Store.SavePeer(account.Id, peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := func(peers []*Peer) map[string]struct{} {
+		result := map[string]struct{}{}
+		for _, peer := range peers {
+			result[peer.Name] = struct{}{}
+		}
+		return result
+	}
+
+	connected, err := manager.ListConnectedPeers(account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := names(connected)["connected"]; !ok || len(connected) != 1 {
+		t.Errorf("expecting only the connected peer, got %v", names(connected))
+	}
+
+	// the result is a copy
+	connected[0].Status.Connected = false
+	peer, err := manager.GetPeer(connected[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peer.Status.Connected {
+		t.Errorf("expecting listed peers to be copies")
+	}
+
+	seen, err := manager.ListPeersSeenSince(account.Id, now.Add(-30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seenNames := names(seen)
+	_, connectedSeen := seenNames["connected"]
+	_, recentlySeen := seenNames["recently-seen"]
+	if !connectedSeen || !recentlySeen || len(seen) != 2 {
+		t.Errorf("expecting connected and recently seen peers, got %v", seenNames)
+	}
+
+	_, err = manager.ListConnectedPeers("unknown_account")
+	if err == nil {
+		t.Errorf("expecting unknown account to fail")
+	}
+}
+
+func TestAccountManager_RotatePeerKey(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := manager.AddAccount("test_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var setupKey *SetupKey
+	for _, key := range account.SetupKeys {
+		setupKey = key
+	}
+
+	oldKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unusedKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := manager.AddPeerToAccount(account.Id, []string{"devs", "ops"}, Peer{Key: oldKey.PublicKey().String(), Name: "laptop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.AddPeer(setupKey.Key, Peer{Key: otherKey.PublicKey().String(), Name: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := manager.RotatePeerKey(account.Id, oldKey.PublicKey().String(), newKey.PublicKey().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rotated.Key != newKey.PublicKey().String() {
+		t.Errorf("expecting peer to be re-keyed to %s, got %s", newKey.PublicKey().String(), rotated.Key)
+	}
+	if !rotated.IP.Equal(peer.IP) || rotated.Name != "laptop" {
+		t.Errorf("expecting peer to keep IP %s and name laptop, got %s and %s", peer.IP, rotated.IP, rotated.Name)
+	}
+	if len(rotated.Groups) != 2 || rotated.Groups[0] != "devs" || rotated.Groups[1] != "ops" {
+		t.Errorf("expecting peer to keep its groups, got %v", rotated.Groups)
+	}
+
+	_, err = manager.GetPeer(oldKey.PublicKey().String())
+	if s, ok := status.FromError(err); !ok || s.Code() != codes.NotFound {
+		t.Errorf("expecting old key not to be found after rotation, got %v", err)
+	}
+	stored, err := manager.GetPeer(newKey.PublicKey().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.IP.Equal(peer.IP) {
+		t.Errorf("expecting stored peer to keep IP %s, got %s", peer.IP, stored.IP)
+	}
+	account, err = manager.GetAccount(account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := account.Peers[oldKey.PublicKey().String()]; ok || len(account.Peers) != 2 {
+		t.Errorf("expecting account peers to be re-keyed, got %d peers", len(account.Peers))
+	}
+
+	for name, keys := range map[string][2]string{
+		"old key not found":   {oldKey.PublicKey().String(), unusedKey.PublicKey().String()},
+		"new key taken":       {newKey.PublicKey().String(), otherKey.PublicKey().String()},
+		"invalid new key":     {newKey.PublicKey().String(), "invalid"},
+		"new key same as old": {newKey.PublicKey().String(), newKey.PublicKey().String()},
+	} {
+		_, err = manager.RotatePeerKey(account.Id, keys[0], keys[1])
+		if err == nil {
+			t.Errorf("%s: expecting rotation to fail", name)
+		}
+	}
+}
+
+func TestAccountManager_UpdatePeerRegion(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, peers := addTestPeers(t, manager, 2)
+
+	updated, err := manager.UpdatePeerRegion(peers[0].Key, "eu-central")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Meta.Region != "eu-central" {
+		t.Errorf("expecting region eu-central, got %q", updated.Meta.Region)
+	}
+
+	// the other peers learn the region with the network map
+	networkMap, err := manager.GetNetworkMap(peers[1].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync := toSyncResponse(&Config{Signal: &Host{Proto: HTTP}}, networkMap.Peer, networkMap.Peers, networkMap.PresharedKeys)
+	if len(sync.GetRemotePeers()) != 1 || sync.GetRemotePeers()[0].GetRegion() != "eu-central" {
+		t.Errorf("expecting remote peer with region eu-central, got %v", sync.GetRemotePeers())
+	}
+
+	unknownKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.UpdatePeerRegion(unknownKey.PublicKey().String(), "eu-central")
+	if err == nil {
+		t.Errorf("expecting region update of an unknown peer to fail")
+	}
+}
+
+func TestAccountManager_UpdatePeerLabels(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accountId, peers := addTestPeers(t, manager, 2)
+	peer := peers[0]
+
+	labels := map[string]string{"asset": "A-1234", "owner": "ops"}
+	updated, err := manager.UpdatePeerLabels(accountId, peer.Key, "rack 4, row 2", labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Description != "rack 4, row 2" || !reflect.DeepEqual(updated.Labels, labels) {
+		t.Errorf("expecting peer with description and labels %v, got %q %v", labels, updated.Description, updated.Labels)
+	}
+
+	// the stored labels are isolated from the map of the caller and from the copies
+	labels["owner"] = "changed"
+	updated.Labels["asset"] = "changed"
+	stored, err := manager.GetPeer(peer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"asset": "A-1234", "owner": "ops"}
+	if !reflect.DeepEqual(stored.Labels, expected) {
+		t.Errorf("expecting stored labels %v, got %v", expected, stored.Labels)
+	}
+	peerCopy := stored.Copy()
+	peerCopy.Labels["asset"] = "changed"
+	if stored.Labels["asset"] != "A-1234" {
+		t.Errorf("expecting a copy not to share the labels of the peer")
+	}
+
+	// an update replaces the labels
+	updated, err = manager.UpdatePeerLabels(accountId, peer.Key, "", map[string]string{"site": "berlin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Description != "" || !reflect.DeepEqual(updated.Labels, map[string]string{"site": "berlin"}) {
+		t.Errorf("expecting labels to be replaced, got %q %v", updated.Description, updated.Labels)
+	}
+
+	// labels don't affect the network map
+	networkMap, err := manager.GetNetworkMap(peers[1].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networkMap.Peers) != 1 {
+		t.Errorf("expecting labels not to change the network map, got %d peers", len(networkMap.Peers))
+	}
+
+	tooMany := map[string]string{}
+	for i := 0; i <= maxPeerLabels; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "value"
+	}
+	invalid := []struct {
+		name        string
+		description string
+		labels      map[string]string
+	}{
+		{name: "long description", description: strings.Repeat("a", maxPeerDescriptionLength+1)},
+		{name: "too many labels", labels: tooMany},
+		{name: "empty key", labels: map[string]string{"": "value"}},
+		{name: "long key", labels: map[string]string{strings.Repeat("k", maxPeerLabelKeyLength+1): "value"}},
+		{name: "long value", labels: map[string]string{"key": strings.Repeat("v", maxPeerLabelValueLength+1)}},
+	}
+	for _, testCase := range invalid {
+		_, err = manager.UpdatePeerLabels(accountId, peer.Key, testCase.description, testCase.labels)
+		if s, ok := status.FromError(err); !ok || s.Code() != codes.InvalidArgument {
+			t.Errorf("%s: expecting labels to be rejected with %s, got %v", testCase.name, codes.InvalidArgument, err)
+		}
+	}
+
+	stored, err = manager.GetPeer(peer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored.Labels, map[string]string{"site": "berlin"}) {
+		t.Errorf("expecting rejected labels not to be stored, got %v", stored.Labels)
+	}
+
+	unknownKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.UpdatePeerLabels(accountId, unknownKey.PublicKey().String(), "", nil)
+	if s, ok := status.FromError(err); !ok || s.Code() != codes.NotFound {
+		t.Errorf("expecting labels update of an unknown peer to fail with %s, got %v", codes.NotFound, err)
+	}
+}
+
+func TestAccountManager_UpdatePeer(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accountId, peers := addTestPeers(t, manager, 1)
+	peer := peers[0]
+
+	name := "renamed"
+	_, err = manager.UpdatePeer(accountId, peer.Key, PeerUpdate{Name: &name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the fields that aren't updated are kept
+	labels := map[string]string{"site": "berlin"}
+	updated, err := manager.UpdatePeer(accountId, peer.Key, PeerUpdate{Labels: labels})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Name != name || !reflect.DeepEqual(updated.Labels, labels) {
+		t.Errorf("expecting peer %s with labels %v, got %s with %v", name, labels, updated.Name, updated.Labels)
+	}
+
+	// an invalid update isn't applied partially
+	otherName := "other"
+	invalid := strings.Repeat("a", maxPeerDescriptionLength+1)
+	_, err = manager.UpdatePeer(accountId, peer.Key, PeerUpdate{Name: &otherName, Description: &invalid})
+	if s, ok := status.FromError(err); !ok || s.Code() != codes.InvalidArgument {
+		t.Errorf("expecting update to be rejected with %s, got %v", codes.InvalidArgument, err)
+	}
+	stored, err := manager.GetPeer(peer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name != name {
+		t.Errorf("expecting rejected update not to rename the peer, got %s", stored.Name)
+	}
+}
+
+func TestAccountManager_GetPeerIP(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, peers := addTestPeers(t, manager, 2)
+
+	for _, peer := range peers {
+		ip, err := manager.GetPeerIP(peer.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ip.Equal(peer.IP) {
+			t.Errorf("expecting peer %s to have IP %s, got %s", peer.Name, peer.IP, ip)
+		}
+	}
+
+	unknownKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.GetPeerIP(unknownKey.PublicKey().String())
+	if s, ok := status.FromError(err); !ok || s.Code() != codes.NotFound {
+		t.Errorf("expecting IP lookup of an unknown peer to fail with %s, got %v", codes.NotFound, err)
+	}
+}
+
+func TestAccountManager_DeletePeers(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accountId, peers := addTestPeers(t, manager, 3)
+
+	unknownKey, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := unknownKey.PublicKey().String()
+
+	deleted, errs := manager.DeletePeers(accountId, []string{peers[0].Key, unknown, peers[1].Key, peers[0].Key})
+	if len(deleted) != 2 || deleted[0].Key != peers[0].Key || deleted[1].Key != peers[1].Key {
+		t.Errorf("expecting peers peer-0 and peer-1 to be deleted, got %v", deleted)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expecting 1 failure, got %v", errs)
+	}
+	if s, ok := status.FromError(errs[unknown]); !ok || s.Code() != codes.NotFound {
+		t.Errorf("expecting unknown peer to fail with NotFound, got %v", errs[unknown])
+	}
+
+	account, err := manager.GetAccount(accountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(account.Peers) != 1 || account.Peers[peers[2].Key] == nil {
+		t.Errorf("expecting only peer-2 to be left, got %d peers", len(account.Peers))
+	}
+	for _, peer := range deleted {
+		_, err = manager.GetPeer(peer.Key)
+		if err == nil {
+			t.Errorf("expecting deleted peer %s not to be found", peer.Name)
+		}
+	}
+
+	// the IPs of the deleted peers are reused
+	_, reused := addTestPeersTo(t, manager, accountId, 1)
+	if !reused[0].IP.Equal(peers[0].IP) && !reused[0].IP.Equal(peers[1].IP) {
+		t.Errorf("expecting a freed IP %s or %s to be reused, got %s", peers[0].IP, peers[1].IP, reused[0].IP)
+	}
+
+	_, errs = manager.DeletePeers(accountId, nil)
+	if errs != nil {
+		t.Errorf("expecting no failures for an empty list, got %v", errs)
+	}
+
+	deleted, errs = manager.DeletePeers("unknown_account", []string{peers[2].Key})
+	if len(deleted) != 0 || errs[peers[2].Key] == nil {
+		t.Errorf("expecting deletion from an unknown account to fail, got %v %v", deleted, errs)
+	}
+}
+
+func TestAccountManager_RequireUniquePeerNames(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectCode := func(err error, code codes.Code, action string) {
+		t.Helper()
+		if s, ok := status.FromError(err); !ok || s.Code() != code {
+			t.Errorf("expecting %s to fail with %s, got %v", action, code, err)
+		}
+	}
+
+	addPeer := func(accountId string, name string) (*Peer, error) {
+		account, err := manager.GetAccount(accountId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var setupKey string
+		for _, key := range account.SetupKeys {
+			setupKey = key.Key
+		}
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manager.AddPeer(setupKey, Peer{Key: key.PublicKey().String(), Name: name})
+	}
+
+	accountId, peers := addTestPeers(t, manager, 2)
+
+	// off: names may collide
+	_, err = addPeer(accountId, peers[0].Name)
+	if err != nil {
+		t.Fatalf("expecting duplicate name to be accepted with the setting off, got %v", err)
+	}
+	_, err = manager.RenamePeer(accountId, peers[1].Key, peers[0].Name)
+	if err != nil {
+		t.Fatalf("expecting rename to a duplicate name to be accepted with the setting off, got %v", err)
+	}
+
+	_, err = manager.SetRequireUniquePeerNames(accountId, true)
+	expectCode(err, codes.FailedPrecondition, "turning the setting on with duplicate names")
+
+	// on: names must be unique
+	account, err := manager.AddAccount("unique_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, peers = addTestPeersTo(t, manager, account.Id, 2)
+	account, err = manager.SetRequireUniquePeerNames(account.Id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !account.RequireUniquePeerNames {
+		t.Fatalf("expecting the setting to be on")
+	}
+
+	_, err = addPeer(account.Id, "PEER-0")
+	expectCode(err, codes.AlreadyExists, "adding a peer with a duplicate name")
+	_, err = manager.RenamePeer(account.Id, peers[1].Key, peers[0].Name)
+	expectCode(err, codes.AlreadyExists, "renaming a peer to a duplicate name")
+
+	renamed, err := manager.RenamePeer(account.Id, peers[0].Key, peers[0].Name)
+	if err != nil {
+		t.Fatalf("expecting rename of a peer to its own name to be accepted, got %v", err)
+	}
+	if renamed.Name != peers[0].Name {
+		t.Errorf("expecting name %s, got %s", peers[0].Name, renamed.Name)
+	}
+
+	_, err = addPeer(account.Id, "peer-2")
+	if err != nil {
+		t.Errorf("expecting a unique name to be accepted, got %v", err)
+	}
+
+	_, err = manager.RenamePeer(account.Id, "unknown_peer", "peer-3")
+	expectCode(err, codes.NotFound, "renaming an unknown peer")
+}
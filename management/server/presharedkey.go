@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+)
+
+// presharedKeyLen is the length of a Wireguard preshared key in bytes
+const presharedKeyLen = 32
+
+// GeneratePresharedKey generates a random Wireguard preshared key encoded in base64
+func GeneratePresharedKey() (string, error) {
+	key := make([]byte, presharedKeyLen)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", fmt.Errorf("failed generating preshared key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// peerPairKey identifies a pair of peers by their Wireguard keys, both orders of the peers give the same pair
+func peerPairKey(peerKey string, otherPeerKey string) string {
+	if peerKey > otherPeerKey {
+		peerKey, otherPeerKey = otherPeerKey, peerKey
+	}
+	return peerKey + ":" + otherPeerKey
+}
+
+// presharedKey derives the preshared key the two peers share from the PresharedKeySecret of the account (HKDF-SHA256 of
+// the secret and the pair of the peers), empty when the account has no secret yet
+func (a *Account) presharedKey(peerKey string, otherPeerKey string) string {
+	if a.PresharedKeySecret == "" {
+		return ""
+	}
+	secret, err := base64.StdEncoding.DecodeString(a.PresharedKeySecret)
+	if err != nil {
+		return ""
+	}
+
+	key := make([]byte, presharedKeyLen)
+	_, err = io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(peerPairKey(peerKey, otherPeerKey))), key)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// updatePresharedKeySecret generates the PresharedKeySecret the preshared keys of the pairs of peers are derived from
+// when the account misses one. With regenerate the secret is replaced, all the pairs get new keys
+func (a *Account) updatePresharedKeySecret(regenerate bool) error {
+	if a.PresharedKeySecret != "" && !regenerate {
+		return nil
+	}
+	secret, err := GeneratePresharedKey()
+	if err != nil {
+		return err
+	}
+	a.PresharedKeySecret = secret
+	return nil
+}
+
+// RotatePresharedKeys replaces the preshared keys of all the pairs of peers of the account with new ones (e.g. periodically)
+// by replacing the secret they are derived from. The peers get the new keys with the next network map they receive
+func (manager *AccountManager) RotatePresharedKeys(accountId string) error {
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+
+	err := manager.Store.Update(accountId, func(account *Account) error {
+		err := account.updatePresharedKeySecret(true)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed generating preshared keys")
+		}
+		return nil
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Errorf(codes.Internal, "failed rotating preshared keys")
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"testing"
+)
+
+func TestGeneratePresharedKey(t *testing.T) {
+	key, err := GeneratePresharedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatalf("expecting base64 encoded key, got %s: %v", key, err)
+	}
+	if len(decoded) != presharedKeyLen {
+		t.Errorf("expecting key of %d bytes, got %d", presharedKeyLen, len(decoded))
+	}
+	_, err = wgtypes.ParseKey(key)
+	if err != nil {
+		t.Errorf("expecting a valid Wireguard key, got %s: %v", key, err)
+	}
+
+	other, err := GeneratePresharedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == key {
+		t.Errorf("expecting generated keys to differ")
+	}
+}
+
+// addTestPeers registers count peers to a new account and returns the account id and the peers
+func addTestPeers(t *testing.T, manager *AccountManager, count int) (string, []*Peer) {
+	account, err := manager.AddAccount("test_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return addTestPeersTo(t, manager, account.Id, count)
+}
+
+// addTestPeersTo registers count peers to the account with its setup key and returns the account id and the peers
+func addTestPeersTo(t *testing.T, manager *AccountManager, accountId string, count int) (string, []*Peer) {
+	account, err := manager.GetAccount(accountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var setupKey *SetupKey
+	for _, key := range account.SetupKeys {
+		setupKey = key
+	}
+
+	var peers []*Peer
+	for i := 0; i < count; i++ {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := manager.AddPeer(setupKey.Key, Peer{Key: key.PublicKey().String(), Name: fmt.Sprintf("peer-%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, peer)
+	}
+
+	return account.Id, peers
+}
+
+// presharedKeysOf returns the preshared keys of the pairs of the peers read from their network maps. Fails when the two
+// peers of a pair got different keys or no key at all
+func presharedKeysOf(t *testing.T, manager *AccountManager, peers []*Peer) map[string]string {
+	keys := make(map[string]string)
+	for _, peer := range peers {
+		networkMap, err := manager.GetNetworkMap(peer.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(networkMap.PresharedKeys) != len(peers)-1 {
+			t.Fatalf("expecting %d preshared keys for peer %s, got %d", len(peers)-1, peer.Name, len(networkMap.PresharedKeys))
+		}
+		for remoteKey, key := range networkMap.PresharedKeys {
+			pair := peerPairKey(peer.Key, remoteKey)
+			if existing, ok := keys[pair]; ok && existing != key {
+				t.Fatalf("expecting both peers of pair %s to get the same preshared key", pair)
+			}
+			keys[pair] = key
+		}
+	}
+	return keys
+}
+
+func TestAccountManager_PresharedKeys(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, peers := addTestPeers(t, manager, 3)
+
+	keys := presharedKeysOf(t, manager, peers)
+	if len(keys) != 3 {
+		t.Fatalf("expecting 3 pairs of peers with preshared keys, got %d", len(keys))
+	}
+	unique := make(map[string]struct{})
+	for _, key := range keys {
+		unique[key] = struct{}{}
+	}
+	if len(unique) != len(keys) {
+		t.Errorf("expecting each pair of peers to get its own preshared key")
+	}
+
+	// the Sync response carries the key of each remote peer
+	networkMap, err := manager.GetNetworkMap(peers[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync := toSyncResponse(&Config{Signal: &Host{Proto: HTTP}}, networkMap.Peer, networkMap.Peers, networkMap.PresharedKeys)
+	for _, remotePeer := range sync.GetRemotePeers() {
+		expected := keys[peerPairKey(peers[0].Key, remotePeer.GetWgPubKey())]
+		if remotePeer.GetPresharedKey() != expected {
+			t.Errorf("expecting preshared key %s for remote peer %s, got %s", expected, remotePeer.GetWgPubKey(), remotePeer.GetPresharedKey())
+		}
+	}
+}
+
+func TestAccountManager_PresharedKeysOfRemainingPeers(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accountId, peers := addTestPeers(t, manager, 3)
+	before := presharedKeysOf(t, manager, peers)
+
+	_, err = manager.DeletePeer(accountId, peers[2].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys are derived from the pair, the pairs left keep theirs
+	after := presharedKeysOf(t, manager, peers[:2])
+	pair := peerPairKey(peers[0].Key, peers[1].Key)
+	if after[pair] != before[pair] {
+		t.Errorf("expecting preshared key of pair %s to stay the same after deleting another peer", pair)
+	}
+}
+
+func TestAccountManager_RotatePresharedKeys(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accountId, peers := addTestPeers(t, manager, 3)
+	before := presharedKeysOf(t, manager, peers)
+
+	err = manager.RotatePresharedKeys(accountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := presharedKeysOf(t, manager, peers)
+	if len(after) != len(before) {
+		t.Fatalf("expecting %d pairs of peers with preshared keys after rotation, got %d", len(before), len(after))
+	}
+	for pair, key := range after {
+		if before[pair] == key {
+			t.Errorf("expecting preshared key of pair %s to be rotated", pair)
+		}
+	}
+
+	err = manager.RotatePresharedKeys("unknown_account")
+	if err == nil {
+		t.Errorf("expecting rotation of an unknown account to fail")
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Rule is an access control rule of an account defining whether peers of the Source groups and peers of the Destination
+// groups can reach each other.
+// Rules are symmetric because a Wireguard tunnel needs both peers to know each other.
+type Rule struct {
+	Id   string
+	Name string
+	// Source is a list of groups of the peers the rule applies to
+	Source []string
+	// Destination is a list of groups of the peers the Source peers can (or can't) reach
+	Destination []string
+	// Allow allows the connection when true and denies it when false. A deny rule overrides allow rules
+	Allow bool
+}
+
+//Copy copies Rule object
+func (r *Rule) Copy() *Rule {
+	return &Rule{
+		Id:          r.Id,
+		Name:        r.Name,
+		Source:      copyGroups(r.Source),
+		Destination: copyGroups(r.Destination),
+		Allow:       r.Allow,
+	}
+}
+
+// matches checks whether the rule applies to the connection between the two peers (in any direction)
+func (r *Rule) matches(peer *Peer, otherPeer *Peer) bool {
+	return (inAnyGroup(peer, r.Source) && inAnyGroup(otherPeer, r.Destination)) ||
+		(inAnyGroup(otherPeer, r.Source) && inAnyGroup(peer, r.Destination))
+}
+
+// inAnyGroup checks whether the peer belongs to at least one of the groups
+func inAnyGroup(peer *Peer, groups []string) bool {
+	for _, group := range groups {
+		for _, peerGroup := range peer.Groups {
+			if group == peerGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isConnectionAllowed evaluates the account rules for the two peers.
+// Without any rules all the peers of the account can reach each other. Otherwise the connection has to be allowed
+// by at least one rule and not denied by any.
+func (a *Account) isConnectionAllowed(peer *Peer, otherPeer *Peer) bool {
+	if len(a.Rules) == 0 {
+		return true
+	}
+
+	allowed := false
+	for _, rule := range a.Rules {
+		if !rule.matches(peer, otherPeer) {
+			continue
+		}
+		if !rule.Allow {
+			return false
+		}
+		allowed = true
+	}
+
+	return allowed
+}
+
+//SaveRule adds a new rule to the account or replaces the existing rule with the same Id. A rule without Id gets a new one
+func (manager *AccountManager) SaveRule(accountId string, rule *Rule) (*Rule, error) {
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+
+	account, err := manager.Store.GetAccount(accountId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "account not found")
+	}
+
+	ruleCopy := rule.Copy()
+	if ruleCopy.Id == "" {
+		ruleCopy.Id = uuid.New().String()
+	}
+
+	if account.Rules == nil {
+		account.Rules = make(map[string]*Rule)
+	}
+	account.Rules[ruleCopy.Id] = ruleCopy
+
+	err = manager.Store.SaveAccount(account)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed saving rule")
+	}
+
+	return ruleCopy, nil
+}
+
+//DeleteRule removes a rule from the account
+func (manager *AccountManager) DeleteRule(accountId string, ruleId string) error {
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+
+	account, err := manager.Store.GetAccount(accountId)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "account not found")
+	}
+
+	if _, ok := account.Rules[ruleId]; !ok {
+		return status.Errorf(codes.NotFound, "rule %s not found", ruleId)
+	}
+
+	delete(account.Rules, ruleId)
+
+	err = manager.Store.SaveAccount(account)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed deleting rule")
+	}
+
+	return nil
+}
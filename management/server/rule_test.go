@@ -0,0 +1,188 @@
+package server
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"sort"
+	"testing"
+)
+
+func TestAccountManager_GetPeersForAPeerWithRules(t *testing.T) {
+	type testCase struct {
+		name  string
+		rules []*Rule
+		// expected is a map of a peer name to the names of the peers it gets
+		expected map[string][]string
+	}
+
+	testCases := []testCase{
+		{
+			name:  "no rules allow all",
+			rules: nil,
+			expected: map[string][]string{
+				"dev1":       {"contractor", "dev2", "server"},
+				"dev2":       {"contractor", "dev1", "server"},
+				"server":     {"contractor", "dev1", "dev2"},
+				"contractor": {"dev1", "dev2", "server"},
+			},
+		},
+		{
+			name: "allow devs to reach servers",
+			rules: []*Rule{
+				{Name: "devs", Source: []string{"devs"}, Destination: []string{"servers"}, Allow: true},
+			},
+			expected: map[string][]string{
+				"dev1":       {"server"},
+				"dev2":       {"server"},
+				"server":     {"dev1", "dev2"},
+				"contractor": {},
+			},
+		},
+		{
+			name: "allow group members to reach each other",
+			rules: []*Rule{
+				{Name: "devs", Source: []string{"devs"}, Destination: []string{"devs"}, Allow: true},
+			},
+			expected: map[string][]string{
+				"dev1":       {"dev2"},
+				"dev2":       {"dev1"},
+				"server":     {},
+				"contractor": {},
+			},
+		},
+		{
+			name: "deny overrides allow",
+			rules: []*Rule{
+				{Name: "all", Source: []string{"all"}, Destination: []string{"all"}, Allow: true},
+				{Name: "no contractors on servers", Source: []string{"contractors"}, Destination: []string{"servers"}, Allow: false},
+			},
+			expected: map[string][]string{
+				"dev1":       {"contractor", "dev2", "server"},
+				"dev2":       {"contractor", "dev1", "server"},
+				"server":     {"dev1", "dev2"},
+				"contractor": {"dev1", "dev2"},
+			},
+		},
+		{
+			name: "deny only rules deny all",
+			rules: []*Rule{
+				{Name: "no contractors on servers", Source: []string{"contractors"}, Destination: []string{"servers"}, Allow: false},
+			},
+			expected: map[string][]string{
+				"dev1":       {},
+				"dev2":       {},
+				"server":     {},
+				"contractor": {},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			manager, err := createManager(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			account, err := manager.AddAccount("test_account")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			peerGroups := map[string][]string{
+				"dev1":       {"all", "devs"},
+				"dev2":       {"all", "devs"},
+				"server":     {"all", "servers"},
+				"contractor": {"all", "contractors"},
+			}
+
+			// peer name -> peer key
+			peerKeys := make(map[string]string)
+			for name, groups := range peerGroups {
+				setupKey, err := manager.AddSetupKey(account.Id, name, SetupKeyOneOff, DefaultSetupKeyDuration, groups)
+				if err != nil {
+					t.Fatal(err)
+				}
+				key, err := wgtypes.GenerateKey()
+				if err != nil {
+					t.Fatal(err)
+				}
+				peer, err := manager.AddPeer(setupKey.Key, Peer{Key: key.PublicKey().String(), Name: name})
+				if err != nil {
+					t.Fatal(err)
+				}
+				peerKeys[name] = peer.Key
+			}
+
+			for _, rule := range testCase.rules {
+				_, err = manager.SaveRule(account.Id, rule)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for name, expectedPeers := range testCase.expected {
+				peers, err := manager.GetPeersForAPeer(peerKeys[name])
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				names := []string{}
+				for _, peer := range peers {
+					names = append(names, peer.Name)
+				}
+				sort.Strings(names)
+
+				if len(names) != len(expectedPeers) {
+					t.Errorf("expecting peer %s to get peers %v, got %v", name, expectedPeers, names)
+					continue
+				}
+				for i := range names {
+					if names[i] != expectedPeers[i] {
+						t.Errorf("expecting peer %s to get peers %v, got %v", name, expectedPeers, names)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAccountManager_DeleteRule(t *testing.T) {
+	manager, err := createManager(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := manager.AddAccount("test_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule, err := manager.SaveRule(account.Id, &Rule{Name: "devs", Source: []string{"devs"}, Destination: []string{"devs"}, Allow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rule.Id == "" {
+		t.Errorf("expecting saved rule to get an Id")
+	}
+
+	err = manager.DeleteRule(account.Id, rule.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err = manager.GetAccount(account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(account.Rules) != 0 {
+		t.Errorf("expecting account to have no rules, got %d", len(account.Rules))
+	}
+
+	err = manager.DeleteRule(account.Id, rule.Id)
+	if err == nil {
+		t.Errorf("expecting deleting a non existing rule to fail")
+	}
+}
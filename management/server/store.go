@@ -8,4 +8,8 @@ type Store interface {
 	GetPeerAccount(peerKey string) (*Account, error)
 	GetAccountBySetupKey(setupKey string) (*Account, error)
 	SaveAccount(account *Account) error
+	// Update atomically applies the update function to the account and saves the result.
+	// Concurrent updates of the same account must not overwrite each other (e.g. by running under a lock or in a transaction).
+	// The account is left unchanged when the update function returns an error
+	Update(accountId string, update func(account *Account) error) error
 }
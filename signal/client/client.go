@@ -3,6 +3,7 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/cenkalti/backoff/v4"
 	log "github.com/sirupsen/logrus"
@@ -23,6 +24,16 @@ import (
 
 // A set of tools to exchange connection details (Wireguard endpoints) with the remote peer.
 
+var (
+	// ErrPeerOffline is returned by Client.Send when the remote peer isn't connected to the Signal Exchange.
+	// Resending won't help until the remote peer comes online
+	ErrPeerOffline = errors.New("remote peer is offline")
+
+	// ErrNotDelivered is returned by Client.Send when the Signal Exchange didn't acknowledge the message (e.g. the
+	// Signal Exchange is unreachable or failed forwarding the message). The message may be resent
+	ErrNotDelivered = errors.New("message wasn't delivered")
+)
+
 // Client Wraps the Signal Exchange Service gRpc client
 type Client struct {
 	key        wgtypes.Key
@@ -207,6 +218,8 @@ func (c *Client) encryptMessage(msg *proto.Message) (*proto.EncryptedMessage, er
 }
 
 // Send sends a message to the remote Peer through the Signal Exchange.
+// Returns nil once the Signal Exchange has acknowledged forwarding the message to the remote peer,
+// ErrPeerOffline when the remote peer isn't connected and ErrNotDelivered when the message wasn't acknowledged.
 func (c *Client) Send(msg *proto.Message) error {
 
 	encryptedMessage, err := c.encryptMessage(msg)
@@ -215,8 +228,12 @@ func (c *Client) Send(msg *proto.Message) error {
 	}
 	_, err = c.realClient.Send(context.TODO(), encryptedMessage)
 	if err != nil {
+		if s, ok := status.FromError(err); ok && s.Code() == codes.NotFound {
+			log.Debugf("message to peer [%s] wasn't delivered because the peer is offline", msg.RemoteKey)
+			return fmt.Errorf("%w: %s", ErrPeerOffline, msg.RemoteKey)
+		}
 		log.Errorf("error while sending message to peer [%s] [error: %v]", msg.RemoteKey, err)
-		return err
+		return fmt.Errorf("%w to peer %s: %v", ErrNotDelivered, msg.RemoteKey, err)
 	}
 
 	return nil
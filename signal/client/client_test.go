@@ -2,6 +2,7 @@ package client
 
 import (
 	"context"
+	"errors"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	log "github.com/sirupsen/logrus"
@@ -92,6 +93,52 @@ var _ = Describe("Client", func() {
 
 			})
 		})
+
+		Context("to a peer that is not connected", func() {
+			It("should report the peer offline", func() {
+
+				keyA, _ := wgtypes.GenerateKey()
+				clientA := createSignalClient(addr, keyA)
+				clientA.Receive(func(msg *sigProto.Message) error {
+					return nil
+				})
+				clientA.WaitConnected()
+
+				keyB, _ := wgtypes.GenerateKey()
+				err := clientA.Send(&sigProto.Message{
+					Key:       keyA.PublicKey().String(),
+					RemoteKey: keyB.PublicKey().String(),
+					Body:      &sigProto.Body{Payload: "ping"},
+				})
+
+				Expect(errors.Is(err, ErrPeerOffline)).To(BeTrue())
+				Expect(errors.Is(err, ErrNotDelivered)).To(BeFalse())
+			})
+		})
+
+		Context("when the Signal Exchange is down", func() {
+			It("should report the message not delivered", func() {
+
+				keyA, _ := wgtypes.GenerateKey()
+				clientA := createSignalClient(addr, keyA)
+				clientA.Receive(func(msg *sigProto.Message) error {
+					return nil
+				})
+				clientA.WaitConnected()
+
+				server.Stop()
+
+				keyB, _ := wgtypes.GenerateKey()
+				err := clientA.Send(&sigProto.Message{
+					Key:       keyA.PublicKey().String(),
+					RemoteKey: keyB.PublicKey().String(),
+					Body:      &sigProto.Body{Payload: "ping"},
+				})
+
+				Expect(errors.Is(err, ErrNotDelivered)).To(BeTrue())
+				Expect(errors.Is(err, ErrPeerOffline)).To(BeFalse())
+			})
+		})
 	})
 
 	Describe("Connecting to the Signal stream channel", func() {
@@ -19,6 +19,8 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type SignalExchangeClient interface {
 	// Synchronously connect to the Signal Exchange service offering connection candidates and waiting for connection candidates from the other party (remote peer)
+	// The response acknowledges that the message has been forwarded to the remote peer. Otherwise, the call fails with
+	// NOT_FOUND when the remote peer isn't connected to the Signal Exchange (offline) or UNAVAILABLE when forwarding failed
 	Send(ctx context.Context, in *EncryptedMessage, opts ...grpc.CallOption) (*EncryptedMessage, error)
 	// Connect to the Signal Exchange service offering connection candidates and maintain a channel for receiving candidates from the other party (remote peer)
 	ConnectStream(ctx context.Context, opts ...grpc.CallOption) (SignalExchange_ConnectStreamClient, error)
@@ -77,6 +79,8 @@ func (x *signalExchangeConnectStreamClient) Recv() (*EncryptedMessage, error) {
 // for forward compatibility
 type SignalExchangeServer interface {
 	// Synchronously connect to the Signal Exchange service offering connection candidates and waiting for connection candidates from the other party (remote peer)
+	// The response acknowledges that the message has been forwarded to the remote peer. Otherwise, the call fails with
+	// NOT_FOUND when the remote peer isn't connected to the Signal Exchange (offline) or UNAVAILABLE when forwarding failed
 	Send(context.Context, *EncryptedMessage) (*EncryptedMessage, error)
 	// Connect to the Signal Exchange service offering connection candidates and maintain a channel for receiving candidates from the other party (remote peer)
 	ConnectStream(SignalExchange_ConnectStreamServer) error
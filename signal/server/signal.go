@@ -2,7 +2,6 @@ package server
 
 import (
 	"context"
-	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/wiretrustee/wiretrustee/signal/peer"
 	"github.com/wiretrustee/wiretrustee/signal/proto"
@@ -25,24 +24,29 @@ func NewServer() *Server {
 	}
 }
 
-// Send forwards a message to the signal peer
+// Send forwards a message to the signal peer.
+// The response acknowledges that the message has been forwarded to the stream of the remote peer.
+// Otherwise, an error is returned: codes.NotFound when the remote peer isn't connected (offline) and
+// codes.Unavailable when forwarding failed (the sender may retry)
 func (s *Server) Send(ctx context.Context, msg *proto.EncryptedMessage) (*proto.EncryptedMessage, error) {
 
 	if !s.registry.IsPeerRegistered(msg.Key) {
-		return nil, fmt.Errorf("unknown peer %s", msg.Key)
+		return nil, status.Errorf(codes.FailedPrecondition, "unknown peer %s", msg.Key)
 	}
 
-	if dstPeer, found := s.registry.Get(msg.RemoteKey); found {
-		//forward the message to the target peer
-		err := dstPeer.Stream.Send(msg)
-		if err != nil {
-			log.Errorf("error while forwarding message from peer [%s] to peer [%s]", msg.Key, msg.RemoteKey)
-			//todo respond to the sender?
-		}
-	} else {
+	dstPeer, found := s.registry.Get(msg.RemoteKey)
+	if !found {
 		log.Warnf("message from peer [%s] can't be forwarded to peer [%s] because destination peer is not connected", msg.Key, msg.RemoteKey)
-		//todo respond to the sender?
+		return nil, status.Errorf(codes.NotFound, "remote peer %s is not connected", msg.RemoteKey)
 	}
+
+	//forward the message to the target peer
+	err := dstPeer.Stream.Send(msg)
+	if err != nil {
+		log.Errorf("error while forwarding message from peer [%s] to peer [%s]: %v", msg.Key, msg.RemoteKey, err)
+		return nil, status.Errorf(codes.Unavailable, "failed forwarding message to remote peer %s", msg.RemoteKey)
+	}
+
 	return &proto.EncryptedMessage{}, nil
 }
 